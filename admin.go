@@ -0,0 +1,209 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+// The methods below act on a user given by ID instead of the user taken
+// from the context, for operator tools that inspect or unstick sessions of
+// other users. Cached values are read and cleared by ID with Get and
+// CleanCache.
+
+// UserState returns the state of the given user, like CurrentState, but
+// without counting as an access, so looking at an idle session does not
+// keep it alive. A storage.StateStorage must also implement
+// storage.StatePeeker for that; otherwise its GetState is used, which may
+// refresh the session.
+func (f *FSM) UserState(ctx context.Context, userID int64) (StateFSM, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return StateNil, false, err
+	}
+
+	if f.states == nil {
+		v, ok := f.current.Load(userID)
+		if !ok {
+			return StateNil, false, nil
+		}
+		return v.(stateData).state, true, nil
+	}
+
+	st, ok, err := "", false, storage.ErrPeekUnsupported
+	if peeker, isPeeker := f.states.(storage.StatePeeker); isPeeker {
+		st, ok, err = peeker.PeekState(ctx, userID)
+	}
+	if errors.Is(err, storage.ErrPeekUnsupported) {
+		st, ok, err = f.states.GetState(ctx, userID)
+	}
+	if err != nil || !ok {
+		return StateNil, false, err
+	}
+	return StateFSM(st), true, nil
+}
+
+// TransitionUser forces the given user into state, like Transition:
+// moving to StateDefault also clears the user's cache.
+func (f *FSM) TransitionUser(ctx context.Context, userID int64, state StateFSM) error {
+	return f.Transition(userWithContext(ctx, userID), state)
+}
+
+// ResetUser puts the given user back to StateDefault and clears the cache,
+// ending whatever conversation the user was in.
+func (f *FSM) ResetUser(ctx context.Context, userID int64) error {
+	return f.TransitionUser(ctx, userID, StateDefault)
+}
+
+// Session describes the FSM state of one user.
+//
+// Sessions of machines and chats are kept under keys hashed with
+// CompositeKey (see Machine.Key and ChatSessionKey), so UserID alone does
+// not tell whose they are. For those, Machine and Owner or ChatID are set
+// from what Machine.Transition and TransitionChat record with the state;
+// they are left empty for sessions created otherwise, e.g. by a custom
+// KeyStrategy, or if the storage does not implement storage.Inspector.
+type Session struct {
+	UserID   int64 // the session key
+	State    StateFSM
+	LastSeen time.Time // zero if the storage does not track it
+
+	Machine string // name of the machine the session belongs to
+	Owner   int64  // session key of the machine's user
+	ChatID  int64  // chat of a chat session
+}
+
+// sessionOwnerKey is the cache key recording whom a session under a
+// composite key belongs to: "m:<owner>:<machine>" or "c:<chat>".
+const sessionOwnerKey = reservedKeyPrefix + "owner"
+
+func machineOwner(name string, userID int64) string {
+	return "m:" + strconv.FormatInt(userID, 10) + ":" + name
+}
+
+func chatOwner(chatID int64) string {
+	return "c:" + strconv.FormatInt(chatID, 10)
+}
+
+// resolveOwner fills in the owner of a session under a composite key from
+// its sessionOwnerKey record, read without counting as an access.
+func (f *FSM) resolveOwner(ctx context.Context, s *Session) error {
+	in, ok := f.storage.(storage.Inspector)
+	if !ok || !isCompositeKey(s.UserID) {
+		return nil
+	}
+	data, err := in.Inspect(ctx, s.UserID)
+	if err != nil {
+		return err
+	}
+	owner, _ := data.Values[sessionOwnerKey].(string)
+	kind, rest, _ := strings.Cut(owner, ":")
+	switch kind {
+	case "m":
+		id, name, _ := strings.Cut(rest, ":")
+		if s.Owner, err = strconv.ParseInt(id, 10, 64); err == nil {
+			s.Machine = name
+		}
+	case "c":
+		s.ChatID, _ = strconv.ParseInt(rest, 10, 64)
+	}
+	return nil
+}
+
+// SessionFilter selects sessions yielded by Sessions.
+type SessionFilter func(Session) bool
+
+// InStates selects sessions in any of the given states.
+func InStates(states ...StateFSM) SessionFilter {
+	return func(s Session) bool {
+		return slices.Contains(states, s.State)
+	}
+}
+
+// IdleFor selects sessions not used for at least d. Sessions without a
+// last-seen time never match.
+func IdleFor(d time.Duration) SessionFilter {
+	return func(s Session) bool {
+		return !s.LastSeen.IsZero() && time.Since(s.LastSeen) >= d
+	}
+}
+
+// Sessions iterates over the sessions of all users that match every
+// filter, including sessions of machines and chats, which can be told
+// apart by their Machine and ChatID. Listing does not count as an access.
+// States kept by the FSM itself are always listable; a
+// storage.StateStorage must also implement storage.SessionLister,
+// otherwise storage.ErrSessionsUnsupported is yielded. Iteration stops
+// after the first error, which is yielded with a zero Session.
+func (f *FSM) Sessions(ctx context.Context, filters ...SessionFilter) iter.Seq2[Session, error] {
+	return func(yield func(Session, error) bool) {
+		match := func(s Session) bool {
+			for _, keep := range filters {
+				if !keep(s) {
+					return false
+				}
+			}
+			return true
+		}
+
+		if f.states == nil {
+			f.current.Range(func(k, v any) bool {
+				if err := ctx.Err(); err != nil {
+					yield(Session{}, err)
+					return false
+				}
+				sd := v.(stateData)
+				s := Session{UserID: k.(int64), State: sd.state, LastSeen: sd.lastUse}
+				if err := f.resolveOwner(ctx, &s); err != nil {
+					yield(Session{}, err)
+					return false
+				}
+				return !match(s) || yield(s, nil)
+			})
+			return
+		}
+
+		lister, ok := f.states.(storage.SessionLister)
+		if !ok {
+			yield(Session{}, storage.ErrSessionsUnsupported)
+			return
+		}
+		for ss, err := range lister.Sessions(ctx) {
+			if err != nil {
+				yield(Session{}, err)
+				return
+			}
+			s := Session{UserID: ss.UserID, State: StateFSM(ss.State), LastSeen: ss.LastSeen}
+			if err := f.resolveOwner(ctx, &s); err != nil {
+				yield(Session{}, err)
+				return
+			}
+			if match(s) && !yield(s, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Inspect returns the cached values and media groups of the given user
+// without counting as an access. Values the FSM keeps for itself, under
+// keys starting with "fsm:", are left out. The storage must implement
+// storage.Inspector, otherwise storage.ErrInspectUnsupported is returned.
+func (f *FSM) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	in, ok := f.storage.(storage.Inspector)
+	if !ok {
+		return storage.UserData{}, storage.ErrInspectUnsupported
+	}
+	data, err := in.Inspect(ctx, userID)
+	for key := range data.Values {
+		if strings.HasPrefix(key, reservedKeyPrefix) {
+			delete(data.Values, key)
+		}
+	}
+	return data, err
+}
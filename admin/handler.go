@@ -0,0 +1,355 @@
+// Package admin exposes FSM sessions over HTTP for operators. The handler
+// lists sessions, counts them per state, shows a user's state, cache and
+// media groups as JSON and can reset a user or force a transition:
+//
+//	GET  /sessions?state=pay&idle=1h&limit=100
+//	GET  /states
+//	GET  /users/{id}
+//	POST /users/{id}/reset
+//	POST /users/{id}/transition   {"state": "pay"}
+//
+// Paths are relative to the handler; mount it under a prefix with
+// http.StripPrefix:
+//
+//	mux.Handle("/fsm/", http.StripPrefix("/fsm", admin.NewHandler(f,
+//		admin.WithAuthorizer(admin.BearerToken(os.Getenv("FSM_ADMIN_TOKEN"))),
+//	)))
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+// DefaultLimit is the number of sessions GET /sessions returns when the
+// request does not set limit.
+const DefaultLimit = 100
+
+var (
+	// ErrUnauthorized is returned by an Authorizer for requests without
+	// valid credentials; the handler answers 401.
+	ErrUnauthorized = errors.New("fsm/admin: unauthorized")
+
+	// ErrForbidden is returned by an Authorizer for authenticated requests
+	// that may not use the handler; the handler answers 403.
+	ErrForbidden = errors.New("fsm/admin: forbidden")
+)
+
+// Authorizer decides whether a request may use the handler. A non-nil
+// error rejects it: ErrForbidden (or an error wrapping it) with 403, any
+// other error with 401.
+type Authorizer func(*http.Request) error
+
+// BearerToken returns an Authorizer accepting requests with the header
+// "Authorization: Bearer <token>". Tokens are compared in constant time.
+// An empty token rejects every request.
+func BearerToken(token string) Authorizer {
+	want := []byte(token)
+	return func(r *http.Request) error {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(want) == 0 || subtle.ConstantTimeCompare([]byte(got), want) != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+}
+
+// Option configures the handler created by NewHandler.
+type Option func(*handler)
+
+// WithAuthorizer checks every request with auth before serving it.
+// Without it the handler serves everyone, so it must only be reachable
+// from a trusted network.
+func WithAuthorizer(auth Authorizer) Option {
+	return func(h *handler) {
+		h.auth = auth
+	}
+}
+
+// WithReadOnly disables the endpoints that change sessions; they answer
+// 403.
+func WithReadOnly() Option {
+	return func(h *handler) {
+		h.readOnly = true
+	}
+}
+
+type handler struct {
+	f        *fsm.FSM
+	auth     Authorizer
+	readOnly bool
+	mux      *http.ServeMux
+}
+
+// NewHandler returns an http.Handler serving the sessions of f. Listing
+// requires states the FSM can enumerate (see fsm.FSM.Sessions); cached
+// values and media are shown when the storage implements
+// storage.Inspector.
+func NewHandler(f *fsm.FSM, opts ...Option) http.Handler {
+	h := &handler{f: f, mux: http.NewServeMux()}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("GET /sessions", h.sessions)
+	h.mux.HandleFunc("GET /states", h.states)
+	h.mux.HandleFunc("GET /users/{id}", h.user)
+	h.mux.HandleFunc("POST /users/{id}/reset", h.write(h.reset))
+	h.mux.HandleFunc("POST /users/{id}/transition", h.write(h.transition))
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.auth != nil {
+		if err := h.auth(r); err != nil {
+			status := http.StatusUnauthorized
+			if errors.Is(err, ErrForbidden) {
+				status = http.StatusForbidden
+			}
+			writeError(w, status, err)
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// write guards an endpoint that changes sessions.
+func (h *handler) write(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.readOnly {
+			writeError(w, http.StatusForbidden, errors.New("fsm/admin: handler is read-only"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// session is the JSON form of fsm.Session.
+type session struct {
+	UserID   int64      `json:"user_id"`
+	State    string     `json:"state"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Machine  string     `json:"machine,omitempty"`
+	Owner    int64      `json:"owner,omitempty"`
+	ChatID   int64      `json:"chat_id,omitempty"`
+}
+
+func newSession(s fsm.Session) session {
+	out := session{UserID: s.UserID, State: string(s.State), Machine: s.Machine, Owner: s.Owner, ChatID: s.ChatID}
+	if !s.LastSeen.IsZero() {
+		out.LastSeen = &s.LastSeen
+	}
+	return out
+}
+
+// sessions serves GET /sessions. Query parameters: state (repeatable)
+// keeps sessions in any of the given states, idle (a time.Duration) keeps
+// sessions not used for at least that long, limit caps the result.
+func (h *handler) sessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var filters []fsm.SessionFilter
+	if states := q["state"]; len(states) > 0 {
+		in := make([]fsm.StateFSM, len(states))
+		for i, s := range states {
+			in[i] = fsm.StateFSM(s)
+		}
+		filters = append(filters, fsm.InStates(in...))
+	}
+	if v := q.Get("idle"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		filters = append(filters, fsm.IdleFor(d))
+	}
+	limit := DefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("fsm/admin: limit must be a positive integer"))
+			return
+		}
+		limit = n
+	}
+
+	out := struct {
+		Sessions  []session `json:"sessions"`
+		Truncated bool      `json:"truncated"`
+	}{Sessions: []session{}}
+	for s, err := range h.f.Sessions(r.Context(), filters...) {
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		if len(out.Sessions) == limit {
+			out.Truncated = true
+			break
+		}
+		out.Sessions = append(out.Sessions, newSession(s))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// states serves GET /states: the number of sessions in each state.
+func (h *handler) states(w http.ResponseWriter, r *http.Request) {
+	out := struct {
+		States map[string]int `json:"states"`
+		Total  int            `json:"total"`
+	}{States: make(map[string]int)}
+	for s, err := range h.f.Sessions(r.Context()) {
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		out.States[string(s.State)]++
+		out.Total++
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// file is the JSON form of media.File.
+type file struct {
+	Type   string `json:"type"`
+	FileID string `json:"file_id"`
+}
+
+// mediaGroup is the JSON form of media.MediaData.
+type mediaGroup struct {
+	Files      []file    `json:"files"`
+	LastUpdate time.Time `json:"last_update"`
+}
+
+// user serves GET /users/{id}. Values and media are null when the storage
+// cannot list them. Like the other reads, it does not count as an access.
+func (h *handler) user(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+
+	out := struct {
+		UserID int64                 `json:"user_id"`
+		State  *string               `json:"state"`
+		Values map[string]any        `json:"values"`
+		Media  map[string]mediaGroup `json:"media"`
+	}{UserID: id}
+
+	state, ok, err := h.f.UserState(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if ok {
+		s := string(state)
+		out.State = &s
+	}
+
+	data, err := h.f.Inspect(r.Context(), id)
+	switch {
+	case errors.Is(err, storage.ErrInspectUnsupported):
+	case err != nil:
+		writeStorageError(w, err)
+		return
+	default:
+		out.Values = data.Values
+		out.Media = make(map[string]mediaGroup, len(data.Media))
+		for group, md := range data.Media {
+			g := mediaGroup{Files: []file{}, LastUpdate: md.LastUpdate()}
+			for _, f := range md.Files() {
+				g.Files = append(g.Files, file{Type: f.Type, FileID: f.FileID})
+			}
+			out.Media[group] = g
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// reset serves POST /users/{id}/reset.
+func (h *handler) reset(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	if err := h.f.ResetUser(r.Context(), id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// transition serves POST /users/{id}/transition with a JSON body
+// {"state": "..."}.
+func (h *handler) transition(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		State *string `json:"state"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.State == nil {
+		writeError(w, http.StatusBadRequest, errors.New("fsm/admin: state is required"))
+		return
+	}
+	if err := h.f.TransitionUser(r.Context(), id, fsm.StateFSM(*body.State)); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userID parses the {id} path value, answering 400 if it is invalid.
+func userID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("fsm/admin: invalid user id"))
+		return 0, false
+	}
+	return id, true
+}
+
+// writeStorageError answers 501 when the storage lacks a capability the
+// endpoint needs and 500 otherwise.
+func writeStorageError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, storage.ErrSessionsUnsupported) || errors.Is(err, storage.ErrInspectUnsupported) {
+		status = http.StatusNotImplemented
+	}
+	writeError(w, status, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// writeJSON encodes v before writing the header, so values that cannot be
+// encoded (e.g. cached functions or channels) yield a 500 instead of a
+// truncated body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(struct {
+			Error string `json:"error"`
+		}{err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
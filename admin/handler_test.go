@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
+)
+
+func newFSM(t *testing.T) *fsm.FSM {
+	t.Helper()
+	ctx := context.Background()
+	f := fsm.New(ctx)
+	t.Cleanup(func() { f.Close() })
+
+	f.TransitionUser(ctx, 1, "pay")
+	f.TransitionUser(ctx, 2, "pay")
+	f.TransitionUser(ctx, 3, "address")
+	f.Set(ctx, 1, "amount", 42)
+	f.SetMedia(ctx, 1, "album", media.File{Type: "photo", FileID: "p1"})
+	return f
+}
+
+func do(t *testing.T, h http.Handler, method, target, body string, out any) int {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if out != nil && rec.Code < 300 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: %v in %s", method, target, err, rec.Body)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandler_Sessions(t *testing.T) {
+	h := NewHandler(newFSM(t))
+
+	var list struct {
+		Sessions  []session
+		Truncated bool
+	}
+	if code := do(t, h, "GET", "/sessions?state=pay", "", &list); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if len(list.Sessions) != 2 || list.Truncated {
+		t.Fatalf("expected both pay sessions, got %+v", list)
+	}
+
+	if do(t, h, "GET", "/sessions?limit=1", "", &list); len(list.Sessions) != 1 || !list.Truncated {
+		t.Fatalf("expected a truncated page of one, got %+v", list)
+	}
+	if do(t, h, "GET", "/sessions?idle=1h", "", &list); len(list.Sessions) != 0 {
+		t.Fatalf("fresh sessions are not idle, got %+v", list)
+	}
+	for _, q := range []string{"idle=soon", "limit=0", "limit=x"} {
+		if code := do(t, h, "GET", "/sessions?"+q, "", nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", q, code)
+		}
+	}
+
+	var counts struct {
+		States map[string]int
+		Total  int
+	}
+	do(t, h, "GET", "/states", "", &counts)
+	if counts.Total != 3 || counts.States["pay"] != 2 || counts.States["address"] != 1 {
+		t.Fatalf("unexpected counts %+v", counts)
+	}
+}
+
+func TestHandler_User(t *testing.T) {
+	h := NewHandler(newFSM(t))
+
+	var user struct {
+		UserID int64 `json:"user_id"`
+		State  *string
+		Values map[string]any
+		Media  map[string]mediaGroup
+	}
+	if code := do(t, h, "GET", "/users/1", "", &user); code != http.StatusOK {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if user.UserID != 1 || user.State == nil || *user.State != "pay" || user.Values["amount"] != float64(42) {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	if g := user.Media["album"]; len(g.Files) != 1 || g.Files[0].FileID != "p1" {
+		t.Fatalf("unexpected media %+v", user.Media)
+	}
+
+	var unknown struct {
+		State  *string
+		Values map[string]any
+	}
+	do(t, h, "GET", "/users/99", "", &unknown)
+	if unknown.State != nil || len(unknown.Values) != 0 {
+		t.Fatalf("unknown user must have no state and no values, got %+v", unknown)
+	}
+
+	if code := do(t, h, "GET", "/users/abc", "", nil); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad id, got %d", code)
+	}
+}
+
+func TestHandler_ResetAndTransition(t *testing.T) {
+	f := newFSM(t)
+	h := NewHandler(f)
+	ctx := context.Background()
+
+	if code := do(t, h, "POST", "/users/2/transition", `{"state":"address"}`, nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if st, _, _ := f.UserState(ctx, 2); st != "address" {
+		t.Fatalf("expected forced state, got %v", st)
+	}
+	for _, body := range []string{`{}`, `nope`} {
+		if code := do(t, h, "POST", "/users/2/transition", body, nil); code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, code)
+		}
+	}
+
+	if code := do(t, h, "POST", "/users/1/reset", "", nil); code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", code)
+	}
+	if st, _, _ := f.UserState(ctx, 1); st != fsm.StateDefault {
+		t.Fatalf("expected StateDefault after reset, got %v", st)
+	}
+	if _, ok, _ := f.Get(ctx, 1, "amount"); ok {
+		t.Fatal("reset must clear the cache")
+	}
+
+	if code := do(t, h, "GET", "/users/1/reset", "", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for GET on a write endpoint, got %d", code)
+	}
+}
+
+func TestHandler_ReadOnly(t *testing.T) {
+	f := newFSM(t)
+	h := NewHandler(f, WithReadOnly())
+
+	if code := do(t, h, "POST", "/users/1/reset", "", nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+	if st, _, _ := f.UserState(context.Background(), 1); st != "pay" {
+		t.Fatalf("read-only handler changed the state to %v", st)
+	}
+	if code := do(t, h, "GET", "/states", "", nil); code != http.StatusOK {
+		t.Fatalf("reads must still work, got %d", code)
+	}
+}
+
+func TestHandler_Authorizer(t *testing.T) {
+	f := newFSM(t)
+
+	if code := do(t, NewHandler(f, WithAuthorizer(BearerToken("secret"))), "GET", "/states", "", nil); code != http.StatusOK {
+		t.Fatalf("valid token rejected with %d", code)
+	}
+	if code := do(t, NewHandler(f, WithAuthorizer(BearerToken("other"))), "GET", "/states", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", code)
+	}
+	if code := do(t, NewHandler(f, WithAuthorizer(BearerToken(""))), "GET", "/states", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("an empty token must reject everyone, got %d", code)
+	}
+
+	forbid := func(*http.Request) error { return errors.Join(ErrForbidden, errors.New("ops only")) }
+	if code := do(t, NewHandler(f, WithAuthorizer(forbid)), "GET", "/states", "", nil); code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", code)
+	}
+}
+
+// stateless hides the optional interfaces of the wrapped storage.
+type stateless struct{ storage.Storage }
+
+func TestHandler_Unsupported(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage(0, 0)
+	defer s.Close()
+	f := fsm.New(ctx, fsm.WithStorage(stateless{s}))
+	defer f.Close()
+	f.TransitionUser(ctx, 1, "pay")
+	h := NewHandler(f)
+
+	var user struct {
+		State  *string
+		Values map[string]any
+	}
+	if code := do(t, h, "GET", "/users/1", "", &user); code != http.StatusOK {
+		t.Fatalf("the state must be shown without Inspector, got %d", code)
+	}
+	if user.State == nil || user.Values != nil {
+		t.Fatalf("expected a state and null values, got %+v", user)
+	}
+}
+
+func TestWriteJSON_Unencodable(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, map[string]any{"f": func() {}})
+	if rec.Code != http.StatusInternalServerError || !json.Valid(rec.Body.Bytes()) {
+		t.Fatalf("expected a JSON 500, got %d %s", rec.Code, rec.Body)
+	}
+}
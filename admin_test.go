@@ -0,0 +1,178 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+func TestAdmin_ByUserID(t *testing.T) {
+	ctx := context.Background()
+	f := New(ctx)
+	defer f.Close()
+
+	if _, ok, _ := f.UserState(ctx, 1); ok {
+		t.Fatal("unknown user must have no state")
+	}
+
+	if err := f.TransitionUser(ctx, 1, "stuck"); err != nil {
+		t.Fatal(err)
+	}
+	f.Set(ctx, 1, "k", "v")
+	if st, ok, _ := f.UserState(ctx, 1); !ok || st != "stuck" {
+		t.Fatalf("expected forced state, got (%v, %v)", st, ok)
+	}
+
+	if err := f.ResetUser(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if st, _, _ := f.UserState(ctx, 1); st != StateDefault {
+		t.Fatalf("expected StateDefault after reset, got %v", st)
+	}
+	if _, ok, _ := f.Get(ctx, 1, "k"); ok {
+		t.Fatal("reset must clear the cache")
+	}
+}
+
+func TestUserState_DoesNotTouch(t *testing.T) {
+	ctx := context.Background()
+	f := New(ctx)
+	defer f.Close()
+
+	f.TransitionUser(ctx, 1, "idle")
+	past := time.Now().Add(-time.Hour)
+	f.current.Store(int64(1), stateData{state: "idle", lastUse: past})
+
+	if st, ok, _ := f.UserState(ctx, 1); !ok || st != "idle" {
+		t.Fatalf("expected idle, got (%v, %v)", st, ok)
+	}
+	if v, _ := f.current.Load(int64(1)); !v.(stateData).lastUse.Equal(past) {
+		t.Fatal("UserState must not count as an access")
+	}
+}
+
+func collect(t *testing.T, f *FSM, filters ...SessionFilter) map[int64]Session {
+	t.Helper()
+	out := make(map[int64]Session)
+	for s, err := range f.Sessions(context.Background(), filters...) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[s.UserID] = s
+	}
+	return out
+}
+
+func TestSessions_Filters(t *testing.T) {
+	f, _ := newTestFSM()
+	now := time.Now()
+	f.current.Store(int64(1), stateData{state: "pay", lastUse: now.Add(-2 * time.Hour)})
+	f.current.Store(int64(2), stateData{state: "pay", lastUse: now})
+	f.current.Store(int64(3), stateData{state: StateDefault, lastUse: now.Add(-2 * time.Hour)})
+
+	if got := collect(t, f); len(got) != 3 {
+		t.Fatalf("expected all 3 sessions, got %v", got)
+	}
+	if got := collect(t, f, InStates("pay")); len(got) != 2 {
+		t.Fatalf("expected 2 sessions in pay, got %v", got)
+	}
+	got := collect(t, f, InStates("pay"), IdleFor(time.Hour))
+	if len(got) != 1 || got[1].State != "pay" {
+		t.Fatalf("expected only user 1, got %v", got)
+	}
+
+	n := 0
+	for range f.Sessions(context.Background()) {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Fatal("iteration must stop when the caller breaks")
+	}
+}
+
+func TestSessions_MachineAndChatOwners(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	ctx := NewContext(context.Background(), f, 7)
+	if err := f.Transition(ctx, "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Machine("survey:v2").Transition(ctx, "rate"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.TransitionChat(NewChatContext(context.Background(), f, -100), "quiz"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := collect(t, f)
+	if s := got[7]; s.Machine != "" || s.Owner != 0 || s.ChatID != 0 {
+		t.Fatalf("a user's own session has no owner, got %+v", s)
+	}
+	if s := got[f.Machine("survey:v2").Key(7)]; s.Machine != "survey:v2" || s.Owner != 7 || s.State != "rate" {
+		t.Fatalf("expected the machine session of user 7, got %+v", s)
+	}
+	if s := got[f.ChatSessionKey(-100)]; s.ChatID != -100 || s.Machine != "" || s.State != "quiz" {
+		t.Fatalf("expected the session of chat -100, got %+v", s)
+	}
+	if data, _ := f.Inspect(context.Background(), f.ChatSessionKey(-100)); len(data.Values) != 0 {
+		t.Fatalf("the owner record must be hidden, got %v", data.Values)
+	}
+}
+
+// statesOnly is a StateStorage that cannot list its sessions.
+type statesOnly struct{ stubStorage }
+
+func (*statesOnly) CreateState(context.Context, int64, string) error { return nil }
+func (*statesOnly) SetState(context.Context, int64, string) error    { return nil }
+func (*statesOnly) GetState(context.Context, int64) (string, bool, error) {
+	return "", false, nil
+}
+
+func TestSessions_Unsupported(t *testing.T) {
+	f := New(context.Background(), WithStorage(&statesOnly{}))
+
+	var errs []error
+	for _, err := range f.Sessions(context.Background()) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], storage.ErrSessionsUnsupported) {
+		t.Fatalf("expected a single ErrSessionsUnsupported, got %v", errs)
+	}
+}
+
+func TestSessions_CancelledContext(t *testing.T) {
+	f, _ := newTestFSM()
+	f.current.Store(int64(1), stateData{state: StateDefault})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, err := range f.Sessions(ctx) {
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		return
+	}
+	t.Fatal("expected an error")
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	f := New(ctx)
+	defer f.Close()
+
+	f.Set(ctx, 1, "k", "v")
+	data, err := f.Inspect(ctx, 1)
+	if err != nil || data.Values["k"] != "v" {
+		t.Fatalf("unexpected inspect result (%+v, %v)", data, err)
+	}
+
+	f, _ = newTestFSM()
+	if _, err := f.Inspect(ctx, 1); !errors.Is(err, storage.ErrInspectUnsupported) {
+		t.Fatalf("expected ErrInspectUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package fsm
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+var (
+	// ErrCallbackSigningDisabled is returned by CallbackData when the FSM
+	// was created without WithCallbackSecret.
+	ErrCallbackSigningDisabled = errors.New("fsm: callback signing is not enabled")
+
+	// ErrCallbackDataTooLong is returned by CallbackData when the data and
+	// its token exceed the 64 bytes Telegram allows.
+	ErrCallbackDataTooLong = errors.New("fsm: callback data too long")
+)
+
+const (
+	// maxCallbackData is the Bot API limit on callback data.
+	maxCallbackData = 64
+
+	// callbackTokenLen is the length of the encoded token appended to
+	// callback data, callbackSep separates it from the data.
+	callbackTokenLen = 8
+	callbackSep      = '#'
+
+	// callbackEpochKey caches the session version tokens are bound to.
+	callbackEpochKey = reservedKeyPrefix + "callback_epoch"
+)
+
+// MaxSignedCallbackData is the longest data CallbackData accepts.
+const MaxSignedCallbackData = maxCallbackData - callbackTokenLen - 1
+
+// Signed callback data binds an inline button to the session version it
+// was sent in. Every transition of a session starts a new version, so a
+// button from an old message is rejected by VerifyCallbacks even when the
+// user happens to be back in the state the button was made for.
+
+// CallbackData returns data with a token appended that binds it to the
+// current version of the session in ctx. Use the result as the callback
+// data of an inline button and register its handler with
+// bot.MatchTypePrefix, since the token follows the data; VerifyCallbacks
+// strips it before the handler runs. data may be up to
+// MaxSignedCallbackData bytes long.
+func (f *FSM) CallbackData(ctx context.Context, data string) (string, error) {
+	if f.callbackSecret == nil {
+		return "", ErrCallbackSigningDisabled
+	}
+	if len(data) > MaxSignedCallbackData {
+		return "", fmt.Errorf("%w: %d bytes, at most %d allowed", ErrCallbackDataTooLong, len(data), MaxSignedCallbackData)
+	}
+
+	userID := userFromContext(ctx)
+	epoch, ok, err := f.callbackEpoch(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		if epoch, err = f.firstCallbackEpoch(ctx, userID); err != nil {
+			return "", err
+		}
+	}
+	return data + string(callbackSep) + f.callbackToken(userID, epoch, data), nil
+}
+
+// callbackEpoch returns the session version of userID, if any.
+func (f *FSM) callbackEpoch(ctx context.Context, userID int64) (string, bool, error) {
+	v, ok, err := f.storage.Get(ctx, userID, callbackEpochKey)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	epoch, ok := v.(string)
+	return epoch, ok, nil
+}
+
+// newCallbackEpoch starts a new session version of userID, invalidating
+// every token issued before.
+func (f *FSM) newCallbackEpoch(ctx context.Context, userID int64) (string, error) {
+	epoch, err := randomEpoch()
+	if err != nil {
+		return "", err
+	}
+	return epoch, f.storage.Set(ctx, userID, callbackEpochKey, epoch)
+}
+
+// firstCallbackEpoch starts the session version of userID if it has none.
+// Concurrent callers must sign with the same version, so it is created
+// with storage.Claimer where available and read back otherwise; without
+// Claimer, a caller may still lose a race against a simultaneous one.
+func (f *FSM) firstCallbackEpoch(ctx context.Context, userID int64) (string, error) {
+	epoch, err := randomEpoch()
+	if err != nil {
+		return "", err
+	}
+	stored, err := f.setIfAbsent(ctx, userID, callbackEpochKey, epoch, 0)
+	if errors.Is(err, storage.ErrClaimUnsupported) {
+		err = f.storage.Set(ctx, userID, callbackEpochKey, epoch)
+	}
+	if err != nil || stored {
+		return epoch, err
+	}
+
+	epoch, ok, err := f.callbackEpoch(ctx, userID)
+	if err == nil && !ok {
+		err = fmt.Errorf("fsm: callback epoch of user %d vanished", userID)
+	}
+	return epoch, err
+}
+
+// randomEpoch returns a new session version.
+func randomEpoch() (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", fmt.Errorf("fsm: callback epoch: %w", err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// callbackToken signs data for the given session version.
+func (f *FSM) callbackToken(userID int64, epoch, data string) string {
+	mac := hmac.New(sha256.New, f.callbackSecret)
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], uint64(userID))
+	mac.Write(id[:])
+	mac.Write([]byte(epoch))
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))[:callbackTokenLen]
+}
+
+// splitCallbackData splits signed callback data into data and token.
+func splitCallbackData(s string) (data, token string, ok bool) {
+	i := len(s) - callbackTokenLen - 1
+	if i < 0 || s[i] != callbackSep {
+		return s, "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// verifyCallback returns signed without its token and reports whether the
+// token is valid for the current version of the session in ctx.
+func (f *FSM) verifyCallback(ctx context.Context, signed string) (string, bool, error) {
+	data, token, ok := splitCallbackData(signed)
+	if !ok {
+		return signed, false, nil
+	}
+	userID := userFromContext(ctx)
+	if userID == 0 {
+		return data, false, nil
+	}
+	epoch, ok, err := f.callbackEpoch(ctx, userID)
+	if err != nil || !ok {
+		return data, false, err
+	}
+	want := f.callbackToken(userID, epoch, data)
+	return data, hmac.Equal([]byte(token), []byte(want)), nil
+}
+
+// DefaultStaleCallbackText answers callback queries rejected by
+// VerifyCallbacks unless WithStaleCallbackText sets another text.
+const DefaultStaleCallbackText = "This button is no longer active."
+
+// CallbackOption configures VerifyCallbacks.
+type CallbackOption func(*callbackConfig)
+
+type callbackConfig struct {
+	text      string
+	showAlert bool
+	unsigned  bool
+}
+
+// WithStaleCallbackText sets the text stale callback queries are answered
+// with; showAlert shows it as a dialog instead of a notification.
+func WithStaleCallbackText(text string, showAlert bool) CallbackOption {
+	return func(c *callbackConfig) {
+		c.text = text
+		c.showAlert = showAlert
+	}
+}
+
+// AllowUnsignedCallbacks lets callback queries without a token through, for
+// buttons created before signing was enabled or by other code.
+func AllowUnsignedCallbacks() CallbackOption {
+	return func(c *callbackConfig) {
+		c.unsigned = true
+	}
+}
+
+// VerifyCallbacks rejects callback queries whose data was not made by
+// CallbackData for the current version of the sender's session: buttons
+// of messages sent before the last transition, buttons of other users'
+// sessions and forged data. Rejected queries are answered with a short
+// text so the button stops spinning, and the handler is skipped. For
+// accepted queries the token is removed from CallbackQuery.Data before
+// the handler runs. Other updates pass through.
+//
+// It must run after Middleware, which attaches the FSM and session, and
+// requires the FSM to be created with WithCallbackSecret.
+func VerifyCallbacks(opts ...CallbackOption) bot.Middleware {
+	cfg := callbackConfig{text: DefaultStaleCallbackText}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return func(next bot.HandlerFunc) bot.HandlerFunc {
+		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			fsm := FromContext(ctx)
+			if update == nil || update.CallbackQuery == nil || fsm == nil || fsm.callbackSecret == nil {
+				next(ctx, b, update)
+				return
+			}
+
+			q := update.CallbackQuery
+			if _, _, signed := splitCallbackData(q.Data); !signed && cfg.unsigned {
+				next(ctx, b, update)
+				return
+			}
+
+			data, ok, err := fsm.verifyCallback(ctx, q.Data)
+			if err != nil {
+				fsm.handleError(ctx, b, update, err)
+				return
+			}
+			if !ok {
+				answerCallback(ctx, b, q, cfg.text, cfg.showAlert)
+				return
+			}
+			q.Data = data
+			next(ctx, b, update)
+		}
+	}
+}
+
+// answerCallback answers q so the client stops showing progress.
+func answerCallback(ctx context.Context, b *bot.Bot, q *models.CallbackQuery, text string, showAlert bool) {
+	if b == nil {
+		return
+	}
+	b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: q.ID,
+		Text:            text,
+		ShowAlert:       showAlert,
+	})
+}
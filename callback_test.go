@@ -0,0 +1,149 @@
+package fsm_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+)
+
+const stateConfirm fsm.StateFSM = "confirm"
+
+// confirmFlow asks to confirm an order with a signed button.
+func confirmFlow(t *testing.T, h *fsmtest.Harness) (buttons *[]string, confirmed *[]string) {
+	buttons, confirmed = new([]string), new([]string)
+	h.Bot.RegisterHandler(bot.HandlerTypeMessageText, "order", bot.MatchTypeCommand,
+		func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+			f := fsm.FromContext(ctx)
+			f.Transition(ctx, stateConfirm)
+			data, err := f.CallbackData(ctx, "confirm")
+			if err != nil {
+				t.Error(err)
+			}
+			*buttons = append(*buttons, data)
+		})
+	h.Bot.RegisterHandler(bot.HandlerTypeCallbackQueryData, "confirm", bot.MatchTypePrefix,
+		func(_ context.Context, _ *bot.Bot, u *models.Update) {
+			*confirmed = append(*confirmed, u.CallbackQuery.Data)
+		}, fsm.WithStates(stateConfirm))
+	return buttons, confirmed
+}
+
+func TestVerifyCallbacks(t *testing.T) {
+	h := fsmtest.New(t,
+		fsmtest.WithFSMOptions(fsm.WithCallbackSecret([]byte("secret"))),
+		fsmtest.WithMiddlewares(fsm.VerifyCallbacks()),
+	)
+	buttons, confirmed := confirmFlow(t, h)
+	alice := fsmtest.User{ID: 1}
+
+	h.Send(alice.Command("order"))
+	old := (*buttons)[0]
+	if len(old) > 64 || !strings.HasPrefix(old, "confirm") {
+		t.Fatalf("unexpected callback data %q", old)
+	}
+
+	// A new order moves the session on; the first button is stale although
+	// the user is back in the state it was made for.
+	h.Send(alice.Command("order"))
+	h.ResetCalls()
+	h.Send(alice.Callback(old))
+	if len(*confirmed) != 0 {
+		t.Fatal("a stale button must not run the handler")
+	}
+	answer := h.CallsTo("answerCallbackQuery")
+	if len(answer) != 1 || answer[0].Param("text") != fsm.DefaultStaleCallbackText {
+		t.Fatalf("a stale button must be answered, got %v", h.Calls())
+	}
+
+	h.Send(alice.Callback((*buttons)[1]))
+	if len(*confirmed) != 1 || (*confirmed)[0] != "confirm" {
+		t.Fatalf("the current button must reach the handler without its token, got %v", *confirmed)
+	}
+
+	// Another user cannot press Alice's button, and forged data is rejected.
+	h.Send(fsmtest.User{ID: 2}.Callback((*buttons)[1]))
+	h.Send(alice.Callback("confirm#AAAAAAAA"))
+	h.Send(alice.Callback("confirm"))
+	if len(*confirmed) != 1 {
+		t.Fatalf("foreign, forged and unsigned data must be rejected, got %v", *confirmed)
+	}
+}
+
+func TestVerifyCallbacks_AllowUnsigned(t *testing.T) {
+	h := fsmtest.New(t,
+		fsmtest.WithFSMOptions(fsm.WithCallbackSecret([]byte("secret"))),
+		fsmtest.WithMiddlewares(fsm.VerifyCallbacks(fsm.AllowUnsignedCallbacks(), fsm.WithStaleCallbackText("Expired", true))),
+	)
+	_, confirmed := confirmFlow(t, h)
+	alice := fsmtest.User{ID: 1}
+
+	h.Send(alice.Command("order"))
+	h.Send(alice.Callback("confirm"))
+	h.Send(alice.Callback("confirm#AAAAAAAA"))
+
+	if len(*confirmed) != 1 {
+		t.Fatalf("unsigned data must pass and forged data must not, got %v", *confirmed)
+	}
+	if a, _ := h.LastCall(); a.Method != "answerCallbackQuery" || a.Param("text") != "Expired" || a.Param("show_alert") != "true" {
+		t.Fatalf("unexpected answer %+v", a)
+	}
+}
+
+func TestCallbackData_Errors(t *testing.T) {
+	f := fsm.New(context.Background())
+	defer f.Close()
+	ctx := fsm.NewContext(context.Background(), f, 1)
+	if _, err := f.CallbackData(ctx, "x"); !errors.Is(err, fsm.ErrCallbackSigningDisabled) {
+		t.Fatalf("expected ErrCallbackSigningDisabled, got %v", err)
+	}
+
+	f = fsm.New(context.Background(), fsm.WithCallbackSecret([]byte("k")))
+	defer f.Close()
+	ctx = fsm.NewContext(context.Background(), f, 1)
+	if _, err := f.CallbackData(ctx, strings.Repeat("x", fsm.MaxSignedCallbackData+1)); !errors.Is(err, fsm.ErrCallbackDataTooLong) {
+		t.Fatalf("expected ErrCallbackDataTooLong, got %v", err)
+	}
+	if data, err := f.CallbackData(ctx, strings.Repeat("x", fsm.MaxSignedCallbackData)); err != nil || len(data) != 64 {
+		t.Fatalf("expected 64 bytes of data, got %d (%v)", len(data), err)
+	}
+}
+
+func TestCallbackData_ConcurrentFirstEpoch(t *testing.T) {
+	f := fsm.New(context.Background(), fsm.WithCallbackSecret([]byte("k")))
+	defer f.Close()
+	ctx := fsm.NewContext(context.Background(), f, 1)
+
+	// Handlers of simultaneous updates of a fresh session sign buttons at
+	// once; all of them must be bound to the same session version.
+	data := make([]string, 8)
+	var wg sync.WaitGroup
+	for i := range data {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data[i], _ = f.CallbackData(ctx, "x")
+		}()
+	}
+	wg.Wait()
+	for _, d := range data {
+		if d != data[0] {
+			t.Fatalf("concurrent signing must share the session version, got %v", data)
+		}
+	}
+
+	user, err := f.Inspect(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Values) != 0 {
+		t.Fatalf("the session version must not be listed as user data, got %v", user.Values)
+	}
+}
@@ -0,0 +1,100 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-telegram/bot"
+)
+
+// ErrNoChat is returned by chat state methods called with a context that
+// carries no chat, e.g. for an inline query.
+var ErrNoChat = errors.New("fsm: no chat in context")
+
+// The methods below keep state and cache shared by all members of a chat,
+// e.g. a game or a poll running in a group, next to each member's own
+// session. Middleware attaches the chat of every update to the context;
+// chat state is created by the first TransitionChat, so a chat that never
+// had one is reported without state.
+
+// ChatSessionKey returns the session key chat state and cache of chatID
+// are kept under. It is derived from the chat ID, so it never collides
+// with the session of a user, even in the private chat with that user.
+func (f *FSM) ChatSessionKey(chatID int64) int64 {
+	return CompositeKey(chatID)
+}
+
+// chatScoped returns ctx with the user's key replaced by the key of the
+// chat in ctx.
+func (f *FSM) chatScoped(ctx context.Context) (context.Context, bool) {
+	chatID := chatFromContext(ctx)
+	if chatID == 0 {
+		return ctx, false
+	}
+	return userWithContext(ctx, f.ChatSessionKey(chatID)), true
+}
+
+// ChatState returns the state of the chat in ctx, like CurrentState. It
+// reports false if the chat has no state or ctx carries no chat.
+func (f *FSM) ChatState(ctx context.Context) (StateFSM, bool, error) {
+	ctx, ok := f.chatScoped(ctx)
+	if !ok {
+		return StateNil, false, nil
+	}
+	return f.CurrentState(ctx)
+}
+
+// TransitionChat sets the state of the chat in ctx, like Transition:
+// moving to StateDefault also clears the chat's cache. The chat is
+// recorded with the state, so that Sessions can report it. It returns
+// ErrNoChat if ctx carries no chat.
+func (f *FSM) TransitionChat(ctx context.Context, state StateFSM) error {
+	chatID := chatFromContext(ctx)
+	scoped, ok := f.chatScoped(ctx)
+	if !ok {
+		return ErrNoChat
+	}
+	if err := f.Transition(scoped, state); err != nil {
+		return err
+	}
+	return f.Set(ctx, f.ChatSessionKey(chatID), sessionOwnerKey, chatOwner(chatID))
+}
+
+// FinishChat resets the state of the chat in ctx to StateDefault and
+// clears the chat's cache. Members' own sessions are left untouched.
+func (f *FSM) FinishChat(ctx context.Context) error {
+	return f.TransitionChat(ctx, StateDefault)
+}
+
+// SetChat stores a value in the cache shared by the chat's members.
+func (f *FSM) SetChat(ctx context.Context, chatID int64, key string, value any) error {
+	return f.Set(ctx, f.ChatSessionKey(chatID), key, value)
+}
+
+// GetChat retrieves a value from the cache shared by the chat's members.
+func (f *FSM) GetChat(ctx context.Context, chatID int64, key string) (any, bool, error) {
+	return f.Get(ctx, f.ChatSessionKey(chatID), key)
+}
+
+// CleanChatCache removes all values cached for the chat.
+func (f *FSM) CleanChatCache(ctx context.Context, chatID int64) error {
+	return f.CleanCache(ctx, f.ChatSessionKey(chatID))
+}
+
+// WithChatStates is WithStates for the state of the update's chat: the
+// handler runs only when the chat's state matches one of states. A chat
+// without state is treated as being in StateDefault, so handlers that
+// start a group flow can be guarded with WithChatStates(StateDefault).
+// Updates outside chats are skipped.
+func WithChatStates(states ...StateFSM) bot.Middleware {
+	return guardStates(states, nil, func(f *FSM, ctx context.Context) (StateFSM, bool, error) {
+		if chatFromContext(ctx) == 0 {
+			return StateNil, false, nil
+		}
+		st, ok, err := f.ChatState(ctx)
+		if err == nil && !ok {
+			return StateDefault, true, nil
+		}
+		return st, ok, err
+	})
+}
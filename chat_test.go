@@ -0,0 +1,115 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestChatState(t *testing.T) {
+	const chat = -10
+	f := New(context.Background())
+	defer f.Close()
+
+	var alice, bob context.Context
+	capture := func(dst *context.Context) bot.HandlerFunc {
+		return func(ctx context.Context, _ *bot.Bot, _ *models.Update) { *dst = ctx }
+	}
+	Middleware(f)(capture(&alice))(context.Background(), nil, groupMessage(chat, 1, 0))
+	Middleware(f)(capture(&bob))(context.Background(), nil, groupMessage(chat, 2, 0))
+
+	if _, ok, _ := f.ChatState(alice); ok {
+		t.Fatal("a chat must have no state before the first transition")
+	}
+	if err := f.TransitionChat(alice, "quiz"); err != nil {
+		t.Fatal(err)
+	}
+	f.Transition(alice, "answering")
+	f.SetChat(alice, chat, "question", 3)
+
+	if st, _, _ := f.ChatState(bob); st != "quiz" {
+		t.Fatalf("members must share the chat state, got %v", st)
+	}
+	if v, _, _ := f.GetChat(bob, chat, "question"); v != 3 {
+		t.Fatalf("members must share the chat cache, got %v", v)
+	}
+	if st, _, _ := f.CurrentState(bob); st != StateDefault {
+		t.Fatalf("members must keep their own state, got %v", st)
+	}
+
+	f.Set(alice, 1, "answer", "b")
+	if err := f.FinishChat(bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := f.GetChat(alice, chat, "question"); ok {
+		t.Fatal("FinishChat must clear the chat cache")
+	}
+	if st, _, _ := f.CurrentState(alice); st != "answering" {
+		t.Fatalf("FinishChat must keep members' state, got %v", st)
+	}
+	if v, _, _ := f.Get(alice, 1, "answer"); v != "b" {
+		t.Fatal("FinishChat must keep members' cache")
+	}
+}
+
+func TestChatState_PrivateChat(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+	ctx := NewChatContext(NewContext(context.Background(), f, 1), f, 1)
+
+	f.Transition(ctx, "user_state")
+	f.TransitionChat(ctx, "chat_state")
+	if st, _, _ := f.CurrentState(ctx); st != "user_state" {
+		t.Fatalf("chat state must not overwrite the user's state in a private chat, got %v", st)
+	}
+}
+
+func TestChatState_NoChat(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+	ctx := NewContext(context.Background(), f, 1)
+
+	if err := f.TransitionChat(ctx, "x"); !errors.Is(err, ErrNoChat) {
+		t.Fatalf("expected ErrNoChat, got %v", err)
+	}
+	if _, ok, err := f.ChatState(ctx); ok || err != nil {
+		t.Fatalf("expected no chat state, got (%v, %v)", ok, err)
+	}
+}
+
+func TestWithChatStates(t *testing.T) {
+	const chat = -10
+	f := New(context.Background())
+	defer f.Close()
+
+	var ran []string
+	handler := func(name string) bot.HandlerFunc {
+		return func(context.Context, *bot.Bot, *models.Update) { ran = append(ran, name) }
+	}
+	start := Middleware(f)(WithChatStates(StateDefault)(handler("start")))
+	answer := Middleware(f)(WithChatStates("quiz")(handler("answer")))
+
+	start(context.Background(), nil, groupMessage(chat, 1, 0))
+	answer(context.Background(), nil, groupMessage(chat, 1, 0))
+	if len(ran) != 1 || ran[0] != "start" {
+		t.Fatalf("a chat without state must be in StateDefault, ran %v", ran)
+	}
+
+	f.TransitionChat(NewChatContext(context.Background(), f, chat), "quiz")
+	ran = nil
+	start(context.Background(), nil, groupMessage(chat, 2, 0))
+	answer(context.Background(), nil, groupMessage(chat, 2, 0))
+	if len(ran) != 1 || ran[0] != "answer" {
+		t.Fatalf("expected only the answer handler, ran %v", ran)
+	}
+
+	ran = nil
+	inline := &models.Update{InlineQuery: &models.InlineQuery{From: &models.User{ID: 1}}}
+	Middleware(f)(WithChatStates(StateDefault)(handler("inline")))(context.Background(), nil, inline)
+	if len(ran) != 0 {
+		t.Fatal("updates outside chats must be skipped")
+	}
+}
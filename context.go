@@ -14,6 +14,12 @@ const (
 
 	// UserKey is the context key for storing/retrieving the user ID.
 	UserKey
+
+	// SenderKey is the context key for storing/retrieving the Sender.
+	SenderKey
+
+	// ChatKey is the context key for storing/retrieving the chat ID.
+	ChatKey
 )
 
 // FromContext extracts the FSM instance from the context.
@@ -25,11 +31,36 @@ func FromContext(ctx context.Context) *FSM {
 	return nil
 }
 
+// SenderFromContext returns the Sender of the update Middleware attached
+// to the context. The boolean is false if the update had no sender.
+func SenderFromContext(ctx context.Context) (Sender, bool) {
+	s, ok := ctx.Value(SenderKey).(Sender)
+	return s, ok
+}
+
+// NewContext returns a copy of ctx carrying f and userID, the same values
+// Middleware attaches for an update. Use it to call FSM methods for a user
+// outside a handler, e.g. from background jobs or tests.
+func NewContext(ctx context.Context, f *FSM, userID int64) context.Context {
+	return userWithContext(fsmWithContext(ctx, f), userID)
+}
+
+// NewChatContext returns a copy of ctx carrying f and chatID, for calling
+// chat state methods such as TransitionChat outside a handler.
+func NewChatContext(ctx context.Context, f *FSM, chatID int64) context.Context {
+	return chatWithContext(fsmWithContext(ctx, f), chatID)
+}
+
 // fsmWithContext returns a new context with the FSM instance attached.
 func fsmWithContext(ctx context.Context, f *FSM) context.Context {
 	return context.WithValue(ctx, FsmKey, f)
 }
 
+// senderWithContext returns a new context with the Sender attached.
+func senderWithContext(ctx context.Context, s Sender) context.Context {
+	return context.WithValue(ctx, SenderKey, s)
+}
+
 // userWithContext returns a new context with the user ID attached.
 func userWithContext(ctx context.Context, userID int64) context.Context {
 	return context.WithValue(ctx, UserKey, userID)
@@ -43,3 +74,17 @@ func userFromContext(ctx context.Context) int64 {
 	}
 	return 0
 }
+
+// chatWithContext returns a new context with the chat ID attached.
+func chatWithContext(ctx context.Context, chatID int64) context.Context {
+	return context.WithValue(ctx, ChatKey, chatID)
+}
+
+// chatFromContext extracts the chat ID from the context.
+// Returns 0 if no chat ID is present.
+func chatFromContext(ctx context.Context) int64 {
+	if chat, ok := ctx.Value(ChatKey).(int64); ok {
+		return chat
+	}
+	return 0
+}
@@ -25,3 +25,15 @@ func TestContextHelpers(t *testing.T) {
 		t.Fatalf("userFromContext on empty ctx = %d, want 0", got)
 	}
 }
+
+func TestNewContext(t *testing.T) {
+	f := &FSM{}
+	ctx := NewContext(context.Background(), f, 42)
+
+	if FromContext(ctx) != f {
+		t.Fatalf("NewContext did not attach the FSM")
+	}
+	if got := userFromContext(ctx); got != 42 {
+		t.Fatalf("userFromContext = %d, want 42", got)
+	}
+}
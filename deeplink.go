@@ -0,0 +1,424 @@
+package fsm
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+var (
+	// ErrStartPayloadInvalid is returned when minting a payload that has
+	// characters other than A-Z, a-z, 0-9, _ and - or is too long.
+	ErrStartPayloadInvalid = errors.New("fsm: invalid start payload")
+
+	// ErrDeepLinkSigningDisabled is returned when minting a signed payload
+	// with DeepLinks created without WithDeepLinkSecret.
+	ErrDeepLinkSigningDisabled = errors.New("fsm: deep link signing is not enabled")
+
+	// ErrDeepLinkRouteUnsigned is returned when minting a signed payload
+	// that no route registered with RequireSigned matches.
+	ErrDeepLinkRouteUnsigned = errors.New("fsm: deep link route does not require signed payloads")
+
+	// ErrDeepLinkTTL is returned when minting a one-time payload without a
+	// positive ttl.
+	ErrDeepLinkTTL = errors.New("fsm: one-time deep links need a positive ttl")
+
+	// ErrDeepLinkUnsigned is reported for a route registered with
+	// RequireSigned when the payload has no valid token.
+	ErrDeepLinkUnsigned = errors.New("fsm: deep link is not signed")
+
+	// ErrDeepLinkExpired is reported for a signed payload past its expiry.
+	ErrDeepLinkExpired = errors.New("fsm: deep link expired")
+
+	// ErrDeepLinkUsed is reported for a one-time payload used before.
+	ErrDeepLinkUsed = errors.New("fsm: deep link already used")
+)
+
+const (
+	// maxStartPayload is the Bot API limit on start payloads.
+	maxStartPayload = 64
+
+	// startTokenSize is the size of the token appended to signed payloads:
+	// one flag byte, the expiry as Unix seconds and a truncated MAC.
+	// startTokenLen is its encoded length.
+	startTokenSize = 12
+	startTokenLen  = startTokenSize / 3 * 4
+
+	startTokenOneTime = 1 << 0
+
+	// usedDeepLinkPrefix prefixes the cache keys of used one-time tokens.
+	usedDeepLinkPrefix = reservedKeyPrefix + "deeplink:"
+)
+
+// MaxSignedStartPayload is the longest data Payload and OneTimePayload
+// accept.
+const MaxSignedStartPayload = maxStartPayload - startTokenLen
+
+// DefaultInvalidDeepLinkText is sent to users opening a rejected deep link
+// unless OnInvalidDeepLink sets another handler.
+const DefaultInvalidDeepLinkText = "This link has expired or is no longer valid."
+
+// startPayloadChars matches the characters Telegram allows in payloads.
+var startPayloadChars = regexp.MustCompile(`^[A-Za-z0-9_-]*$`)
+
+// DeepLinks routes "/start <payload>" messages of deep links such as
+// t.me/our_bot?start=ref_123 into flows: the payload is matched against
+// registered patterns, the sender is moved to the route's state and the
+// pattern's parameters are stored in the sender's cache.
+//
+// Register it with the bot after Middleware, which attaches the session:
+//
+//	links := fsm.NewDeepLinks(f)
+//	links.Route("ref_{ref}", "referral")
+//	b.RegisterHandlerMatchFunc(links.Match, links.Handle)
+//
+// Payloads no route matches, and /start without payload, are left to other
+// handlers.
+type DeepLinks struct {
+	f         *FSM
+	routes    []*deepLinkRoute
+	secret    []byte
+	onInvalid ErrorHandler
+	now       func() time.Time
+}
+
+// DeepLinkOption configures DeepLinks.
+type DeepLinkOption func(*DeepLinks)
+
+// WithDeepLinkSecret enables signed payloads, minted by Payload and
+// OneTimePayload, with secret as the HMAC key. Keep it stable across
+// restarts and replicas, or links sent earlier stop working.
+func WithDeepLinkSecret(secret []byte) DeepLinkOption {
+	return func(d *DeepLinks) {
+		d.secret = secret
+	}
+}
+
+// OnInvalidDeepLink sets the handler called instead of the route when a
+// payload is rejected with ErrDeepLinkUnsigned, ErrDeepLinkExpired or
+// ErrDeepLinkUsed. By default the sender gets DefaultInvalidDeepLinkText.
+func OnInvalidDeepLink(h ErrorHandler) DeepLinkOption {
+	return func(d *DeepLinks) {
+		d.onInvalid = h
+	}
+}
+
+// NewDeepLinks creates an empty deep link router for f.
+func NewDeepLinks(f *FSM, opts ...DeepLinkOption) *DeepLinks {
+	d := &DeepLinks{f: f, onInvalid: answerInvalidDeepLink, now: time.Now}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// RouteOption configures a route of DeepLinks.
+type RouteOption func(*deepLinkRoute)
+
+// RouteHandler sets a handler run after the sender was moved to the
+// route's state, e.g. to send the flow's first message.
+func RouteHandler(h bot.HandlerFunc) RouteOption {
+	return func(r *deepLinkRoute) {
+		r.then = h
+	}
+}
+
+// RequireSigned makes the route accept only payloads minted by Payload or
+// OneTimePayload, so users cannot make up links, e.g. for orders of others.
+func RequireSigned() RouteOption {
+	return func(r *deepLinkRoute) {
+		r.signed = true
+	}
+}
+
+type deepLinkRoute struct {
+	re     *regexp.Regexp
+	state  StateFSM
+	then   bot.HandlerFunc
+	signed bool
+}
+
+// routePattern matches a parameter in a route pattern.
+var routePattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Route registers a route moving senders of payloads that match pattern to
+// state. A pattern is a payload with parameters in braces, e.g.
+// "order_{id}"; each parameter matches one or more payload characters and
+// its value is stored as a string in the sender's cache under the
+// parameter's name, after the transition. Routes are tried in the order
+// they were registered. Route panics if pattern is malformed.
+func (d *DeepLinks) Route(pattern string, state StateFSM, opts ...RouteOption) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, m := range routePattern.FindAllStringSubmatchIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+		fmt.Fprintf(&expr, "(?P<%s>[A-Za-z0-9_-]+?)", pattern[m[2]:m[3]])
+		last = m[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString("$")
+
+	literals := routePattern.ReplaceAllString(pattern, "")
+	if !startPayloadChars.MatchString(literals) {
+		panic(fmt.Sprintf("fsm: malformed deep link pattern %q", pattern))
+	}
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		panic(fmt.Sprintf("fsm: malformed deep link pattern %q: %v", pattern, err))
+	}
+
+	r := &deepLinkRoute{re: re, state: state}
+	for _, opt := range opts {
+		opt(r)
+	}
+	d.routes = append(d.routes, r)
+}
+
+// Payload returns data with a token appended that proves it was made with
+// the DeepLinks secret and expires after ttl; a non-positive ttl never
+// expires. data may be up to MaxSignedStartPayload characters long and must
+// match a route registered with RequireSigned, otherwise
+// ErrDeepLinkRouteUnsigned is returned: a route accepting unsigned payloads
+// would accept data without its token, and with it without expiry.
+func (d *DeepLinks) Payload(data string, ttl time.Duration) (string, error) {
+	return d.sign(data, ttl, 0)
+}
+
+// OneTimePayload is Payload for links that can be opened once: the first
+// sender to open it is routed, later ones are rejected with
+// ErrDeepLinkUsed. ttl must be positive, since used tokens are remembered
+// in the FSM's storage until they expire.
+//
+// Tokens are used up with storage.Claimer, so of several senders opening
+// a link at once exactly one gets through, across replicas too. With a
+// storage that does not implement it, one-time links fail closed: every
+// attempt is reported to the FSM's ErrorHandler with
+// storage.ErrClaimUnsupported. A used token that the storage forgets before
+// it expires, e.g. because the memory storage evicts its session under
+// memory pressure, becomes usable again.
+func (d *DeepLinks) OneTimePayload(data string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		return "", ErrDeepLinkTTL
+	}
+	return d.sign(data, ttl, startTokenOneTime)
+}
+
+func (d *DeepLinks) sign(data string, ttl time.Duration, flags byte) (string, error) {
+	if d.secret == nil {
+		return "", ErrDeepLinkSigningDisabled
+	}
+	if len(data) > MaxSignedStartPayload || !startPayloadChars.MatchString(data) {
+		return "", fmt.Errorf("%w: %q", ErrStartPayloadInvalid, data)
+	}
+	if r, _ := d.match(data); r == nil || !r.signed {
+		return "", fmt.Errorf("%w: %q", ErrDeepLinkRouteUnsigned, data)
+	}
+
+	var tok [startTokenSize]byte
+	tok[0] = flags
+	if ttl > 0 {
+		binary.BigEndian.PutUint32(tok[1:5], uint32(d.now().Add(ttl).Unix()))
+	}
+	copy(tok[5:], d.mac(tok[:5], data))
+	return data + base64.RawURLEncoding.EncodeToString(tok[:]), nil
+}
+
+// mac signs the token header and data.
+func (d *DeepLinks) mac(header []byte, data string) []byte {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(header)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)[:startTokenSize-len(header)]
+}
+
+// startToken is the verified token of a signed payload.
+type startToken struct {
+	raw     string
+	oneTime bool
+	expires time.Time // zero if the payload never expires
+}
+
+// verify splits payload into data and token. Payloads without a valid
+// token are returned whole.
+func (d *DeepLinks) verify(payload string) (string, *startToken) {
+	i := len(payload) - startTokenLen
+	if d.secret == nil || i < 0 {
+		return payload, nil
+	}
+	data, raw := payload[:i], payload[i:]
+	tok, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil || len(tok) != startTokenSize || !hmac.Equal(tok[5:], d.mac(tok[:5], data)) {
+		return payload, nil
+	}
+
+	st := &startToken{raw: raw, oneTime: tok[0]&startTokenOneTime != 0}
+	if exp := binary.BigEndian.Uint32(tok[1:5]); exp != 0 {
+		st.expires = time.Unix(int64(exp), 0)
+	}
+	return data, st
+}
+
+// route finds the route of payload and the values of its parameters.
+func (d *DeepLinks) route(payload string) (*deepLinkRoute, map[string]string, *startToken, bool) {
+	data, tok := d.verify(payload)
+	r, params := d.match(data)
+	return r, params, tok, r != nil
+}
+
+// match finds the first route matching data and the values of its
+// parameters.
+func (d *DeepLinks) match(data string) (*deepLinkRoute, map[string]string) {
+	for _, r := range d.routes {
+		m := r.re.FindStringSubmatch(data)
+		if m == nil {
+			continue
+		}
+		params := make(map[string]string, len(m)-1)
+		for i, name := range r.re.SubexpNames()[1:] {
+			params[name] = m[i+1]
+		}
+		return r, params
+	}
+	return nil, nil
+}
+
+// startPayload returns the payload of a "/start <payload>" message.
+func startPayload(u *models.Update) (string, bool) {
+	if !Command("start")(u) {
+		return "", false
+	}
+	_, payload, _ := strings.Cut(u.Message.Text, " ")
+	payload = strings.TrimSpace(payload)
+	return payload, payload != ""
+}
+
+// Match reports whether u is a /start message with a payload one of the
+// routes matches. Use it as the match function of Handle.
+func (d *DeepLinks) Match(u *models.Update) bool {
+	payload, ok := startPayload(u)
+	if !ok {
+		return false
+	}
+	_, _, _, ok = d.route(payload)
+	return ok
+}
+
+// Handle routes the payload of a /start message: it checks the payload's
+// token, moves the sender to the route's state, stores the parameters and
+// runs the route's handler. Rejected payloads are passed to the
+// OnInvalidDeepLink handler, storage failures to the FSM's ErrorHandler;
+// a one-time token is given back if the sender could not be moved to the
+// route's state. Updates without a session are ignored.
+func (d *DeepLinks) Handle(ctx context.Context, b *bot.Bot, update *models.Update) {
+	payload, ok := startPayload(update)
+	if !ok {
+		return
+	}
+	r, params, tok, ok := d.route(payload)
+	userID := userFromContext(ctx)
+	if !ok || userID == 0 {
+		return
+	}
+
+	release, err := d.check(ctx, r, tok)
+	if err != nil {
+		if errors.Is(err, ErrDeepLinkUnsigned) || errors.Is(err, ErrDeepLinkExpired) || errors.Is(err, ErrDeepLinkUsed) {
+			d.onInvalid(ctx, b, update, err)
+		} else {
+			d.f.handleError(ctx, b, update, err)
+		}
+		return
+	}
+
+	if err := d.enter(ctx, userID, r, params); err != nil {
+		if release != nil {
+			err = errors.Join(err, release())
+		}
+		d.f.handleError(ctx, b, update, err)
+		return
+	}
+	if r.then != nil {
+		r.then(ctx, b, update)
+	}
+}
+
+// enter moves the sender to the route's state and stores the parameters.
+func (d *DeepLinks) enter(ctx context.Context, userID int64, r *deepLinkRoute, params map[string]string) error {
+	if err := d.f.Transition(ctx, r.state); err != nil {
+		return err
+	}
+	for name, value := range params {
+		if err := d.f.Set(ctx, userID, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check validates tok for r and uses up one-time tokens, returning a
+// function that gives the token back.
+func (d *DeepLinks) check(ctx context.Context, r *deepLinkRoute, tok *startToken) (func() error, error) {
+	if tok == nil {
+		if r.signed {
+			return nil, ErrDeepLinkUnsigned
+		}
+		return nil, nil
+	}
+
+	var ttl time.Duration
+	if !tok.expires.IsZero() {
+		if ttl = tok.expires.Sub(d.now()); ttl <= 0 {
+			return nil, ErrDeepLinkExpired
+		}
+	}
+	if !tok.oneTime {
+		return nil, nil
+	}
+	if ttl <= 0 {
+		return nil, ErrDeepLinkExpired // one-time tokens are never minted without expiry
+	}
+
+	// Used tokens are shared by all users, so they are kept under a session
+	// key of their own until they expire.
+	session, key := d.f.Machine("fsm:deeplinks").Key(0), usedDeepLinkPrefix+tok.raw
+	claimed, err := d.f.setIfAbsent(ctx, session, key, true, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, ErrDeepLinkUsed
+	}
+	return func() error {
+		return d.f.storage.(storage.Claimer).Delete(context.WithoutCancel(ctx), session, key)
+	}, nil
+}
+
+// answerInvalidDeepLink tells the sender the link cannot be used.
+func answerInvalidDeepLink(ctx context.Context, b *bot.Bot, update *models.Update, _ error) {
+	if b == nil {
+		return
+	}
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: update.Message.Chat.ID,
+		Text:   DefaultInvalidDeepLinkText,
+	})
+}
+
+// StartLink returns the deep link starting the bot with username with
+// payload, e.g. https://t.me/our_bot?start=ref_123.
+func StartLink(username, payload string) string {
+	return "https://t.me/" + strings.TrimPrefix(username, "@") + "?start=" + payload
+}
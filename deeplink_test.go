@@ -0,0 +1,228 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
+)
+
+func startMessage(user int64, payload string) *models.Update {
+	u := privateMessage(user)
+	u.Message.Text = "/start " + payload
+	u.Message.Entities = []models.MessageEntity{{Type: models.MessageEntityTypeBotCommand, Length: len("/start")}}
+	return u
+}
+
+// deepLinkHarness runs updates through Middleware and d, as a bot would.
+func deepLinkHarness(f *FSM, d *DeepLinks) func(*models.Update) bool {
+	handle := Middleware(f)(d.Handle)
+	return func(u *models.Update) bool {
+		if !d.Match(u) {
+			return false
+		}
+		handle(context.Background(), nil, u)
+		return true
+	}
+}
+
+func TestDeepLinks_Route(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	var ran []string
+	d := NewDeepLinks(f)
+	d.Route("ref_{ref}", "referral")
+	d.Route("order_{shop}_{id}", "order", RouteHandler(func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		st, _, _ := FromContext(ctx).CurrentState(ctx)
+		ran = append(ran, string(st))
+	}))
+	send := deepLinkHarness(f, d)
+	ctx := NewContext(context.Background(), f, 1)
+
+	if !send(startMessage(1, "ref_123")) {
+		t.Fatal("a matching payload must be routed")
+	}
+	if st, _, _ := f.CurrentState(ctx); st != "referral" {
+		t.Fatalf("expected referral state, got %v", st)
+	}
+	if v, _, _ := f.Get(ctx, 1, "ref"); v != "123" {
+		t.Fatalf("expected ref parameter, got %v", v)
+	}
+
+	send(startMessage(1, "order_main_shop_987"))
+	if shop, _, _ := f.Get(ctx, 1, "shop"); shop != "main" {
+		t.Fatalf("expected shop parameter, got %v", shop)
+	}
+	if id, _, _ := f.Get(ctx, 1, "id"); id != "shop_987" {
+		t.Fatalf("expected id parameter, got %v", id)
+	}
+	if len(ran) != 1 || ran[0] != "order" {
+		t.Fatalf("the route handler must run after the transition, ran %v", ran)
+	}
+
+	if send(startMessage(1, "promo_1")) || send(privateMessage(1)) {
+		t.Fatal("unknown payloads and other messages must be left to other handlers")
+	}
+	start := startMessage(1, "")
+	start.Message.Text = "/start"
+	if send(start) {
+		t.Fatal("/start without payload must be left to other handlers")
+	}
+}
+
+func TestDeepLinks_Signed(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	var rejected []error
+	now := time.Unix(1_700_000_000, 0)
+	d := NewDeepLinks(f, WithDeepLinkSecret([]byte("secret")), OnInvalidDeepLink(
+		func(_ context.Context, _ *bot.Bot, _ *models.Update, err error) { rejected = append(rejected, err) },
+	))
+	d.now = func() time.Time { return now }
+	d.Route("order_{id}", "order", RequireSigned())
+	d.Route("invite_{team}", "invite", RequireSigned())
+	send := deepLinkHarness(f, d)
+
+	order, err := d.Payload("order_987", time.Hour)
+	if err != nil || len(order) > maxStartPayload {
+		t.Fatalf("unexpected payload %q (%v)", order, err)
+	}
+	send(startMessage(1, order))
+	if v, _, _ := f.Get(context.Background(), 1, "id"); v != "987" {
+		t.Fatalf("a signed payload must be routed without its token, got %v", v)
+	}
+
+	forged := "order_988" + order[len("order_987"):]
+	send(startMessage(2, "order_988"))
+	send(startMessage(2, forged))
+	now = now.Add(2 * time.Hour)
+	send(startMessage(2, order))
+	want := []error{ErrDeepLinkUnsigned, ErrDeepLinkUnsigned, ErrDeepLinkExpired}
+	if len(rejected) != len(want) {
+		t.Fatalf("expected %v, got %v", want, rejected)
+	}
+	for i := range want {
+		if !errors.Is(rejected[i], want[i]) {
+			t.Fatalf("expected %v, got %v", want, rejected)
+		}
+	}
+	if _, ok, _ := f.Get(context.Background(), 2, "id"); ok {
+		t.Fatal("rejected payloads must not store parameters")
+	}
+
+	rejected = nil
+	invite, err := d.OneTimePayload("invite_red", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(startMessage(3, invite))
+	send(startMessage(4, invite))
+	send(startMessage(5, "invite_red"))
+	want = []error{ErrDeepLinkUsed, ErrDeepLinkUnsigned}
+	if len(rejected) != len(want) || !errors.Is(rejected[0], want[0]) || !errors.Is(rejected[1], want[1]) {
+		t.Fatalf("a one-time payload must be rejected the second time and without its token, got %v", rejected)
+	}
+	if st, _, _ := f.CurrentState(NewContext(context.Background(), f, 3)); st != "invite" {
+		t.Fatalf("the first sender must be routed, got %v", st)
+	}
+}
+
+func TestDeepLinks_PayloadErrors(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	if _, err := NewDeepLinks(f).Payload("x", 0); !errors.Is(err, ErrDeepLinkSigningDisabled) {
+		t.Fatalf("expected ErrDeepLinkSigningDisabled, got %v", err)
+	}
+	d := NewDeepLinks(f, WithDeepLinkSecret([]byte("k")))
+	d.Route("ref_{ref}", "referral")
+	d.Route("x{id}", "order", RequireSigned())
+	if _, err := d.Payload("ref_1", time.Hour); !errors.Is(err, ErrDeepLinkRouteUnsigned) {
+		t.Errorf("a route accepting unsigned payloads must not get signed ones, got %v", err)
+	}
+	if _, err := d.Payload("a-b", 0); !errors.Is(err, ErrDeepLinkRouteUnsigned) {
+		t.Errorf("a payload no route matches must not be signed, got %v", err)
+	}
+	for _, ttl := range []time.Duration{0, -time.Second} {
+		if _, err := d.OneTimePayload("x", ttl); !errors.Is(err, ErrDeepLinkTTL) {
+			t.Errorf("ttl %v: expected ErrDeepLinkTTL, got %v", ttl, err)
+		}
+	}
+	for _, data := range []string{"a b", "ä", strings.Repeat("x", MaxSignedStartPayload+1)} {
+		if _, err := d.Payload(data, 0); !errors.Is(err, ErrStartPayloadInvalid) {
+			t.Errorf("%q: expected ErrStartPayloadInvalid, got %v", data, err)
+		}
+	}
+	if p, err := d.Payload(strings.Repeat("x", MaxSignedStartPayload), 0); err != nil || len(p) != maxStartPayload {
+		t.Fatalf("expected %d characters, got %d (%v)", maxStartPayload, len(p), err)
+	}
+}
+
+// failingSet is a memory storage whose Set fails for one key.
+type failingSet struct {
+	*memory.MemoryStorage
+	key string
+	err error
+}
+
+func (s *failingSet) Set(ctx context.Context, userID int64, key string, value any) error {
+	if key == s.key {
+		return s.err
+	}
+	return s.MemoryStorage.Set(ctx, userID, key, value)
+}
+
+func TestDeepLinks_OneTimeReleasedOnFailure(t *testing.T) {
+	fail := &failingSet{MemoryStorage: memory.NewMemoryStorage(time.Hour, time.Hour), key: "team", err: errors.New("disk full")}
+	var failed []error
+	f := New(context.Background(), WithStorage(fail), WithErrorHandler(
+		func(_ context.Context, _ *bot.Bot, _ *models.Update, err error) { failed = append(failed, err) },
+	))
+	defer f.Close()
+
+	d := NewDeepLinks(f, WithDeepLinkSecret([]byte("secret")), OnInvalidDeepLink(
+		func(_ context.Context, _ *bot.Bot, _ *models.Update, err error) {
+			t.Errorf("unexpected rejection: %v", err)
+		},
+	))
+	d.Route("invite_{team}", "invite", RequireSigned())
+	send := deepLinkHarness(f, d)
+
+	invite, err := d.OneTimePayload("invite_red", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(startMessage(1, invite))
+	if len(failed) != 1 || !errors.Is(failed[0], fail.err) {
+		t.Fatalf("expected the storage error, got %v", failed)
+	}
+
+	fail.key = ""
+	send(startMessage(1, invite))
+	if v, _, _ := f.Get(context.Background(), 1, "team"); v != "red" {
+		t.Fatalf("a link that failed to open must stay usable, got %v", v)
+	}
+}
+
+func TestDeepLinks_MalformedPattern(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a malformed pattern must panic")
+		}
+	}()
+	NewDeepLinks(nil).Route("ref {id}", "x")
+}
+
+func TestStartLink(t *testing.T) {
+	if got := StartLink("@our_bot", "ref_1"); got != "https://t.me/our_bot?start=ref_1" {
+		t.Fatalf("unexpected link %q", got)
+	}
+}
@@ -0,0 +1,187 @@
+package fsm
+
+import "github.com/go-telegram/bot/models"
+
+// Sender describes who an update comes from and where, as reported by an
+// Extractor. KeyStrategy derives the session key from it.
+type Sender struct {
+	// UserID is the sending user. For updates sent on behalf of a chat
+	// (see Anonymous) it is the ID of that chat; 0 if the update names no
+	// sender, e.g. reaction counts.
+	UserID int64
+
+	// ChatID is the chat the update belongs to and ChatType its type;
+	// zero for updates outside chats, such as inline queries.
+	ChatID   int64
+	ChatType models.ChatType
+
+	// ThreadID is the forum topic of the update's message; 0 outside
+	// topics.
+	ThreadID int
+
+	// IsBot reports that the sending user is a bot.
+	IsBot bool
+
+	// Anonymous reports that the update was sent on behalf of a chat:
+	// channel posts, messages of anonymous group admins or of users
+	// posting as a channel, reactions and poll answers of chats. Anonymous
+	// senders get no session unless WithAnonymousSessions is set.
+	Anonymous bool
+}
+
+// Extractor reports the sender of an update. The boolean is false when
+// the update has no session at all, e.g. a poll state update.
+type Extractor func(*models.Update) (Sender, bool)
+
+// ExtractSender is the default Extractor. It covers every update type of
+// the Bot API; updates that name neither a sender nor a chat have no
+// session.
+func ExtractSender(u *models.Update) (Sender, bool) {
+	if m := updateMessage(u); m != nil {
+		return messageSender(m), true
+	}
+
+	var s Sender
+	switch {
+	case u.CallbackQuery != nil:
+		// The sender is the user who pressed the button, not the author
+		// of the message it is attached to.
+		q := u.CallbackQuery
+		if m := q.Message.Message; m != nil {
+			s = messageSender(m)
+			s.Anonymous = false
+		} else if im := q.Message.InaccessibleMessage; im != nil {
+			s.setChat(&im.Chat)
+		}
+		s.setUser(&q.From)
+	case u.InlineQuery != nil:
+		s.setUser(u.InlineQuery.From)
+	case u.ChosenInlineResult != nil:
+		s.setUser(&u.ChosenInlineResult.From)
+	case u.ShippingQuery != nil:
+		s.setUser(u.ShippingQuery.From)
+	case u.PreCheckoutQuery != nil:
+		s.setUser(u.PreCheckoutQuery.From)
+	case u.PurchasedPaidMedia != nil:
+		s.setUser(&u.PurchasedPaidMedia.From)
+	case u.ChatMember != nil:
+		s.setUser(&u.ChatMember.From)
+		s.setChat(&u.ChatMember.Chat)
+	case u.MyChatMember != nil:
+		s.setUser(&u.MyChatMember.From)
+		s.setChat(&u.MyChatMember.Chat)
+	case u.ChatJoinRequest != nil:
+		s.setUser(&u.ChatJoinRequest.From)
+		s.setChat(&u.ChatJoinRequest.Chat)
+	case u.PollAnswer != nil:
+		if a := u.PollAnswer; a.VoterChat != nil {
+			s.UserID, s.Anonymous = a.VoterChat.ID, true
+		} else {
+			s.setUser(a.User)
+		}
+	case u.MessageReaction != nil:
+		r := u.MessageReaction
+		s.setChat(&r.Chat)
+		if r.ActorChat != nil {
+			s.UserID, s.Anonymous = r.ActorChat.ID, true
+		} else {
+			s.setUser(r.User)
+		}
+	case u.MessageReactionCount != nil:
+		s.setChat(&u.MessageReactionCount.Chat)
+	case u.ChatBoost != nil:
+		s.setUser(boostUser(u.ChatBoost.Boost.Source))
+		s.setChat(&u.ChatBoost.Chat)
+	case u.RemovedChatBoost != nil:
+		s.setUser(boostUser(u.RemovedChatBoost.Source))
+		s.setChat(&u.RemovedChatBoost.Chat)
+	case u.BusinessConnection != nil:
+		s.setUser(&u.BusinessConnection.User)
+		s.ChatID, s.ChatType = u.BusinessConnection.UserChatID, models.ChatTypePrivate
+	case u.DeletedBusinessMessages != nil:
+		s.setChat(&u.DeletedBusinessMessages.Chat)
+	}
+	return s, s.UserID != 0 || s.ChatID != 0
+}
+
+// messageSender describes the sender of a message. Messages with a
+// SenderChat are sent on behalf of that chat.
+func messageSender(m *models.Message) Sender {
+	var s Sender
+	s.setChat(&m.Chat)
+	if m.IsTopicMessage {
+		s.ThreadID = m.MessageThreadID
+	}
+	if m.SenderChat != nil {
+		s.UserID, s.Anonymous = m.SenderChat.ID, true
+	} else {
+		s.setUser(m.From)
+	}
+	return s
+}
+
+// setUser records u, if any, as the sending user.
+func (s *Sender) setUser(u *models.User) {
+	if u != nil {
+		s.UserID, s.IsBot = u.ID, u.IsBot
+	}
+}
+
+// setChat records c as the chat of the update.
+func (s *Sender) setChat(c *models.Chat) {
+	s.ChatID, s.ChatType = c.ID, c.Type
+}
+
+// boostUser returns the user who added a boost, or nil for unclaimed
+// giveaways.
+func boostUser(src models.ChatBoostSource) *models.User {
+	var u *models.User
+	switch {
+	case src.ChatBoostSourcePremium != nil:
+		u = &src.ChatBoostSourcePremium.User
+	case src.ChatBoostSourceGiftCode != nil:
+		u = &src.ChatBoostSourceGiftCode.User
+	case src.ChatBoostSourceGiveaway != nil:
+		u = &src.ChatBoostSourceGiveaway.User
+	}
+	if u == nil || u.ID == 0 {
+		return nil
+	}
+	return u
+}
+
+// updateMessage returns the message an update carries.
+func updateMessage(u *models.Update) *models.Message {
+	switch {
+	case u.Message != nil:
+		return u.Message
+	case u.EditedMessage != nil:
+		return u.EditedMessage
+	case u.ChannelPost != nil:
+		return u.ChannelPost
+	case u.EditedChannelPost != nil:
+		return u.EditedChannelPost
+	case u.BusinessMessage != nil:
+		return u.BusinessMessage
+	case u.EditedBusinessMessage != nil:
+		return u.EditedBusinessMessage
+	}
+	return nil
+}
+
+// ExtractUserID extracts the ID of the user who sent an update.
+// Returns 0 if the update has no sending user, including updates sent on
+// behalf of a chat.
+func ExtractUserID(u *models.Update) int64 {
+	if s, ok := ExtractSender(u); ok && !s.Anonymous {
+		return s.UserID
+	}
+	return 0
+}
+
+// ExtractChatID extracts the ID of the chat an update belongs to.
+// Returns 0 if the update is not bound to a chat.
+func ExtractChatID(u *models.Update) int64 {
+	s, _ := ExtractSender(u)
+	return s.ChatID
+}
@@ -0,0 +1,131 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestExtractSender(t *testing.T) {
+	user := &models.User{ID: 1}
+	group := models.Chat{ID: -10, Type: models.ChatTypeSupergroup}
+	channel := models.Chat{ID: -20, Type: models.ChatTypeChannel}
+
+	cases := []struct {
+		name   string
+		update *models.Update
+		want   Sender
+		ok     bool
+	}{
+		{"message", &models.Update{Message: &models.Message{From: user, Chat: group}},
+			Sender{UserID: 1, ChatID: -10, ChatType: "supergroup"}, true},
+		{"anonymous admin", &models.Update{Message: &models.Message{From: &models.User{ID: 1087968824}, SenderChat: &group, Chat: group}},
+			Sender{UserID: -10, ChatID: -10, ChatType: "supergroup", Anonymous: true}, true},
+		{"channel post", &models.Update{ChannelPost: &models.Message{SenderChat: &channel, Chat: channel}},
+			Sender{UserID: -20, ChatID: -20, ChatType: "channel", Anonymous: true}, true},
+		{"edited channel post", &models.Update{EditedChannelPost: &models.Message{SenderChat: &channel, Chat: channel}},
+			Sender{UserID: -20, ChatID: -20, ChatType: "channel", Anonymous: true}, true},
+		{"callback on a channel post", &models.Update{CallbackQuery: &models.CallbackQuery{From: *user,
+			Message: models.MaybeInaccessibleMessage{Message: &models.Message{SenderChat: &channel, Chat: channel}}}},
+			Sender{UserID: 1, ChatID: -20, ChatType: "channel"}, true},
+		{"inline callback", &models.Update{CallbackQuery: &models.CallbackQuery{From: *user, InlineMessageID: "x"}},
+			Sender{UserID: 1}, true},
+		{"reaction of a chat", &models.Update{MessageReaction: &models.MessageReactionUpdated{Chat: group, ActorChat: &channel}},
+			Sender{UserID: -20, ChatID: -10, ChatType: "supergroup", Anonymous: true}, true},
+		{"reaction count", &models.Update{MessageReactionCount: &models.MessageReactionCountUpdated{Chat: group}},
+			Sender{ChatID: -10, ChatType: "supergroup"}, true},
+		{"poll answer of a chat", &models.Update{PollAnswer: &models.PollAnswer{VoterChat: &channel}},
+			Sender{UserID: -20, Anonymous: true}, true},
+		{"chat boost", &models.Update{ChatBoost: &models.ChatBoostUpdated{Chat: channel, Boost: models.ChatBoost{
+			Source: models.ChatBoostSource{ChatBoostSourcePremium: &models.ChatBoostSourcePremium{User: *user}}}}},
+			Sender{UserID: 1, ChatID: -20, ChatType: "channel"}, true},
+		{"removed chat boost", &models.Update{RemovedChatBoost: &models.ChatBoostRemoved{Chat: channel,
+			Source: models.ChatBoostSource{ChatBoostSourceGiveaway: &models.ChatBoostSourceGiveaway{IsUnclaimed: true}}}},
+			Sender{ChatID: -20, ChatType: "channel"}, true},
+		{"business connection", &models.Update{BusinessConnection: &models.BusinessConnection{User: *user, UserChatID: 1}},
+			Sender{UserID: 1, ChatID: 1, ChatType: "private"}, true},
+		{"deleted business messages", &models.Update{DeletedBusinessMessages: &models.BusinessMessagesDeleted{Chat: models.Chat{ID: 5}}},
+			Sender{ChatID: 5}, true},
+		{"poll", &models.Update{Poll: &models.Poll{ID: "p"}}, Sender{}, false},
+		{"empty", &models.Update{}, Sender{}, false},
+	}
+	for _, c := range cases {
+		got, ok := ExtractSender(c.update)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%s: expected (%+v, %v), got (%+v, %v)", c.name, c.want, c.ok, got, ok)
+		}
+	}
+}
+
+func TestExtractUserID_IgnoresAnonymous(t *testing.T) {
+	channel := models.Chat{ID: -20, Type: models.ChatTypeChannel}
+	upd := &models.Update{ChannelPost: &models.Message{SenderChat: &channel, Chat: channel}}
+	if ExtractUserID(upd) != 0 || ExtractChatID(upd) != -20 {
+		t.Fatal("a channel post has a chat but no user")
+	}
+}
+
+func TestMiddleware_Anonymous(t *testing.T) {
+	group := models.Chat{ID: -10, Type: models.ChatTypeSupergroup}
+	anon := &models.Update{Message: &models.Message{SenderChat: &group, Chat: group}}
+
+	run := func(f *FSM) (key int64, sender Sender, hasSender bool) {
+		Middleware(f)(func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+			key = userFromContext(ctx)
+			sender, hasSender = SenderFromContext(ctx)
+		})(context.Background(), nil, anon)
+		return
+	}
+
+	f := New(context.Background())
+	defer f.Close()
+	key, sender, ok := run(f)
+	if key != 0 || !ok || !sender.Anonymous {
+		t.Fatalf("anonymous senders must get a sender but no session, got key %d, (%+v, %v)", key, sender, ok)
+	}
+	if _, ok, _ := f.UserState(context.Background(), -10); ok {
+		t.Fatal("no state must be created for an anonymous sender")
+	}
+
+	f = New(context.Background(), WithAnonymousSessions())
+	defer f.Close()
+	if key, _, _ := run(f); key != -10 {
+		t.Fatalf("WithAnonymousSessions must key by the sender chat, got %d", key)
+	}
+}
+
+func TestMiddleware_NoSession(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	called, hasSender := false, true
+	Middleware(f)(func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		called = true
+		_, hasSender = SenderFromContext(ctx)
+	})(context.Background(), nil, &models.Update{Poll: &models.Poll{ID: "p"}})
+
+	if !called || hasSender {
+		t.Fatalf("updates without a session must reach the handler without a sender, got (%v, %v)", called, hasSender)
+	}
+}
+
+func TestWithExtractor(t *testing.T) {
+	// Key payments by the invoice payload owner instead of the payer.
+	extract := func(u *models.Update) (Sender, bool) {
+		if q := u.PreCheckoutQuery; q != nil {
+			return Sender{UserID: 99}, true
+		}
+		return ExtractSender(u)
+	}
+	f := New(context.Background(), WithExtractor(extract))
+	defer f.Close()
+
+	if k := f.SessionKey(&models.Update{PreCheckoutQuery: &models.PreCheckoutQuery{From: &models.User{ID: 1}}}); k != 99 {
+		t.Fatalf("expected the custom extractor's key, got %d", k)
+	}
+	if k := f.SessionKey(&models.Update{Message: &models.Message{From: &models.User{ID: 1}}}); k != 1 {
+		t.Fatalf("expected the default for other updates, got %d", k)
+	}
+}
@@ -0,0 +1,131 @@
+package fsm
+
+import (
+	"slices"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// UpdateFilter decides whether Middleware gives an update a session. It
+// receives the update and its sender as reported by the FSM's Extractor.
+type UpdateFilter func(u *models.Update, s Sender) bool
+
+// FilterUpdates makes Middleware create or touch sessions only for updates
+// that pass every filter. Other updates still reach the handler with the
+// FSM and the sender in the context, but without a session, as if the
+// update had no sender at all: WithStates skips them and storage is left
+// untouched.
+func FilterUpdates(filters ...UpdateFilter) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.filters = append(c.filters, filters...)
+	}
+}
+
+// OnlyUpdateTypes passes updates of the given types, named as in the Bot
+// API and the models.AllowedUpdate* constants, e.g.
+// models.AllowedUpdateMessage.
+func OnlyUpdateTypes(types ...string) UpdateFilter {
+	return func(u *models.Update, _ Sender) bool {
+		return slices.Contains(types, updateType(u))
+	}
+}
+
+// SkipUpdateTypes passes updates of all types but the given ones.
+func SkipUpdateTypes(types ...string) UpdateFilter {
+	return func(u *models.Update, _ Sender) bool {
+		return !slices.Contains(types, updateType(u))
+	}
+}
+
+// OnlyChatTypes passes updates from chats of the given types. Updates
+// outside chats, such as inline queries, never pass.
+func OnlyChatTypes(types ...models.ChatType) UpdateFilter {
+	return func(_ *models.Update, s Sender) bool {
+		return s.ChatType != "" && slices.Contains(types, s.ChatType)
+	}
+}
+
+// SkipBots passes updates not sent by bots.
+func SkipBots(_ *models.Update, s Sender) bool {
+	return !s.IsBot
+}
+
+// AllowUsers passes updates sent by the given users only.
+func AllowUsers(ids ...int64) UpdateFilter {
+	allowed := userSet(ids)
+	return func(_ *models.Update, s Sender) bool {
+		_, ok := allowed[s.UserID]
+		return ok
+	}
+}
+
+// DenyUsers passes updates of all senders but the given users.
+func DenyUsers(ids ...int64) UpdateFilter {
+	denied := userSet(ids)
+	return func(_ *models.Update, s Sender) bool {
+		_, ok := denied[s.UserID]
+		return !ok
+	}
+}
+
+func userSet(ids []int64) map[int64]struct{} {
+	set := make(map[int64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+// updateType returns the Bot API name of the update's type, or "" for an
+// empty update.
+func updateType(u *models.Update) string {
+	switch {
+	case u.Message != nil:
+		return models.AllowedUpdateMessage
+	case u.EditedMessage != nil:
+		return models.AllowedUpdateEditedMessage
+	case u.ChannelPost != nil:
+		return models.AllowedUpdateChannelPost
+	case u.EditedChannelPost != nil:
+		return models.AllowedUpdateEditedChannelPost
+	case u.BusinessConnection != nil:
+		return models.AllowedUpdateBusinessConnection
+	case u.BusinessMessage != nil:
+		return models.AllowedUpdateBusinessMessage
+	case u.EditedBusinessMessage != nil:
+		return models.AllowedUpdateEditedBusinessMessage
+	case u.DeletedBusinessMessages != nil:
+		return models.AllowedUpdateDeletedBusinessMessages
+	case u.MessageReaction != nil:
+		return models.AllowedUpdateMessageReaction
+	case u.MessageReactionCount != nil:
+		return models.AllowedUpdateMessageReactionCount
+	case u.InlineQuery != nil:
+		return models.AllowedUpdateInlineQuery
+	case u.ChosenInlineResult != nil:
+		return models.AllowedUpdateChosenInlineResult
+	case u.CallbackQuery != nil:
+		return models.AllowedUpdateCallbackQuery
+	case u.ShippingQuery != nil:
+		return models.AllowedUpdateShippingQuery
+	case u.PreCheckoutQuery != nil:
+		return models.AllowedUpdatePreCheckoutQuery
+	case u.PurchasedPaidMedia != nil:
+		return models.AllowedUpdatePurchasedPaidMedia
+	case u.Poll != nil:
+		return models.AllowedUpdatePoll
+	case u.PollAnswer != nil:
+		return models.AllowedUpdatePollAnswer
+	case u.MyChatMember != nil:
+		return models.AllowedUpdateMyChatMember
+	case u.ChatMember != nil:
+		return models.AllowedUpdateChatMember
+	case u.ChatJoinRequest != nil:
+		return models.AllowedUpdateChatJoinRequest
+	case u.ChatBoost != nil:
+		return models.AllowedUpdateChatBoost
+	case u.RemovedChatBoost != nil:
+		return models.AllowedUpdateRemovedChatBoost
+	}
+	return ""
+}
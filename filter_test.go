@@ -0,0 +1,74 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestUpdateFilters(t *testing.T) {
+	private := privateMessage(1)
+	group := groupMessage(-10, 2, 0)
+	fromBot := &models.Update{Message: &models.Message{
+		From: &models.User{ID: 3, IsBot: true},
+		Chat: models.Chat{ID: -10, Type: models.ChatTypeGroup},
+	}}
+	inline := &models.Update{InlineQuery: &models.InlineQuery{From: &models.User{ID: 1}}}
+	member := &models.Update{ChatMember: &models.ChatMemberUpdated{From: models.User{ID: 1}, Chat: models.Chat{ID: -10}}}
+
+	cases := []struct {
+		name   string
+		filter UpdateFilter
+		pass   []*models.Update
+		reject []*models.Update
+	}{
+		{"OnlyUpdateTypes", OnlyUpdateTypes(models.AllowedUpdateMessage), []*models.Update{private, group}, []*models.Update{inline, member}},
+		{"SkipUpdateTypes", SkipUpdateTypes(models.AllowedUpdateChatMember, models.AllowedUpdateInlineQuery), []*models.Update{private}, []*models.Update{inline, member}},
+		{"OnlyChatTypes", OnlyChatTypes(models.ChatTypePrivate), []*models.Update{private}, []*models.Update{group, inline}},
+		{"SkipBots", SkipBots, []*models.Update{private, group}, []*models.Update{fromBot}},
+		{"AllowUsers", AllowUsers(1), []*models.Update{private, inline}, []*models.Update{group}},
+		{"DenyUsers", DenyUsers(1), []*models.Update{group}, []*models.Update{private, inline}},
+	}
+	for _, c := range cases {
+		for _, u := range c.pass {
+			if s, _ := ExtractSender(u); !c.filter(u, s) {
+				t.Errorf("%s: expected %s update to pass", c.name, updateType(u))
+			}
+		}
+		for _, u := range c.reject {
+			if s, _ := ExtractSender(u); c.filter(u, s) {
+				t.Errorf("%s: expected %s update to be rejected", c.name, updateType(u))
+			}
+		}
+	}
+}
+
+func TestMiddleware_FilterUpdates(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+	mw := Middleware(f, FilterUpdates(OnlyChatTypes(models.ChatTypePrivate), SkipBots))
+
+	var key int64
+	var hasFSM bool
+	next := func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		key, hasFSM = userFromContext(ctx), FromContext(ctx) != nil
+	}
+
+	mw(next)(context.Background(), nil, groupMessage(-10, 2, 0))
+	if key != 0 || !hasFSM {
+		t.Fatalf("a filtered update must reach the handler with the FSM but no session, got key %d", key)
+	}
+	if _, ok, _ := f.UserState(context.Background(), 2); ok {
+		t.Fatal("no state must be created for a filtered update")
+	}
+
+	mw(next)(context.Background(), nil, privateMessage(1))
+	if key != 1 {
+		t.Fatalf("expected a session for a private message, got key %d", key)
+	}
+	if _, ok, _ := f.UserState(context.Background(), 1); !ok {
+		t.Fatal("expected a state for a private message")
+	}
+}
@@ -2,21 +2,38 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
 )
 
 // FSM implements a finite state machine for users, maintaining states and local cache.
 type FSM struct {
 	current sync.Map // current state and last usage time keyed by user ID.
 
-	storage     storage.Storage // pluggable storage backend.
+	storage     storage.Storage      // pluggable storage backend.
+	states      storage.StateStorage // optional persistent state backend; nil means current is used.
 	ownsStorage bool
 
 	ttl             time.Duration
 	cleanupInterval time.Duration
+
+	onError    ErrorHandler    // called by middlewares when state loading fails.
+	onMismatch MismatchHandler // called by state guards that skip a handler.
+	extract    Extractor       // reports the sender of updates; nil means ExtractSender.
+	key        KeyStrategy     // derives session keys from senders.
+	anonymous  bool            // give anonymous senders sessions.
+
+	callbackSecret []byte // key for signed callback data; nil disables signing.
+
+	snapshotPath     string        // file for periodic snapshots; empty disables them.
+	snapshotInterval time.Duration // period of snapshot writes; non-positive means only on Close.
+	onSnapshotError  func(error)
+	stopSnapshot     chan struct{}
+	snapshotDone     chan struct{}
+	closeOnce        sync.Once
 }
 
 // stateData holds the FSM state and the timestamp of last update.
@@ -28,6 +45,7 @@ type stateData struct {
 // New creates a new FSM instance and starts a background worker
 // to periodically clean up expired states.
 // Storage backend can be customised via options.
+// If the storage also implements storage.StateStorage, user states are kept there.
 func New(ctx context.Context, opts ...Option) *FSM {
 
 	fsm := &FSM{
@@ -36,6 +54,7 @@ func New(ctx context.Context, opts ...Option) *FSM {
 
 		ttl:             30 * time.Minute,
 		cleanupInterval: 30 * time.Second,
+		key:             KeyByUser,
 	}
 
 	for _, opt := range opts {
@@ -46,5 +65,43 @@ func New(ctx context.Context, opts ...Option) *FSM {
 		fsm.storage = NewMemoryStorage(fsm.ttl, fsm.cleanupInterval)
 	}
 
+	if ss, ok := fsm.storage.(storage.StateStorage); ok {
+		fsm.states = ss
+	}
+
+	if fsm.snapshotPath != "" {
+		if err := fsm.loadSnapshotFile(fsm.snapshotPath); err != nil {
+			// Keep the unreadable file intact instead of overwriting it.
+			fsm.reportSnapshotError(err)
+			fsm.snapshotPath = ""
+		}
+	}
+
+	if fsm.snapshotPath != "" && fsm.snapshotInterval > 0 {
+		fsm.stopSnapshot = make(chan struct{})
+		fsm.snapshotDone = make(chan struct{})
+		go fsm.snapshotWorker(ctx.Done())
+	}
+
 	return fsm
 }
+
+// Close writes the final snapshot (see WithSnapshotFile) and releases the
+// storage created by New. A storage supplied via WithStorage is left open
+// and must be closed by the caller. Calling Close more than once is a no-op.
+func (f *FSM) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		if f.stopSnapshot != nil {
+			close(f.stopSnapshot)
+			<-f.snapshotDone
+		}
+		if f.snapshotPath != "" {
+			err = f.writeSnapshotFile(f.snapshotPath)
+		}
+		if f.ownsStorage && f.storage != nil {
+			err = errors.Join(err, f.storage.Close())
+		}
+	})
+	return err
+}
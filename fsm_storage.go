@@ -4,41 +4,66 @@ import (
 	"context"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
-	"github.com/whynot00/go-telegram-fsm/storage"
-	"github.com/whynot00/go-telegram-fsm/storage/memory"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
 )
 
 func NewMemoryStorage(ttl, interval time.Duration) storage.Storage {
 	return memory.NewMemoryStorage(ttl, interval)
 }
 
+// reservedKeyPrefix starts the cache keys the FSM uses for its own data,
+// such as the session version of signed callback data.
+const reservedKeyPrefix = "fsm:"
+
 // Set stores a key-value pair for the user using configured storage.
-func (f *FSM) Set(ctx context.Context, userID int64, key string, value any) {
-	f.storage.Set(ctx, userID, key, value)
+// Keys starting with "fsm:" are reserved for the FSM.
+func (f *FSM) Set(ctx context.Context, userID int64, key string, value any) error {
+	return f.storage.Set(ctx, userID, key, value)
+}
+
+// SetWithTTL stores a key-value pair that expires after ttl, independently of
+// the user's activity. Useful for short-lived values such as one-time codes
+// or "resend allowed after" markers. A non-positive ttl behaves like Set.
+func (f *FSM) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	return f.storage.SetWithTTL(ctx, userID, key, value, ttl)
 }
 
 // Get retrieves a cached value by key for the user.
-func (f *FSM) Get(ctx context.Context, userID int64, key string) (any, bool) {
+// A missing key is reported by the boolean result, not by an error.
+func (f *FSM) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
 	return f.storage.Get(ctx, userID, key)
 }
 
 // SetMedia stores a media file for the specified media group.
-func (f *FSM) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) {
-	f.storage.SetMedia(ctx, userID, mediaGroupID, file)
+func (f *FSM) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	return f.storage.SetMedia(ctx, userID, mediaGroupID, file)
 }
 
 // GetMedia returns media data for the specified media group.
-func (f *FSM) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool) {
+func (f *FSM) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
 	return f.storage.GetMedia(ctx, userID, mediaGroupID)
 }
 
 // CleanMediaCache removes cached media for the user and group.
-func (f *FSM) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) bool {
+// It reports whether the group existed.
+func (f *FSM) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
 	return f.storage.CleanMediaCache(ctx, userID, mediaGroupID)
 }
 
 // CleanCache removes all cached data for the user.
-func (f *FSM) CleanCache(ctx context.Context, userID int64) {
-	f.storage.CleanCache(ctx, userID)
+func (f *FSM) CleanCache(ctx context.Context, userID int64) error {
+	return f.storage.CleanCache(ctx, userID)
+}
+
+// setIfAbsent stores value under key like SetWithTTL unless the key holds
+// a value, and reports whether it stored it. It returns
+// storage.ErrClaimUnsupported if the storage cannot decide atomically.
+func (f *FSM) setIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	claimer, ok := f.storage.(storage.Claimer)
+	if !ok {
+		return false, storage.ErrClaimUnsupported
+	}
+	return claimer.SetIfAbsent(ctx, userID, key, value, ttl)
 }
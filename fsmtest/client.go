@@ -0,0 +1,232 @@
+package fsmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// Call is a Bot API request made by a handler under test.
+type Call struct {
+	// Method is the Bot API method name, e.g. "sendMessage".
+	Method string
+
+	// Params holds the request fields as the bot sent them: strings as is,
+	// everything else JSON-encoded. Uploaded files are recorded by file name.
+	Params map[string]string
+}
+
+// Param returns the named request field, or "" if it was not sent.
+func (c Call) Param(name string) string {
+	return c.Params[name]
+}
+
+// ChatID returns the chat_id field parsed as a number, or 0 if it is absent
+// or a channel username.
+func (c Call) ChatID() int64 {
+	id, _ := strconv.ParseInt(c.Params["chat_id"], 10, 64)
+	return id
+}
+
+// Text returns the text field of the request.
+func (c Call) Text() string {
+	return c.Params["text"]
+}
+
+// Decode unmarshals a JSON-encoded field (e.g. "reply_markup") into dst.
+func (c Call) Decode(name string, dst any) error {
+	return json.Unmarshal([]byte(c.Params[name]), dst)
+}
+
+// Responder builds the result of a Bot API call. A non-nil error is
+// returned to the bot as a failed request with the error text.
+type Responder func(Call) (any, error)
+
+// messageMethods lists the methods whose result is the sent or edited Message.
+var messageMethods = map[string]bool{
+	"sendMessage":             true,
+	"forwardMessage":          true,
+	"sendPhoto":               true,
+	"sendAudio":               true,
+	"sendDocument":            true,
+	"sendVideo":               true,
+	"sendAnimation":           true,
+	"sendVoice":               true,
+	"sendVideoNote":           true,
+	"sendPaidMedia":           true,
+	"sendLocation":            true,
+	"sendVenue":               true,
+	"sendContact":             true,
+	"sendPoll":                true,
+	"sendDice":                true,
+	"sendSticker":             true,
+	"sendInvoice":             true,
+	"sendGame":                true,
+	"editMessageText":         true,
+	"editMessageCaption":      true,
+	"editMessageMedia":        true,
+	"editMessageLiveLocation": true,
+	"stopMessageLiveLocation": true,
+	"editMessageReplyMarkup":  true,
+}
+
+// recorder is a bot.HttpClient that answers Bot API requests in process
+// and keeps every call it served.
+type recorder struct {
+	mu         sync.Mutex
+	calls      []Call
+	responders map[string]Responder
+	nextID     int
+}
+
+func newRecorder() *recorder {
+	return &recorder{responders: make(map[string]Responder)}
+}
+
+// Do implements bot.HttpClient.
+func (r *recorder) Do(req *http.Request) (*http.Response, error) {
+	_, result, err := r.serve(req)
+	return respond(result, err), nil
+}
+
+// serve records the call in req and builds its result: from the method's
+// Responder if one is set, otherwise a synthesised one.
+func (r *recorder) serve(req *http.Request) (Call, any, error) {
+	call := Call{Method: path.Base(req.URL.Path), Params: make(map[string]string)}
+	if err := parseForm(req, call.Params); err != nil {
+		return call, nil, err
+	}
+
+	r.mu.Lock()
+	r.calls = append(r.calls, call)
+	responder := r.responders[call.Method]
+	r.mu.Unlock()
+
+	if responder != nil {
+		result, err := responder(call)
+		return call, result, err
+	}
+	return call, r.result(call), nil
+}
+
+// result synthesises a plausible successful result for call.
+func (r *recorder) result(call Call) any {
+	switch {
+	case messageMethods[call.Method]:
+		return r.message(call, call.Text())
+	case call.Method == "sendMediaGroup":
+		var items []struct {
+			Caption string `json:"caption"`
+		}
+		_ = call.Decode("media", &items)
+		msgs := make([]*models.Message, len(items))
+		for i, item := range items {
+			msgs[i] = r.message(call, "")
+			msgs[i].Caption = item.Caption
+		}
+		return msgs
+	case call.Method == "copyMessage":
+		return models.MessageID{ID: r.message(call, "").ID}
+	case call.Method == "getMe":
+		return models.User{ID: 1, IsBot: true, FirstName: "fsmtest", Username: "fsmtest_bot"}
+	case call.Method == "getFile":
+		id := call.Param("file_id")
+		return models.File{FileID: id, FileUniqueID: id, FilePath: "files/" + id}
+	}
+	return true
+}
+
+// message returns a new Message addressed to the call's chat.
+func (r *recorder) message(call Call, text string) *models.Message {
+	r.mu.Lock()
+	r.nextID++
+	id := r.nextID
+	r.mu.Unlock()
+
+	if mid, err := strconv.Atoi(call.Param("message_id")); err == nil {
+		id = mid // edits keep the id of the edited message
+	}
+	return &models.Message{
+		ID:   id,
+		Date: int(time.Now().Unix()),
+		Chat: models.Chat{ID: call.ChatID()},
+		Text: text,
+	}
+}
+
+func (r *recorder) handle(method string, fn Responder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responders[method] = fn
+}
+
+func (r *recorder) snapshot() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+func (r *recorder) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+// parseForm reads the multipart body the bot sends into params.
+func parseForm(req *http.Request, params map[string]string) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	_, mp, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	mr := multipart.NewReader(req.Body, mp["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if name := part.FileName(); name != "" {
+			params[part.FormName()] = name
+			continue
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		params[part.FormName()] = string(data)
+	}
+}
+
+// envelope wraps a result or an error in a Bot API response body.
+func envelope(result any, err error) map[string]any {
+	if err != nil {
+		return map[string]any{"ok": false, "error_code": http.StatusBadRequest, "description": err.Error()}
+	}
+	return map[string]any{"ok": true, "result": result}
+}
+
+// respond builds the HTTP response carrying envelope(result, err).
+func respond(result any, err error) *http.Response {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(envelope(result, err))
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(&buf),
+	}
+}
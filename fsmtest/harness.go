@@ -0,0 +1,229 @@
+// Package fsmtest runs conversations against FSM-driven handlers without a
+// network. A Harness wires a bot.Bot to an FSM through fsm.Middleware,
+// delivers updates built by User synchronously, records every Bot API call
+// the handlers make and offers assertions on the resulting state and cache.
+package fsmtest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+)
+
+// Harness delivers updates to a bot under test and records its calls.
+// Register handlers on Bot (or pass them with WithBotOptions) before Send.
+type Harness struct {
+	t   testing.TB
+	ctx context.Context
+	rec *recorder
+
+	// FSM is the state machine the middleware attaches to every update.
+	FSM *fsm.FSM
+
+	// Bot is the bot updates are delivered to. Its requests never leave
+	// the process.
+	Bot *bot.Bot
+}
+
+// config collects Harness options.
+type config struct {
+	fsm         *fsm.FSM
+	fsmOpts     []fsm.Option
+	botOpts     []bot.Option
+	middlewares []bot.Middleware
+}
+
+// Option configures a Harness.
+type Option func(*config)
+
+// WithFSM makes the harness use f instead of creating its own FSM.
+// The caller keeps ownership of f and closes it.
+func WithFSM(f *fsm.FSM) Option {
+	return func(c *config) {
+		c.fsm = f
+	}
+}
+
+// WithFSMOptions sets the options for the FSM the harness creates,
+// e.g. fsm.WithStorage to test against a specific backend.
+func WithFSMOptions(opts ...fsm.Option) Option {
+	return func(c *config) {
+		c.fsmOpts = append(c.fsmOpts, opts...)
+	}
+}
+
+// WithBotOptions adds bot options applied after the harness defaults,
+// so they can register handlers or override the default handler.
+func WithBotOptions(opts ...bot.Option) Option {
+	return func(c *config) {
+		c.botOpts = append(c.botOpts, opts...)
+	}
+}
+
+// WithMiddlewares adds bot middlewares that run after fsm.Middleware.
+func WithMiddlewares(mws ...bot.Middleware) Option {
+	return func(c *config) {
+		c.middlewares = append(c.middlewares, mws...)
+	}
+}
+
+// New creates a Harness. Unless WithFSM is given it creates an FSM that
+// is closed when the test finishes.
+func New(t testing.TB, opts ...Option) *Harness {
+	t.Helper()
+
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	h := &Harness{t: t, ctx: context.Background(), rec: newRecorder(), FSM: cfg.fsm}
+	if h.FSM == nil {
+		h.FSM = fsm.New(h.ctx, cfg.fsmOpts...)
+		t.Cleanup(func() { h.FSM.Close() })
+	}
+
+	botOpts := []bot.Option{
+		bot.WithSkipGetMe(),
+		bot.WithNotAsyncHandlers(),
+		bot.WithHTTPClient(time.Second, h.rec),
+		bot.WithMiddlewares(append([]bot.Middleware{fsm.Middleware(h.FSM)}, cfg.middlewares...)...),
+		bot.WithDefaultHandler(func(context.Context, *bot.Bot, *models.Update) {}),
+		bot.WithErrorsHandler(func(err error) { t.Logf("fsmtest: bot error: %v", err) }),
+	}
+	b, err := bot.New(Token, append(botOpts, cfg.botOpts...)...)
+	if err != nil {
+		t.Fatalf("fsmtest: create bot: %v", err)
+	}
+	h.Bot = b
+
+	return h
+}
+
+// Send delivers updates one by one; each returns after its handler did.
+func (h *Harness) Send(updates ...*models.Update) {
+	for _, u := range updates {
+		h.Bot.ProcessUpdate(h.ctx, u)
+	}
+}
+
+// Handle sets the response for every later call of a Bot API method,
+// replacing the synthesised one; use it to simulate API failures.
+func (h *Harness) Handle(method string, fn Responder) {
+	h.rec.handle(method, fn)
+}
+
+// Calls returns all Bot API calls recorded so far, oldest first.
+func (h *Harness) Calls() []Call {
+	return h.rec.snapshot()
+}
+
+// CallsTo returns the recorded calls of one Bot API method.
+func (h *Harness) CallsTo(method string) []Call {
+	var out []Call
+	for _, c := range h.rec.snapshot() {
+		if c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// LastCall returns the most recent call and false if there was none.
+func (h *Harness) LastCall() (Call, bool) {
+	calls := h.rec.snapshot()
+	if len(calls) == 0 {
+		return Call{}, false
+	}
+	return calls[len(calls)-1], true
+}
+
+// Sent returns the texts of sendMessage calls to chatID, oldest first.
+func (h *Harness) Sent(chatID int64) []string {
+	var out []string
+	for _, c := range h.CallsTo("sendMessage") {
+		if c.ChatID() == chatID {
+			out = append(out, c.Text())
+		}
+	}
+	return out
+}
+
+// ResetCalls forgets the recorded calls, e.g. between conversation steps.
+func (h *Harness) ResetCalls() {
+	h.rec.reset()
+}
+
+// State returns the user's current state and whether the user has one.
+func (h *Harness) State(userID int64) (fsm.StateFSM, bool) {
+	h.t.Helper()
+
+	st, ok, err := h.FSM.UserState(h.ctx, userID)
+	if err != nil {
+		h.t.Fatalf("fsmtest: load state of user %d: %v", userID, err)
+	}
+	return st, ok
+}
+
+// AssertState fails the test unless the user is in state want.
+func (h *Harness) AssertState(userID int64, want fsm.StateFSM) {
+	h.t.Helper()
+
+	st, ok := h.State(userID)
+	if !ok {
+		h.t.Errorf("user %d has no state, want %q", userID, want)
+		return
+	}
+	if st != want {
+		h.t.Errorf("user %d is in state %q, want %q", userID, st, want)
+	}
+}
+
+// AssertCache fails the test unless the user's cache holds key with a value
+// deeply equal to want.
+func (h *Harness) AssertCache(userID int64, key string, want any) {
+	h.t.Helper()
+
+	v, ok, err := h.FSM.Get(h.ctx, userID, key)
+	switch {
+	case err != nil:
+		h.t.Fatalf("fsmtest: read %q of user %d: %v", key, userID, err)
+	case !ok:
+		h.t.Errorf("user %d has no cached %q, want %v", userID, key, want)
+	case !reflect.DeepEqual(v, want):
+		h.t.Errorf("user %d has cached %q = %#v, want %#v", userID, key, v, want)
+	}
+}
+
+// AssertNoCache fails the test if the user's cache holds key.
+func (h *Harness) AssertNoCache(userID int64, key string) {
+	h.t.Helper()
+
+	v, ok, err := h.FSM.Get(h.ctx, userID, key)
+	if err != nil {
+		h.t.Fatalf("fsmtest: read %q of user %d: %v", key, userID, err)
+	}
+	if ok {
+		h.t.Errorf("user %d has cached %q = %#v, want none", userID, key, v)
+	}
+}
+
+// AssertSent fails the test unless a message with exactly text was sent
+// to chatID.
+func (h *Harness) AssertSent(chatID int64, text string) {
+	h.t.Helper()
+
+	sent := h.Sent(chatID)
+	for _, s := range sent {
+		if s == text {
+			return
+		}
+	}
+	h.t.Errorf("no message %q sent to chat %d, sent: %q", text, chatID, sent)
+}
@@ -0,0 +1,154 @@
+package fsmtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+)
+
+const (
+	stateName  fsm.StateFSM = "ask_name"
+	statePhone fsm.StateFSM = "ask_phone"
+)
+
+// signup registers a small three-step conversation on b.
+func signup(b *bot.Bot) {
+	b.RegisterHandler(bot.HandlerTypeMessageText, "start", bot.MatchTypeCommand,
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			f := fsm.FromContext(ctx)
+			f.Transition(ctx, stateName)
+			b.SendMessage(ctx, &bot.SendMessageParams{ChatID: u.Message.Chat.ID, Text: "What's your name?"})
+		})
+
+	b.RegisterHandlerMatchFunc(func(u *models.Update) bool { return u.Message != nil && u.Message.Text != "" },
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			f := fsm.FromContext(ctx)
+			f.Set(ctx, u.Message.From.ID, "name", u.Message.Text)
+			f.Transition(ctx, statePhone)
+			b.SendMessage(ctx, &bot.SendMessageParams{ChatID: u.Message.Chat.ID, Text: "Share your phone"})
+		}, fsm.WithStates(stateName))
+
+	b.RegisterHandlerMatchFunc(func(u *models.Update) bool { return u.Message != nil && u.Message.Contact != nil },
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			f := fsm.FromContext(ctx)
+			f.Set(ctx, u.Message.From.ID, "phone", u.Message.Contact.PhoneNumber)
+			f.Finish(ctx)
+			b.SendMessage(ctx, &bot.SendMessageParams{ChatID: u.Message.Chat.ID, Text: "Done"})
+		}, fsm.WithStates(statePhone))
+}
+
+func TestConversation(t *testing.T) {
+	h := fsmtest.New(t)
+	signup(h.Bot)
+	alice := fsmtest.User{ID: 42, FirstName: "Alice"}
+
+	h.Send(alice.Command("start"))
+	h.AssertState(alice.ID, stateName)
+	h.AssertSent(alice.ID, "What's your name?")
+
+	h.Send(alice.Text("Alice"))
+	h.AssertState(alice.ID, statePhone)
+	h.AssertCache(alice.ID, "name", "Alice")
+
+	h.Send(alice.Contact("+100"))
+	h.AssertState(alice.ID, fsm.StateDefault)
+	h.AssertNoCache(alice.ID, "name") // Finish clears the cache
+
+	if got := h.Sent(alice.ID); len(got) != 3 || got[2] != "Done" {
+		t.Fatalf("unexpected messages: %q", got)
+	}
+}
+
+func TestConversation_WrongStepIgnored(t *testing.T) {
+	h := fsmtest.New(t)
+	signup(h.Bot)
+	bob := fsmtest.User{ID: 7}
+
+	h.Send(bob.Contact("+200")) // no conversation yet
+	h.AssertState(bob.ID, fsm.StateDefault)
+	h.AssertNoCache(bob.ID, "phone")
+	if calls := h.Calls(); len(calls) != 0 {
+		t.Fatalf("expected no calls, got %v", calls)
+	}
+}
+
+func TestCallback(t *testing.T) {
+	h := fsmtest.New(t)
+	h.Bot.RegisterHandler(bot.HandlerTypeCallbackQueryData, "pick:", bot.MatchTypePrefix,
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: u.CallbackQuery.ID, Text: "ok"})
+			b.EditMessageText(ctx, &bot.EditMessageTextParams{
+				ChatID:    u.CallbackQuery.Message.Message.Chat.ID,
+				MessageID: u.CallbackQuery.Message.Message.ID,
+				Text:      u.CallbackQuery.Data,
+			})
+		})
+
+	upd := fsmtest.User{ID: 5}.Callback("pick:red")
+	h.Send(upd)
+
+	answers := h.CallsTo("answerCallbackQuery")
+	if len(answers) != 1 || answers[0].Param("callback_query_id") != upd.CallbackQuery.ID {
+		t.Fatalf("unexpected answers: %v", answers)
+	}
+	last, ok := h.LastCall()
+	if !ok || last.Method != "editMessageText" || last.Text() != "pick:red" || last.ChatID() != 5 {
+		t.Fatalf("unexpected last call: %+v", last)
+	}
+}
+
+func TestPhotoAlbum(t *testing.T) {
+	h := fsmtest.New(t)
+	h.Bot.RegisterHandlerMatchFunc(func(u *models.Update) bool { return u.Message != nil && u.Message.MediaGroupID != "" },
+		func(ctx context.Context, _ *bot.Bot, u *models.Update) {
+			p := u.Message.Photo[len(u.Message.Photo)-1]
+			fsm.FromContext(ctx).SetMedia(ctx, u.Message.From.ID, u.Message.MediaGroupID, media.File{Type: "photo", FileID: p.FileID})
+		})
+
+	updates := fsmtest.User{ID: 9}.PhotoAlbum("album", "holiday", "a", "b", "c")
+	if updates[0].Message.Caption != "holiday" || updates[1].Message.Caption != "" {
+		t.Fatal("caption must be on the first photo only")
+	}
+	h.Send(updates...)
+
+	md, ok, err := h.FSM.GetMedia(context.Background(), 9, "album")
+	if err != nil || !ok || len(md.Files()) != 3 {
+		t.Fatalf("unexpected album (%v, %v, %v)", md, ok, err)
+	}
+}
+
+func TestHandle_Failure(t *testing.T) {
+	h := fsmtest.New(t)
+	var sendErr error
+	h.Bot.RegisterHandler(bot.HandlerTypeMessageText, "", bot.MatchTypePrefix,
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			_, sendErr = b.SendMessage(ctx, &bot.SendMessageParams{ChatID: u.Message.Chat.ID, Text: "hi"})
+		})
+	h.Handle("sendMessage", func(fsmtest.Call) (any, error) { return nil, errors.New("chat not found") })
+
+	h.Send(fsmtest.User{ID: 3}.Text("hello"))
+	if !errors.Is(sendErr, bot.ErrorBadRequest) {
+		t.Fatalf("expected bad request, got %v", sendErr)
+	}
+	if len(h.Calls()) != 1 {
+		t.Fatal("failed call must still be recorded")
+	}
+}
+
+func TestCommand_GroupChat(t *testing.T) {
+	u := fsmtest.User{ID: 1, ChatID: -100}.Command("start", "ref_1")
+
+	if u.Message.Text != "/start ref_1" || u.Message.Entities[0].Length != len("/start") {
+		t.Fatalf("unexpected command message: %+v", u.Message)
+	}
+	if u.Message.Chat.ID != -100 || u.Message.Chat.Type != models.ChatTypeGroup {
+		t.Fatalf("unexpected chat: %+v", u.Message.Chat)
+	}
+}
@@ -0,0 +1,90 @@
+package fsmtest
+
+import (
+	"fmt"
+	"io"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/replay"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+// Step is the outcome of one replayed update.
+type Step struct {
+	Record replay.Record
+
+	// UserID is the session key of the update (the sender's ID unless the
+	// FSM uses another KeyStrategy); 0 for updates without a session.
+	UserID int64
+
+	// State is the user's state after the handler returned and HasState
+	// reports whether the user had one.
+	State    fsm.StateFSM
+	HasState bool
+
+	// Calls are the Bot API calls the handler made for this update.
+	Calls []Call
+}
+
+// String formats the step for test logs.
+func (s Step) String() string {
+	state := "-"
+	if s.HasState {
+		state = string(s.State)
+	}
+	return fmt.Sprintf("update %d user %d: state %s, %d calls", s.Record.Update.ID, s.UserID, state, len(s.Calls))
+}
+
+// replayConfig collects Replay options.
+type replayConfig struct {
+	clock *storagetest.Clock
+}
+
+// ReplayOption configures Harness.Replay.
+type ReplayOption func(*replayConfig)
+
+// WithReplayClock advances clock by the recorded time between consecutive
+// updates, so storages built on it (e.g. memory.WithClock(clock.Now)) see
+// TTLs expire as they did when the updates were recorded.
+func WithReplayClock(clock *storagetest.Clock) ReplayOption {
+	return func(c *replayConfig) {
+		c.clock = clock
+	}
+}
+
+// Replay reads a recording made by replay.Middleware from r and delivers
+// its updates in order, reporting the sender's state after each one.
+// A recording that cannot be read fails the test.
+func (h *Harness) Replay(r io.Reader, opts ...ReplayOption) []Step {
+	h.t.Helper()
+
+	var cfg replayConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	records, err := replay.Read(r)
+	if err != nil {
+		h.t.Fatalf("fsmtest: read recording: %v", err)
+	}
+
+	steps := make([]Step, len(records))
+	for i, rec := range records {
+		if cfg.clock != nil && i > 0 {
+			if d := rec.Time.Sub(records[i-1].Time); d > 0 {
+				cfg.clock.Advance(d)
+			}
+		}
+
+		before := len(h.rec.snapshot())
+		h.Send(rec.Update)
+
+		step := Step{Record: rec, UserID: h.FSM.SessionKey(rec.Update)}
+		step.Calls = h.rec.snapshot()[before:]
+		if step.UserID != 0 {
+			step.State, step.HasState = h.State(step.UserID)
+		}
+		steps[i] = step
+	}
+	return steps
+}
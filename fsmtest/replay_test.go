@@ -0,0 +1,95 @@
+package fsmtest_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+	"github.com/whynot00/go-telegram-fsm/v2/replay"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+const (
+	stateCode    fsm.StateFSM = "enter_code"
+	stateExpired fsm.StateFSM = "code_expired"
+)
+
+// otp registers a flow whose one-time code lives for five minutes.
+func otp(b *bot.Bot) {
+	b.RegisterHandler(bot.HandlerTypeMessageText, "login", bot.MatchTypeCommand,
+		func(ctx context.Context, _ *bot.Bot, u *models.Update) {
+			f := fsm.FromContext(ctx)
+			f.SetWithTTL(ctx, u.Message.From.ID, "code", "1234", 5*time.Minute)
+			f.Transition(ctx, stateCode)
+		})
+	b.RegisterHandlerMatchFunc(func(u *models.Update) bool { return u.Message != nil },
+		func(ctx context.Context, _ *bot.Bot, u *models.Update) {
+			f := fsm.FromContext(ctx)
+			if _, ok, _ := f.Get(ctx, u.Message.From.ID, "code"); !ok {
+				f.Transition(ctx, stateExpired)
+				return
+			}
+			f.Finish(ctx)
+		}, fsm.WithStates(stateCode))
+}
+
+func TestReplay(t *testing.T) {
+	// Record a session in which the user typed the code ten minutes late.
+	var recording bytes.Buffer
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	rec := fsmtest.New(t, fsmtest.WithMiddlewares(
+		replay.Middleware(&recording, replay.WithClock(func() time.Time { return now }), replay.WithRedactor(replay.RedactPersonal)),
+	))
+	otp(rec.Bot)
+	user := fsmtest.User{ID: 42, FirstName: "Alice"}
+	rec.Send(user.Command("login"))
+	now = now.Add(10 * time.Minute)
+	rec.Send(user.Text("1234"))
+
+	// Replay it against a storage on a fake clock.
+	clock := storagetest.NewClock()
+	store := memory.NewMemoryStorage(time.Hour, 0, memory.WithClock(clock.Now))
+	h := fsmtest.New(t, fsmtest.WithFSMOptions(fsm.WithStorage(store)))
+	otp(h.Bot)
+
+	steps := h.Replay(&recording, fsmtest.WithReplayClock(clock))
+	if len(steps) != 2 {
+		t.Fatalf("expected 2 steps, got %d", len(steps))
+	}
+	for _, s := range steps {
+		t.Log(s)
+	}
+	if s := steps[0]; s.UserID != 42 || !s.HasState || s.State != stateCode {
+		t.Fatalf("unexpected first step: %v", s)
+	}
+	if s := steps[1]; s.State != stateExpired {
+		t.Fatalf("the late code must expire on replay, got %v", s)
+	}
+}
+
+func TestReplay_WithoutClock(t *testing.T) {
+	var recording bytes.Buffer
+	user := fsmtest.User{ID: 1}
+	mw := replay.Middleware(&recording)
+	for _, u := range []*models.Update{user.Command("start"), user.Text("Bob")} {
+		mw(func(context.Context, *bot.Bot, *models.Update) {})(context.Background(), nil, u)
+	}
+
+	h := fsmtest.New(t)
+	signup(h.Bot)
+	steps := h.Replay(&recording)
+
+	if steps[1].State != statePhone {
+		t.Fatalf("unexpected final state %v", steps[1])
+	}
+	if len(steps[0].Calls) != 1 || steps[0].Calls[0].Text() != "What's your name?" {
+		t.Fatalf("each step must report its own calls, got %v", steps[0].Calls)
+	}
+}
@@ -0,0 +1,328 @@
+package fsmtest
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// Token is a well-formed bot token for tests. Server and Harness accept
+// any token; this one just saves inventing one.
+const Token = "1:fsmtest"
+
+// Server is an in-process fake of the Telegram Bot API for end-to-end
+// tests of a bot started with bot.Start. Pass its URL with bot.WithServerURL;
+// getUpdates then long-polls the updates injected with Send, and every other
+// request is recorded and answered like Harness does. Sent messages are kept
+// per chat with later edits applied.
+type Server struct {
+	t   testing.TB
+	srv *httptest.Server
+	rec *recorder
+
+	// URL is the base URL to pass to bot.WithServerURL.
+	URL string
+
+	timeout time.Duration
+
+	mu       sync.Mutex
+	updates  []*models.Update
+	lastID   int64
+	messages map[int64][]*models.Message
+	files    map[string][]byte
+	changed  chan struct{} // closed and replaced on every update or call
+	done     chan struct{}
+}
+
+// ServerOption configures a Server.
+type ServerOption func(*Server)
+
+// WithWaitTimeout sets how long the Wait methods wait before failing the
+// test. The default is 5 seconds.
+func WithWaitTimeout(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.timeout = d
+	}
+}
+
+// NewServer starts a Server that is shut down when the test finishes.
+func NewServer(t testing.TB, opts ...ServerOption) *Server {
+	t.Helper()
+
+	s := &Server{
+		t:        t,
+		rec:      newRecorder(),
+		timeout:  5 * time.Second,
+		messages: make(map[int64][]*models.Message),
+		files:    make(map[string][]byte),
+		changed:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.rec.handle("getFile", s.getFile)
+	s.srv = httptest.NewServer(s)
+	s.URL = s.srv.URL
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Close releases pending long polls and shuts the server down.
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.srv.Close()
+}
+
+// Send queues updates for the bot's next getUpdates. Update IDs are
+// renumbered in delivery order so the bot's offset never skips them.
+func (s *Server) Send(updates ...*models.Update) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range updates {
+		s.lastID++
+		u.ID = s.lastID
+		s.updates = append(s.updates, u)
+	}
+	s.notify()
+}
+
+// AddFile makes content downloadable under fileID: getFile returns its
+// path and the server serves it at the bot's file download link.
+func (s *Server) AddFile(fileID string, content []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fileID] = content
+}
+
+// Handle sets the response for every later call of a Bot API method,
+// replacing the built-in one.
+func (s *Server) Handle(method string, fn Responder) {
+	s.rec.handle(method, fn)
+}
+
+// Calls returns all recorded calls except getUpdates, oldest first.
+func (s *Server) Calls() []Call {
+	return s.rec.snapshot()
+}
+
+// CallsTo returns the recorded calls of one Bot API method.
+func (s *Server) CallsTo(method string) []Call {
+	var out []Call
+	for _, c := range s.rec.snapshot() {
+		if c.Method == method {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Messages returns the messages the bot sent to chatID, oldest first,
+// as they currently read after edits.
+func (s *Server) Messages(chatID int64) []models.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]models.Message, len(s.messages[chatID]))
+	for i, m := range s.messages[chatID] {
+		out[i] = *m
+	}
+	return out
+}
+
+// WaitMessages waits until the bot has sent at least n messages to chatID
+// and returns them. It fails the test on timeout.
+func (s *Server) WaitMessages(chatID int64, n int) []models.Message {
+	s.t.Helper()
+
+	var msgs []models.Message
+	s.wait(func() bool {
+		msgs = s.Messages(chatID)
+		return len(msgs) >= n
+	}, "%d messages to chat %d", n, chatID)
+	return msgs
+}
+
+// WaitCalls waits until the bot has called method at least n times and
+// returns those calls. It fails the test on timeout.
+func (s *Server) WaitCalls(method string, n int) []Call {
+	s.t.Helper()
+
+	var calls []Call
+	s.wait(func() bool {
+		calls = s.CallsTo(method)
+		return len(calls) >= n
+	}, "%d %s calls", n, method)
+	return calls
+}
+
+// wait re-evaluates cond after every change until it holds or the timeout
+// passes.
+func (s *Server) wait(cond func() bool, format string, args ...any) {
+	s.t.Helper()
+
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		if cond() {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			s.t.Fatalf("fsmtest: timed out waiting for "+format, args...)
+			return
+		}
+	}
+}
+
+// notify wakes long polls and waiters. Callers hold s.mu.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/file/") {
+		s.download(w, r)
+		return
+	}
+	if path.Base(r.URL.Path) == "getUpdates" {
+		s.getUpdates(w, r)
+		return
+	}
+
+	call, result, err := s.rec.serve(r)
+	s.mu.Lock()
+	if err == nil {
+		s.track(call, result)
+	}
+	s.notify()
+	s.mu.Unlock()
+
+	writeResponse(w, result, err)
+}
+
+// track keeps sent messages per chat and applies edits. Callers hold s.mu.
+func (s *Server) track(call Call, result any) {
+	var msgs []*models.Message
+	switch v := result.(type) {
+	case *models.Message:
+		msgs = []*models.Message{v}
+	case []*models.Message:
+		msgs = v
+	}
+
+	for _, m := range msgs {
+		chat := s.messages[m.Chat.ID]
+		if strings.HasPrefix(call.Method, "edit") {
+			for i, old := range chat {
+				if old.ID == m.ID {
+					edited := *old
+					switch call.Method {
+					case "editMessageText":
+						edited.Text = m.Text
+					case "editMessageCaption":
+						edited.Caption = call.Param("caption")
+					}
+					chat[i] = &edited
+				}
+			}
+			continue
+		}
+		s.messages[m.Chat.ID] = append(chat, m)
+	}
+}
+
+// getUpdates answers a long poll with the updates at or after offset,
+// waiting up to the requested timeout for new ones.
+func (s *Server) getUpdates(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]string)
+	if err := parseForm(r, params); err != nil {
+		writeResponse(w, nil, err)
+		return
+	}
+	offset, _ := strconv.ParseInt(params["offset"], 10, 64)
+	timeout, _ := strconv.Atoi(params["timeout"])
+
+	timer := time.NewTimer(time.Duration(timeout) * time.Second)
+	defer timer.Stop()
+	for {
+		s.mu.Lock()
+		// Updates before offset are confirmed by the bot and dropped.
+		for len(s.updates) > 0 && s.updates[0].ID < offset {
+			s.updates = s.updates[1:]
+		}
+		pending := append([]*models.Update{}, s.updates...)
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(pending) > 0 || timeout <= 0 {
+			writeResponse(w, pending, nil)
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			timeout = 0
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			timeout = 0
+		}
+	}
+}
+
+// getFile resolves files registered with AddFile.
+func (s *Server) getFile(call Call) (any, error) {
+	id := call.Param("file_id")
+
+	s.mu.Lock()
+	content, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.New("Bad Request: invalid file_id")
+	}
+	return models.File{FileID: id, FileUniqueID: id, FileSize: int64(len(content)), FilePath: "files/" + id}, nil
+}
+
+// download serves /file/bot<token>/files/<file_id>.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.files[path.Base(r.URL.Path)]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(content)
+}
+
+// writeResponse writes a Bot API response envelope to w.
+func writeResponse(w http.ResponseWriter, result any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(envelope(result, err))
+}
@@ -0,0 +1,135 @@
+package fsmtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+)
+
+// startBot runs a bot against srv until the test finishes.
+func startBot(t *testing.T, srv *fsmtest.Server, opts ...bot.Option) *bot.Bot {
+	t.Helper()
+
+	b, err := bot.New(fsmtest.Token, append([]bot.Option{bot.WithServerURL(srv.URL)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return b
+}
+
+func TestServer_Conversation(t *testing.T) {
+	srv := fsmtest.NewServer(t)
+	f := fsm.New(context.Background())
+	defer f.Close()
+
+	b := startBot(t, srv, bot.WithMiddlewares(fsm.Middleware(f)))
+	signup(b)
+	alice := fsmtest.User{ID: 42}
+
+	srv.Send(alice.Command("start"))
+	srv.WaitMessages(alice.ID, 1)
+
+	srv.Send(alice.Text("Alice"))
+	srv.WaitMessages(alice.ID, 2)
+
+	srv.Send(alice.Contact("+100"))
+	msgs := srv.WaitMessages(alice.ID, 3)
+
+	if msgs[0].Text != "What's your name?" || msgs[2].Text != "Done" {
+		t.Fatalf("unexpected transcript: %q, %q", msgs[0].Text, msgs[2].Text)
+	}
+	if st, _, _ := f.CurrentState(fsm.NewContext(context.Background(), f, alice.ID)); st != fsm.StateDefault {
+		t.Fatalf("conversation must finish, got state %q", st)
+	}
+}
+
+func TestServer_CallbackEdit(t *testing.T) {
+	srv := fsmtest.NewServer(t)
+	b := startBot(t, srv, bot.WithDefaultHandler(func(ctx context.Context, b *bot.Bot, u *models.Update) {
+		if u.Message != nil {
+			b.SendMessage(ctx, &bot.SendMessageParams{ChatID: u.Message.Chat.ID, Text: "pick a colour"})
+		}
+	}))
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, "", bot.MatchTypePrefix,
+		func(ctx context.Context, b *bot.Bot, u *models.Update) {
+			b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{CallbackQueryID: u.CallbackQuery.ID})
+			b.EditMessageText(ctx, &bot.EditMessageTextParams{
+				ChatID:    u.CallbackQuery.Message.Message.Chat.ID,
+				MessageID: u.CallbackQuery.Message.Message.ID,
+				Text:      "you picked " + u.CallbackQuery.Data,
+			})
+		})
+	user := fsmtest.User{ID: 5}
+
+	srv.Send(user.Text("hi"))
+	sent := srv.WaitMessages(user.ID, 1)[0]
+
+	press := user.Callback("red")
+	press.CallbackQuery.Message.Message.ID = sent.ID // the button is on the bot's message
+	srv.Send(press)
+	srv.WaitCalls("editMessageText", 1)
+
+	msgs := srv.Messages(user.ID)
+	if len(msgs) != 1 || msgs[0].Text != "you picked red" {
+		t.Fatalf("expected the message to be edited in place, got %+v", msgs)
+	}
+	if calls := srv.CallsTo("answerCallbackQuery"); len(calls) != 1 {
+		t.Fatalf("expected the callback to be answered, got %d calls", len(calls))
+	}
+}
+
+func TestServer_MediaGroupAndFiles(t *testing.T) {
+	srv := fsmtest.NewServer(t)
+	srv.AddFile("doc", []byte("hello"))
+	b := startBot(t, srv, bot.WithSkipGetMe())
+	ctx := context.Background()
+
+	msgs, err := b.SendMediaGroup(ctx, &bot.SendMediaGroupParams{
+		ChatID: 9,
+		Media: []models.InputMedia{
+			&models.InputMediaPhoto{Media: "a", Caption: "album"},
+			&models.InputMediaPhoto{Media: "b"},
+		},
+	})
+	if err != nil || len(msgs) != 2 || msgs[0].Caption != "album" {
+		t.Fatalf("unexpected media group result (%v, %v)", msgs, err)
+	}
+	if got := srv.Messages(9); len(got) != 2 {
+		t.Fatalf("expected both album messages in the transcript, got %d", len(got))
+	}
+
+	file, err := b.GetFile(ctx, &bot.GetFileParams{FileID: "doc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(b.FileDownloadLink(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "hello" {
+		t.Fatalf("unexpected file content %q", body)
+	}
+
+	if _, err := b.GetFile(ctx, &bot.GetFileParams{FileID: "missing"}); err == nil {
+		t.Fatal("expected an error for an unknown file")
+	}
+}
@@ -0,0 +1,122 @@
+package fsmtest
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// updateSeq and messageSeq number the built updates and messages so every
+// update looks like a distinct delivery.
+var updateSeq, messageSeq atomic.Int64
+
+// User is a simulated Telegram user whose methods build updates as if the
+// user had sent them. A zero ChatID means the private chat with the bot,
+// whose ID equals the user ID; any other chat is treated as a group.
+type User struct {
+	ID        int64
+	ChatID    int64
+	FirstName string
+	Username  string
+}
+
+// Text builds a plain text message.
+func (u User) Text(text string) *models.Update {
+	msg := u.message()
+	msg.Text = text
+	return u.update(msg)
+}
+
+// Command builds a "/command args..." message with a bot_command entity,
+// the way Telegram delivers commands. The leading slash is optional.
+func (u User) Command(command string, args ...string) *models.Update {
+	command = "/" + strings.TrimPrefix(command, "/")
+
+	msg := u.message()
+	msg.Text = strings.Join(append([]string{command}, args...), " ")
+	msg.Entities = []models.MessageEntity{{
+		Type:   models.MessageEntityTypeBotCommand,
+		Length: len(command),
+	}}
+	return u.update(msg)
+}
+
+// Callback builds a callback query with data, as if the user pressed an
+// inline button under a bot message in the user's chat.
+func (u User) Callback(data string) *models.Update {
+	msg := &models.Message{
+		ID:   int(messageSeq.Add(1)),
+		Date: int(time.Now().Unix()),
+		Chat: u.chat(),
+		From: &models.User{ID: 1, IsBot: true, FirstName: "fsmtest"},
+	}
+	id := updateSeq.Add(1)
+	return &models.Update{
+		ID: id,
+		CallbackQuery: &models.CallbackQuery{
+			ID:           strconv.FormatInt(id, 10),
+			From:         u.user(),
+			Message:      models.MaybeInaccessibleMessage{Type: models.MaybeInaccessibleMessageTypeMessage, Message: msg},
+			ChatInstance: strconv.FormatInt(u.chat().ID, 10),
+			Data:         data,
+		},
+	}
+}
+
+// PhotoAlbum builds one message per file, all sharing mediaGroupID, like
+// an album of photos arrives from Telegram. The first photo carries caption.
+func (u User) PhotoAlbum(mediaGroupID, caption string, fileIDs ...string) []*models.Update {
+	updates := make([]*models.Update, len(fileIDs))
+	for i, id := range fileIDs {
+		msg := u.message()
+		msg.MediaGroupID = mediaGroupID
+		msg.Photo = []models.PhotoSize{{FileID: id, FileUniqueID: id, Width: 1280, Height: 960}}
+		if i == 0 {
+			msg.Caption = caption
+		}
+		updates[i] = u.update(msg)
+	}
+	return updates
+}
+
+// Contact builds a message sharing the user's own contact.
+func (u User) Contact(phone string) *models.Update {
+	msg := u.message()
+	msg.Contact = &models.Contact{PhoneNumber: phone, FirstName: u.firstName(), UserID: u.ID}
+	return u.update(msg)
+}
+
+func (u User) update(msg *models.Message) *models.Update {
+	return &models.Update{ID: updateSeq.Add(1), Message: msg}
+}
+
+func (u User) message() *models.Message {
+	from := u.user()
+	return &models.Message{
+		ID:   int(messageSeq.Add(1)),
+		Date: int(time.Now().Unix()),
+		Chat: u.chat(),
+		From: &from,
+	}
+}
+
+func (u User) user() models.User {
+	return models.User{ID: u.ID, FirstName: u.firstName(), Username: u.Username}
+}
+
+func (u User) chat() models.Chat {
+	if u.ChatID == 0 || u.ChatID == u.ID {
+		return models.Chat{ID: u.ID, Type: models.ChatTypePrivate, FirstName: u.firstName(), Username: u.Username}
+	}
+	return models.Chat{ID: u.ChatID, Type: models.ChatTypeGroup, Title: "fsmtest"}
+}
+
+func (u User) firstName() string {
+	if u.FirstName != "" {
+		return u.FirstName
+	}
+	return "User" + strconv.FormatInt(u.ID, 10)
+}
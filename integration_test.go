@@ -5,9 +5,9 @@ import (
 	"testing"
 	"time"
 
-	fsm "github.com/whynot00/go-telegram-fsm"
-	"github.com/whynot00/go-telegram-fsm/media"
-	"github.com/whynot00/go-telegram-fsm/storage/memory"
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -54,7 +54,7 @@ func TestIntegration_FullFlow_StateAndHandlers(t *testing.T) {
 		calledDefault = true
 
 		// До перехода проверим состояние — должно быть StateDefault после Middleware.Create.
-		if st, ok := f.CurrentState(ctx); !ok || st != fsm.StateDefault {
+		if st, ok, _ := f.CurrentState(ctx); !ok || st != fsm.StateDefault {
 			t.Fatalf("expected initial state=StateDefault, got (%v, ok=%v)", st, ok)
 		}
 		f.Transition(ctx, NextState)
@@ -63,7 +63,7 @@ func TestIntegration_FullFlow_StateAndHandlers(t *testing.T) {
 	// 2) Второй обработчик разрешён только в NextState.
 	hNext := func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
 		calledNext = true
-		if st, ok := f.CurrentState(ctx); !ok || st != NextState {
+		if st, ok, _ := f.CurrentState(ctx); !ok || st != NextState {
 			t.Fatalf("expected state=%s inside second handler, got (%v, ok=%v)", NextState, st, ok)
 		}
 	}
@@ -105,7 +105,7 @@ func TestIntegration_CacheAndMedia_CleanOnFinish(t *testing.T) {
 	// затем Finish() и проверяем, что кеш очищен.
 	handler := func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
 		// Перед началом — мы уже в Default (через Middleware.Create).
-		if st, ok := f.CurrentState(ctx); !ok || st != fsm.StateDefault {
+		if st, ok, _ := f.CurrentState(ctx); !ok || st != fsm.StateDefault {
 			t.Fatalf("expected initial state=StateDefault, got (%v, ok=%v)", st, ok)
 		}
 
@@ -115,7 +115,7 @@ func TestIntegration_CacheAndMedia_CleanOnFinish(t *testing.T) {
 
 		// Кладём обычный key/value.
 		f.Set(ctx, testUserID, key, "value-123")
-		if v, ok := f.Get(ctx, testUserID, key); !ok || v.(string) != "value-123" {
+		if v, ok, _ := f.Get(ctx, testUserID, key); !ok || v.(string) != "value-123" {
 			t.Fatalf("expected cached value, got (%v, ok=%v)", v, ok)
 		}
 
@@ -123,7 +123,7 @@ func TestIntegration_CacheAndMedia_CleanOnFinish(t *testing.T) {
 		f.SetMedia(ctx, testUserID, mediaGroupID, media.File{Type: "photo", FileID: "A"})
 		f.SetMedia(ctx, testUserID, mediaGroupID, media.File{Type: "video", FileID: "B"})
 
-		md, ok := f.GetMedia(ctx, testUserID, mediaGroupID)
+		md, ok, _ := f.GetMedia(ctx, testUserID, mediaGroupID)
 		if !ok {
 			t.Fatal("expected media data to exist")
 		}
@@ -136,13 +136,13 @@ func TestIntegration_CacheAndMedia_CleanOnFinish(t *testing.T) {
 		f.Finish(ctx)
 
 		// Кеш должен быть пуст.
-		if _, ok := f.Get(ctx, testUserID, key); ok {
+		if _, ok, _ := f.Get(ctx, testUserID, key); ok {
 			t.Fatal("expected value cache to be cleaned after Finish")
 		}
 
 		// А медиакеш? По текущей логике CleanCache чистит всё пользовательское —
 		// проверим, что этой группы больше нет (или она пуста).
-		if md2, ok := f.GetMedia(ctx, testUserID, mediaGroupID); ok && len(md2.Files()) > 0 {
+		if md2, ok, _ := f.GetMedia(ctx, testUserID, mediaGroupID); ok && len(md2.Files()) > 0 {
 			t.Fatal("expected media cache to be cleaned after Finish")
 		}
 	}
@@ -177,3 +177,26 @@ func TestIntegration_WithStates_SkipsWithoutMiddleware(t *testing.T) {
 		t.Fatal("handler should have been called with FSM middleware")
 	}
 }
+
+func TestIntegration_SetWithTTL(t *testing.T) {
+	ctx := context.Background()
+	f := fsm.New(ctx, fsm.WithStorage(memory.NewMemoryStorage(time.Minute, 10*time.Millisecond)))
+
+	if err := f.SetWithTTL(ctx, testUserID, "otp", "1234", 30*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	f.Set(ctx, testUserID, "name", "Ann")
+
+	if v, ok, _ := f.Get(ctx, testUserID, "otp"); !ok || v != "1234" {
+		t.Fatalf("expected otp before expiry, got (%v, ok=%v)", v, ok)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok, _ := f.Get(ctx, testUserID, "otp"); ok {
+		t.Fatal("expected otp to expire")
+	}
+	if _, ok, _ := f.Get(ctx, testUserID, "name"); !ok {
+		t.Fatal("expected regular value to stay")
+	}
+}
@@ -0,0 +1,107 @@
+package fsm
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// KeyStrategy derives the session key from the sender of an update: the
+// ID states and cached values are stored under and the value FSM methods
+// receive as userID. Returning 0 means the update has no session.
+//
+// KeyByUser, KeyByChat, KeyByUserInChat and KeyByChatThread cover the
+// common cases; any other function (e.g. one built with CompositeKey) can
+// be used as well.
+type KeyStrategy func(Sender) int64
+
+// SessionKey returns the key Middleware keys the session of u by, using
+// the FSM's Extractor and KeyStrategy; 0 if u has no session.
+func (f *FSM) SessionKey(u *models.Update) int64 {
+	s, ok := f.sender(u)
+	if !ok {
+		return 0
+	}
+	return f.keyWith(f.key, s)
+}
+
+// sender reports the sender of u with the FSM's Extractor.
+func (f *FSM) sender(u *models.Update) (Sender, bool) {
+	if f.extract == nil {
+		return ExtractSender(u)
+	}
+	return f.extract(u)
+}
+
+// keyWith derives the session key of s with k (KeyByUser if nil), or 0
+// for anonymous senders unless WithAnonymousSessions is set.
+func (f *FSM) keyWith(k KeyStrategy, s Sender) int64 {
+	if s.Anonymous && !f.anonymous {
+		return 0
+	}
+	if k == nil {
+		return KeyByUser(s)
+	}
+	return k(s)
+}
+
+// KeyByUser keys sessions by the sender, so a user has one conversation
+// across all chats. It is the default strategy.
+func KeyByUser(s Sender) int64 {
+	return s.UserID
+}
+
+// KeyByChat keys sessions by chat, so all members of a group share one
+// conversation, e.g. a quiz run in the chat. In private chats it is the
+// same as KeyByUser. Updates without a chat, such as inline queries, have
+// no session.
+func KeyByChat(s Sender) int64 {
+	return s.ChatID
+}
+
+// KeyByUserInChat keys sessions by sender and chat, so a user's flow in a
+// group does not collide with their private flow or with flows in other
+// groups. In private chats, and for updates without a chat, the key is the
+// user ID, as with KeyByUser.
+func KeyByUserInChat(s Sender) int64 {
+	if s.UserID == 0 {
+		return 0
+	}
+	if s.ChatID == 0 || s.ChatID == s.UserID {
+		return s.UserID
+	}
+	return CompositeKey(s.ChatID, s.UserID)
+}
+
+// KeyByChatThread keys sessions by chat and forum topic, so each topic of
+// a forum supergroup has its own conversation. Outside topics it is the
+// same as KeyByChat.
+func KeyByChatThread(s Sender) int64 {
+	if s.ChatID == 0 {
+		return 0
+	}
+	if s.ThreadID != 0 {
+		return CompositeKey(s.ChatID, int64(s.ThreadID))
+	}
+	return s.ChatID
+}
+
+// CompositeKey combines IDs into one session key for custom strategies.
+// The key is a hash of the IDs in order, placed below -2^62 so it never
+// collides with a Telegram user or chat ID used as a key directly.
+func CompositeKey(ids ...int64) int64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, id := range ids {
+		binary.BigEndian.PutUint64(buf[:], uint64(id))
+		h.Write(buf[:])
+	}
+	return math.MinInt64 | int64(h.Sum64()>>2)
+}
+
+// isCompositeKey reports whether id lies in the range of CompositeKey.
+func isCompositeKey(id int64) bool {
+	return id < math.MinInt64+1<<62
+}
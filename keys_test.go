@@ -0,0 +1,125 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func groupMessage(chat, user int64, thread int) *models.Update {
+	return &models.Update{Message: &models.Message{
+		From:            &models.User{ID: user},
+		Chat:            models.Chat{ID: chat, Type: models.ChatTypeSupergroup},
+		MessageThreadID: thread,
+		IsTopicMessage:  thread != 0,
+	}}
+}
+
+func privateMessage(user int64) *models.Update {
+	return &models.Update{Message: &models.Message{
+		From: &models.User{ID: user},
+		Chat: models.Chat{ID: user, Type: models.ChatTypePrivate},
+	}}
+}
+
+// key derives the session key of u with k, as Middleware does.
+func key(k KeyStrategy, u *models.Update) int64 {
+	s, _ := ExtractSender(u)
+	return k(s)
+}
+
+func TestKeyStrategies(t *testing.T) {
+	const chat, alice, bob = -100123, 1, 2
+
+	if key(KeyByUser, groupMessage(chat, alice, 0)) != alice || key(KeyByUser, privateMessage(alice)) != alice {
+		t.Fatal("KeyByUser must key by the sender")
+	}
+	if key(KeyByChat, groupMessage(chat, alice, 0)) != chat || key(KeyByChat, groupMessage(chat, bob, 0)) != chat {
+		t.Fatal("KeyByChat must give group members one key")
+	}
+
+	private := key(KeyByUserInChat, privateMessage(alice))
+	inGroup := key(KeyByUserInChat, groupMessage(chat, alice, 0))
+	if private != alice {
+		t.Fatalf("KeyByUserInChat must keep private chats keyed by user, got %d", private)
+	}
+	if inGroup == alice || inGroup == key(KeyByUserInChat, groupMessage(chat, bob, 0)) || inGroup == key(KeyByUserInChat, groupMessage(-100999, alice, 0)) {
+		t.Fatal("KeyByUserInChat must separate users and chats")
+	}
+	if inGroup != key(KeyByUserInChat, groupMessage(chat, alice, 7)) {
+		t.Fatal("KeyByUserInChat must ignore topics")
+	}
+
+	if key(KeyByChatThread, groupMessage(chat, alice, 0)) != chat {
+		t.Fatal("KeyByChatThread outside topics must key by chat")
+	}
+	topic := key(KeyByChatThread, groupMessage(chat, alice, 7))
+	if topic == chat || topic != key(KeyByChatThread, groupMessage(chat, bob, 7)) || topic == key(KeyByChatThread, groupMessage(chat, alice, 8)) {
+		t.Fatal("KeyByChatThread must give each topic one key")
+	}
+	reply := groupMessage(chat, alice, 7)
+	reply.Message.IsTopicMessage = false // a reply thread in a non-forum group
+	if key(KeyByChatThread, reply) != chat {
+		t.Fatal("KeyByChatThread must ignore reply threads")
+	}
+}
+
+func TestKeyStrategies_NoSession(t *testing.T) {
+	inline := &models.Update{InlineQuery: &models.InlineQuery{From: &models.User{ID: 1}}}
+	if key(KeyByChat, inline) != 0 || key(KeyByChatThread, inline) != 0 {
+		t.Fatal("updates without a chat have no chat session")
+	}
+	if key(KeyByUserInChat, inline) != 1 {
+		t.Fatal("KeyByUserInChat falls back to the user without a chat")
+	}
+	if key(KeyByUserInChat, &models.Update{}) != 0 {
+		t.Fatal("an empty update has no session")
+	}
+}
+
+func TestKeyStrategies_Callback(t *testing.T) {
+	upd := &models.Update{CallbackQuery: &models.CallbackQuery{
+		From: models.User{ID: 1},
+		Message: models.MaybeInaccessibleMessage{
+			InaccessibleMessage: &models.InaccessibleMessage{Chat: models.Chat{ID: -5}},
+		},
+	}}
+	if key(KeyByChat, upd) != -5 || key(KeyByUserInChat, upd) != CompositeKey(-5, 1) {
+		t.Fatal("callbacks must be keyed by the chat of their message")
+	}
+}
+
+func TestCompositeKey(t *testing.T) {
+	k := CompositeKey(-1001234567890, 42)
+	if k >= -(1 << 62) {
+		t.Fatalf("composite keys must stay below -2^62, got %d", k)
+	}
+	if k != CompositeKey(-1001234567890, 42) || k == CompositeKey(42, -1001234567890) {
+		t.Fatal("composite keys must be deterministic and ordered")
+	}
+}
+
+func TestMiddleware_KeyStrategy(t *testing.T) {
+	const chat = -100123
+	f := New(context.Background(), WithKeyStrategy(KeyByChat))
+	defer f.Close()
+
+	var keys []int64
+	next := func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		keys = append(keys, userFromContext(ctx))
+	}
+	Middleware(f)(next)(context.Background(), nil, groupMessage(chat, 1, 0))
+	Middleware(f, KeyBy(KeyByUser))(next)(context.Background(), nil, groupMessage(chat, 1, 0))
+
+	if len(keys) != 2 || keys[0] != chat || keys[1] != 1 {
+		t.Fatalf("expected keys [%d 1], got %v", chat, keys)
+	}
+	if f.SessionKey(groupMessage(chat, 2, 0)) != chat {
+		t.Fatal("SessionKey must use the FSM's strategy")
+	}
+	if st, ok, _ := f.UserState(context.Background(), chat); !ok || st != StateDefault {
+		t.Fatalf("expected a chat session with a negative key, got (%v, %v)", st, ok)
+	}
+}
@@ -0,0 +1,141 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"time"
+
+	"github.com/go-telegram/bot"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+)
+
+// ErrNoUser is returned by machine state methods called with a context
+// that carries no user, e.g. for an update without a session.
+var ErrNoUser = errors.New("fsm: no user in context")
+
+// Machine is a named state machine running alongside the FSM's own for
+// the same users, e.g. a support survey answered in the middle of a
+// checkout. Each machine keeps its own state and cache per user:
+// transitions and Finish of one machine leave the others and the FSM's
+// own state untouched.
+//
+// A machine stores its data under a session key derived from the user's
+// key and the machine name (see Key), in the same storage as the FSM.
+// Users who have not entered a machine have no state in it.
+type Machine struct {
+	f    *FSM
+	name string
+	ns   int64
+}
+
+// Machine returns the machine called name. Machines are cheap views of f
+// and need no registration; every call with the same name addresses the
+// same data.
+func (f *FSM) Machine(name string) *Machine {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return &Machine{f: f, name: name, ns: int64(h.Sum64())}
+}
+
+// Name returns the machine's name.
+func (m *Machine) Name() string {
+	return m.name
+}
+
+// Key returns the session key the machine keeps the data of userID
+// under, as listed by FSM.Sessions and accepted by the FSM's methods
+// that take a user ID.
+func (m *Machine) Key(userID int64) int64 {
+	return CompositeKey(userID, m.ns)
+}
+
+// scoped returns ctx with the user's key replaced by the machine's key.
+func (m *Machine) scoped(ctx context.Context) context.Context {
+	return userWithContext(ctx, m.Key(userFromContext(ctx)))
+}
+
+// Transition sets the user's state in the machine, like FSM.Transition.
+// Moving to StateDefault clears the machine's cache of the user. The
+// machine's name and the user are recorded with the state, so that
+// FSM.Sessions can report whom the session belongs to. It returns
+// ErrNoUser if ctx carries no user.
+func (m *Machine) Transition(ctx context.Context, state StateFSM) error {
+	userID := userFromContext(ctx)
+	if userID == 0 {
+		return ErrNoUser
+	}
+	if err := m.f.Transition(m.scoped(ctx), state); err != nil {
+		return err
+	}
+	return m.f.Set(ctx, m.Key(userID), sessionOwnerKey, machineOwner(m.name, userID))
+}
+
+// Finish resets the user's state in the machine to StateDefault and clears
+// the machine's cache of the user only.
+func (m *Machine) Finish(ctx context.Context) error {
+	return m.Transition(ctx, StateDefault)
+}
+
+// CurrentState returns the user's state in the machine, like
+// FSM.CurrentState. It reports false if the user has not entered the
+// machine.
+func (m *Machine) CurrentState(ctx context.Context) (StateFSM, bool, error) {
+	return m.f.CurrentState(m.scoped(ctx))
+}
+
+// Set stores a value in the machine's cache of the user.
+func (m *Machine) Set(ctx context.Context, userID int64, key string, value any) error {
+	return m.f.Set(ctx, m.Key(userID), key, value)
+}
+
+// SetWithTTL stores a value in the machine's cache of the user that
+// expires after ttl, like FSM.SetWithTTL.
+func (m *Machine) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	return m.f.SetWithTTL(ctx, m.Key(userID), key, value, ttl)
+}
+
+// Get retrieves a value from the machine's cache of the user.
+func (m *Machine) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	return m.f.Get(ctx, m.Key(userID), key)
+}
+
+// SetMedia stores a media file in the machine's cache of the user.
+func (m *Machine) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	return m.f.SetMedia(ctx, m.Key(userID), mediaGroupID, file)
+}
+
+// GetMedia returns a media group from the machine's cache of the user.
+func (m *Machine) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	return m.f.GetMedia(ctx, m.Key(userID), mediaGroupID)
+}
+
+// CleanMediaCache removes a media group from the machine's cache of the
+// user and reports whether it existed.
+func (m *Machine) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	return m.f.CleanMediaCache(ctx, m.Key(userID), mediaGroupID)
+}
+
+// CleanCache removes the machine's cache of the user.
+func (m *Machine) CleanCache(ctx context.Context, userID int64) error {
+	return m.f.CleanCache(ctx, m.Key(userID))
+}
+
+// InMachine is WithStates for the named machine: the handler runs only
+// when the user's state in that machine matches one of states. A user who
+// has not entered the machine is treated as being in StateDefault, so
+// handlers that start the machine's flow can be guarded with
+// InMachine(name, StateDefault). Updates without a session are skipped.
+func InMachine(name string, states ...StateFSM) bot.Middleware {
+	return guardStates(states, nil, func(f *FSM, ctx context.Context) (StateFSM, bool, error) {
+		if userFromContext(ctx) == 0 {
+			return StateNil, false, nil
+		}
+		st, ok, err := f.Machine(name).CurrentState(ctx)
+		if err == nil && !ok {
+			return StateDefault, true, nil
+		}
+		return st, ok, err
+	})
+}
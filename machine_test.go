@@ -0,0 +1,105 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestMachine_IsolatesStateAndCache(t *testing.T) {
+	ctx := context.Background()
+	f := New(ctx)
+	defer f.Close()
+	uctx := NewContext(ctx, f, 1)
+
+	checkout, survey := f.Machine("checkout"), f.Machine("survey")
+	if _, ok, _ := checkout.CurrentState(uctx); ok {
+		t.Fatal("a user must have no state in a machine not entered yet")
+	}
+
+	f.Transition(uctx, "main_menu")
+	f.Set(ctx, 1, "lang", "en")
+	checkout.Transition(uctx, "pay")
+	checkout.Set(ctx, 1, "cart", "book")
+	survey.Transition(uctx, "rate")
+	survey.Set(ctx, 1, "score", 5)
+
+	if st, _, _ := checkout.CurrentState(uctx); st != "pay" {
+		t.Fatalf("expected checkout state pay, got %v", st)
+	}
+	if _, ok, _ := checkout.Get(ctx, 1, "score"); ok {
+		t.Fatal("machines must not share cache")
+	}
+
+	if err := survey.Finish(uctx); err != nil {
+		t.Fatal(err)
+	}
+	if st, _, _ := survey.CurrentState(uctx); st != StateDefault {
+		t.Fatalf("expected survey reset, got %v", st)
+	}
+	if _, ok, _ := survey.Get(ctx, 1, "score"); ok {
+		t.Fatal("Finish must clear the machine's cache")
+	}
+	if v, _, _ := checkout.Get(ctx, 1, "cart"); v != "book" {
+		t.Fatal("Finish of one machine must keep the others' cache")
+	}
+	if st, _, _ := f.CurrentState(uctx); st != "main_menu" {
+		t.Fatalf("Finish of a machine must keep the FSM's own state, got %v", st)
+	}
+	if v, _, _ := f.Get(ctx, 1, "lang"); v != "en" {
+		t.Fatal("Finish of a machine must keep the FSM's own cache")
+	}
+
+	if f.Machine("checkout").Key(1) != checkout.Key(1) || checkout.Key(1) == survey.Key(1) || checkout.Key(1) == checkout.Key(2) {
+		t.Fatal("machine keys must be stable per name and user")
+	}
+}
+
+func TestMachine_NoUser(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+	ctx := NewChatContext(context.Background(), f, -10)
+
+	if err := f.Machine("survey").Transition(ctx, "x"); !errors.Is(err, ErrNoUser) {
+		t.Fatalf("expected ErrNoUser, got %v", err)
+	}
+	for s := range f.Sessions(context.Background()) {
+		t.Fatalf("no session must be created, got %+v", s)
+	}
+}
+
+func TestInMachine(t *testing.T) {
+	f := New(context.Background())
+	defer f.Close()
+
+	var ran []string
+	handler := func(name string) bot.HandlerFunc {
+		return func(context.Context, *bot.Bot, *models.Update) { ran = append(ran, name) }
+	}
+	start := Middleware(f)(InMachine("checkout", StateDefault)(handler("start")))
+	pay := Middleware(f)(InMachine("checkout", "pay")(handler("pay")))
+
+	upd := privateMessage(1)
+	start(context.Background(), nil, upd)
+	pay(context.Background(), nil, upd)
+	if len(ran) != 1 || ran[0] != "start" {
+		t.Fatalf("a user outside the machine must be in StateDefault, ran %v", ran)
+	}
+
+	f.Machine("checkout").Transition(NewContext(context.Background(), f, 1), "pay")
+	ran = nil
+	start(context.Background(), nil, upd)
+	pay(context.Background(), nil, upd)
+	if len(ran) != 1 || ran[0] != "pay" {
+		t.Fatalf("expected only the pay handler, ran %v", ran)
+	}
+
+	ran = nil
+	Middleware(f)(InMachine("checkout", StateDefault)(handler("poll")))(context.Background(), nil, &models.Update{Poll: &models.Poll{}})
+	if len(ran) != 0 {
+		t.Fatal("updates without a session must be skipped")
+	}
+}
@@ -0,0 +1,206 @@
+package fsm
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// The bot runs the first handler whose match function accepts an update,
+// before any middleware. A handler guarded by WithStates therefore still
+// claims updates meant for handlers registered after it, which it then
+// skips. The match functions below check the state while matching, so
+// handlers for the same input in different states can coexist:
+//
+//	b.RegisterHandlerMatchFunc(fsm.And(f.StateIs("ask_name"), fsm.AnyText), askName)
+//	b.RegisterHandlerMatchFunc(fsm.And(f.StateIs("ask_city"), fsm.AnyText), askCity)
+
+// StateIs returns a match function accepting updates whose sender's state
+// is state. See StateIn.
+func (f *FSM) StateIs(state StateFSM) bot.MatchFunc {
+	return f.StateIn(state)
+}
+
+// matchStateTimeout bounds the state reads of match functions, which run
+// before any handler can be dispatched.
+const matchStateTimeout = time.Second
+
+// StateIn returns a match function accepting updates whose sender's state
+// is one of states; StateAny accepts every update. The session key is
+// derived by the FSM's Extractor and KeyStrategy, as Middleware does
+// without KeyBy. A sender without a session yet is in StateDefault, since
+// Middleware creates it in that state; updates without a session key are
+// rejected. The state is read like UserState, so matching does not count
+// as an access, and within one second; a failure to read it rejects the
+// update.
+func (f *FSM) StateIn(states ...StateFSM) bot.MatchFunc {
+	wildcard := slices.Contains(states, StateAny)
+	return func(u *models.Update) bool {
+		if wildcard {
+			return true
+		}
+		if u == nil {
+			return false
+		}
+		userID := f.SessionKey(u)
+		if userID == 0 {
+			return false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), matchStateTimeout)
+		defer cancel()
+		st, ok, err := f.UserState(ctx, userID)
+		if err != nil {
+			return false
+		}
+		if !ok {
+			st = StateDefault
+		}
+		return slices.Contains(states, st)
+	}
+}
+
+// And returns a match function accepting updates accepted by every one of
+// matches. Matches are checked in order and the first rejection stops the
+// check, so cheap predicates should precede state checks.
+func And(matches ...bot.MatchFunc) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		for _, match := range matches {
+			if !match(u) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a match function accepting updates accepted by any of
+// matches.
+func Or(matches ...bot.MatchFunc) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		for _, match := range matches {
+			if match(u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not returns a match function accepting updates rejected by match.
+func Not(match bot.MatchFunc) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		return !match(u)
+	}
+}
+
+// AnyText accepts messages with text.
+func AnyText(u *models.Update) bool {
+	return u != nil && u.Message != nil && u.Message.Text != ""
+}
+
+// Text returns a match function accepting messages whose text is text.
+func Text(text string) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		return u != nil && u.Message != nil && u.Message.Text == text
+	}
+}
+
+// TextPrefix returns a match function accepting messages whose text starts
+// with prefix.
+func TextPrefix(prefix string) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		return u != nil && u.Message != nil && strings.HasPrefix(u.Message.Text, prefix)
+	}
+}
+
+// Command returns a match function accepting messages starting with the
+// command name, given without the slash, e.g. "start". Commands addressed
+// to a bot by username, as in "/start@our_bot", match too.
+func Command(name string) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		if u == nil || u.Message == nil {
+			return false
+		}
+		for _, e := range u.Message.Entities {
+			if e.Type != models.MessageEntityTypeBotCommand || e.Offset != 0 || e.Length < 2 || e.Length > len(u.Message.Text) {
+				continue
+			}
+			cmd, _, _ := strings.Cut(u.Message.Text[1:e.Length], "@")
+			return cmd == name
+		}
+		return false
+	}
+}
+
+// CallbackPrefix returns a match function accepting callback queries whose
+// data starts with prefix.
+func CallbackPrefix(prefix string) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		return u != nil && u.CallbackQuery != nil && strings.HasPrefix(u.CallbackQuery.Data, prefix)
+	}
+}
+
+// ContentType names the kind of content a message carries.
+type ContentType string
+
+// Content types reported by MessageContentType.
+const (
+	ContentText      ContentType = "text"
+	ContentPhoto     ContentType = "photo"
+	ContentVideo     ContentType = "video"
+	ContentAnimation ContentType = "animation"
+	ContentDocument  ContentType = "document"
+	ContentAudio     ContentType = "audio"
+	ContentVoice     ContentType = "voice"
+	ContentVideoNote ContentType = "video_note"
+	ContentSticker   ContentType = "sticker"
+	ContentContact   ContentType = "contact"
+	ContentLocation  ContentType = "location"
+	ContentPoll      ContentType = "poll"
+	ContentOther     ContentType = "other"
+)
+
+// MessageContentType returns the type of content m carries, ContentOther
+// for kinds not listed above such as service messages.
+func MessageContentType(m *models.Message) ContentType {
+	switch {
+	case m.Text != "":
+		return ContentText
+	case len(m.Photo) > 0:
+		return ContentPhoto
+	// Animations are also reported as documents.
+	case m.Animation != nil:
+		return ContentAnimation
+	case m.Video != nil:
+		return ContentVideo
+	case m.Document != nil:
+		return ContentDocument
+	case m.Audio != nil:
+		return ContentAudio
+	case m.Voice != nil:
+		return ContentVoice
+	case m.VideoNote != nil:
+		return ContentVideoNote
+	case m.Sticker != nil:
+		return ContentSticker
+	case m.Contact != nil:
+		return ContentContact
+	case m.Location != nil:
+		return ContentLocation
+	case m.Poll != nil:
+		return ContentPoll
+	}
+	return ContentOther
+}
+
+// HasContent returns a match function accepting messages carrying content
+// of one of types.
+func HasContent(types ...ContentType) bot.MatchFunc {
+	return func(u *models.Update) bool {
+		return u != nil && u.Message != nil && slices.Contains(types, MessageContentType(u.Message))
+	}
+}
@@ -0,0 +1,128 @@
+package fsm_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+)
+
+func TestStateMatchFuncs(t *testing.T) {
+	h := fsmtest.New(t)
+	f := h.FSM
+
+	var ran []string
+	handler := func(name string, next fsm.StateFSM) bot.HandlerFunc {
+		return func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+			ran = append(ran, name)
+			if next != "" {
+				fsm.FromContext(ctx).Transition(ctx, next)
+			}
+		}
+	}
+	// Both handlers accept any text; only the state tells them apart.
+	h.Bot.RegisterHandlerMatchFunc(fsm.And(fsm.AnyText, f.StateIs("ask_name")), handler("name", "ask_city"))
+	h.Bot.RegisterHandlerMatchFunc(fsm.And(fsm.AnyText, f.StateIs("ask_city")), handler("city", fsm.StateDefault))
+	h.Bot.RegisterHandlerMatchFunc(fsm.And(fsm.Command("start"), f.StateIs(fsm.StateDefault)), handler("start", "ask_name"))
+	h.Bot.RegisterHandlerMatchFunc(fsm.Or(fsm.Command("cancel"), fsm.CallbackPrefix("cancel")), handler("cancel", fsm.StateDefault))
+
+	alice := fsmtest.User{ID: 1}
+	h.Send(alice.Text("hi"), alice.Command("start"), alice.Text("Alice"), alice.Text("Paris"), alice.Text("again"))
+	if want := []string{"start", "name", "city"}; !slices.Equal(ran, want) {
+		t.Fatalf("expected %v, ran %v", want, ran)
+	}
+
+	ran = nil
+	h.Send(alice.Command("start"), alice.Callback("cancel:1"), alice.Text("Bob"))
+	if want := []string{"start", "cancel"}; !slices.Equal(ran, want) {
+		t.Fatalf("expected %v, ran %v", want, ran)
+	}
+	h.AssertState(1, fsm.StateDefault)
+}
+
+func TestStateIn_NoSession(t *testing.T) {
+	f := fsm.New(context.Background())
+	defer f.Close()
+
+	inline := &models.Update{InlineQuery: &models.InlineQuery{}}
+	if f.StateIn(fsm.StateDefault)(inline) {
+		t.Fatal("updates without a session key must be rejected")
+	}
+	if !f.StateIn(fsm.StateAny)(inline) {
+		t.Fatal("StateAny must accept every update")
+	}
+	if !f.StateIn("a", fsm.StateDefault)(fsmtest.User{ID: 1}.Text("x")) {
+		t.Fatal("a new sender must be in StateDefault")
+	}
+}
+
+func TestStateIn_DoesNotTouch(t *testing.T) {
+	f := fsm.New(context.Background())
+	defer f.Close()
+
+	ctx := fsm.NewContext(context.Background(), f, 1)
+	if err := f.Transition(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen := func() time.Time {
+		for s, err := range f.Sessions(context.Background()) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s.LastSeen
+		}
+		t.Fatal("no session")
+		return time.Time{}
+	}
+	before := lastSeen()
+
+	time.Sleep(5 * time.Millisecond)
+	if !f.StateIs("a")(fsmtest.User{ID: 1}.Text("x")) {
+		t.Fatal("expected the update to match")
+	}
+	if after := lastSeen(); !after.Equal(before) {
+		t.Fatalf("matching must not refresh the session, last seen %v -> %v", before, after)
+	}
+}
+
+func TestMatchPredicates(t *testing.T) {
+	alice := fsmtest.User{ID: 1}
+	photo := alice.PhotoAlbum("g", "", "f1")[0]
+	addressed := alice.Command("start@our_bot", "ref")
+	emptyEntity := alice.Command("start")
+	emptyEntity.Message.Entities[0].Length = 0
+
+	cases := []struct {
+		name  string
+		match bot.MatchFunc
+		u     *models.Update
+		want  bool
+	}{
+		{"text", fsm.Text("yes"), alice.Text("yes"), true},
+		{"text mismatch", fsm.Text("yes"), alice.Text("yes!"), false},
+		{"text prefix", fsm.TextPrefix("ye"), alice.Text("yes"), true},
+		{"command", fsm.Command("start"), alice.Command("start", "ref"), true},
+		{"command addressed", fsm.Command("start"), addressed, true},
+		{"command other", fsm.Command("start"), alice.Command("stop"), false},
+		{"command as text", fsm.Command("start"), alice.Text("/start"), false},
+		{"callback prefix", fsm.CallbackPrefix("buy:"), alice.Callback("buy:1"), true},
+		{"callback on text", fsm.CallbackPrefix("buy:"), alice.Text("buy:1"), false},
+		{"content photo", fsm.HasContent(fsm.ContentPhoto, fsm.ContentVideo), photo, true},
+		{"content text", fsm.HasContent(fsm.ContentPhoto), alice.Text("x"), false},
+		{"content contact", fsm.HasContent(fsm.ContentContact), alice.Contact("+1"), true},
+		{"not", fsm.Not(fsm.AnyText), alice.Text("x"), false},
+		{"nil update", fsm.AnyText, nil, false},
+		{"empty command entity", fsm.Command("start"), emptyEntity, false},
+	}
+	for _, tc := range cases {
+		if got := tc.match(tc.u); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -12,6 +12,22 @@ type MediaData struct {
 	lastUpdate time.Time
 }
 
+// NewMediaData creates MediaData pre-filled with files and lastUpdate.
+// It is intended for storages that rebuild media groups from persisted data.
+func NewMediaData(files []File, lastUpdate time.Time) *MediaData {
+	md := &MediaData{lastUpdate: lastUpdate}
+	md.files = append(md.files, files...)
+	return md
+}
+
+// LastUpdate returns the time of the last Touch.
+func (md *MediaData) LastUpdate() time.Time {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+
+	return md.lastUpdate
+}
+
 // Files returns a copy of the stored files to preserve encapsulation.
 //
 // TODO: This operation is expensive — it allocates and copies the entire slice
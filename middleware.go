@@ -8,17 +8,76 @@ import (
 	"github.com/go-telegram/bot/models"
 )
 
-// Middleware attaches the FSM instance and user ID (if present)
-// to the context for every incoming update.
-// User state is created lazily only if a valid user ID (>0) is extracted.
-func Middleware(fsm *FSM) bot.Middleware {
+// ErrorHandler handles a failure to load or create the user's state.
+// It receives the same arguments as the skipped handler plus the error.
+type ErrorHandler func(ctx context.Context, b *bot.Bot, update *models.Update, err error)
+
+// handleError reports err to the configured ErrorHandler, if any.
+func (f *FSM) handleError(ctx context.Context, b *bot.Bot, update *models.Update, err error) {
+	if f.onError != nil {
+		f.onError(ctx, b, update, err)
+	}
+}
+
+// MiddlewareOption configures Middleware.
+type MiddlewareOption func(*middlewareConfig)
+
+// middlewareConfig collects Middleware options.
+type middlewareConfig struct {
+	key     KeyStrategy
+	filters []UpdateFilter
+}
+
+// KeyBy makes Middleware derive session keys with k instead of the
+// FSM's strategy (see WithKeyStrategy).
+func KeyBy(k KeyStrategy) MiddlewareOption {
+	return func(c *middlewareConfig) {
+		c.key = k
+	}
+}
+
+// pass reports whether u passes every filter.
+func (c *middlewareConfig) pass(u *models.Update, s Sender) bool {
+	for _, keep := range c.filters {
+		if !keep(u, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// Middleware attaches the FSM instance, the update's Sender, its chat and
+// the session key (if present) to the context for every incoming update. The sender is
+// reported by the FSM's Extractor (see WithExtractor) and the key derived
+// by its KeyStrategy, by default the sender's user ID.
+// State is created lazily only if a non-zero key is derived; anonymous
+// senders get none unless WithAnonymousSessions is set, and neither do
+// updates rejected by FilterUpdates.
+// If creating the state fails, the handler is skipped and the FSM's
+// ErrorHandler (see WithErrorHandler) is called instead.
+func Middleware(fsm *FSM, opts ...MiddlewareOption) bot.Middleware {
+	cfg := middlewareConfig{key: fsm.key}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	return func(next bot.HandlerFunc) bot.HandlerFunc {
 		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
 			if update != nil {
-				uid := extractUserID(update)
-				if uid > 0 {
-					ctx = userWithContext(ctx, uid)
-					fsm.Create(ctx)
+				if sender, ok := fsm.sender(update); ok {
+					ctx = senderWithContext(ctx, sender)
+					if cfg.pass(update, sender) {
+						if sender.ChatID != 0 {
+							ctx = chatWithContext(ctx, sender.ChatID)
+						}
+						if uid := fsm.keyWith(cfg.key, sender); uid != 0 {
+							ctx = userWithContext(ctx, uid)
+							if err := fsm.Create(ctx); err != nil {
+								fsm.handleError(fsmWithContext(ctx, fsm), b, update, err)
+								return
+							}
+						}
+					}
 				}
 			}
 
@@ -30,12 +89,51 @@ func Middleware(fsm *FSM) bot.Middleware {
 	}
 }
 
+// MismatchHandler is called when a state guard such as WithStates skips a
+// handler because the state does not match. expected are the guard's
+// states and actual the current one, StateNil if there is none.
+type MismatchHandler func(ctx context.Context, b *bot.Bot, update *models.Update, expected []StateFSM, actual StateFSM)
+
+// DefaultMismatchText is the text AnswerCallbackMismatch answers with when
+// given an empty one.
+const DefaultMismatchText = "This action is no longer available."
+
+// AnswerCallbackMismatch returns a MismatchHandler that answers skipped
+// callback queries with text (DefaultMismatchText if empty), so the button
+// stops spinning. Other updates are left unanswered.
+func AnswerCallbackMismatch(text string) MismatchHandler {
+	if text == "" {
+		text = DefaultMismatchText
+	}
+	return func(ctx context.Context, b *bot.Bot, update *models.Update, _ []StateFSM, _ StateFSM) {
+		if update != nil && update.CallbackQuery != nil {
+			answerCallback(ctx, b, update.CallbackQuery, text, false)
+		}
+	}
+}
+
 // WithStates restricts handler execution to specific FSM states.
 // - If no states are provided → handler is always executed.
 // - If StateAny is provided → handler is always executed.
 // - Otherwise → handler runs only when the current state matches one of the provided states.
-// If no FSM or state is found, the handler is skipped.
+// If no FSM is found, the handler is skipped. If no state is found or it
+// does not match, the handler is skipped and the FSM's MismatchHandler
+// (see WithMismatchHandler), if any, is called.
+// If loading the state fails, the handler is skipped and the FSM's ErrorHandler is called.
 func WithStates(states ...StateFSM) bot.Middleware {
+	return guardStates(states, nil, (*FSM).CurrentState)
+}
+
+// WithStatesElse is WithStates calling onMismatch instead of the FSM's
+// MismatchHandler when it skips the handler.
+func WithStatesElse(onMismatch MismatchHandler, states ...StateFSM) bot.Middleware {
+	return guardStates(states, onMismatch, (*FSM).CurrentState)
+}
+
+// guardStates builds the state guards: the handler runs when the state
+// reported by load is one of states. Otherwise onMismatch, or the FSM's
+// MismatchHandler if nil, is called.
+func guardStates(states []StateFSM, onMismatch MismatchHandler, load func(*FSM, context.Context) (StateFSM, bool, error)) bot.Middleware {
 	return func(next bot.HandlerFunc) bot.HandlerFunc {
 		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
 			if len(states) == 0 {
@@ -53,52 +151,26 @@ func WithStates(states ...StateFSM) bot.Middleware {
 				return // no FSM → skip handler
 			}
 
-			currentState, ok := fsm.CurrentState(ctx)
-			if !ok {
-				return // no state → skip handler
+			currentState, ok, err := load(fsm, ctx)
+			if err != nil {
+				fsm.handleError(ctx, b, update, err)
+				return
 			}
-
-			if slices.Contains(states, currentState) {
+			if ok && slices.Contains(states, currentState) {
 				next(ctx, b, update)
+				return
 			}
-		}
-	}
-}
 
-// extractUserID extracts the user ID from an incoming update.
-// Returns 0 if no valid user is present in the update.
-func extractUserID(u *models.Update) int64 {
-	switch {
-	case u.Message != nil && u.Message.From != nil:
-		return u.Message.From.ID
-	case u.EditedMessage != nil && u.EditedMessage.From != nil:
-		return u.EditedMessage.From.ID
-	case u.BusinessMessage != nil && u.BusinessMessage.From != nil:
-		return u.BusinessMessage.From.ID
-	case u.EditedBusinessMessage != nil && u.EditedBusinessMessage.From != nil:
-		return u.EditedBusinessMessage.From.ID
-	case u.CallbackQuery != nil:
-		return u.CallbackQuery.From.ID
-	case u.InlineQuery != nil && u.InlineQuery.From != nil:
-		return u.InlineQuery.From.ID
-	case u.ChosenInlineResult != nil:
-		return u.ChosenInlineResult.From.ID
-	case u.ShippingQuery != nil && u.ShippingQuery.From != nil:
-		return u.ShippingQuery.From.ID
-	case u.PreCheckoutQuery != nil && u.PreCheckoutQuery.From != nil:
-		return u.PreCheckoutQuery.From.ID
-	case u.PurchasedPaidMedia != nil:
-		return u.PurchasedPaidMedia.From.ID
-	case u.ChatMember != nil:
-		return u.ChatMember.From.ID
-	case u.MyChatMember != nil:
-		return u.MyChatMember.From.ID
-	case u.ChatJoinRequest != nil:
-		return u.ChatJoinRequest.From.ID
-	case u.PollAnswer != nil && u.PollAnswer.User != nil:
-		return u.PollAnswer.User.ID
-	case u.MessageReaction != nil && u.MessageReaction.User != nil:
-		return u.MessageReaction.User.ID
+			if !ok {
+				currentState = StateNil
+			}
+			mismatch := onMismatch
+			if mismatch == nil {
+				mismatch = fsm.onMismatch
+			}
+			if mismatch != nil {
+				mismatch(ctx, b, update, slices.Clone(states), currentState)
+			}
+		}
 	}
-	return 0
 }
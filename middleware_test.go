@@ -2,6 +2,7 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	"github.com/go-telegram/bot"
@@ -98,3 +99,53 @@ func TestWithStates_BasicBranches(t *testing.T) {
 		t.Fatalf("expected next to run 3 times, got %d", run)
 	}
 }
+
+// failingStates is a storage whose state operations always fail.
+type failingStates struct {
+	stubStorage
+	err error
+}
+
+func (s *failingStates) CreateState(context.Context, int64, string) error { return s.err }
+func (s *failingStates) SetState(context.Context, int64, string) error    { return s.err }
+func (s *failingStates) GetState(context.Context, int64) (string, bool, error) {
+	return "", false, s.err
+}
+
+func TestMiddleware_StateErrorSkipsHandlerAndCallsErrorHandler(t *testing.T) {
+	fail := &failingStates{err: errors.New("redis is down")}
+
+	var gotErr error
+	f := New(context.Background(), WithStorage(fail), WithErrorHandler(
+		func(ctx context.Context, _ *bot.Bot, _ *models.Update, err error) {
+			if FromContext(ctx) == nil {
+				t.Error("FSM must be available to the error handler")
+			}
+			gotErr = err
+		}))
+
+	called := false
+	next := func(context.Context, *bot.Bot, *models.Update) { called = true }
+	upd := &models.Update{Message: &models.Message{From: &models.User{ID: 1}}}
+
+	Middleware(f)(next)(context.Background(), nil, upd)
+
+	if called {
+		t.Fatal("handler must be skipped when state cannot be created")
+	}
+	if !errors.Is(gotErr, fail.err) {
+		t.Fatalf("error handler got %v, want %v", gotErr, fail.err)
+	}
+
+	// WithStates follows the same policy when the state cannot be loaded.
+	gotErr = nil
+	ctx := userWithContext(fsmWithContext(context.Background(), f), 1)
+	WithStates(StateDefault)(next)(ctx, nil, upd)
+
+	if called {
+		t.Fatal("guarded handler must be skipped when state cannot be loaded")
+	}
+	if !errors.Is(gotErr, fail.err) {
+		t.Fatalf("error handler got %v, want %v", gotErr, fail.err)
+	}
+}
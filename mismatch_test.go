@@ -0,0 +1,92 @@
+package fsm_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/fsmtest"
+)
+
+func TestMismatchHandler_Global(t *testing.T) {
+	h := fsmtest.New(t, fsmtest.WithFSMOptions(fsm.WithMismatchHandler(fsm.AnswerCallbackMismatch(""))))
+	ran := false
+	h.Bot.RegisterHandler(bot.HandlerTypeCallbackQueryData, "pay", bot.MatchTypeExact,
+		func(context.Context, *bot.Bot, *models.Update) { ran = true }, fsm.WithStates("checkout"))
+	alice := fsmtest.User{ID: 1}
+
+	h.Send(alice.Callback("pay"))
+	if ran {
+		t.Fatal("the handler must be skipped in the wrong state")
+	}
+	calls := h.CallsTo("answerCallbackQuery")
+	if len(calls) != 1 || calls[0].Param("text") != fsm.DefaultMismatchText {
+		t.Fatalf("the skipped callback must be answered, got %v", h.Calls())
+	}
+
+	h.ResetCalls()
+	h.Send(alice.Text("pay"))
+	if len(h.Calls()) != 0 {
+		t.Fatalf("other updates must not be answered, got %v", h.Calls())
+	}
+}
+
+func TestWithStatesElse(t *testing.T) {
+	var expected []fsm.StateFSM
+	var actual fsm.StateFSM
+	global := false
+	h := fsmtest.New(t, fsmtest.WithFSMOptions(fsm.WithMismatchHandler(
+		func(context.Context, *bot.Bot, *models.Update, []fsm.StateFSM, fsm.StateFSM) { global = true },
+	)))
+	onMismatch := func(_ context.Context, _ *bot.Bot, _ *models.Update, exp []fsm.StateFSM, act fsm.StateFSM) {
+		expected, actual = exp, act
+	}
+	h.Bot.RegisterHandler(bot.HandlerTypeMessageText, "", bot.MatchTypePrefix,
+		func(context.Context, *bot.Bot, *models.Update) {}, fsm.WithStatesElse(onMismatch, "a", "b"))
+
+	h.Send(fsmtest.User{ID: 1}.Text("hi"))
+	if !slices.Equal(expected, []fsm.StateFSM{"a", "b"}) || actual != fsm.StateDefault {
+		t.Fatalf("expected ([a b], default), got (%v, %v)", expected, actual)
+	}
+	if global {
+		t.Fatal("WithStatesElse must override the FSM's handler")
+	}
+}
+
+func TestMismatchHandler_NoState(t *testing.T) {
+	f := fsm.New(context.Background())
+	defer f.Close()
+
+	var actual fsm.StateFSM
+	onMismatch := func(_ context.Context, _ *bot.Bot, _ *models.Update, _ []fsm.StateFSM, act fsm.StateFSM) {
+		actual = act
+	}
+	ctx := fsm.NewContext(context.Background(), f, 1) // no state created
+	fsm.WithStatesElse(onMismatch, "a")(func(context.Context, *bot.Bot, *models.Update) {
+		t.Fatal("the handler must be skipped")
+	})(ctx, nil, &models.Update{})
+
+	if actual != fsm.StateNil {
+		t.Fatalf("expected StateNil for a user without state, got %v", actual)
+	}
+}
+
+func TestMismatchHandler_Machine(t *testing.T) {
+	var actual fsm.StateFSM
+	h := fsmtest.New(t, fsmtest.WithFSMOptions(fsm.WithMismatchHandler(
+		func(_ context.Context, _ *bot.Bot, _ *models.Update, _ []fsm.StateFSM, act fsm.StateFSM) {
+			actual = act
+		},
+	)))
+	h.Bot.RegisterHandler(bot.HandlerTypeMessageText, "", bot.MatchTypePrefix,
+		func(context.Context, *bot.Bot, *models.Update) {}, fsm.InMachine("survey", "rate"))
+
+	h.Send(fsmtest.User{ID: 1}.Text("5"))
+	if actual != fsm.StateDefault {
+		t.Fatalf("InMachine must report the machine's state, got %q", actual)
+	}
+}
@@ -3,7 +3,7 @@ package fsm
 import (
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
 )
 
 // Option defines a configuration function for FSM.
@@ -34,3 +34,81 @@ func WithCleanupInterval(t time.Duration) Option {
 		f.cleanupInterval = t
 	}
 }
+
+// WithErrorHandler sets the handler called when Middleware or WithStates
+// fail to load or create the user's state (e.g. the storage is unreachable
+// or the update context was cancelled). The guarded handler is skipped in
+// that case; the error handler may reply to the user, log or record metrics.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(f *FSM) {
+		f.onError = h
+	}
+}
+
+// WithMismatchHandler sets the handler called when WithStates, InMachine
+// or WithChatStates skip a handler because the state does not match, e.g.
+// AnswerCallbackMismatch to stop the button of a stale callback query from
+// spinning. WithStatesElse overrides it for one handler.
+func WithMismatchHandler(h MismatchHandler) Option {
+	return func(f *FSM) {
+		f.onMismatch = h
+	}
+}
+
+// WithKeyStrategy sets how Middleware derives session keys from updates.
+// The default, KeyByUser, gives each user one conversation across chats.
+func WithKeyStrategy(k KeyStrategy) Option {
+	return func(f *FSM) {
+		f.key = k
+	}
+}
+
+// WithExtractor replaces ExtractSender, which reports the sender of each
+// update to the KeyStrategy, e.g. to take the user from a custom update
+// field or to ignore some update types.
+func WithExtractor(e Extractor) Option {
+	return func(f *FSM) {
+		f.extract = e
+	}
+}
+
+// WithAnonymousSessions gives sessions to updates sent on behalf of a chat
+// (see Sender.Anonymous), keyed by that chat as their sender. Without it
+// such updates reach handlers with no session, since an anonymous admin
+// or a channel cannot be told apart from others of its kind.
+func WithAnonymousSessions() Option {
+	return func(f *FSM) {
+		f.anonymous = true
+	}
+}
+
+// WithCallbackSecret enables signed callback data (see CallbackData and
+// VerifyCallbacks) with secret as the HMAC key. Every transition then also
+// stores a new session version, which invalidates older buttons. Replicas
+// sharing a storage must use the same secret.
+func WithCallbackSecret(secret []byte) Option {
+	return func(f *FSM) {
+		f.callbackSecret = secret
+	}
+}
+
+// WithSnapshotFile makes the FSM persist itself to path: the file is loaded
+// by New if it exists, rewritten atomically every interval and once more on
+// Close. A non-positive interval writes the file only on Close.
+// Only storages implementing storage.Snapshotter (such as the default memory
+// storage) contribute cache data; FSM states are always included.
+func WithSnapshotFile(path string, interval time.Duration) Option {
+	return func(f *FSM) {
+		f.snapshotPath = path
+		f.snapshotInterval = interval
+	}
+}
+
+// WithSnapshotErrorHandler sets the handler for snapshot file failures.
+// If the file cannot be loaded at startup, the handler is called and the file
+// is left untouched: no snapshots are written for the lifetime of the FSM.
+func WithSnapshotErrorHandler(h func(error)) Option {
+	return func(f *FSM) {
+		f.onSnapshotError = h
+	}
+}
@@ -0,0 +1,96 @@
+package replay
+
+import "github.com/go-telegram/bot/models"
+
+// redactedPhone replaces phone numbers of shared contacts.
+const redactedPhone = "+0"
+
+// RedactPersonal is a Redactor that removes personal data Telegram attaches
+// to updates: names and usernames of users and private chats, shared
+// contacts, locations, venues, shipping addresses and order info. Shared
+// contacts and locations stay present with placeholder values, so a replay
+// still takes the branch that expects them. IDs are kept, since replaying a
+// conversation needs them, and so is message text; add a Redactor of your
+// own if the text itself is sensitive.
+func RedactPersonal(u *models.Update) {
+	for _, m := range []*models.Message{
+		u.Message, u.EditedMessage, u.ChannelPost, u.EditedChannelPost,
+		u.BusinessMessage, u.EditedBusinessMessage,
+	} {
+		redactMessage(m)
+	}
+
+	if q := u.CallbackQuery; q != nil {
+		redactUser(&q.From)
+		redactMessage(q.Message.Message)
+	}
+	if q := u.InlineQuery; q != nil {
+		redactUser(q.From)
+		q.Location = nil
+	}
+	if r := u.ChosenInlineResult; r != nil {
+		redactUser(&r.From)
+		r.Location = nil
+	}
+	if q := u.ShippingQuery; q != nil {
+		redactUser(q.From)
+		q.ShippingAddress = models.ShippingAddress{}
+	}
+	if q := u.PreCheckoutQuery; q != nil {
+		redactUser(q.From)
+		q.OrderInfo = nil
+	}
+	for _, cm := range []*models.ChatMemberUpdated{u.ChatMember, u.MyChatMember} {
+		if cm != nil {
+			redactUser(&cm.From)
+			redactChat(&cm.Chat)
+		}
+	}
+	if r := u.ChatJoinRequest; r != nil {
+		redactUser(&r.From)
+		redactChat(&r.Chat)
+	}
+	if a := u.PollAnswer; a != nil {
+		redactUser(a.User)
+	}
+	if r := u.MessageReaction; r != nil {
+		redactUser(r.User)
+		redactChat(&r.Chat)
+	}
+}
+
+// redactMessage scrubs a message and the message it replies to.
+func redactMessage(m *models.Message) {
+	for ; m != nil; m = m.ReplyToMessage {
+		redactUser(m.From)
+		redactChat(&m.Chat)
+		if c := m.Contact; c != nil {
+			*c = models.Contact{PhoneNumber: redactedPhone, UserID: c.UserID}
+		}
+		if m.Location != nil {
+			*m.Location = models.Location{}
+		}
+		if m.Venue != nil {
+			*m.Venue = models.Venue{}
+		}
+	}
+}
+
+func redactUser(u *models.User) {
+	if u == nil {
+		return
+	}
+	u.FirstName = ""
+	u.LastName = ""
+	u.Username = ""
+}
+
+// redactChat clears names of private chats; group titles are left as is.
+func redactChat(c *models.Chat) {
+	if c.Type != models.ChatTypePrivate {
+		return
+	}
+	c.FirstName = ""
+	c.LastName = ""
+	c.Username = ""
+}
@@ -0,0 +1,139 @@
+// Package replay records incoming updates as JSON Lines so a broken
+// conversation can be reproduced later. Add Middleware to a bot to record
+// updates, optionally redacted, and read the file back with Read; fsmtest's
+// Harness.Replay feeds the records through handlers under test.
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// Record is one line of a recording: an update and when it arrived.
+type Record struct {
+	Time   time.Time      `json:"time"`
+	Update *models.Update `json:"update"`
+}
+
+// Redactor scrubs a recorded update in place. It receives a copy, so the
+// update passed to handlers is never modified.
+type Redactor func(*models.Update)
+
+// recorder holds the Middleware configuration and serialises writes.
+type recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+
+	redact  []Redactor
+	now     func() time.Time
+	onError func(error)
+}
+
+// Option configures Middleware.
+type Option func(*recorder)
+
+// WithRedactor adds redactors applied to every update before it is written,
+// in the order given.
+func WithRedactor(fns ...Redactor) Option {
+	return func(r *recorder) {
+		r.redact = append(r.redact, fns...)
+	}
+}
+
+// WithClock sets the source of record timestamps. It exists for tests.
+func WithClock(now func() time.Time) Option {
+	return func(r *recorder) {
+		r.now = now
+	}
+}
+
+// WithErrorHandler sets a function called when an update cannot be
+// encoded or written. Recording never blocks the handler; by default
+// failures are dropped.
+func WithErrorHandler(fn func(error)) Option {
+	return func(r *recorder) {
+		r.onError = fn
+	}
+}
+
+// Middleware writes every incoming update to w as a Record on its own line
+// before calling the next handler. Writes are serialised, so w need not be
+// safe for concurrent use.
+func Middleware(w io.Writer, opts ...Option) bot.Middleware {
+	r := &recorder{enc: json.NewEncoder(w), now: time.Now}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return func(next bot.HandlerFunc) bot.HandlerFunc {
+		return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+			if update != nil {
+				if err := r.record(update); err != nil && r.onError != nil {
+					r.onError(err)
+				}
+			}
+			next(ctx, b, update)
+		}
+	}
+}
+
+// record redacts a copy of update and appends it to the output.
+func (r *recorder) record(update *models.Update) error {
+	rec := Record{Time: r.now(), Update: update}
+	if len(r.redact) > 0 {
+		cp, err := clone(update)
+		if err != nil {
+			return err
+		}
+		for _, fn := range r.redact {
+			fn(cp)
+		}
+		rec.Update = cp
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.enc.Encode(rec)
+}
+
+// clone deep-copies an update through its JSON form, the form it is
+// recorded in anyway.
+func clone(u *models.Update) (*models.Update, error) {
+	raw, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+	var cp models.Update
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// Read decodes all records from r, in file order.
+func Read(r io.Reader) ([]Record, error) {
+	dec := json.NewDecoder(r)
+
+	var out []Record
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		if rec.Update == nil {
+			return out, errors.New("replay: record without update")
+		}
+		out = append(out, rec)
+	}
+}
@@ -0,0 +1,142 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func textUpdate(id, uid int64, text string) *models.Update {
+	return &models.Update{
+		ID: id,
+		Message: &models.Message{
+			ID:   int(id),
+			From: &models.User{ID: uid, FirstName: "Alice", Username: "alice"},
+			Chat: models.Chat{ID: uid, Type: models.ChatTypePrivate, FirstName: "Alice"},
+			Text: text,
+		},
+	}
+}
+
+func TestMiddleware_RecordsAndReads(t *testing.T) {
+	var buf bytes.Buffer
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	mw := Middleware(&buf, WithClock(func() time.Time { return now }))
+
+	var handled int
+	h := mw(func(context.Context, *bot.Bot, *models.Update) { handled++ })
+	h(context.Background(), nil, textUpdate(1, 7, "/start"))
+	now = now.Add(time.Minute)
+	h(context.Background(), nil, textUpdate(2, 7, "hello"))
+
+	if handled != 2 {
+		t.Fatalf("next handler must run for every update, ran %d times", handled)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Fatalf("expected one line per update, got %d", n)
+	}
+
+	records, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	if !records[0].Time.Equal(start) || records[1].Time.Sub(records[0].Time) != time.Minute {
+		t.Fatalf("unexpected timestamps %v, %v", records[0].Time, records[1].Time)
+	}
+	if m := records[1].Update.Message; m.Text != "hello" || m.From.ID != 7 {
+		t.Fatalf("unexpected message %+v", m)
+	}
+}
+
+func TestMiddleware_Redacts(t *testing.T) {
+	var buf bytes.Buffer
+	mw := Middleware(&buf, WithRedactor(RedactPersonal))
+
+	upd := textUpdate(1, 7, "hi")
+	upd.Message.Contact = &models.Contact{PhoneNumber: "+123456", FirstName: "Alice", UserID: 7}
+	var seen *models.Update
+	mw(func(_ context.Context, _ *bot.Bot, u *models.Update) { seen = u })(context.Background(), nil, upd)
+
+	if seen.Message.From.FirstName != "Alice" || seen.Message.Contact.PhoneNumber != "+123456" {
+		t.Fatal("the handler must get the update unredacted")
+	}
+	if strings.Contains(buf.String(), "Alice") || strings.Contains(buf.String(), "+123456") {
+		t.Fatalf("personal data leaked into the recording: %s", buf.String())
+	}
+
+	records, _ := Read(&buf)
+	m := records[0].Update.Message
+	if m.From.ID != 7 || m.Text != "hi" || m.Contact == nil || m.Contact.UserID != 7 {
+		t.Fatalf("redaction must keep IDs, text and the contact itself: %+v", m)
+	}
+}
+
+func TestRedactPersonal_Callback(t *testing.T) {
+	upd := &models.Update{CallbackQuery: &models.CallbackQuery{
+		From: models.User{ID: 1, Username: "bob"},
+		Message: models.MaybeInaccessibleMessage{Message: &models.Message{
+			Chat: models.Chat{ID: 1, Type: models.ChatTypePrivate, Username: "bob"},
+		}},
+	}}
+	RedactPersonal(upd)
+
+	if upd.CallbackQuery.From.Username != "" || upd.CallbackQuery.Message.Message.Chat.Username != "" {
+		t.Fatalf("callback query not redacted: %+v", upd.CallbackQuery)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestMiddleware_ErrorHandler(t *testing.T) {
+	var got error
+	mw := Middleware(failingWriter{}, WithErrorHandler(func(err error) { got = err }))
+
+	called := false
+	mw(func(context.Context, *bot.Bot, *models.Update) { called = true })(context.Background(), nil, textUpdate(1, 1, "x"))
+
+	if got == nil || !called {
+		t.Fatalf("expected the error reported and the handler run, got (%v, %v)", got, called)
+	}
+}
+
+func TestMiddleware_Concurrent(t *testing.T) {
+	var buf bytes.Buffer
+	h := Middleware(&buf)(func(context.Context, *bot.Bot, *models.Update) {})
+
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h(context.Background(), nil, textUpdate(int64(i), int64(i), "x"))
+		}()
+	}
+	wg.Wait()
+
+	records, err := Read(&buf)
+	if err != nil || len(records) != 50 {
+		t.Fatalf("expected 50 intact records, got %d (%v)", len(records), err)
+	}
+}
+
+func TestRead_Invalid(t *testing.T) {
+	if _, err := Read(strings.NewReader(`{"time":"2025-01-01T00:00:00Z"}` + "\n")); err == nil {
+		t.Fatal("expected an error for a record without update")
+	}
+	if _, err := Read(strings.NewReader("not json\n")); err == nil {
+		t.Fatal("expected a decode error")
+	}
+}
@@ -0,0 +1,167 @@
+package fsm
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+// snapshotVersion is bumped on incompatible changes of the snapshot format.
+const snapshotVersion = 1
+
+// snapshotHeader is the first JSON document of an FSM snapshot.
+// If Storage is true, the storage's own snapshot follows it in the stream.
+type snapshotHeader struct {
+	Version int             `json:"version"`
+	States  []stateSnapshot `json:"states"`
+	Storage bool            `json:"storage"`
+}
+
+type stateSnapshot struct {
+	UserID  int64     `json:"user_id"`
+	State   StateFSM  `json:"state"`
+	LastUse time.Time `json:"last_use"`
+}
+
+// Snapshot writes user states kept by the FSM and, if the storage implements
+// storage.Snapshotter, the storage content (cache values, media groups and
+// last-seen times) to w. States kept in a storage.StateStorage are not part of
+// the FSM section: they live in the storage itself.
+// If the storage skipped values it cannot encode, the snapshot is complete
+// otherwise and the error wraps storage.ErrSnapshotIncomplete.
+func (f *FSM) Snapshot(w io.Writer) error {
+	h := snapshotHeader{Version: snapshotVersion}
+
+	f.current.Range(func(k, v any) bool {
+		sd := v.(stateData)
+		h.States = append(h.States, stateSnapshot{UserID: k.(int64), State: sd.state, LastUse: sd.lastUse})
+		return true
+	})
+
+	snap, ok := f.storage.(storage.Snapshotter)
+	h.Storage = ok
+
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		return err
+	}
+	if ok {
+		return snap.Snapshot(w)
+	}
+	return nil
+}
+
+// Restore loads a snapshot written by Snapshot. Users from the snapshot replace
+// users with the same ID; other users are kept. The storage section is applied
+// first, so states are only restored if the storage accepted its data.
+func (f *FSM) Restore(r io.Reader) error {
+	dec := json.NewDecoder(r)
+
+	var h snapshotHeader
+	if err := dec.Decode(&h); err != nil {
+		return fmt.Errorf("fsm: decode snapshot: %w", err)
+	}
+	if h.Version != snapshotVersion {
+		return fmt.Errorf("fsm: unsupported snapshot version %d", h.Version)
+	}
+
+	if h.Storage {
+		snap, ok := f.storage.(storage.Snapshotter)
+		if !ok {
+			return errors.New("fsm: snapshot contains storage data, but the storage cannot restore it")
+		}
+		if err := snap.Restore(io.MultiReader(dec.Buffered(), r)); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range h.States {
+		f.current.Store(s.UserID, stateData{state: s.State, lastUse: s.LastUse})
+	}
+	return nil
+}
+
+// loadSnapshotFile restores the FSM from path. A missing file is not an error.
+func (f *FSM) loadSnapshotFile(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return f.Restore(bufio.NewReader(file))
+}
+
+// writeSnapshotFile atomically replaces path with a fresh snapshot:
+// it is written to a temporary file in the same directory, synced and renamed.
+// A snapshot missing values the storage could not encode still replaces the
+// file, and its error is returned afterwards.
+func (f *FSM) writeSnapshotFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	w := bufio.NewWriter(tmp)
+	incomplete := f.Snapshot(w)
+	if incomplete != nil && !errors.Is(incomplete, storage.ErrSnapshotIncomplete) {
+		tmp.Close()
+		return incomplete
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return incomplete
+}
+
+// snapshotWorker periodically writes the snapshot file until Close is called
+// or the context passed to New is done.
+func (f *FSM) snapshotWorker(done <-chan struct{}) {
+	defer close(f.snapshotDone)
+
+	ticker := time.NewTicker(f.snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.writeSnapshotFile(f.snapshotPath); err != nil {
+				f.reportSnapshotError(err)
+			}
+		case <-f.stopSnapshot:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// reportSnapshotError passes err to the handler set by WithSnapshotErrorHandler.
+func (f *FSM) reportSnapshotError(err error) {
+	if f.onSnapshotError != nil {
+		f.onSnapshotError(fmt.Errorf("fsm: snapshot %s: %w", f.snapshotPath, err))
+	}
+}
@@ -0,0 +1,121 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+func TestSnapshotRestore_StatesAndStorage(t *testing.T) {
+	ctx := context.Background()
+	src := New(ctx)
+	defer src.Close()
+
+	uctx := userWithContext(ctx, 10)
+	src.Transition(uctx, "step")
+	src.Set(uctx, 10, "k", "v")
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := New(ctx)
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	if st, ok, _ := dst.CurrentState(uctx); !ok || st != "step" {
+		t.Fatalf("state not restored: (%q, %v)", st, ok)
+	}
+	if v, ok, _ := dst.Get(uctx, 10, "k"); !ok || v != "v" {
+		t.Fatalf("cache not restored: (%v, %v)", v, ok)
+	}
+}
+
+func TestSnapshotFile_LoadedAtStartupAndWrittenOnClose(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fsm.snapshot")
+	uctx := userWithContext(ctx, 5)
+
+	first := New(ctx, WithSnapshotFile(path, 0))
+	first.Transition(uctx, "waiting")
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	second := New(ctx, WithSnapshotFile(path, 0))
+	defer second.Close()
+	if st, ok, _ := second.CurrentState(uctx); !ok || st != "waiting" {
+		t.Fatalf("state not loaded from snapshot file: (%q, %v)", st, ok)
+	}
+}
+
+func TestSnapshotFile_Periodic(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fsm.snapshot")
+
+	f := New(ctx, WithSnapshotFile(path, 10*time.Millisecond))
+	defer f.Close()
+	f.Transition(userWithContext(ctx, 1), "x")
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("snapshot file was not written periodically")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSnapshotFile_CorruptFileIsKept(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fsm.snapshot")
+	if err := os.WriteFile(path, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var gotErr error
+	f := New(ctx, WithSnapshotFile(path, 0), WithSnapshotErrorHandler(func(err error) { gotErr = err }))
+	f.Transition(userWithContext(ctx, 1), "x")
+	f.Close()
+
+	if gotErr == nil {
+		t.Fatal("expected snapshot error handler to be called")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "garbage" {
+		t.Fatal("unreadable snapshot file must not be overwritten")
+	}
+}
+
+func TestSnapshotFile_SkipsUnencodableValue(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "fsm.snapshot")
+
+	first := New(ctx, WithSnapshotFile(path, 0))
+	first.Transition(userWithContext(ctx, 1), "waiting")
+	first.Set(ctx, 1, "ch", make(chan int))
+	first.Set(ctx, 2, "k", "v")
+	if err := first.Close(); !errors.Is(err, storage.ErrSnapshotIncomplete) {
+		t.Fatalf("the skipped value must be reported, got %v", err)
+	}
+
+	second := New(ctx, WithSnapshotFile(path, 0))
+	defer second.Close()
+	if st, _, _ := second.CurrentState(userWithContext(ctx, 1)); st != "waiting" {
+		t.Fatalf("state not loaded from snapshot file: %q", st)
+	}
+	if v, _, _ := second.Get(ctx, 2, "k"); v != "v" {
+		t.Fatalf("other users' data must be written, got %v", v)
+	}
+}
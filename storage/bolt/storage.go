@@ -0,0 +1,841 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"iter"
+	"sync"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+)
+
+// Bucket and key names used inside a user bucket.
+var (
+	keySeen    = []byte("seen")    // last-seen time, unix nano
+	keyState   = []byte("state")   // FSM state
+	keyUpdated = []byte("updated") // media group last update, unix nano
+
+	bucketData    = []byte("data")    // key -> encoded value
+	bucketExpires = []byte("expires") // key -> deadline of SetWithTTL values, unix nano
+	bucketMedia   = []byte("media")   // mediaGroupID -> group bucket
+	bucketFiles   = []byte("files")   // sequence -> JSON media.File
+)
+
+// BoltStorage is an embedded file-based storage on top of bbolt.
+// It suits single-instance bots that need sessions to survive restarts
+// without running a database server.
+//
+// Every user gets one top-level bucket keyed by the big-endian user ID:
+//
+//	<userID>
+//	├── seen, state
+//	├── data/  key -> encoded value
+//	├── expires/ key -> deadline, for values set with SetWithTTL
+//	└── media/ <mediaGroupID>/ updated, files/ seq -> JSON media.File
+//
+// Every write runs in its own bbolt transaction, which is fsynced on
+// commit, so a crash never leaves a half-written update behind. Reads run
+// in read-only transactions, which do not block each other or writes, and
+// record the access in memory; these last-seen times are written by the
+// next cleanup, or earlier once many have piled up, and by Close. Eviction
+// mirrors memory.MemoryStorage: a background worker drops users that were
+// inactive for longer than TTL. After a crash, users seen only by reads
+// since the last cleanup count as inactive since their last write.
+//
+// Values passed to Set are serialised with a codec.Codec (codec.JSON by
+// default), so Get returns them with their original Go type. Custom types
+// must be registered with codec.Register.
+type BoltStorage struct {
+	db       *bbolt.DB
+	codec    codec.Codec
+	ttl      time.Duration
+	interval time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+
+	seenMu sync.Mutex
+	seen   map[int64]int64 // last-seen times of reads not written yet, unix nano
+
+	stopOnce sync.Once
+	stopFn   context.CancelFunc
+	done     chan struct{}
+}
+
+// maxPendingSeen is how many last-seen times of reads are kept in memory
+// before they are written outside of cleanup.
+const maxPendingSeen = 1024
+
+// Option configures a BoltStorage.
+type Option func(*BoltStorage)
+
+// WithCodec sets the codec used to serialise values passed to Set.
+func WithCodec(c codec.Codec) Option {
+	return func(b *BoltStorage) {
+		b.codec = c
+	}
+}
+
+// WithTTL sets how long user data is kept after the last access.
+// A non-positive value keeps inactive users forever.
+func WithTTL(ttl time.Duration) Option {
+	return func(b *BoltStorage) {
+		b.ttl = ttl
+	}
+}
+
+// WithCleanupInterval sets how often expired users are deleted.
+// A non-positive value disables cleanup.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(b *BoltStorage) {
+		b.interval = interval
+	}
+}
+
+// WithLockTimeout sets how long NewBoltStorage waits for the file lock
+// held by another process. Zero waits forever.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(b *BoltStorage) {
+		b.timeout = timeout
+	}
+}
+
+// WithClock sets the source of the current time used for last-seen times
+// and expiry. It exists for tests, e.g. with storagetest.Clock.
+func WithClock(now func() time.Time) Option {
+	return func(b *BoltStorage) {
+		b.now = now
+	}
+}
+
+// NewBoltStorage opens (or creates) the database file at path and starts
+// the cleanup worker. The file is locked until Close is called.
+func NewBoltStorage(path string, opts ...Option) (*BoltStorage, error) {
+	b := &BoltStorage{
+		codec:    codec.JSON,
+		ttl:      30 * time.Minute,
+		interval: 30 * time.Second,
+		timeout:  time.Second,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: b.timeout})
+	if err != nil {
+		return nil, err
+	}
+	b.db = db
+
+	// Start background cleanup worker
+	ctx, cancel := context.WithCancel(context.Background())
+	b.stopFn = cancel
+	go b.cleanupWorker(ctx)
+
+	return b, nil
+}
+
+// Close stops the cleanup worker, flushes the database file to disk
+// and releases the file lock.
+func (b *BoltStorage) Close() error {
+	var err error
+	b.stopOnce.Do(func() {
+		b.stopFn()
+		<-b.done
+
+		err = errors.Join(b.flushSeen(), b.db.Sync(), b.db.Close())
+	})
+	return err
+}
+
+// cleanupWorker periodically evicts users that exceeded TTL and expired values.
+func (b *BoltStorage) cleanupWorker(ctx context.Context) {
+	defer close(b.done)
+
+	if b.interval <= 0 {
+		// nothing to do
+		return
+	}
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = b.cleanup(b.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cleanup deletes every user bucket last seen more than ttl before now
+// and values of the remaining users whose own TTL has passed.
+func (b *BoltStorage) cleanup(now time.Time) error {
+	deadline := now.Add(-b.ttl).UnixNano()
+
+	seen := b.takeSeen()
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		if err := writeSeen(tx, seen); err != nil {
+			return err
+		}
+
+		var expired [][]byte
+		err := tx.ForEach(func(name []byte, ub *bbolt.Bucket) error {
+			if b.ttl > 0 && decodeInt(ub.Get(keySeen)) < deadline {
+				expired = append(expired, bytes.Clone(name))
+				return nil
+			}
+			return expireValues(ub, now)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, name := range expired {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.restoreSeen(seen)
+	}
+	return err
+}
+
+// markSeen records a read of the user's data as an access.
+func (b *BoltStorage) markSeen(userID int64) error {
+	b.seenMu.Lock()
+	if b.seen == nil {
+		b.seen = make(map[int64]int64)
+	}
+	b.seen[userID] = b.now().UnixNano()
+	full := len(b.seen) >= maxPendingSeen
+	b.seenMu.Unlock()
+
+	if full {
+		return b.flushSeen()
+	}
+	return nil
+}
+
+// flushSeen writes the last-seen times recorded by reads.
+func (b *BoltStorage) flushSeen() error {
+	seen := b.takeSeen()
+	if len(seen) == 0 {
+		return nil
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		return writeSeen(tx, seen)
+	})
+	if err != nil {
+		b.restoreSeen(seen)
+	}
+	return err
+}
+
+// takeSeen removes and returns the last-seen times recorded by reads.
+func (b *BoltStorage) takeSeen() map[int64]int64 {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	seen := b.seen
+	b.seen = nil
+	return seen
+}
+
+// restoreSeen puts back last-seen times that could not be written, unless
+// newer ones were recorded meanwhile.
+func (b *BoltStorage) restoreSeen(seen map[int64]int64) {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	if b.seen == nil {
+		b.seen = make(map[int64]int64, len(seen))
+	}
+	for userID, ts := range seen {
+		b.seen[userID] = max(b.seen[userID], ts)
+	}
+}
+
+// pendingSeen returns the last-seen time of the user recorded by reads and
+// not written yet, 0 if there is none.
+func (b *BoltStorage) pendingSeen(userID int64) int64 {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	return b.seen[userID]
+}
+
+// writeSeen stores last-seen times in the buckets of users that still
+// exist, unless a write has recorded a later one.
+func writeSeen(tx *bbolt.Tx, seen map[int64]int64) error {
+	for userID, ts := range seen {
+		ub := tx.Bucket(userKey(userID))
+		if ub == nil || decodeInt(ub.Get(keySeen)) >= ts {
+			continue
+		}
+		if err := ub.Put(keySeen, encodeInt(ts)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userKey encodes userID as a sortable bucket name.
+func userKey(userID int64) []byte {
+	return encodeInt(userID)
+}
+
+func encodeInt(v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return buf
+}
+
+func decodeInt(buf []byte) int64 {
+	if len(buf) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(buf))
+}
+
+// userBucket returns the user's bucket, creating it if needed,
+// and updates the last-seen timestamp.
+func (b *BoltStorage) userBucket(tx *bbolt.Tx, userID int64) (*bbolt.Bucket, error) {
+	ub, err := tx.CreateBucketIfNotExists(userKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	return ub, b.touch(ub)
+}
+
+// touch updates last-seen timestamp of the user bucket.
+func (b *BoltStorage) touch(ub *bbolt.Bucket) error {
+	return ub.Put(keySeen, encodeInt(b.now().UnixNano()))
+}
+
+// update runs fn in a read-write transaction unless ctx is already done.
+// bbolt transactions cannot be interrupted, so the context is checked up front.
+func (b *BoltStorage) update(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.Update(fn)
+}
+
+// view runs fn in a read-only transaction unless ctx is already done.
+func (b *BoltStorage) view(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.db.View(fn)
+}
+
+// Set stores a key/value pair for the given userID.
+func (b *BoltStorage) Set(ctx context.Context, userID int64, key string, value any) error {
+	raw, err := b.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		data, err := ub.CreateBucketIfNotExists(bucketData)
+		if err != nil {
+			return err
+		}
+		if exp := ub.Bucket(bucketExpires); exp != nil {
+			if err := exp.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return data.Put([]byte(key), raw)
+	})
+}
+
+// SetWithTTL stores a key/value pair that expires after ttl regardless of the
+// user's activity. Expired values are never returned by Get and are deleted by
+// the cleanup worker. A non-positive ttl behaves like Set.
+func (b *BoltStorage) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return b.Set(ctx, userID, key, value)
+	}
+	raw, err := b.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	expiresAt := encodeInt(b.now().Add(ttl).UnixNano())
+
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		data, err := ub.CreateBucketIfNotExists(bucketData)
+		if err != nil {
+			return err
+		}
+		exp, err := ub.CreateBucketIfNotExists(bucketExpires)
+		if err != nil {
+			return err
+		}
+		if err := exp.Put([]byte(key), expiresAt); err != nil {
+			return err
+		}
+		return data.Put([]byte(key), raw)
+	})
+}
+
+// SetIfAbsent stores a key/value pair like SetWithTTL unless the key holds
+// an unexpired value, and reports whether it stored it.
+func (b *BoltStorage) SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	raw, err := b.codec.Encode(value)
+	if err != nil {
+		return false, err
+	}
+	now := b.now()
+
+	var stored bool
+	err = b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		data, err := ub.CreateBucketIfNotExists(bucketData)
+		if err != nil {
+			return err
+		}
+		exp, err := ub.CreateBucketIfNotExists(bucketExpires)
+		if err != nil {
+			return err
+		}
+		if data.Get([]byte(key)) != nil {
+			deadline := exp.Get([]byte(key))
+			if deadline == nil || decodeInt(deadline) > now.UnixNano() {
+				return nil
+			}
+		}
+
+		stored = true
+		if ttl > 0 {
+			err = exp.Put([]byte(key), encodeInt(now.Add(ttl).UnixNano()))
+		} else {
+			err = exp.Delete([]byte(key))
+		}
+		if err != nil {
+			return err
+		}
+		return data.Put([]byte(key), raw)
+	})
+	return stored && err == nil, err
+}
+
+// Delete removes the value of key for the given userID.
+func (b *BoltStorage) Delete(ctx context.Context, userID int64, key string) error {
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub := tx.Bucket(userKey(userID))
+		if ub == nil {
+			return nil
+		}
+		for _, name := range [][]byte{bucketData, bucketExpires} {
+			if bk := ub.Bucket(name); bk != nil {
+				if err := bk.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// expireValues deletes values of the user bucket whose deadline is not after now.
+func expireValues(ub *bbolt.Bucket, now time.Time) error {
+	exp := ub.Bucket(bucketExpires)
+	if exp == nil {
+		return nil
+	}
+
+	var keys [][]byte
+	_ = exp.ForEach(func(k, v []byte) error {
+		if decodeInt(v) <= now.UnixNano() {
+			keys = append(keys, bytes.Clone(k))
+		}
+		return nil
+	})
+
+	data := ub.Bucket(bucketData)
+	for _, k := range keys {
+		if err := exp.Delete(k); err != nil {
+			return err
+		}
+		if data != nil {
+			if err := data.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get retrieves a value by key for the given userID. Values past their
+// own TTL are reported missing and deleted by the next cleanup.
+func (b *BoltStorage) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	var raw []byte
+
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		ub := tx.Bucket(userKey(userID))
+		if ub == nil {
+			return nil
+		}
+		data := ub.Bucket(bucketData)
+		if data == nil {
+			return nil
+		}
+		if exp := ub.Bucket(bucketExpires); exp != nil {
+			if d := exp.Get([]byte(key)); d != nil && decodeInt(d) <= b.now().UnixNano() {
+				return nil
+			}
+		}
+		if v := data.Get([]byte(key)); v != nil {
+			raw = bytes.Clone(v)
+		}
+		return nil
+	})
+	if err != nil || raw == nil {
+		return nil, false, err
+	}
+	if err := b.markSeen(userID); err != nil {
+		return nil, false, err
+	}
+
+	v, err := b.codec.Decode(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// SetMedia appends a media.File into a mediaGroupID for the given user.
+func (b *BoltStorage) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	raw, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		mb, err := ub.CreateBucketIfNotExists(bucketMedia)
+		if err != nil {
+			return err
+		}
+		gb, err := mb.CreateBucketIfNotExists([]byte(mediaGroupID))
+		if err != nil {
+			return err
+		}
+		files, err := gb.CreateBucketIfNotExists(bucketFiles)
+		if err != nil {
+			return err
+		}
+
+		seq, err := files.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := files.Put(encodeInt(int64(seq)), raw); err != nil {
+			return err
+		}
+		return gb.Put(keyUpdated, encodeInt(b.now().UnixNano()))
+	})
+}
+
+// GetMedia retrieves MediaData for a given user and mediaGroupID.
+// The returned value is a snapshot: adding files to it does not affect the file.
+func (b *BoltStorage) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	var md *media.MediaData
+
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		gb := mediaGroup(tx, userID, mediaGroupID)
+		if gb == nil {
+			return nil
+		}
+
+		var err error
+		md, err = readMediaGroup(gb)
+		return err
+	})
+	if err != nil || md == nil {
+		return nil, false, err
+	}
+	if err := b.markSeen(userID); err != nil {
+		return nil, false, err
+	}
+
+	return md, md != nil, nil
+}
+
+// readMediaGroup decodes the files and last update time of a group bucket.
+func readMediaGroup(gb *bbolt.Bucket) (*media.MediaData, error) {
+	var files []media.File
+	if fb := gb.Bucket(bucketFiles); fb != nil {
+		err := fb.ForEach(func(_, v []byte) error {
+			var f media.File
+			if err := json.Unmarshal(v, &f); err != nil {
+				return err
+			}
+			files = append(files, f)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return media.NewMediaData(files, time.Unix(0, decodeInt(gb.Get(keyUpdated)))), nil
+}
+
+// mediaGroup returns the bucket of a media group or nil if it does not exist.
+func mediaGroup(tx *bbolt.Tx, userID int64, mediaGroupID string) *bbolt.Bucket {
+	ub := tx.Bucket(userKey(userID))
+	if ub == nil {
+		return nil
+	}
+	mb := ub.Bucket(bucketMedia)
+	if mb == nil {
+		return nil
+	}
+	return mb.Bucket([]byte(mediaGroupID))
+}
+
+// CleanMediaCache removes MediaData for a given user and mediaGroupID.
+func (b *BoltStorage) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	var existed bool
+
+	err := b.update(ctx, func(tx *bbolt.Tx) error {
+		if mediaGroup(tx, userID, mediaGroupID) == nil {
+			return nil
+		}
+		ub := tx.Bucket(userKey(userID))
+		if err := ub.Bucket(bucketMedia).DeleteBucket([]byte(mediaGroupID)); err != nil {
+			return err
+		}
+		existed = true
+		return b.touch(ub) // consider it an access
+	})
+
+	return existed && err == nil, err
+}
+
+// CleanCache removes all cached data and media for the given userID.
+// The user's FSM state is kept.
+func (b *BoltStorage) CleanCache(ctx context.Context, userID int64) error {
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub := tx.Bucket(userKey(userID))
+		if ub == nil {
+			return nil
+		}
+		for _, name := range [][]byte{bucketData, bucketExpires, bucketMedia} {
+			if ub.Bucket(name) == nil {
+				continue
+			}
+			if err := ub.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CreateState stores state for the user only if no state exists yet.
+func (b *BoltStorage) CreateState(ctx context.Context, userID int64, state string) error {
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		if ub.Get(keyState) != nil {
+			return nil
+		}
+		return ub.Put(keyState, []byte(state))
+	})
+}
+
+// SetState stores state for the user.
+func (b *BoltStorage) SetState(ctx context.Context, userID int64, state string) error {
+	return b.update(ctx, func(tx *bbolt.Tx) error {
+		ub, err := b.userBucket(tx, userID)
+		if err != nil {
+			return err
+		}
+		return ub.Put(keyState, []byte(state))
+	})
+}
+
+// GetState returns the user's state and refreshes the last-seen timestamp.
+func (b *BoltStorage) GetState(ctx context.Context, userID int64) (string, bool, error) {
+	var (
+		st string
+		ok bool
+	)
+
+	err := b.view(ctx, func(tx *bbolt.Tx) error {
+		if ub := tx.Bucket(userKey(userID)); ub != nil {
+			if v := ub.Get(keyState); v != nil {
+				st, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	if err != nil || !ok {
+		return "", false, err
+	}
+	if err := b.markSeen(userID); err != nil {
+		return "", false, err
+	}
+	return st, true, nil
+}
+
+// PeekState returns the user's state without refreshing the last-seen
+// timestamp.
+func (b *BoltStorage) PeekState(ctx context.Context, userID int64) (string, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	var (
+		st string
+		ok bool
+	)
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		if ub := tx.Bucket(userKey(userID)); ub != nil {
+			if v := ub.Get(keyState); v != nil {
+				st, ok = string(v), true
+			}
+		}
+		return nil
+	})
+	return st, ok, err
+}
+
+// sessionPage is how many user buckets Sessions reads per transaction.
+const sessionPage = 100
+
+// Sessions lists stored states in bucket order. Buckets are read in pages
+// of short read transactions, so the caller may write to the storage while
+// iterating.
+func (b *BoltStorage) Sessions(ctx context.Context) iter.Seq2[storage.Session, error] {
+	return func(yield func(storage.Session, error) bool) {
+		var after []byte
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(storage.Session{}, err)
+				return
+			}
+
+			var page []storage.Session
+			err := b.db.View(func(tx *bbolt.Tx) error {
+				c := tx.Cursor()
+				k, _ := c.First()
+				if after != nil {
+					k, _ = c.Seek(after)
+					if bytes.Equal(k, after) {
+						k, _ = c.Next()
+					}
+				}
+				for ; k != nil && len(page) < sessionPage; k, _ = c.Next() {
+					after = bytes.Clone(k)
+					ub := tx.Bucket(k)
+					st := ub.Get(keyState)
+					if st == nil {
+						continue
+					}
+					sess := storage.Session{UserID: decodeInt(k), State: string(st)}
+					if seen := max(decodeInt(ub.Get(keySeen)), b.pendingSeen(sess.UserID)); seen > 0 {
+						sess.LastSeen = time.Unix(0, seen)
+					}
+					page = append(page, sess)
+				}
+				if k == nil {
+					after = nil // reached the end
+				}
+				return nil
+			})
+			if err != nil {
+				yield(storage.Session{}, err)
+				return
+			}
+
+			for _, sess := range page {
+				if !yield(sess, nil) {
+					return
+				}
+			}
+			if after == nil {
+				return
+			}
+		}
+	}
+}
+
+// Inspect returns the user's unexpired values and media groups.
+func (b *BoltStorage) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	out := storage.UserData{Values: make(map[string]any), Media: make(map[string]*media.MediaData)}
+	if err := ctx.Err(); err != nil {
+		return out, err
+	}
+	now := b.now().UnixNano()
+
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		ub := tx.Bucket(userKey(userID))
+		if ub == nil {
+			return nil
+		}
+
+		exp := ub.Bucket(bucketExpires)
+		if data := ub.Bucket(bucketData); data != nil {
+			err := data.ForEach(func(k, raw []byte) error {
+				if exp != nil {
+					if d := exp.Get(k); d != nil && decodeInt(d) <= now {
+						return nil
+					}
+				}
+				v, err := b.codec.Decode(raw)
+				if err != nil {
+					return err
+				}
+				out.Values[string(k)] = v
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		mb := ub.Bucket(bucketMedia)
+		if mb == nil {
+			return nil
+		}
+		return mb.ForEachBucket(func(group []byte) error {
+			md, err := readMediaGroup(mb.Bucket(group))
+			if err != nil {
+				return err
+			}
+			out.Media[string(group)] = md
+			return nil
+		})
+	})
+	return out, err
+}
@@ -0,0 +1,389 @@
+package bolt
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+func f(tpe, id string) media.File {
+	return media.File{Type: tpe, FileID: id}
+}
+
+func newTestStorage(t *testing.T, opts ...Option) (*BoltStorage, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "fsm.db")
+	store, err := NewBoltStorage(path, opts...)
+	if err != nil {
+		t.Fatalf("NewBoltStorage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store, path
+}
+
+func TestSetAndGet(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	store.Set(ctx, userID, "key1", "value1")
+
+	v, ok, _ := store.Get(ctx, userID, "key1")
+	if !ok || v.(string) != "value1" {
+		t.Errorf("expected value1, got %#v", v)
+	}
+
+	_, ok, _ = store.Get(ctx, userID, "nonexistent")
+	if ok {
+		t.Error("expected not found for nonexistent key")
+	}
+}
+
+func TestSetMediaAndGetMedia(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(42)
+	groupID := "grp1"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id1"))
+	store.SetMedia(ctx, userID, groupID, f("video", "id2"))
+
+	md, ok, _ := store.GetMedia(ctx, userID, groupID)
+	if !ok {
+		t.Fatal("expected media group to exist")
+	}
+
+	files := md.Files()
+	if len(files) != 2 || files[0].FileID != "id1" || files[1].FileID != "id2" {
+		t.Errorf("unexpected files: %+v", files)
+	}
+	if md.Elapsed(time.Minute) {
+		t.Error("last update should be recent")
+	}
+}
+
+func TestCleanMediaCache(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(99)
+	groupID := "g"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id"))
+	if ok, _ := store.CleanMediaCache(ctx, userID, groupID); !ok {
+		t.Error("expected CleanMediaCache to succeed")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, groupID); ok {
+		t.Error("expected media to be gone after CleanMediaCache")
+	}
+	if ok, _ := store.CleanMediaCache(ctx, userID, "nonexistent"); ok {
+		t.Error("expected false when cleaning nonexistent")
+	}
+}
+
+func TestCleanCacheKeepsState(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(100)
+
+	store.SetState(ctx, userID, "step")
+	store.Set(ctx, userID, "k", "v")
+	store.SetMedia(ctx, userID, "g", f("photo", "id"))
+	store.CleanCache(ctx, userID)
+
+	if _, ok, _ := store.Get(ctx, userID, "k"); ok {
+		t.Error("expected cache to be cleaned")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, "g"); ok {
+		t.Error("expected media to be cleaned")
+	}
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "step" {
+		t.Errorf("state must survive CleanCache, got (%q, %v)", st, ok)
+	}
+}
+
+func TestStates(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(7)
+
+	if _, ok, _ := store.GetState(ctx, userID); ok {
+		t.Fatal("expected no state for new user")
+	}
+
+	store.CreateState(ctx, userID, "default")
+	store.SetState(ctx, userID, "custom")
+	store.CreateState(ctx, userID, "default")
+
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "custom" {
+		t.Fatalf("CreateState must not overwrite existing state, got (%q, %v)", st, ok)
+	}
+}
+
+func TestCleanupDeletesExpiredUsers(t *testing.T) {
+	store, _ := newTestStorage(t, WithTTL(time.Minute), WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetState(ctx, 1, "s")
+	store.Set(ctx, 1, "k", "v")
+
+	if err := store.cleanup(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get(ctx, 1, "k"); !ok {
+		t.Fatal("user removed before TTL")
+	}
+
+	if err := store.cleanup(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.GetState(ctx, 1); ok {
+		t.Fatal("expected expired user to be removed")
+	}
+}
+
+func TestReadsAreSeenWithoutWriting(t *testing.T) {
+	clock := storagetest.NewClock()
+	store, path := newTestStorage(t, WithTTL(time.Hour), WithCleanupInterval(0), WithClock(clock.Now))
+	ctx := context.Background()
+
+	store.SetState(ctx, 1, "s")
+	store.Set(ctx, 1, "k", "v")
+	clock.Advance(40 * time.Minute)
+
+	pageWrites := func() int64 {
+		stats := store.db.Stats()
+		return stats.TxStats.GetWrite()
+	}
+	writes := pageWrites()
+	for range 3 {
+		store.Get(ctx, 1, "k")
+		store.GetState(ctx, 1)
+	}
+	if n := pageWrites() - writes; n != 0 {
+		t.Fatalf("reads must not write, got %d writes", n)
+	}
+	for s, err := range store.Sessions(ctx) {
+		if err != nil || !s.LastSeen.Equal(clock.Now()) {
+			t.Fatalf("expected the read as last seen, got %v (%v)", s.LastSeen, err)
+		}
+	}
+
+	clock.Advance(40 * time.Minute)
+	if err := store.cleanup(clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.GetState(ctx, 1); !ok {
+		t.Fatal("a user seen by reads must not be evicted")
+	}
+
+	// Close writes last-seen times recorded since the last cleanup.
+	clock.Advance(40 * time.Minute)
+	store.Close()
+	reopened, err := NewBoltStorage(path, WithTTL(time.Hour), WithCleanupInterval(0), WithClock(clock.Now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.cleanup(clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := reopened.GetState(ctx, 1); !ok {
+		t.Fatal("last-seen times of reads must survive Close")
+	}
+}
+
+func TestCleanupWorker(t *testing.T) {
+	store, _ := newTestStorage(t, WithTTL(20*time.Millisecond), WithCleanupInterval(10*time.Millisecond))
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok, _ := store.Get(ctx, 1, "k"); ok {
+		t.Fatal("expected worker to evict inactive user")
+	}
+}
+
+func TestPersistsAcrossReopen(t *testing.T) {
+	store, path := newTestStorage(t)
+	ctx := context.Background()
+
+	store.SetState(ctx, 1, "step")
+	store.Set(ctx, 1, "k", "v")
+	store.SetMedia(ctx, 1, "g", f("photo", "id"))
+	store.Close()
+	store.Close() // idempotent
+
+	// Close must release the file lock, otherwise reopening times out.
+	reopened, err := NewBoltStorage(path, WithLockTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+
+	if st, ok, _ := reopened.GetState(ctx, 1); !ok || st != "step" {
+		t.Errorf("state lost after reopen: (%q, %v)", st, ok)
+	}
+	if v, ok, _ := reopened.Get(ctx, 1, "k"); !ok || v.(string) != "v" {
+		t.Errorf("value lost after reopen: (%v, %v)", v, ok)
+	}
+	if md, ok, _ := reopened.GetMedia(ctx, 1, "g"); !ok || len(md.Files()) != 1 {
+		t.Error("media lost after reopen")
+	}
+}
+
+func TestLockedFile(t *testing.T) {
+	_, path := newTestStorage(t)
+
+	if _, err := NewBoltStorage(path, WithLockTimeout(50*time.Millisecond)); err == nil {
+		t.Fatal("expected error when the file is locked by another storage")
+	}
+}
+
+func TestConcurrencySafety(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Set(ctx, userID, "key", i)
+			store.SetMedia(ctx, userID, "grp", f("photo", string(rune('A'+i%26))))
+			_, _, _ = store.Get(ctx, userID, "key")
+		}(i)
+	}
+	wg.Wait()
+
+	md, ok, _ := store.GetMedia(ctx, userID, "grp")
+	if !ok || len(md.Files()) != 50 {
+		t.Fatalf("expected 50 files after concurrent appends, got %v", md)
+	}
+}
+
+type profile struct {
+	Name string
+	Age  int
+}
+
+func init() {
+	codec.Register(profile{})
+}
+
+func TestCodecPreservesType(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.Gob} {
+		store, _ := newTestStorage(t, WithCodec(c))
+		ctx := context.Background()
+
+		store.Set(ctx, 1, "profile", profile{Name: "Ann", Age: 30})
+		store.Set(ctx, 1, "age", 30)
+
+		if v, ok, _ := store.Get(ctx, 1, "profile"); !ok || v.(profile) != (profile{Name: "Ann", Age: 30}) {
+			t.Errorf("expected profile to round-trip, got (%#v, %v)", v, ok)
+		}
+		if v, ok, _ := store.Get(ctx, 1, "age"); !ok || v.(int) != 30 {
+			t.Errorf("expected int to round-trip, got (%#v, %v)", v, ok)
+		}
+
+		// values the codec cannot encode are rejected and not stored
+		if err := store.Set(ctx, 1, "ch", make(chan int)); !errors.Is(err, codec.ErrUnregisteredType) {
+			t.Errorf("expected ErrUnregisteredType, got %v", err)
+		}
+		if _, ok, _ := store.Get(ctx, 1, "ch"); ok {
+			t.Error("unencodable value must not be stored")
+		}
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.Set(ctx, 1, "k", "v"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Set: expected context.Canceled, got %v", err)
+	}
+	if _, _, err := store.GetMedia(ctx, 1, "g"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetMedia: expected context.Canceled, got %v", err)
+	}
+	if err := store.SetState(ctx, 1, "s"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SetState: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store, _ := newTestStorage(t, WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", 30*time.Millisecond)
+	store.SetWithTTL(ctx, 1, "plain", "x", 30*time.Millisecond)
+	store.Set(ctx, 1, "plain", "y") // Set drops the expiry
+
+	if v, ok, _ := store.Get(ctx, 1, "otp"); !ok || v != "1234" {
+		t.Fatalf("expected otp before expiry, got (%v, %v)", v, ok)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if _, ok, _ := store.Get(ctx, 1, "otp"); ok {
+		t.Fatal("expired value must not be returned")
+	}
+	if v, ok, _ := store.Get(ctx, 1, "plain"); !ok || v != "y" {
+		t.Fatalf("value overwritten by Set must not expire, got (%v, %v)", v, ok)
+	}
+}
+
+func TestCleanupDeletesExpiredValues(t *testing.T) {
+	store, _ := newTestStorage(t, WithTTL(0), WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", time.Minute)
+	store.Set(ctx, 1, "name", "Ann")
+
+	if err := store.cleanup(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.db.View(func(tx *bbolt.Tx) error {
+		ub := tx.Bucket(userKey(1))
+		if ub.Bucket(bucketData).Get([]byte("otp")) != nil {
+			t.Error("expired value must be deleted by cleanup")
+		}
+		if ub.Bucket(bucketData).Get([]byte("name")) == nil {
+			t.Error("plain value must stay")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+			store, _ := newTestStorage(t, WithTTL(time.Hour), WithCleanupInterval(0), WithClock(clock.Now))
+			clock.OnAdvance(func(time.Duration) {
+				if err := store.cleanup(clock.Now()); err != nil {
+					t.Errorf("cleanup: %v", err)
+				}
+			})
+			return store
+		},
+		TTL: time.Hour,
+	})
+}
@@ -0,0 +1,132 @@
+// Package codec converts cached values to bytes and back for storages that
+// cannot keep Go values in memory (Redis, SQL, bolt).
+//
+// Codecs preserve the dynamic type of a value: Decode returns the same Go type
+// that was passed to Encode, a *T as a *T. Basic types, their slices and common maps are
+// known out of the box; custom types must be registered with Register before
+// they are stored, much like gob.Register.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUnregisteredType is returned when a value's type was not registered.
+	ErrUnregisteredType = errors.New("codec: type is not registered")
+
+	// ErrNotEncodable is returned when a value cannot be represented by the codec
+	// (e.g. channels, functions or values failing their own marshalers).
+	ErrNotEncodable = errors.New("codec: value is not encodable")
+)
+
+// Codec encodes values stored via storage.Storage.Set.
+type Codec interface {
+	// Encode serialises v together with its type.
+	Encode(v any) ([]byte, error)
+	// Decode restores the value produced by Encode with its original type.
+	Decode(data []byte) (any, error)
+}
+
+// registry maps type names to types and back.
+type registry struct {
+	mu     sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}
+
+var types = &registry{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+func init() {
+	for _, v := range []any{
+		"", false, []byte(nil),
+		int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0),
+		[]string(nil), []int(nil), []int64(nil), []float64(nil), []bool(nil), []any(nil),
+		map[string]string(nil), map[string]int(nil), map[string]any(nil),
+		time.Time{}, time.Duration(0),
+	} {
+		Register(v)
+	}
+}
+
+// Register records the type of value under its default name so that codecs
+// can restore it. The default name is the package path and type name for
+// named types (e.g. "example.com/bot.Order") and the type literal otherwise
+// (e.g. "[]string"); pointer types are prefixed with "*".
+// Registering the same type twice is a no-op.
+func Register(value any) {
+	RegisterName(typeName(reflect.TypeOf(value)), value)
+}
+
+// RegisterName records the type of value under the given name. Use it to keep
+// stored data readable after a type is renamed or moved.
+// It panics if value is nil or if the name or type is already bound differently.
+func RegisterName(name string, value any) {
+	if value == nil {
+		panic("codec: cannot register nil value")
+	}
+	rt := reflect.TypeOf(value)
+
+	types.mu.Lock()
+	defer types.mu.Unlock()
+
+	if t, ok := types.byName[name]; ok && t != rt {
+		panic(fmt.Sprintf("codec: name %q already registered for %s", name, t))
+	}
+	if n, ok := types.byType[rt]; ok && n != name {
+		panic(fmt.Sprintf("codec: type %s already registered as %q", rt, n))
+	}
+
+	types.byName[name] = rt
+	types.byType[rt] = name
+	registerGob(name, value)
+}
+
+// nameOf returns the registered name of v's type.
+func nameOf(v any) (string, error) {
+	rt := reflect.TypeOf(v)
+
+	types.mu.RLock()
+	name, ok := types.byType[rt]
+	types.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnregisteredType, rt)
+	}
+	return name, nil
+}
+
+// typeOf returns the type registered under name.
+func typeOf(name string) (reflect.Type, error) {
+	types.mu.RLock()
+	rt, ok := types.byName[name]
+	types.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnregisteredType, name)
+	}
+	return rt, nil
+}
+
+// typeName builds the default registration name for rt.
+func typeName(rt reflect.Type) string {
+	if rt == nil {
+		return ""
+	}
+	if rt.Kind() == reflect.Pointer {
+		return "*" + typeName(rt.Elem())
+	}
+	if rt.Name() != "" && rt.PkgPath() != "" {
+		return rt.PkgPath() + "." + rt.Name()
+	}
+	return rt.String()
+}
@@ -0,0 +1,152 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type order struct {
+	ID    int64
+	Items []string
+}
+
+type unregistered struct{ A int }
+
+func init() {
+	Register(order{})
+	Register(&order{})
+}
+
+func TestRoundTripPreservesType(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	values := []any{
+		"text", true, 42, int64(-7), uint8(3), 3.5, float32(1.5),
+		[]byte("raw"), []string{"a", "b"}, map[string]any{"k": "v"},
+		now, 90 * time.Second,
+		order{ID: 1, Items: []string{"x"}},
+		&order{ID: 2},
+		nil,
+	}
+
+	for _, c := range []struct {
+		name  string
+		codec Codec
+	}{{"json", JSON}, {"gob", Gob}} {
+		for _, v := range values {
+			data, err := c.codec.Encode(v)
+			if err != nil {
+				t.Fatalf("%s: encode %T: %v", c.name, v, err)
+			}
+			got, err := c.codec.Decode(data)
+			if err != nil {
+				t.Fatalf("%s: decode %T: %v", c.name, v, err)
+			}
+			if reflect.TypeOf(got) != reflect.TypeOf(v) {
+				t.Errorf("%s: type changed: %T -> %T", c.name, v, got)
+				continue
+			}
+			if !reflect.DeepEqual(got, v) {
+				t.Errorf("%s: value changed: %#v -> %#v", c.name, v, got)
+			}
+		}
+	}
+}
+
+func TestNestedNumbers(t *testing.T) {
+	v := map[string]any{"n": 7}
+
+	for _, c := range []struct {
+		name  string
+		codec Codec
+		want  any
+	}{{"json", JSON, float64(7)}, {"gob", Gob, 7}} {
+		data, err := c.codec.Encode(v)
+		if err != nil {
+			t.Fatalf("%s: encode: %v", c.name, err)
+		}
+		got, err := c.codec.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", c.name, err)
+		}
+		if n := got.(map[string]any)["n"]; n != c.want {
+			t.Errorf("%s: nested number = %#v, want %#v", c.name, n, c.want)
+		}
+	}
+}
+
+func TestGob_LegacyPointerPayload(t *testing.T) {
+	// Pointers used to be encoded bare, and so were flattened by gob.
+	var v any = &order{ID: 3}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Gob.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := got.(order); !ok || o.ID != 3 {
+		t.Fatalf("expected order{ID: 3}, got %#v", got)
+	}
+}
+
+func TestGob_NilPointer(t *testing.T) {
+	if _, err := Gob.Encode((*order)(nil)); !errors.Is(err, ErrNotEncodable) {
+		t.Fatalf("expected ErrNotEncodable, got %v", err)
+	}
+}
+
+func TestUnregisteredType(t *testing.T) {
+	for _, c := range []Codec{JSON, Gob} {
+		_, err := c.Encode(unregistered{A: 1})
+		if !errors.Is(err, ErrUnregisteredType) {
+			t.Fatalf("expected ErrUnregisteredType, got %v", err)
+		}
+	}
+}
+
+func TestNotEncodable(t *testing.T) {
+	type withChan struct{ C chan int }
+	Register(withChan{})
+
+	for _, c := range []Codec{JSON, Gob} {
+		_, err := c.Encode(withChan{C: make(chan int)})
+		if !errors.Is(err, ErrNotEncodable) {
+			t.Fatalf("expected ErrNotEncodable, got %v", err)
+		}
+	}
+}
+
+func TestRegisterName(t *testing.T) {
+	type renamed struct{ N int }
+	RegisterName("legacy.Renamed", renamed{})
+
+	data, err := JSON.Encode(renamed{N: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"type":"legacy.Renamed","value":{"N":5}}`; string(data) != want {
+		t.Fatalf("unexpected envelope %s, want %s", data, want)
+	}
+
+	// re-registering the same pair is allowed, a conflicting one panics
+	RegisterName("legacy.Renamed", renamed{})
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for conflicting registration")
+		}
+	}()
+	RegisterName("legacy.Renamed", order{})
+}
+
+func TestDecodeUnknownName(t *testing.T) {
+	_, err := JSON.Decode([]byte(`{"type":"nope.Type","value":1}`))
+	if !errors.Is(err, ErrUnregisteredType) {
+		t.Fatalf("expected ErrUnregisteredType, got %v", err)
+	}
+}
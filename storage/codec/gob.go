@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+// Gob is a Codec based on encoding/gob. It is more compact than JSON, but the
+// payload is binary. Unexported struct fields are not stored.
+var Gob Codec = gobCodec{}
+
+type gobCodec struct{}
+
+// gobPointer wraps the value a pointer points to, since gob flattens
+// pointers: values are encoded bare, pointers as gobPointer, so data
+// written before pointers were wrapped still decodes (a *T as T).
+type gobPointer struct {
+	V any
+}
+
+// registerGob makes the type known to encoding/gob under name,
+// unless gob already knows it (basic types are pre-registered there).
+func registerGob(name string, value any) {
+	defer func() {
+		// gob panics on conflicting registrations of its built-in types;
+		// those are already encodable, so the conflict is harmless.
+		_ = recover()
+	}()
+	gob.RegisterName(name, value)
+}
+
+// Encode implements Codec.
+func (gobCodec) Encode(v any) ([]byte, error) {
+	if v != nil {
+		if _, err := nameOf(v); err != nil {
+			return nil, err
+		}
+	}
+
+	var out any = &v
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("%w: nil %T", ErrNotEncodable, v)
+		}
+		out = gobPointer{V: rv.Elem().Interface()}
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(out); err != nil {
+		return nil, fmt.Errorf("%w: %T: %v", ErrNotEncodable, v, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode implements Codec.
+func (gobCodec) Decode(data []byte) (any, error) {
+	var v any
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	if err == nil {
+		return v, nil
+	}
+
+	var p gobPointer
+	if gob.NewDecoder(bytes.NewReader(data)).Decode(&p) != nil || p.V == nil {
+		return nil, fmt.Errorf("codec: gob decode: %w", err)
+	}
+	rv := reflect.ValueOf(p.V)
+	if rv.Kind() == reflect.Pointer {
+		return p.V, nil // registered as a pointer, which gob restores itself
+	}
+	ptr := reflect.New(rv.Type())
+	ptr.Elem().Set(rv)
+	return ptr.Interface(), nil
+}
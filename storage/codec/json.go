@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// JSON is a Codec that stores values as a JSON envelope with the registered
+// type name, e.g. {"type":"string","value":"hello"}. The payload stays
+// human-readable in the database.
+//
+// The registered type itself round-trips, but values without a concrete Go
+// type do not: numbers inside map[string]any, []any or struct fields typed
+// any come back as float64, as with encoding/json. Use Gob when such values
+// must keep their dynamic types.
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+type jsonEnvelope struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Encode implements Codec.
+func (jsonCodec) Encode(v any) ([]byte, error) {
+	if v == nil {
+		return json.Marshal(jsonEnvelope{})
+	}
+
+	name, err := nameOf(v)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %T: %v", ErrNotEncodable, v, err)
+	}
+
+	return json.Marshal(jsonEnvelope{Type: name, Value: raw})
+}
+
+// Decode implements Codec.
+func (jsonCodec) Decode(data []byte) (any, error) {
+	var env jsonEnvelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("codec: malformed JSON envelope: %w", err)
+	}
+	if env.Type == "" {
+		return nil, nil
+	}
+
+	rt, err := typeOf(env.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	ptr := reflect.New(rt)
+	if err := json.Unmarshal(env.Value, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("codec: decode %s: %w", env.Type, err)
+	}
+	return ptr.Elem().Interface(), nil
+}
@@ -2,17 +2,124 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
+	"iter"
+	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
 )
 
 // Storage defines the behaviour for caching user data and media.
+//
+// Every method reports backend failures through its error result and must
+// return ctx.Err() when the context is cancelled or its deadline is exceeded.
+// A missing key or media group is not an error: it is signalled by the
+// boolean result.
+//
+// SetWithTTL stores a value that expires after ttl regardless of the user's
+// activity; a non-positive ttl behaves like Set. A later Set of the same key
+// drops the expiry.
 type Storage interface {
-	Set(ctx context.Context, userID int64, key string, value any)
-	Get(ctx context.Context, userID int64, key string) (any, bool)
-	SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File)
-	GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool)
-	CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) bool
-	CleanCache(ctx context.Context, userID int64)
-	Close()
+	Set(ctx context.Context, userID int64, key string, value any) error
+	SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error
+	Get(ctx context.Context, userID int64, key string) (any, bool, error)
+	SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error
+	GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error)
+	CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error)
+	CleanCache(ctx context.Context, userID int64) error
+	Close() error
+}
+
+// StateStorage is an optional extension of Storage for backends that can
+// persist FSM states. When the configured storage implements it, the FSM
+// keeps user states in the storage instead of process memory, so several
+// bot replicas can share them.
+type StateStorage interface {
+	// CreateState stores state for the user only if no state exists yet.
+	CreateState(ctx context.Context, userID int64, state string) error
+	// SetState stores state for the user, overwriting any previous value.
+	SetState(ctx context.Context, userID int64, state string) error
+	// GetState returns the user's state and refreshes its last-use time.
+	GetState(ctx context.Context, userID int64) (string, bool, error)
+}
+
+// ErrClaimUnsupported is returned by SetIfAbsent of a storage that cannot
+// set values atomically, e.g. because it wraps one that cannot.
+var ErrClaimUnsupported = errors.New("fsm/storage: storage cannot set values atomically")
+
+// Claimer is an optional extension of Storage for backends that can store
+// a value only if its key holds none, atomically with respect to every
+// client of the storage, so concurrent callers agree on a single winner.
+type Claimer interface {
+	// SetIfAbsent stores value like SetWithTTL unless key holds an
+	// unexpired value, and reports whether it stored it.
+	SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error)
+	// Delete removes the value of key, e.g. to give up a claim. A missing
+	// key is not an error.
+	Delete(ctx context.Context, userID int64, key string) error
+}
+
+// ErrPeekUnsupported is returned by PeekState of a storage that cannot
+// read states without touching them, e.g. because it wraps one that cannot.
+var ErrPeekUnsupported = errors.New("fsm/storage: storage cannot peek states")
+
+// StatePeeker is an optional extension of StateStorage for backends that
+// can read a state without counting it as an access, for operator tools
+// built on FSM.UserState.
+type StatePeeker interface {
+	PeekState(ctx context.Context, userID int64) (string, bool, error)
+}
+
+// ErrSessionsUnsupported is yielded when listing sessions of a storage that
+// cannot enumerate its users.
+var ErrSessionsUnsupported = errors.New("fsm/storage: storage cannot list sessions")
+
+// Session is the stored FSM state of one user.
+type Session struct {
+	UserID   int64
+	State    string
+	LastSeen time.Time // zero if the backend does not track it
+}
+
+// SessionLister is an optional extension of StateStorage for backends that
+// can enumerate stored states, for operator tools built on FSM.Sessions.
+// Listing does not count as an access. Iteration stops after the first
+// error, which is yielded with a zero Session. Users written while the
+// iteration runs may or may not be seen.
+type SessionLister interface {
+	Sessions(ctx context.Context) iter.Seq2[Session, error]
+}
+
+// UserData is everything a storage caches for one user.
+type UserData struct {
+	Values map[string]any
+	Media  map[string]*media.MediaData
+}
+
+// ErrInspectUnsupported is returned when inspecting a user of a storage
+// that cannot list cached data.
+var ErrInspectUnsupported = errors.New("fsm/storage: storage cannot list user data")
+
+// Inspector is an optional extension of Storage for backends that can list
+// a user's cached values and media groups, for debugging tools. Inspect
+// skips expired values, does not count as an access and returns empty maps
+// for an unknown user.
+type Inspector interface {
+	Inspect(ctx context.Context, userID int64) (UserData, error)
+}
+
+// ErrSnapshotIncomplete is wrapped by the error of a Snapshot that skipped
+// values it could not encode. Such a snapshot is still written in full
+// otherwise, and the error lists the skipped values.
+var ErrSnapshotIncomplete = errors.New("fsm/storage: snapshot skipped values")
+
+// Snapshotter is implemented by in-process storages that can serialise their
+// whole content, so it survives a restart. Restore merges the snapshot into
+// the storage, replacing users present in both. A value that cannot be
+// serialised is left out of the snapshot and reported with
+// ErrSnapshotIncomplete rather than failing it.
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
 }
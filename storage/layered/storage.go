@@ -0,0 +1,542 @@
+package layered
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
+)
+
+// stateKey is the L1 key holding the cached FSM state. It cannot collide
+// with user keys, which never contain NUL bytes in practice.
+const stateKey = "\x00state"
+
+// touchKey is the L1 key marking that an L1 hit was recently forwarded to
+// L2 to keep the user's data there alive.
+const touchKey = "\x00touched"
+
+// ErrClosed is returned by writes issued after Close in write-behind mode.
+var ErrClosed = errors.New("fsm/layered: storage closed")
+
+// LayeredStorage puts a local memory.MemoryStorage (L1) in front of another
+// storage (L2), typically Redis or SQL, so repeated reads of values and
+// states do not leave the process.
+//
+// Values and states read from L2 are kept in L1 for at most the configured
+// staleness, after which they are read from L2 again. Writes go to L2 and
+// update L1: synchronously in the default write-through mode, or from a
+// background queue in write-behind mode (see WithWriteBehind). Media groups
+// are not cached and always go to L2.
+//
+// Several replicas sharing one L2 can keep their L1 copies coherent by
+// publishing the IDs passed to the WithInvalidator hook and calling
+// Invalidate with the IDs received from other replicas.
+//
+// If L2 implements storage.StateStorage, states are cached like values;
+// otherwise they are kept in L1 only.
+//
+// Reads served from L1 do not reach L2, so they do not refresh the user's
+// expiry there. When entries may be served from L1 for longer than the
+// touch interval (see WithTouchInterval), an L1 hit is therefore forwarded
+// to L2 as a read at most once per interval per user.
+type LayeredStorage struct {
+	l1     *memory.MemoryStorage
+	l2     storage.Storage
+	states storage.StateStorage // L2 states; nil if L2 cannot keep them
+
+	l1TTL      time.Duration
+	l1Interval time.Duration
+	l1Opts     []memory.Option
+
+	staleness  time.Duration
+	touchEvery time.Duration
+	invalidate func(userID int64)
+
+	queue   chan op // write-behind queue; nil in write-through mode
+	onError func(error)
+	done    chan struct{}
+
+	mu     sync.RWMutex // guards closed against sends on queue
+	closed bool
+}
+
+// op is a write queued for L2 in write-behind mode.
+type op struct {
+	userID int64
+	apply  func(ctx context.Context) error
+	flush  chan struct{} // set for Flush barriers instead of apply
+}
+
+// Option configures a LayeredStorage.
+type Option func(*LayeredStorage)
+
+// WithMaxStaleness bounds how long an entry read from or written to L2 is
+// served from L1 (5s by default). A non-positive value keeps entries until
+// they are invalidated or evicted from L1.
+func WithMaxStaleness(d time.Duration) Option {
+	return func(l *LayeredStorage) {
+		l.staleness = d
+	}
+}
+
+// WithTouchInterval sets how often reads served from L1 refresh the
+// user's expiry in L2 (1m by default) when WithMaxStaleness lets entries
+// stay in L1 for longer, so that active users are not expired from L2.
+// Keep it well below L2's TTL. A non-positive value disables the refresh.
+func WithTouchInterval(d time.Duration) Option {
+	return func(l *LayeredStorage) {
+		l.touchEvery = d
+	}
+}
+
+// WithL1 configures the local memory storage: users idle for longer than
+// ttl are evicted from L1 (not from L2) every interval. Memory options such
+// as memory.WithMaxUsers bound its size.
+func WithL1(ttl, interval time.Duration, opts ...memory.Option) Option {
+	return func(l *LayeredStorage) {
+		l.l1TTL = ttl
+		l.l1Interval = interval
+		l.l1Opts = opts
+	}
+}
+
+// WithWriteBehind makes writes return as soon as L1 is updated; they are
+// applied to L2 in order by a background worker with a queue of the given
+// size. Writes block while the queue is full. Errors of queued writes are
+// passed to the WithErrorHandler handler.
+//
+// A read that misses L1 may observe L2 before queued writes for the user
+// have landed; call Flush where this matters.
+func WithWriteBehind(queueSize int) Option {
+	return func(l *LayeredStorage) {
+		l.queue = make(chan op, max(queueSize, 1))
+	}
+}
+
+// WithErrorHandler sets the handler for errors of writes applied in the
+// background in write-behind mode.
+func WithErrorHandler(h func(error)) Option {
+	return func(l *LayeredStorage) {
+		l.onError = h
+	}
+}
+
+// WithInvalidator sets a hook called with the user ID after every write
+// reaches L2. Publish the ID to other replicas (e.g. over Redis pub/sub)
+// and call Invalidate there, so they drop their L1 copies.
+func WithInvalidator(fn func(userID int64)) Option {
+	return func(l *LayeredStorage) {
+		l.invalidate = fn
+	}
+}
+
+// NewLayeredStorage creates a LayeredStorage in front of l2. The layered
+// storage takes ownership of l2: Close closes it.
+func NewLayeredStorage(l2 storage.Storage, opts ...Option) *LayeredStorage {
+	l := &LayeredStorage{
+		l2:         l2,
+		l1TTL:      30 * time.Minute,
+		l1Interval: 30 * time.Second,
+		staleness:  5 * time.Second,
+		touchEvery: time.Minute,
+	}
+
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	l.l1 = memory.NewMemoryStorage(l.l1TTL, l.l1Interval, l.l1Opts...)
+	if ss, ok := l2.(storage.StateStorage); ok {
+		l.states = ss
+	}
+
+	if l.queue != nil {
+		l.done = make(chan struct{})
+		go l.writeWorker()
+	}
+
+	return l
+}
+
+// Close applies queued writes, then closes L1 and L2.
+func (l *LayeredStorage) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	if l.queue != nil {
+		close(l.queue)
+	}
+	l.mu.Unlock()
+
+	if l.done != nil {
+		<-l.done
+	}
+	return errors.Join(l.l1.Close(), l.l2.Close())
+}
+
+// Invalidate drops the user's entries from L1, so the next reads go to L2.
+// A state kept only in L1 (L2 without storage.StateStorage) is preserved.
+func (l *LayeredStorage) Invalidate(userID int64) {
+	_ = l.cleanL1(context.Background(), userID, l.states == nil)
+}
+
+// cleanL1 drops the user's entries from L1, keeping the state if asked to.
+func (l *LayeredStorage) cleanL1(ctx context.Context, userID int64, keepState bool) error {
+	var (
+		st  any
+		ok  bool
+		err error
+	)
+	if keepState {
+		if st, ok, err = l.l1.Get(ctx, userID, stateKey); err != nil {
+			return err
+		}
+	}
+	if err := l.l1.CleanCache(ctx, userID); err != nil {
+		return err
+	}
+	if ok {
+		return l.cacheState(ctx, userID, st.(string))
+	}
+	return nil
+}
+
+// Flush waits until all writes queued before the call have been applied to
+// L2. It returns immediately in write-through mode.
+func (l *LayeredStorage) Flush(ctx context.Context) error {
+	if l.queue == nil {
+		return ctx.Err()
+	}
+	barrier := make(chan struct{})
+	if err := l.enqueue(ctx, op{flush: barrier}); err != nil {
+		return err
+	}
+	select {
+	case <-barrier:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeWorker applies queued writes to L2 in order until the queue is closed.
+func (l *LayeredStorage) writeWorker() {
+	defer close(l.done)
+	for o := range l.queue {
+		if o.flush != nil {
+			close(o.flush)
+			continue
+		}
+		if err := o.apply(context.Background()); err != nil {
+			// L1 is ahead of L2 now: let the next read go to L2.
+			l.Invalidate(o.userID)
+			if l.onError != nil {
+				l.onError(err)
+			}
+			continue
+		}
+		l.published(o.userID)
+	}
+}
+
+func (l *LayeredStorage) enqueue(ctx context.Context, o op) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrClosed
+	}
+	select {
+	case l.queue <- o:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// write applies fn to L2 and then updates L1 with cache. In write-behind
+// mode L1 is updated first and fn is queued.
+func (l *LayeredStorage) write(ctx context.Context, userID int64, fn func(ctx context.Context) error, cache func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if l.queue != nil {
+		if err := cache(ctx); err != nil {
+			return err
+		}
+		return l.enqueue(ctx, op{userID: userID, apply: fn})
+	}
+
+	if err := fn(ctx); err != nil {
+		l.Invalidate(userID)
+		return err
+	}
+	l.published(userID)
+	return cache(ctx)
+}
+
+// published reports a write that reached L2.
+func (l *LayeredStorage) published(userID int64) {
+	if l.invalidate != nil {
+		l.invalidate(userID)
+	}
+}
+
+// cache stores value in L1 for at most the staleness bound and ttl.
+func (l *LayeredStorage) cache(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	if l.staleness > 0 && (ttl <= 0 || l.staleness < ttl) {
+		ttl = l.staleness
+	}
+	return l.l1.SetWithTTL(ctx, userID, key, value, ttl)
+}
+
+// touch forwards an L1 hit of the user to L2 with read, unless entries go
+// stale before the touch interval anyway or L2 was touched within it.
+func (l *LayeredStorage) touch(ctx context.Context, userID int64, read func(ctx context.Context) error) error {
+	if l.touchEvery <= 0 || (l.staleness > 0 && l.staleness <= l.touchEvery) {
+		return nil
+	}
+	due, err := l.l1.SetIfAbsent(ctx, userID, touchKey, true, l.touchEvery)
+	if err != nil || !due {
+		return err
+	}
+	return read(ctx)
+}
+
+// Set stores a key/value pair in L2 and L1.
+func (l *LayeredStorage) Set(ctx context.Context, userID int64, key string, value any) error {
+	return l.write(ctx, userID,
+		func(ctx context.Context) error { return l.l2.Set(ctx, userID, key, value) },
+		func(ctx context.Context) error { return l.cache(ctx, userID, key, value, 0) },
+	)
+}
+
+// SetWithTTL stores a key/value pair with its own expiry in L2 and L1.
+// The L1 copy never outlives ttl.
+func (l *LayeredStorage) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	return l.write(ctx, userID,
+		func(ctx context.Context) error { return l.l2.SetWithTTL(ctx, userID, key, value, ttl) },
+		func(ctx context.Context) error { return l.cache(ctx, userID, key, value, ttl) },
+	)
+}
+
+// Get returns the value from L1 or, on a miss, from L2, caching it in L1.
+func (l *LayeredStorage) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	if v, ok, err := l.l1.Get(ctx, userID, key); err != nil || ok {
+		if err == nil {
+			err = l.touch(ctx, userID, func(ctx context.Context) error {
+				_, _, err := l.l2.Get(ctx, userID, key)
+				return err
+			})
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return v, true, nil
+	}
+
+	v, ok, err := l.l2.Get(ctx, userID, key)
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	if err := l.cache(ctx, userID, key, v, 0); err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// SetIfAbsent stores a key/value pair in L2 like SetWithTTL unless the key
+// holds an unexpired value there, and caches it in L1 if it was stored.
+// Queued writes are flushed first, since only L2 can decide atomically. If
+// L2 does not implement storage.Claimer, storage.ErrClaimUnsupported is
+// returned.
+func (l *LayeredStorage) SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	claimer, ok := l.l2.(storage.Claimer)
+	if !ok {
+		return false, storage.ErrClaimUnsupported
+	}
+	if err := l.Flush(ctx); err != nil {
+		return false, err
+	}
+	stored, err := claimer.SetIfAbsent(ctx, userID, key, value, ttl)
+	if err != nil || !stored {
+		return false, err
+	}
+	l.published(userID)
+	return true, l.cache(ctx, userID, key, value, ttl)
+}
+
+// Delete removes the value of key in L2 and L1. If L2 does not implement
+// storage.Claimer, storage.ErrClaimUnsupported is returned.
+func (l *LayeredStorage) Delete(ctx context.Context, userID int64, key string) error {
+	claimer, ok := l.l2.(storage.Claimer)
+	if !ok {
+		return storage.ErrClaimUnsupported
+	}
+	return l.write(ctx, userID,
+		func(ctx context.Context) error { return claimer.Delete(ctx, userID, key) },
+		func(ctx context.Context) error { return l.l1.Delete(ctx, userID, key) },
+	)
+}
+
+// SetMedia appends a media.File in L2.
+func (l *LayeredStorage) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	return l.l2.SetMedia(ctx, userID, mediaGroupID, file)
+}
+
+// GetMedia retrieves MediaData from L2.
+func (l *LayeredStorage) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	return l.l2.GetMedia(ctx, userID, mediaGroupID)
+}
+
+// CleanMediaCache removes MediaData in L2.
+func (l *LayeredStorage) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	return l.l2.CleanMediaCache(ctx, userID, mediaGroupID)
+}
+
+// CleanCache removes the user's values and media in L2 and L1.
+// A state cached in L1 is kept.
+func (l *LayeredStorage) CleanCache(ctx context.Context, userID int64) error {
+	return l.write(ctx, userID,
+		func(ctx context.Context) error { return l.l2.CleanCache(ctx, userID) },
+		func(ctx context.Context) error { return l.cleanL1(ctx, userID, true) },
+	)
+}
+
+// cacheState stores the state in L1. States that only live in L1 never
+// go stale.
+func (l *LayeredStorage) cacheState(ctx context.Context, userID int64, state string) error {
+	if l.states == nil {
+		return l.l1.Set(ctx, userID, stateKey, state)
+	}
+	return l.cache(ctx, userID, stateKey, state, 0)
+}
+
+// touchState forwards an L1 hit of the user's state to L2.
+func (l *LayeredStorage) touchState(ctx context.Context, userID int64) error {
+	if l.states == nil {
+		return nil
+	}
+	return l.touch(ctx, userID, func(ctx context.Context) error {
+		_, _, err := l.states.GetState(ctx, userID)
+		return err
+	})
+}
+
+// CreateState stores state for the user only if no state exists yet.
+// A state cached in L1 counts as existing, so repeated calls within the
+// staleness bound do not reach L2.
+func (l *LayeredStorage) CreateState(ctx context.Context, userID int64, state string) error {
+	if _, ok, err := l.l1.Get(ctx, userID, stateKey); err != nil || ok {
+		if err == nil {
+			err = l.touchState(ctx, userID)
+		}
+		return err
+	}
+	if l.states == nil {
+		return l.cacheState(ctx, userID, state)
+	}
+
+	if err := l.states.CreateState(ctx, userID, state); err != nil {
+		return err
+	}
+	l.published(userID)
+	return nil
+}
+
+// SetState stores state for the user in L2 and L1.
+func (l *LayeredStorage) SetState(ctx context.Context, userID int64, state string) error {
+	if l.states == nil {
+		return l.cacheState(ctx, userID, state)
+	}
+	return l.write(ctx, userID,
+		func(ctx context.Context) error { return l.states.SetState(ctx, userID, state) },
+		func(ctx context.Context) error { return l.cacheState(ctx, userID, state) },
+	)
+}
+
+// GetState returns the user's state from L1 or, on a miss, from L2.
+func (l *LayeredStorage) GetState(ctx context.Context, userID int64) (string, bool, error) {
+	v, ok, err := l.l1.Get(ctx, userID, stateKey)
+	if err != nil {
+		return "", false, err
+	}
+	if ok {
+		if err := l.touchState(ctx, userID); err != nil {
+			return "", false, err
+		}
+		return v.(string), true, nil
+	}
+	if l.states == nil {
+		return "", false, nil
+	}
+
+	st, ok, err := l.states.GetState(ctx, userID)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	if err := l.cacheState(ctx, userID, st); err != nil {
+		return "", false, err
+	}
+	return st, true, nil
+}
+
+// PeekState returns the user's state from L2 without touching it, after
+// flushing queued writes in write-behind mode. States kept in L1 only
+// cannot be peeked: if L2 does not implement storage.StatePeeker,
+// storage.ErrPeekUnsupported is returned.
+func (l *LayeredStorage) PeekState(ctx context.Context, userID int64) (string, bool, error) {
+	peeker, ok := l.l2.(storage.StatePeeker)
+	if !ok || l.states == nil {
+		return "", false, storage.ErrPeekUnsupported
+	}
+	if err := l.Flush(ctx); err != nil {
+		return "", false, err
+	}
+	return peeker.PeekState(ctx, userID)
+}
+
+// Sessions lists the states stored in L2, after flushing queued writes in
+// write-behind mode. States kept in L1 only cannot be listed: if L2 does
+// not implement storage.SessionLister, storage.ErrSessionsUnsupported is
+// yielded.
+func (l *LayeredStorage) Sessions(ctx context.Context) iter.Seq2[storage.Session, error] {
+	return func(yield func(storage.Session, error) bool) {
+		lister, ok := l.l2.(storage.SessionLister)
+		if !ok || l.states == nil {
+			yield(storage.Session{}, storage.ErrSessionsUnsupported)
+			return
+		}
+		if err := l.Flush(ctx); err != nil {
+			yield(storage.Session{}, err)
+			return
+		}
+		for sess, err := range lister.Sessions(ctx) {
+			if !yield(sess, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Inspect returns the user's data as stored in L2, after flushing queued
+// writes in write-behind mode. If L2 does not implement storage.Inspector,
+// storage.ErrInspectUnsupported is returned.
+func (l *LayeredStorage) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	in, ok := l.l2.(storage.Inspector)
+	if !ok {
+		return storage.UserData{}, storage.ErrInspectUnsupported
+	}
+	if err := l.Flush(ctx); err != nil {
+		return storage.UserData{}, err
+	}
+	return in.Inspect(ctx, userID)
+}
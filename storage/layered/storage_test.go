@@ -0,0 +1,368 @@
+package layered
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/memory"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+// remote is an L2 stand-in: a memory storage with states, call counters,
+// injectable failures and an optional gate that holds writes.
+type remote struct {
+	*memory.MemoryStorage
+
+	mu     sync.Mutex
+	states map[int64]string
+
+	gets, stateGets atomic.Int64
+	fail            atomic.Bool
+	gate            chan struct{} // when set, writes wait for it
+}
+
+func newRemote() *remote {
+	return &remote{
+		MemoryStorage: memory.NewMemoryStorage(time.Hour, time.Hour),
+		states:        make(map[int64]string),
+	}
+}
+
+var errRemote = errors.New("remote down")
+
+func (r *remote) wait() error {
+	if r.gate != nil {
+		<-r.gate
+	}
+	if r.fail.Load() {
+		return errRemote
+	}
+	return nil
+}
+
+func (r *remote) Set(ctx context.Context, userID int64, key string, value any) error {
+	if err := r.wait(); err != nil {
+		return err
+	}
+	return r.MemoryStorage.Set(ctx, userID, key, value)
+}
+
+func (r *remote) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	r.gets.Add(1)
+	if r.fail.Load() {
+		return nil, false, errRemote
+	}
+	return r.MemoryStorage.Get(ctx, userID, key)
+}
+
+func (r *remote) CreateState(_ context.Context, userID int64, state string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.states[userID]; !ok {
+		r.states[userID] = state
+	}
+	return nil
+}
+
+func (r *remote) SetState(_ context.Context, userID int64, state string) error {
+	if err := r.wait(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.states[userID] = state
+	return nil
+}
+
+func (r *remote) GetState(_ context.Context, userID int64) (string, bool, error) {
+	r.stateGets.Add(1)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st, ok := r.states[userID]
+	return st, ok, nil
+}
+
+func (r *remote) Sessions(context.Context) iter.Seq2[storage.Session, error] {
+	return func(yield func(storage.Session, error) bool) {
+		r.mu.Lock()
+		var out []storage.Session
+		for uid, st := range r.states {
+			out = append(out, storage.Session{UserID: uid, State: st})
+		}
+		r.mu.Unlock()
+		for _, s := range out {
+			if !yield(s, nil) {
+				return
+			}
+		}
+	}
+}
+
+func newTestStorage(t *testing.T, opts ...Option) (*LayeredStorage, *remote) {
+	t.Helper()
+	l2 := newRemote()
+	l := NewLayeredStorage(l2, opts...)
+	t.Cleanup(func() { l.Close() })
+	return l, l2
+}
+
+func TestGet_ServedFromL1(t *testing.T) {
+	l, l2 := newTestStorage(t)
+	ctx := context.Background()
+
+	l2.MemoryStorage.Set(ctx, 1, "k", "v")
+	for range 3 {
+		if v, ok, err := l.Get(ctx, 1, "k"); err != nil || !ok || v != "v" {
+			t.Fatalf("unexpected Get result (%v, %v, %v)", v, ok, err)
+		}
+	}
+	if n := l2.gets.Load(); n != 1 {
+		t.Fatalf("expected a single L2 read, got %d", n)
+	}
+}
+
+func TestGet_BoundedStaleness(t *testing.T) {
+	l, l2 := newTestStorage(t, WithMaxStaleness(20*time.Millisecond))
+	ctx := context.Background()
+
+	l.Set(ctx, 1, "k", "old")
+	l2.MemoryStorage.Set(ctx, 1, "k", "new") // another replica writes
+
+	if v, _, _ := l.Get(ctx, 1, "k"); v != "old" {
+		t.Fatalf("expected cached value, got %v", v)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if v, _, _ := l.Get(ctx, 1, "k"); v != "new" {
+		t.Fatalf("stale value served past the bound: %v", v)
+	}
+}
+
+func TestGet_TouchesL2(t *testing.T) {
+	l, l2 := newTestStorage(t, WithMaxStaleness(0), WithTouchInterval(20*time.Millisecond))
+	ctx := context.Background()
+
+	l.Set(ctx, 1, "k", "v")
+	l.CreateState(ctx, 1, "start")
+	for range 3 {
+		if v, ok, err := l.Get(ctx, 1, "k"); err != nil || !ok || v != "v" {
+			t.Fatalf("unexpected Get result (%v, %v, %v)", v, ok, err)
+		}
+	}
+	if n := l2.gets.Load(); n != 1 {
+		t.Fatalf("expected one L2 read per touch interval, got %d", n)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	l.GetState(ctx, 1) // miss, cached
+	l.GetState(ctx, 1) // hit, touches L2
+	l.Get(ctx, 1, "k")
+	if n, m := l2.gets.Load(), l2.stateGets.Load(); n != 1 || m != 2 {
+		t.Fatalf("expected one touch for the interval, got %d value and %d state reads", n, m)
+	}
+
+	l2.fail.Store(true)
+	time.Sleep(30 * time.Millisecond)
+	if _, _, err := l.Get(ctx, 1, "k"); !errors.Is(err, errRemote) {
+		t.Fatalf("expected the touch error, got %v", err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	var published []int64
+	l, l2 := newTestStorage(t, WithInvalidator(func(userID int64) { published = append(published, userID) }))
+	ctx := context.Background()
+
+	l.Set(ctx, 7, "k", "old")
+	if len(published) != 1 || published[0] != 7 {
+		t.Fatalf("expected the write to be published, got %v", published)
+	}
+
+	l2.MemoryStorage.Set(ctx, 7, "k", "new")
+	l.Invalidate(7)
+	if v, _, _ := l.Get(ctx, 7, "k"); v != "new" {
+		t.Fatalf("expected fresh value after Invalidate, got %v", v)
+	}
+}
+
+func TestWriteThrough_Error(t *testing.T) {
+	l, l2 := newTestStorage(t)
+	ctx := context.Background()
+
+	l.Set(ctx, 1, "k", "v1")
+	l2.fail.Store(true)
+	if err := l.Set(ctx, 1, "k", "v2"); !errors.Is(err, errRemote) {
+		t.Fatalf("expected L2 error, got %v", err)
+	}
+	l2.fail.Store(false)
+
+	if v, _, _ := l.Get(ctx, 1, "k"); v != "v1" {
+		t.Fatalf("failed write must not be visible, got %v", v)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	l, l2 := newTestStorage(t, WithWriteBehind(16))
+	ctx := context.Background()
+	l2.gate = make(chan struct{})
+
+	if err := l.Set(ctx, 1, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := l.Get(ctx, 1, "k"); !ok || v != "v" {
+		t.Fatalf("write must be visible locally at once, got (%v, %v)", v, ok)
+	}
+	if _, ok, _ := l2.MemoryStorage.Get(ctx, 1, "k"); ok {
+		t.Fatal("write must not have reached L2 yet")
+	}
+
+	close(l2.gate)
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, _ := l2.MemoryStorage.Get(ctx, 1, "k"); !ok || v != "v" {
+		t.Fatalf("write must reach L2 after Flush, got (%v, %v)", v, ok)
+	}
+}
+
+func TestWriteBehind_ErrorHandler(t *testing.T) {
+	errs := make(chan error, 1)
+	l, l2 := newTestStorage(t, WithWriteBehind(16), WithErrorHandler(func(err error) { errs <- err }))
+	ctx := context.Background()
+
+	l2.fail.Store(true)
+	l.Set(ctx, 1, "k", "v")
+	if err := <-errs; !errors.Is(err, errRemote) {
+		t.Fatalf("expected L2 error, got %v", err)
+	}
+	l2.fail.Store(false)
+
+	if _, ok, _ := l.Get(ctx, 1, "k"); ok {
+		t.Fatal("value that failed to reach L2 must be dropped from L1")
+	}
+}
+
+func TestWriteBehind_CloseFlushes(t *testing.T) {
+	l2 := newRemote()
+	l := NewLayeredStorage(l2, WithWriteBehind(16))
+	ctx := context.Background()
+
+	for i := range 10 {
+		l.Set(ctx, int64(i), "k", i)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		if _, ok, _ := l2.MemoryStorage.Get(ctx, int64(i), "k"); !ok {
+			t.Fatalf("write %d lost on Close", i)
+		}
+	}
+	if err := l.Set(ctx, 1, "k", 1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestStates_Cached(t *testing.T) {
+	l, l2 := newTestStorage(t)
+	ctx := context.Background()
+
+	l.CreateState(ctx, 1, "start")
+	for range 3 {
+		if st, ok, _ := l.GetState(ctx, 1); !ok || st != "start" {
+			t.Fatalf("unexpected state (%v, %v)", st, ok)
+		}
+	}
+	if n := l2.stateGets.Load(); n != 1 {
+		t.Fatalf("expected a single L2 state read, got %d", n)
+	}
+
+	l.SetState(ctx, 1, "next")
+	if st := l2.states[1]; st != "next" {
+		t.Fatalf("state must reach L2, got %q", st)
+	}
+	l.CleanCache(ctx, 1)
+	if st, ok, _ := l.GetState(ctx, 1); !ok || st != "next" {
+		t.Fatalf("CleanCache must keep the state, got (%v, %v)", st, ok)
+	}
+	if n := l2.stateGets.Load(); n != 1 {
+		t.Fatalf("state must stay cached after CleanCache, got %d L2 reads", n)
+	}
+}
+
+func TestStates_WithoutStateStorage(t *testing.T) {
+	l := NewLayeredStorage(memory.NewMemoryStorage(time.Hour, time.Hour), WithMaxStaleness(10*time.Millisecond))
+	defer l.Close()
+	ctx := context.Background()
+
+	l.CreateState(ctx, 1, "start")
+	l.CreateState(ctx, 1, "ignored")
+	time.Sleep(20 * time.Millisecond)
+	l.Invalidate(1)
+
+	if st, ok, _ := l.GetState(ctx, 1); !ok || st != "start" {
+		t.Fatalf("states kept in L1 must not go stale, got (%v, %v)", st, ok)
+	}
+}
+
+func TestSessions_FlushesWriteBehind(t *testing.T) {
+	l, _ := newTestStorage(t, WithWriteBehind(16))
+	ctx := context.Background()
+
+	l.SetState(ctx, 1, "queued")
+	var got []storage.Session
+	for sess, err := range l.Sessions(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, sess)
+	}
+	if len(got) != 1 || got[0].State != "queued" {
+		t.Fatalf("queued state must be listed, got %+v", got)
+	}
+}
+
+func TestSessions_Unsupported(t *testing.T) {
+	l := NewLayeredStorage(memory.NewMemoryStorage(time.Hour, time.Hour))
+	defer l.Close()
+
+	var errs []error
+	for _, err := range l.Sessions(context.Background()) {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], storage.ErrSessionsUnsupported) {
+		t.Fatalf("expected a single ErrSessionsUnsupported, got %v", errs)
+	}
+}
+
+func TestMediaPassesThrough(t *testing.T) {
+	l, l2 := newTestStorage(t)
+	ctx := context.Background()
+
+	l.SetMedia(ctx, 1, "g", mediaFile("a"))
+	if _, ok, _ := l2.MemoryStorage.GetMedia(ctx, 1, "g"); !ok {
+		t.Fatal("media must be written to L2")
+	}
+	if ok, _ := l.CleanMediaCache(ctx, 1, "g"); !ok {
+		t.Fatal("expected existing media group to be removed")
+	}
+}
+
+func mediaFile(id string) media.File { return media.File{Type: "photo", FileID: id} }
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+			l2 := memory.NewMemoryStorage(time.Hour, time.Hour, memory.WithClock(clock.Now))
+			l := NewLayeredStorage(l2, WithL1(time.Hour, time.Hour, memory.WithClock(clock.Now)))
+			t.Cleanup(func() { l.Close() })
+			return l
+		},
+	})
+}
@@ -0,0 +1,133 @@
+package memory
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// expiry is a scheduled check of a user or of a value set with SetWithTTL.
+//
+// User entries are never updated in place: touching a user only moves its
+// last-seen timestamp, and the user's entry is rescheduled when it comes due.
+// A value has at most one entry, which SetWithTTL of the same key moves to
+// the new deadline. The entries of a user are removed when its cache is
+// dropped, so the queue only references live caches; entries that come due
+// while the cache is being dropped are recognised by pointer identity.
+type expiry struct {
+	at     int64 // unix nanoseconds
+	userID int64
+	user   *cacheData
+	key    string
+	value  *expiringValue // nil for user expiry
+}
+
+// entryRef identifies an entry among those of its user.
+type entryRef struct {
+	key   string
+	value bool
+}
+
+func (e expiry) ref() entryRef {
+	return entryRef{key: e.key, value: e.value != nil}
+}
+
+// expiryQueue is a min-heap of expiries ordered by deadline.
+type expiryQueue struct {
+	mu    sync.Mutex
+	items expiryHeap
+}
+
+// push schedules the given expiries. An expiry of a value that is already
+// queued replaces the queued one.
+func (q *expiryQueue) push(es ...expiry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, e := range es {
+		if e.value != nil {
+			if i, ok := q.items.index[e.user][e.ref()]; ok {
+				q.items.es[i] = e
+				heap.Fix(&q.items, i)
+				continue
+			}
+		}
+		heap.Push(&q.items, e)
+	}
+}
+
+// popDue removes and returns all expiries with a deadline at or before now.
+func (q *expiryQueue) popDue(now int64) []expiry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []expiry
+	for len(q.items.es) > 0 && q.items.es[0].at <= now {
+		due = append(due, heap.Pop(&q.items).(expiry))
+	}
+	return due
+}
+
+// removeUser drops all entries of the cache cd.
+func (q *expiryQueue) removeUser(cd *cacheData) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items.index[cd]) > 0 {
+		for _, i := range q.items.index[cd] {
+			heap.Remove(&q.items, i)
+			break // positions moved
+		}
+	}
+}
+
+func (q *expiryQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items.es)
+}
+
+// expiryHeap keeps the position of every entry by user, so that value
+// entries can be moved and all entries of a user removed.
+type expiryHeap struct {
+	es    []expiry
+	index map[*cacheData]map[entryRef]int
+}
+
+func (h *expiryHeap) Len() int           { return len(h.es) }
+func (h *expiryHeap) Less(i, j int) bool { return h.es[i].at < h.es[j].at }
+
+func (h *expiryHeap) Swap(i, j int) {
+	h.es[i], h.es[j] = h.es[j], h.es[i]
+	h.reindex(i)
+	h.reindex(j)
+}
+
+func (h *expiryHeap) Push(x any) {
+	h.es = append(h.es, x.(expiry))
+	h.reindex(len(h.es) - 1)
+}
+
+func (h *expiryHeap) Pop() any {
+	n := len(h.es)
+	e := h.es[n-1]
+	h.es[n-1] = expiry{} // release references
+	h.es = h.es[:n-1]
+	refs := h.index[e.user]
+	delete(refs, e.ref())
+	if len(refs) == 0 {
+		delete(h.index, e.user)
+	}
+	return e
+}
+
+// reindex records the position of the entry at i.
+func (h *expiryHeap) reindex(i int) {
+	e := h.es[i]
+	if h.index == nil {
+		h.index = make(map[*cacheData]map[entryRef]int)
+	}
+	refs := h.index[e.user]
+	if refs == nil {
+		refs = make(map[entryRef]int)
+		h.index[e.user] = refs
+	}
+	refs[e.ref()] = i
+}
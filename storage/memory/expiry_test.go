@@ -0,0 +1,132 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEvict_ReschedulesActiveUsers(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+	start := time.Now()
+
+	store.Set(ctx, 1, "k", "v")
+	u, _ := store.loadUser(1)
+	u.lastSeen.Store(start.Add(30 * time.Second).UnixNano()) // active later on
+
+	store.evict(start.Add(70 * time.Second))
+	if _, ok, _ := store.Get(ctx, 1, "k"); !ok {
+		t.Fatal("user active since scheduling must not be evicted")
+	}
+	u.lastSeen.Store(start.Add(30 * time.Second).UnixNano())
+
+	store.evict(start.Add(100 * time.Second))
+	if _, ok := store.loadUser(1); ok {
+		t.Fatal("user must be evicted at the rescheduled deadline")
+	}
+	if st := store.Stats(); st.EvictedByTTL != 1 {
+		t.Fatalf("expected one TTL eviction, got %+v", st)
+	}
+}
+
+func TestEvict_IgnoresRecreatedUser(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+	start := time.Now()
+
+	store.Set(ctx, 1, "k", "old")
+	store.CleanCache(ctx, 1)
+	store.Set(ctx, 1, "k", "new")
+	u, _ := store.loadUser(1)
+	u.lastSeen.Store(start.Add(time.Minute).UnixNano())
+
+	// the stale entry of the first incarnation comes due, and so does the
+	// entry of the new one, which is rescheduled
+	store.evict(start.Add(90 * time.Second))
+	if v, ok, _ := store.Get(ctx, 1, "k"); !ok || v != "new" {
+		t.Fatalf("re-created user must survive, got (%v, %v)", v, ok)
+	}
+	if n := store.queue.len(); n != 1 {
+		t.Fatalf("expected a single entry for the live user, got %d", n)
+	}
+}
+
+func TestDroppedUsers_LeaveQueue(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, time.Hour, WithMaxUsers(1))
+	defer store.Close()
+	ctx := context.Background()
+
+	for range 100 {
+		store.Set(ctx, 1, "k", "v")
+		store.SetWithTTL(ctx, 1, "otp", "1", time.Minute)
+		store.CleanCache(ctx, 1)
+	}
+	if n := store.queue.len(); n != 0 {
+		t.Fatalf("CleanCache must drop the user's entries, got %d", n)
+	}
+
+	store.SetWithTTL(ctx, 1, "otp", "1", time.Minute)
+	store.SetWithTTL(ctx, 2, "otp", "1", time.Minute) // evicts user 1
+	if _, ok := store.loadUser(1); ok {
+		t.Fatal("expected user 1 to be evicted by pressure")
+	}
+	if n := store.queue.len(); n != 2 {
+		t.Fatalf("expected only the entries of user 2, got %d", n)
+	}
+}
+
+func TestTouch_DoesNotGrowQueue(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	for range 100 {
+		store.Get(ctx, 1, "k")
+		store.Set(ctx, 1, "k", "v")
+	}
+	if n := store.queue.len(); n != 1 {
+		t.Fatalf("touches must not enqueue expiries, got %d entries", n)
+	}
+}
+
+func TestNoWorker_NothingQueued(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, 0)
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	store.SetWithTTL(ctx, 1, "otp", "1", time.Minute)
+	if n := store.queue.len(); n != 0 {
+		t.Fatalf("without a cleanup worker nothing should be queued, got %d", n)
+	}
+}
+
+func TestSetWithTTL_OneEntryPerKey(t *testing.T) {
+	store := NewMemoryStorage(0, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+	start := time.Now()
+
+	for i := range 100 {
+		store.SetWithTTL(ctx, 1, "otp", i, time.Duration(100-i)*time.Minute)
+	}
+	if n := store.queue.len(); n != 1 {
+		t.Fatalf("refreshing a key must keep one queued entry, got %d", n)
+	}
+
+	store.evict(start.Add(30 * time.Second))
+	if v, ok, _ := store.Get(ctx, 1, "otp"); !ok || v != 99 {
+		t.Fatalf("the last value must live until its own deadline, got (%v, %v)", v, ok)
+	}
+	store.evict(start.Add(2 * time.Minute))
+	if _, ok, _ := store.Get(ctx, 1, "otp"); ok {
+		t.Fatal("the value must expire at the deadline of the last SetWithTTL")
+	}
+	if n := store.queue.len(); n != 0 {
+		t.Fatalf("expected an empty queue, got %d", n)
+	}
+}
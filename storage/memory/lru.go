@@ -0,0 +1,221 @@
+package memory
+
+import (
+	"container/list"
+	"reflect"
+	"sync"
+)
+
+// EvictReason tells why a user was evicted from a MemoryStorage.
+type EvictReason int
+
+const (
+	// EvictedByTTL means the user was inactive for longer than the storage TTL.
+	EvictedByTTL EvictReason = iota + 1
+	// EvictedByPressure means the user was the least recently used one when
+	// the storage exceeded WithMaxUsers or WithMaxBytes.
+	EvictedByPressure
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictedByTTL:
+		return "ttl"
+	case EvictedByPressure:
+		return "pressure"
+	default:
+		return "unknown"
+	}
+}
+
+// Stats is a point-in-time view of a MemoryStorage.
+type Stats struct {
+	Users             int   // users currently cached
+	Bytes             int64 // approximate size of cached data; tracked only with WithMaxBytes
+	EvictedByTTL      uint64
+	EvictedByPressure uint64
+}
+
+// entryOverhead approximates the bookkeeping cost of a single cached entry
+// (map slots, interface headers) on top of the key and value themselves.
+const entryOverhead = 64
+
+// lru orders users by last access and tracks the approximate size of their
+// data. It is only allocated for storages with WithMaxUsers or WithMaxBytes.
+type lru struct {
+	mu       sync.Mutex
+	order    *list.List // front is the most recently used; elements hold *lruEntry
+	users    map[int64]*list.Element
+	bytes    int64
+	maxUsers int
+	maxBytes int64
+}
+
+type lruEntry struct {
+	userID int64
+	bytes  int64
+	sizes  map[string]int64 // per key, only with a byte budget
+}
+
+func newLRU(maxUsers int, maxBytes int64) *lru {
+	return &lru{
+		order:    list.New(),
+		users:    make(map[int64]*list.Element),
+		maxUsers: maxUsers,
+		maxBytes: maxBytes,
+	}
+}
+
+// access marks the user as most recently used and, with a byte budget,
+// adds delta to the size of key (replacing it if replace is set).
+// It returns the users that must be evicted to get back within the limits;
+// the accessed user itself is never among them.
+func (l *lru) access(userID int64, key string, size int64, replace bool) []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.users[userID]
+	if ok {
+		l.order.MoveToFront(el)
+	} else {
+		el = l.order.PushFront(&lruEntry{userID: userID})
+		l.users[userID] = el
+	}
+
+	if l.maxBytes > 0 && key != "" {
+		e := el.Value.(*lruEntry)
+		if e.sizes == nil {
+			e.sizes = make(map[string]int64)
+		}
+		old := e.sizes[key]
+		if !replace {
+			size += old
+		}
+		e.sizes[key] = size
+		e.bytes += size - old
+		l.bytes += size - old
+	}
+
+	var evicted []int64
+	for l.order.Len() > 1 && l.over() {
+		back := l.order.Back()
+		e := back.Value.(*lruEntry)
+		l.removeElement(back)
+		evicted = append(evicted, e.userID)
+	}
+	return evicted
+}
+
+func (l *lru) over() bool {
+	return (l.maxUsers > 0 && l.order.Len() > l.maxUsers) ||
+		(l.maxBytes > 0 && l.bytes > l.maxBytes)
+}
+
+// forget drops the size of a single key of the user.
+func (l *lru) forget(userID int64, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.users[userID]
+	if !ok {
+		return
+	}
+	e := el.Value.(*lruEntry)
+	if size, ok := e.sizes[key]; ok {
+		delete(e.sizes, key)
+		e.bytes -= size
+		l.bytes -= size
+	}
+}
+
+// remove drops the user from the ordering.
+func (l *lru) remove(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.users[userID]; ok {
+		l.removeElement(el)
+	}
+}
+
+func (l *lru) removeElement(el *list.Element) {
+	e := el.Value.(*lruEntry)
+	l.order.Remove(el)
+	delete(l.users, e.userID)
+	l.bytes -= e.bytes
+}
+
+func (l *lru) stats() (users int, bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len(), l.bytes
+}
+
+// approxSize estimates the memory held by v. The estimate is deliberately
+// rough: it counts string and slice contents, numbers and the elements of
+// containers a few levels deep, and ignores sharing and allocator overhead.
+func approxSize(v any) int64 {
+	if v == nil {
+		return 0
+	}
+	switch x := v.(type) {
+	case string:
+		return int64(len(x)) + 16
+	case []byte:
+		return int64(len(x)) + 24
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, int64, uint, uint64, float64, uintptr:
+		return 8
+	}
+	return sizeOfValue(reflect.ValueOf(v), 4)
+}
+
+func sizeOfValue(v reflect.Value, depth int) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len()) + 16
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return 8
+		}
+		if depth == 0 {
+			return 8
+		}
+		return 8 + sizeOfValue(v.Elem(), depth-1)
+	case reflect.Slice, reflect.Array:
+		size := int64(24)
+		if depth == 0 || v.Len() == 0 {
+			return size + int64(v.Len())*int64(v.Type().Elem().Size())
+		}
+		for i := range v.Len() {
+			size += sizeOfValue(v.Index(i), depth-1)
+		}
+		return size
+	case reflect.Map:
+		size := int64(48)
+		if depth == 0 {
+			return size + int64(v.Len())*int64(v.Type().Key().Size()+v.Type().Elem().Size())
+		}
+		it := v.MapRange()
+		for it.Next() {
+			size += sizeOfValue(it.Key(), depth-1) + sizeOfValue(it.Value(), depth-1)
+		}
+		return size
+	case reflect.Struct:
+		if depth == 0 {
+			return int64(v.Type().Size())
+		}
+		var size int64
+		for i := range v.NumField() {
+			size += sizeOfValue(v.Field(i), depth-1)
+		}
+		return size
+	default:
+		return int64(v.Type().Size())
+	}
+}
@@ -0,0 +1,201 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type evictLog struct {
+	mu     sync.Mutex
+	events map[int64]EvictReason
+}
+
+func (l *evictLog) record(userID int64, reason EvictReason) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.events == nil {
+		l.events = make(map[int64]EvictReason)
+	}
+	l.events[userID] = reason
+}
+
+func (l *evictLog) get(userID int64) (EvictReason, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r, ok := l.events[userID]
+	return r, ok
+}
+
+func TestMaxUsers_EvictsLeastRecentlyUsed(t *testing.T) {
+	var log evictLog
+	store := NewMemoryStorage(time.Hour, time.Hour, WithMaxUsers(2), WithEvictionCallback(log.record))
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v1")
+	store.Set(ctx, 2, "k", "v2")
+	store.Get(ctx, 1, "k") // user 2 is now the least recently used
+	store.Set(ctx, 3, "k", "v3")
+
+	if _, ok, _ := store.Get(ctx, 2, "k"); ok {
+		t.Fatal("least recently used user must be evicted")
+	}
+	for _, uid := range []int64{1, 3} {
+		if _, ok, _ := store.Get(ctx, uid, "k"); !ok {
+			t.Fatalf("user %d must stay", uid)
+		}
+	}
+	if r, ok := log.get(2); !ok || r != EvictedByPressure {
+		t.Fatalf("expected pressure eviction callback for user 2, got (%v, %v)", r, ok)
+	}
+
+	st := store.Stats()
+	if st.Users != 2 || st.EvictedByPressure != 1 || st.EvictedByTTL != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestMaxBytes_EvictsUntilWithinBudget(t *testing.T) {
+	store := NewMemoryStorage(time.Hour, time.Hour, WithMaxBytes(3000))
+	defer store.Close()
+	ctx := context.Background()
+
+	big := strings.Repeat("x", 1000)
+	for uid := int64(1); uid <= 5; uid++ {
+		store.Set(ctx, uid, "blob", big)
+	}
+
+	st := store.Stats()
+	if st.Bytes > 3000 {
+		t.Fatalf("budget exceeded: %d bytes", st.Bytes)
+	}
+	if st.Users != 2 || st.EvictedByPressure != 3 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if _, ok, _ := store.Get(ctx, 5, "blob"); !ok {
+		t.Fatal("most recent user must stay")
+	}
+
+	// overwriting a key replaces its size instead of adding to it
+	store.Set(ctx, 5, "blob", "small")
+	if after := store.Stats().Bytes; after >= st.Bytes {
+		t.Fatalf("expected size to shrink after overwrite, %d -> %d", st.Bytes, after)
+	}
+}
+
+func TestMaxBytes_KeepsOversizedCurrentUser(t *testing.T) {
+	store := NewMemoryStorage(time.Hour, time.Hour, WithMaxBytes(100))
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "blob", strings.Repeat("x", 1000))
+	if _, ok, _ := store.Get(ctx, 1, "blob"); !ok {
+		t.Fatal("the user being written must not be evicted")
+	}
+}
+
+func TestMaxBytes_TracksMediaAndCleanups(t *testing.T) {
+	store := NewMemoryStorage(time.Hour, time.Hour, WithMaxBytes(1<<20))
+	defer store.Close()
+	ctx := context.Background()
+
+	store.SetMedia(ctx, 1, "g", mf("photo", "a"))
+	one := store.Stats().Bytes
+	store.SetMedia(ctx, 1, "g", mf("photo", "b"))
+	if two := store.Stats().Bytes; two <= one {
+		t.Fatalf("appending media must grow the size, %d -> %d", one, two)
+	}
+
+	store.CleanMediaCache(ctx, 1, "g")
+	if b := store.Stats().Bytes; b != 0 {
+		t.Fatalf("expected no bytes after media cleanup, got %d", b)
+	}
+
+	store.Set(ctx, 1, "k", "v")
+	store.CleanCache(ctx, 1)
+	if st := store.Stats(); st.Users != 0 || st.Bytes != 0 {
+		t.Fatalf("CleanCache must release the user, got %+v", st)
+	}
+}
+
+func TestEvictionByTTL_Counted(t *testing.T) {
+	var log evictLog
+	store := NewMemoryStorage(time.Minute, time.Hour, WithMaxUsers(10), WithEvictionCallback(log.record))
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	store.evict(time.Now().Add(2 * time.Minute))
+
+	if r, ok := log.get(1); !ok || r != EvictedByTTL {
+		t.Fatalf("expected TTL eviction callback, got (%v, %v)", r, ok)
+	}
+	if st := store.Stats(); st.Users != 0 || st.EvictedByTTL != 1 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestStats_Unbounded(t *testing.T) {
+	store := NewMemoryStorage(time.Minute, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	store.Set(ctx, 2, "k", "v")
+	store.evict(time.Now().Add(2 * time.Minute))
+
+	if st := store.Stats(); st.Users != 0 || st.EvictedByTTL != 2 || st.Bytes != 0 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+}
+
+func TestRestore_KeepsMostRecentUsers(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryStorage(time.Hour, time.Hour)
+	defer src.Close()
+
+	for uid := int64(1); uid <= 3; uid++ {
+		src.Set(ctx, uid, "k", "v")
+		time.Sleep(time.Millisecond)
+	}
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemoryStorage(time.Hour, time.Hour, WithMaxUsers(2))
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := dst.Get(ctx, 1, "k"); ok {
+		t.Fatal("the least recently seen user must not be restored")
+	}
+	if st := dst.Stats(); st.Users != 2 {
+		t.Fatalf("expected 2 users, got %+v", st)
+	}
+}
+
+func TestApproxSize(t *testing.T) {
+	type order struct {
+		ID    int64
+		Items []string
+	}
+
+	if s := approxSize(strings.Repeat("x", 100)); s < 100 {
+		t.Fatalf("string size too small: %d", s)
+	}
+	small := approxSize(order{ID: 1, Items: []string{"a"}})
+	large := approxSize(&order{ID: 1, Items: []string{strings.Repeat("a", 500), "b"}})
+	if large <= small+500 {
+		t.Fatalf("expected nested contents to be counted, small=%d large=%d", small, large)
+	}
+	if approxSize(nil) != 0 {
+		t.Fatal("nil must be free")
+	}
+}
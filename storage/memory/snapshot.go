@@ -0,0 +1,192 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+// snapshotVersion is bumped on incompatible changes of the snapshot format.
+const snapshotVersion = 1
+
+// snapshot is the serialised form of a MemoryStorage.
+type snapshot struct {
+	Version int            `json:"version"`
+	Users   []userSnapshot `json:"users"`
+}
+
+type userSnapshot struct {
+	UserID   int64                    `json:"user_id"`
+	LastSeen time.Time                `json:"last_seen"`
+	Values   map[string][]byte        `json:"values,omitempty"`  // codec encoded
+	Expires  map[string]time.Time     `json:"expires,omitempty"` // keys set with SetWithTTL
+	Media    map[string]mediaSnapshot `json:"media,omitempty"`
+}
+
+type mediaSnapshot struct {
+	LastUpdate time.Time    `json:"last_update"`
+	Files      []media.File `json:"files"`
+}
+
+// Snapshot writes every user with values, media groups and last-seen time to w
+// as JSON. Values are encoded with the storage codec. A value the codec cannot
+// encode is left out, so one bad value does not cost the data of every user;
+// the snapshot is written and the returned error, wrapping
+// storage.ErrSnapshotIncomplete, names each skipped value.
+func (m *MemoryStorage) Snapshot(w io.Writer) error {
+	snap := snapshot{Version: snapshotVersion}
+	now := m.now()
+
+	var skipped []error
+	m.rangeUsers(func(uid int64, cd *cacheData) bool {
+		us := userSnapshot{UserID: uid, LastSeen: time.Unix(0, cd.lastSeen.Load())}
+
+		cd.data.Range(func(key, val any) bool {
+			if mc, ok := val.(*cacheData); ok && key == "media" {
+				us.Media = snapshotMedia(mc)
+				return true
+			}
+
+			if ev, ok := val.(*expiringValue); ok {
+				if ev.expired(now) {
+					return true
+				}
+				if us.Expires == nil {
+					us.Expires = make(map[string]time.Time)
+				}
+				us.Expires[key.(string)] = ev.expires
+				val = ev.value
+			}
+
+			raw, err := m.codec.Encode(val)
+			if err != nil {
+				skipped = append(skipped, fmt.Errorf("memory: snapshot user %d key %q: %w", uid, key, err))
+				delete(us.Expires, key.(string))
+				return true
+			}
+			if us.Values == nil {
+				us.Values = make(map[string][]byte)
+			}
+			us.Values[key.(string)] = raw
+			return true
+		})
+
+		snap.Users = append(snap.Users, us)
+		return true
+	})
+
+	if err := json.NewEncoder(w).Encode(snap); err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("%w: %w", storage.ErrSnapshotIncomplete, errors.Join(skipped...))
+	}
+	return nil
+}
+
+func snapshotMedia(mc *cacheData) map[string]mediaSnapshot {
+	out := make(map[string]mediaSnapshot)
+	mc.data.Range(func(k, v any) bool {
+		md := v.(*media.MediaData)
+		out[k.(string)] = mediaSnapshot{LastUpdate: md.LastUpdate(), Files: md.Files()}
+		return true
+	})
+	return out
+}
+
+// Restore loads a snapshot produced by Snapshot. Users from the snapshot
+// replace users with the same ID; other users are kept. The snapshot is fully
+// decoded before anything is applied, so a corrupt input leaves the storage
+// unchanged. A bounded storage restores users from the least to the most
+// recently seen one, so the limits keep the most recent users.
+func (m *MemoryStorage) Restore(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("memory: decode snapshot: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("memory: unsupported snapshot version %d", snap.Version)
+	}
+
+	users := make(map[int64]*cacheData, len(snap.Users))
+	for _, us := range snap.Users {
+		cd := &cacheData{}
+		if us.LastSeen.IsZero() {
+			cd.lastSeen.Store(m.now().UnixNano())
+		} else {
+			cd.lastSeen.Store(us.LastSeen.UnixNano())
+		}
+		for key, raw := range us.Values {
+			v, err := m.codec.Decode(raw)
+			if err != nil {
+				return fmt.Errorf("memory: restore user %d key %q: %w", us.UserID, key, err)
+			}
+			if exp, ok := us.Expires[key]; ok {
+				v = &expiringValue{value: v, expires: exp}
+			}
+			cd.data.Store(key, v)
+		}
+		if len(us.Media) > 0 {
+			mc := &cacheData{}
+			for group, ms := range us.Media {
+				mc.data.Store(group, media.NewMediaData(ms.Files, ms.LastUpdate))
+			}
+			cd.data.Store("media", mc)
+		}
+		users[us.UserID] = cd
+	}
+
+	if m.lru != nil {
+		slices.SortFunc(snap.Users, func(a, b userSnapshot) int { return a.LastSeen.Compare(b.LastSeen) })
+	}
+
+	for _, us := range snap.Users {
+		cd := users[us.UserID]
+		m.storeUser(us.UserID, cd)
+		for key := range us.Expires {
+			if v, ok := cd.data.Load(key); ok {
+				m.scheduleValue(us.UserID, cd, key, v.(*expiringValue))
+			}
+		}
+		if m.lru != nil {
+			m.restoreSizes(us.UserID, cd)
+		}
+	}
+	return nil
+}
+
+// restoreSizes registers a restored user in the LRU together with the
+// sizes of its values and media groups.
+func (m *MemoryStorage) restoreSizes(userID int64, cd *cacheData) {
+	m.lru.remove(userID)
+	m.evictUsers(m.lru.access(userID, "", 0, false), EvictedByPressure)
+	if m.maxBytes <= 0 {
+		return
+	}
+
+	cd.data.Range(func(k, v any) bool {
+		key := k.(string)
+		if mc, ok := v.(*cacheData); ok && key == "media" {
+			mc.data.Range(func(g, md any) bool {
+				var size int64
+				for _, f := range md.(*media.MediaData).Files() {
+					size += entryOverhead + approxSize(f)
+				}
+				m.evictUsers(m.lru.access(userID, mediaKey(g.(string)), size, true), EvictedByPressure)
+				return true
+			})
+			return true
+		}
+		if ev, ok := v.(*expiringValue); ok {
+			v = ev.value
+		}
+		m.evictUsers(m.lru.access(userID, key, valueSize(key, v)(), true), EvictedByPressure)
+		return true
+	})
+}
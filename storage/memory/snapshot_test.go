@@ -0,0 +1,132 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryStorage(time.Hour, time.Hour)
+	defer src.Close()
+
+	src.Set(ctx, 1, "name", "Ann")
+	src.Set(ctx, 1, "age", 30)
+	src.SetMedia(ctx, 1, "grp", f("photo", "p1"))
+	src.SetMedia(ctx, 1, "grp", f("video", "v1"))
+	src.Set(ctx, 2, "k", []string{"a", "b"})
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	dst := NewMemoryStorage(time.Hour, time.Hour, WithCodec(codec.JSON))
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+
+	if v, ok, _ := dst.Get(ctx, 1, "age"); !ok || v.(int) != 30 {
+		t.Errorf("expected age=30 with original type, got (%#v, %v)", v, ok)
+	}
+	if v, ok, _ := dst.Get(ctx, 2, "k"); !ok || len(v.([]string)) != 2 {
+		t.Errorf("expected []string value, got (%#v, %v)", v, ok)
+	}
+
+	md, ok, _ := dst.GetMedia(ctx, 1, "grp")
+	if !ok {
+		t.Fatal("media group not restored")
+	}
+	if files := md.Files(); len(files) != 2 || files[1].FileID != "v1" {
+		t.Errorf("unexpected restored files: %+v", files)
+	}
+
+	if cd, ok := dst.loadUser(1); !ok || cd.lastSeen.Load() == 0 {
+		t.Error("last-seen time not restored")
+	}
+}
+
+func TestSnapshotUnencodableValue(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+
+	store.Set(ctx, 1, "ch", make(chan int))
+	store.SetWithTTL(ctx, 1, "fn", func() {}, time.Hour)
+	store.Set(ctx, 1, "name", "Ann")
+	store.Set(ctx, 2, "k", "v")
+
+	var buf bytes.Buffer
+	err := store.Snapshot(&buf)
+	if !errors.Is(err, storage.ErrSnapshotIncomplete) || !errors.Is(err, codec.ErrUnregisteredType) {
+		t.Fatalf("expected ErrSnapshotIncomplete, got %v", err)
+	}
+
+	dst := NewMemoryStorage(time.Hour, time.Hour)
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if v, _, _ := dst.Get(ctx, 1, "name"); v != "Ann" {
+		t.Errorf("encodable values of the same user must survive, got %v", v)
+	}
+	if v, _, _ := dst.Get(ctx, 2, "k"); v != "v" {
+		t.Errorf("other users must survive, got %v", v)
+	}
+	if _, ok, _ := dst.Get(ctx, 1, "ch"); ok {
+		t.Error("the skipped value must not be restored")
+	}
+}
+
+func TestRestoreCorruptKeepsData(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+
+	store.Set(ctx, 1, "k", "v")
+
+	bad := `{"version":1,"users":[{"user_id":1,"values":{"k":"` + "bm90IGpzb24=" + `"}}]}`
+	if err := store.Restore(bytes.NewBufferString(bad)); err == nil {
+		t.Fatal("expected error for undecodable value")
+	}
+	if v, ok, _ := store.Get(ctx, 1, "k"); !ok || v != "v" {
+		t.Fatalf("storage changed by failed restore: (%v, %v)", v, ok)
+	}
+}
+
+func TestSnapshotKeepsValueTTL(t *testing.T) {
+	ctx := context.Background()
+	src := NewMemoryStorage(time.Hour, time.Hour)
+	defer src.Close()
+
+	src.SetWithTTL(ctx, 1, "otp", "1234", 30*time.Millisecond)
+	src.SetWithTTL(ctx, 1, "gone", "x", time.Nanosecond)
+
+	var buf bytes.Buffer
+	if err := src.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewMemoryStorage(time.Hour, time.Hour)
+	defer dst.Close()
+	if err := dst.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := dst.Get(ctx, 1, "gone"); ok {
+		t.Fatal("expired value must not be snapshotted")
+	}
+	if _, ok, _ := dst.Get(ctx, 1, "otp"); !ok {
+		t.Fatal("live value must be restored")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if _, ok, _ := dst.Get(ctx, 1, "otp"); ok {
+		t.Fatal("restored value must keep its expiry")
+	}
+}
@@ -3,36 +3,138 @@ package memory
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
 )
 
+// shardCount is the number of independently locked user partitions.
+const shardCount = 64
+
 // cacheData wraps per-user data map.
 type cacheData struct {
-	data sync.Map
+	data     sync.Map
+	lastSeen atomic.Int64 // unix nanoseconds of the last access; unused below user level
+}
+
+// shard is a partition of users guarded by its own lock. The lock only
+// protects the map: user data and last-seen times are updated without it.
+type shard struct {
+	mu    sync.RWMutex
+	users map[int64]*cacheData
+}
+
+// expiringValue is stored in place of a value set with SetWithTTL.
+type expiringValue struct {
+	value   any
+	expires time.Time
+}
+
+func (ev *expiringValue) expired(now time.Time) bool {
+	return !now.Before(ev.expires)
 }
 
 // MemoryStorage is an in-memory storage partitioned by userID.
 // It maintains last-seen timestamps per user and runs a background
 // cleanup worker that evicts inactive users based on TTL.
+// With WithMaxUsers or WithMaxBytes it is also bounded: the least recently
+// used users are evicted as soon as a limit is exceeded.
+//
+// Users are spread over shards with separate locks, and accessing a user only
+// stores an atomic timestamp. Expiry is driven by a deadline queue, so a
+// cleanup pass costs time proportional to the users and values that come
+// due rather than to the total number of users.
 type MemoryStorage struct {
-	storage  sync.Map // userID -> *cacheData
-	lastSeen sync.Map // userID -> time.Time
+	shards   [shardCount]shard
+	queue    expiryQueue // scheduled user and value expiries; empty without a worker
 	ttl      time.Duration
 	interval time.Duration
+	codec    codec.Codec // encodes values in snapshots
+	now      func() time.Time
+
+	lru      *lru // nil unless the storage is bounded
+	maxUsers int
+	maxBytes int64
+	onEvict  func(userID int64, reason EvictReason)
+
+	evictedTTL      atomic.Uint64
+	evictedPressure atomic.Uint64
 
 	stopOnce sync.Once
 	stopFn   context.CancelFunc
 }
 
+// Option configures a MemoryStorage.
+type Option func(*MemoryStorage)
+
+// WithCodec sets the codec used to encode cached values in snapshots.
+// Values themselves are kept in memory as is; codec.JSON is used by default.
+func WithCodec(c codec.Codec) Option {
+	return func(m *MemoryStorage) {
+		m.codec = c
+	}
+}
+
+// WithMaxUsers bounds the number of cached users. When a new user would
+// exceed n, the least recently used user is evicted. Zero means no limit.
+func WithMaxUsers(n int) Option {
+	return func(m *MemoryStorage) {
+		m.maxUsers = n
+	}
+}
+
+// WithMaxBytes sets an approximate budget for cached values and media files.
+// Sizes are estimated when data is written (see Stats.Bytes); when the total
+// exceeds n, the least recently used users are evicted. The user being
+// written is never evicted, even if it alone exceeds the budget.
+// Zero means no limit.
+func WithMaxBytes(n int64) Option {
+	return func(m *MemoryStorage) {
+		m.maxBytes = n
+	}
+}
+
+// WithEvictionCallback sets a function called after a user is evicted by
+// TTL or by memory pressure. It is not called for CleanCache. The callback
+// runs synchronously on the goroutine that caused the eviction, so it must
+// be fast; it may call the storage.
+func WithEvictionCallback(fn func(userID int64, reason EvictReason)) Option {
+	return func(m *MemoryStorage) {
+		m.onEvict = fn
+	}
+}
+
+// WithClock sets the source of the current time used for last-seen times
+// and expiry. It exists for tests, e.g. with storagetest.Clock.
+func WithClock(now func() time.Time) Option {
+	return func(m *MemoryStorage) {
+		m.now = now
+	}
+}
+
 // NewMemoryStorage creates a MemoryStorage and starts the cleanup worker.
 // The worker evicts users that were inactive for longer than ttl,
 // scanning with the given interval.
-func NewMemoryStorage(ttl, interval time.Duration) *MemoryStorage {
+func NewMemoryStorage(ttl, interval time.Duration, opts ...Option) *MemoryStorage {
 	m := &MemoryStorage{
 		ttl:      ttl,
 		interval: interval,
+		codec:    codec.JSON,
+		now:      time.Now,
+	}
+	for i := range m.shards {
+		m.shards[i].users = make(map[int64]*cacheData)
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	if m.maxUsers > 0 || m.maxBytes > 0 {
+		m.lru = newLRU(m.maxUsers, m.maxBytes)
 	}
 
 	// Start background cleanup worker
@@ -44,24 +146,187 @@ func NewMemoryStorage(ttl, interval time.Duration) *MemoryStorage {
 }
 
 // Close stops the background cleanup worker.
-func (m *MemoryStorage) Close() {
+func (m *MemoryStorage) Close() error {
 	m.stopOnce.Do(func() {
 		if m.stopFn != nil {
 			m.stopFn()
 		}
 	})
+	return nil
 }
 
 var cacheDataPool = sync.Pool{New: func() any { return &cacheData{} }}
 
-// touch updates last-seen timestamp for the given userID.
-func (m *MemoryStorage) touch(userID int64) {
-	m.lastSeen.Store(userID, time.Now())
+func (m *MemoryStorage) shard(userID int64) *shard {
+	return &m.shards[uint64(userID)%shardCount]
 }
 
-// cleanupWorker periodically evicts users that exceeded TTL.
-func (m *MemoryStorage) cleanupWorker(ctx context.Context) {
+// loadUser returns the user's cache, if present.
+func (m *MemoryStorage) loadUser(userID int64) (*cacheData, bool) {
+	s := m.shard(userID)
+	s.mu.RLock()
+	cd, ok := s.users[userID]
+	s.mu.RUnlock()
+	return cd, ok
+}
+
+// storeUser puts cd in place of the user's cache, scheduling its expiry.
+func (m *MemoryStorage) storeUser(userID int64, cd *cacheData) {
+	s := m.shard(userID)
+	s.mu.Lock()
+	s.users[userID] = cd
+	s.mu.Unlock()
+	m.scheduleUser(userID, cd)
+}
+
+// deleteUser removes the user's cache and its queued expiries. If cd is
+// not nil, the cache is only removed if it is still cd, which protects
+// users re-created meanwhile.
+func (m *MemoryStorage) deleteUser(userID int64, cd *cacheData) bool {
+	s := m.shard(userID)
+	s.mu.Lock()
+	cur, ok := s.users[userID]
+	if !ok || (cd != nil && cur != cd) {
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.users, userID)
+	s.mu.Unlock()
+
+	m.queue.removeUser(cur)
+	return true
+}
+
+// rangeUsers calls fn for every user until it returns false. Each shard is
+// copied under its lock, so fn may freely call the storage.
+func (m *MemoryStorage) rangeUsers(fn func(userID int64, cd *cacheData) bool) {
+	type entry struct {
+		userID int64
+		cd     *cacheData
+	}
+	var batch []entry
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		batch = batch[:0]
+		for uid, cd := range s.users {
+			batch = append(batch, entry{uid, cd})
+		}
+		s.mu.RUnlock()
+
+		for _, e := range batch {
+			if !fn(e.userID, e.cd) {
+				return
+			}
+		}
+	}
+}
+
+// scheduleUser queues the TTL check of a user. Without a cleanup worker or
+// with TTL disabled there is nothing to schedule.
+func (m *MemoryStorage) scheduleUser(userID int64, cd *cacheData) {
 	if m.interval <= 0 || m.ttl <= 0 {
+		return
+	}
+	m.queue.push(expiry{at: cd.lastSeen.Load() + int64(m.ttl), userID: userID, user: cd})
+}
+
+// scheduleValue queues the removal of a value set with SetWithTTL.
+func (m *MemoryStorage) scheduleValue(userID int64, cd *cacheData, key string, ev *expiringValue) {
+	if m.interval <= 0 {
+		return
+	}
+	m.queue.push(expiry{at: ev.expires.UnixNano(), userID: userID, user: cd, key: key, value: ev})
+}
+
+// touch updates last-seen timestamp for the given user.
+func (m *MemoryStorage) touch(userID int64, cd *cacheData) {
+	cd.lastSeen.Store(m.now().UnixNano())
+	if m.lru != nil {
+		m.evictUsers(m.lru.access(userID, "", 0, false), EvictedByPressure)
+	}
+}
+
+// touchKey is touch that also records the approximate size of key for
+// the byte budget. Unless replace is set, size is added to the current one.
+func (m *MemoryStorage) touchKey(userID int64, cd *cacheData, key string, size func() int64, replace bool) {
+	cd.lastSeen.Store(m.now().UnixNano())
+	if m.lru == nil {
+		return
+	}
+	var n int64
+	if m.maxBytes > 0 {
+		n = size()
+	}
+	m.evictUsers(m.lru.access(userID, key, n, replace), EvictedByPressure)
+}
+
+// forgetKey drops the recorded size of key after it was deleted.
+func (m *MemoryStorage) forgetKey(userID int64, key string) {
+	if m.lru != nil {
+		m.lru.forget(userID, key)
+	}
+}
+
+// valueSize estimates the memory held by a cached key/value pair.
+func valueSize(key string, value any) func() int64 {
+	return func() int64 { return entryOverhead + int64(len(key)) + approxSize(value) }
+}
+
+// mediaKey is the size-accounting key of a media group. It cannot collide
+// with user keys, which never contain NUL bytes in practice.
+func mediaKey(mediaGroupID string) string {
+	return "\x00media\x00" + mediaGroupID
+}
+
+// evictUsers drops the users, counts the evictions and reports them.
+// Users evicted by pressure have already been removed from the LRU.
+func (m *MemoryStorage) evictUsers(userIDs []int64, reason EvictReason) {
+	for _, uid := range userIDs {
+		m.deleteUser(uid, nil)
+		m.evicted(uid, reason)
+	}
+}
+
+// evicted counts an eviction and reports it.
+func (m *MemoryStorage) evicted(userID int64, reason EvictReason) {
+	if reason == EvictedByTTL {
+		m.evictedTTL.Add(1)
+		if m.lru != nil {
+			m.lru.remove(userID)
+		}
+	} else {
+		m.evictedPressure.Add(1)
+	}
+	if m.onEvict != nil {
+		m.onEvict(userID, reason)
+	}
+}
+
+// Stats returns the number of cached users, the approximate size of their
+// data and eviction counters.
+func (m *MemoryStorage) Stats() Stats {
+	st := Stats{
+		EvictedByTTL:      m.evictedTTL.Load(),
+		EvictedByPressure: m.evictedPressure.Load(),
+	}
+	if m.lru != nil {
+		st.Users, st.Bytes = m.lru.stats()
+		return st
+	}
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.RLock()
+		st.Users += len(s.users)
+		s.mu.RUnlock()
+	}
+	return st
+}
+
+// cleanupWorker periodically evicts users that exceeded TTL
+// and values whose own TTL (see SetWithTTL) has passed.
+func (m *MemoryStorage) cleanupWorker(ctx context.Context) {
+	if m.interval <= 0 {
 		// nothing to do
 		return
 	}
@@ -71,72 +336,186 @@ func (m *MemoryStorage) cleanupWorker(ctx context.Context) {
 	for {
 		select {
 		case <-ticker.C:
-			now := time.Now()
-			m.lastSeen.Range(func(k, v any) bool {
-				uid, ok := k.(int64)
-				if !ok {
-					return true
-				}
-				last, ok := v.(time.Time)
-				if !ok {
-					return true
-				}
-				if now.Sub(last) > m.ttl {
-					// Evict user: drop data and lastSeen entry
-					m.storage.Delete(uid)
-					m.lastSeen.Delete(uid)
-				}
-				return true
-			})
+			m.evict(m.now())
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// Set stores a key/value pair for the given userID.
-func (m *MemoryStorage) Set(_ context.Context, userID int64, key string, value any) {
+// evict drops inactive users and expired values as of now.
+// Only entries whose deadline has passed are examined: a user that was
+// active since its entry was queued is rescheduled at its new deadline.
+func (m *MemoryStorage) evict(now time.Time) {
+	nowNanos := now.UnixNano()
+
+	var again []expiry
+	for _, e := range m.queue.popDue(nowNanos) {
+		if e.value != nil {
+			if e.user.data.CompareAndDelete(e.key, e.value) {
+				m.forgetKey(e.userID, e.key)
+			}
+			continue
+		}
+
+		if cur, ok := m.loadUser(e.userID); !ok || cur != e.user {
+			continue // already gone or re-created with its own entry
+		}
+		if deadline := e.user.lastSeen.Load() + int64(m.ttl); deadline >= nowNanos {
+			e.at = deadline
+			again = append(again, e)
+			continue
+		}
+		// Evict user: drop data and last-seen time
+		if m.deleteUser(e.userID, e.user) {
+			m.evicted(e.userID, EvictedByTTL)
+		}
+	}
+	if len(again) > 0 {
+		m.queue.push(again...)
+	}
+}
+
+// userCache returns the user's cache, creating it if needed.
+func (m *MemoryStorage) userCache(userID int64) *cacheData {
 	// fast path
-	if v, ok := m.storage.Load(userID); ok {
-		v.(*cacheData).data.Store(key, value)
-		m.touch(userID)
-		return
+	if cd, ok := m.loadUser(userID); ok {
+		return cd
+	}
+
+	// slow path under the shard lock
+	s := m.shard(userID)
+	s.mu.Lock()
+	cd, ok := s.users[userID]
+	if !ok {
+		cd = &cacheData{}
+		cd.lastSeen.Store(m.now().UnixNano())
+		s.users[userID] = cd
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		m.scheduleUser(userID, cd)
+	}
+	return cd
+}
+
+// Set stores a key/value pair for the given userID.
+func (m *MemoryStorage) Set(ctx context.Context, userID int64, key string, value any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cd := m.userCache(userID)
+	cd.data.Store(key, value)
+	m.touchKey(userID, cd, key, valueSize(key, value), true)
+	return nil
+}
+
+// SetWithTTL stores a key/value pair that expires after ttl, independently
+// of the user's activity. Expired values are never returned by Get and are
+// removed by the cleanup worker. A non-positive ttl behaves like Set.
+func (m *MemoryStorage) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return m.Set(ctx, userID, key, value)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cd := m.userCache(userID)
+	ev := &expiringValue{value: value, expires: m.now().Add(ttl)}
+	cd.data.Store(key, ev)
+	m.scheduleValue(userID, cd, key, ev)
+	m.touchKey(userID, cd, key, valueSize(key, value), true)
+	return nil
+}
+
+// SetIfAbsent stores a key/value pair like SetWithTTL unless the key holds
+// an unexpired value, and reports whether it stored it.
+func (m *MemoryStorage) SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	cd := m.userCache(userID)
+	var (
+		stored any = value
+		ev     *expiringValue
+	)
+	if ttl > 0 {
+		ev = &expiringValue{value: value, expires: m.now().Add(ttl)}
+		stored = ev
+	}
+	for {
+		cur, loaded := cd.data.LoadOrStore(key, stored)
+		if !loaded {
+			break
+		}
+		if old, isExp := cur.(*expiringValue); !isExp || !old.expired(m.now()) {
+			m.touch(userID, cd)
+			return false, nil
+		}
+		if cd.data.CompareAndSwap(key, cur, stored) {
+			break
+		}
+	}
+	if ev != nil {
+		m.scheduleValue(userID, cd, key, ev)
+	}
+	m.touchKey(userID, cd, key, valueSize(key, value), true)
+	return true, nil
+}
+
+// Delete removes the value of key for the given userID.
+func (m *MemoryStorage) Delete(ctx context.Context, userID int64, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	// slow path with pooling
-	cd := cacheDataPool.Get().(*cacheData)
-	actual, loaded := m.storage.LoadOrStore(userID, cd)
-	if loaded {
-		cacheDataPool.Put(cd)
+	if cd, ok := m.loadUser(userID); ok {
+		if _, existed := cd.data.LoadAndDelete(key); existed {
+			m.forgetKey(userID, key)
+		}
 	}
-	actual.(*cacheData).data.Store(key, value)
-	m.touch(userID)
+	return nil
 }
 
 // Get retrieves a value by key for the given userID.
-func (m *MemoryStorage) Get(_ context.Context, userID int64, key string) (any, bool) {
-	if cache, ok := m.storage.Load(userID); ok {
-		v, ok := cache.(*cacheData).data.Load(key)
-		if ok {
-			m.touch(userID)
+func (m *MemoryStorage) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	cache, ok := m.loadUser(userID)
+	if !ok {
+		return nil, false, nil
+	}
+	v, ok := cache.data.Load(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if ev, isExp := v.(*expiringValue); isExp {
+		if ev.expired(m.now()) {
+			if cache.data.CompareAndDelete(key, v) {
+				m.forgetKey(userID, key)
+			}
+			return nil, false, nil
 		}
-		return v, ok
+		v = ev.value
 	}
-	return nil, false
+	m.touch(userID, cache)
+	return v, true, nil
 }
 
 // SetMedia appends a media.File into a mediaGroupID for the given user.
 // Hierarchy: user → "media" → mediaGroupID → *MediaData
-func (m *MemoryStorage) SetMedia(_ context.Context, userID int64, mediaGroupID string, file media.File) {
-	// user level
-	u, ok := m.storage.Load(userID)
-	if !ok {
-		cd := cacheDataPool.Get().(*cacheData)
-		u, _ = m.storage.LoadOrStore(userID, cd)
-		if u != cd {
-			cacheDataPool.Put(cd)
-		}
+func (m *MemoryStorage) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	userCache := u.(*cacheData)
+
+	// user level
+	userCache := m.userCache(userID)
 
 	// "media" level
 	mv, ok := userCache.data.Load("media")
@@ -165,54 +544,103 @@ func (m *MemoryStorage) SetMedia(_ context.Context, userID int64, mediaGroupID s
 
 	md.AddFile(file)
 	md.Touch()
-	m.touch(userID)
+	m.touchKey(userID, userCache, mediaKey(mediaGroupID), func() int64 { return entryOverhead + approxSize(file) }, false)
+	return nil
 }
 
 // GetMedia retrieves MediaData for a given user and mediaGroupID.
-func (m *MemoryStorage) GetMedia(_ context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool) {
-	u, ok := m.storage.Load(userID)
-	if !ok {
-		return nil, false
+func (m *MemoryStorage) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
 	}
-	userCache := u.(*cacheData)
 
-	mv, ok := userCache.data.Load("media")
+	userCache, mediaCache, ok := m.mediaCache(userID)
 	if !ok {
-		return nil, false
+		return nil, false, nil
 	}
-	mediaCache := mv.(*cacheData)
 
 	v, ok := mediaCache.data.Load(mediaGroupID)
 	if !ok {
-		return nil, false
+		return nil, false, nil
 	}
-	m.touch(userID)
-	return v.(*media.MediaData), true
+	m.touch(userID, userCache)
+	return v.(*media.MediaData), true, nil
 }
 
 // CleanMediaCache removes MediaData for a given user and mediaGroupID.
-func (m *MemoryStorage) CleanMediaCache(_ context.Context, userID int64, mediaGroupID string) bool {
-	u, ok := m.storage.Load(userID)
-	if !ok {
-		return false
+func (m *MemoryStorage) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
 	}
-	userCache := u.(*cacheData)
 
-	mv, ok := userCache.data.Load("media")
+	userCache, mediaCache, ok := m.mediaCache(userID)
 	if !ok {
-		return false
+		return false, nil
 	}
-	mediaCache := mv.(*cacheData)
 
 	_, existed := mediaCache.data.LoadAndDelete(mediaGroupID)
 	if existed {
-		m.touch(userID) // consider it an access
+		m.forgetKey(userID, mediaKey(mediaGroupID))
+		m.touch(userID, userCache) // consider it an access
+	}
+	return existed, nil
+}
+
+// mediaCache returns the user's cache and its "media" level, if present.
+func (m *MemoryStorage) mediaCache(userID int64) (*cacheData, *cacheData, bool) {
+	userCache, ok := m.loadUser(userID)
+	if !ok {
+		return nil, nil, false
 	}
-	return existed
+
+	mv, ok := userCache.data.Load("media")
+	if !ok {
+		return nil, nil, false
+	}
+	return userCache, mv.(*cacheData), true
 }
 
 // CleanCache removes all cached data for the given userID.
-func (m *MemoryStorage) CleanCache(_ context.Context, userID int64) {
-	m.storage.Delete(userID)
-	m.lastSeen.Delete(userID)
+func (m *MemoryStorage) CleanCache(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.deleteUser(userID, nil)
+	if m.lru != nil {
+		m.lru.remove(userID)
+	}
+	return nil
+}
+
+// Inspect returns copies of the user's values and media groups.
+func (m *MemoryStorage) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.UserData{}, err
+	}
+
+	out := storage.UserData{Values: make(map[string]any), Media: make(map[string]*media.MediaData)}
+	cd, ok := m.loadUser(userID)
+	if !ok {
+		return out, nil
+	}
+
+	now := m.now()
+	cd.data.Range(func(key, val any) bool {
+		if mc, ok := val.(*cacheData); ok && key == "media" {
+			for group, ms := range snapshotMedia(mc) {
+				out.Media[group] = media.NewMediaData(ms.Files, ms.LastUpdate)
+			}
+			return true
+		}
+		if ev, ok := val.(*expiringValue); ok {
+			if ev.expired(now) {
+				return true
+			}
+			val = ev.value
+		}
+		out.Values[key.(string)] = val
+		return true
+	})
+	return out, nil
 }
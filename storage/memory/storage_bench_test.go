@@ -4,10 +4,11 @@ import (
 	"context"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
 )
 
 func mf(tpe, id string) media.File { return media.File{Type: tpe, FileID: id} }
@@ -26,6 +27,18 @@ func BenchmarkMemoryStorage_Set(b *testing.B) {
 	}
 }
 
+// ограниченное хранилище: каждый Set нового пользователя вытесняет старого
+func BenchmarkMemoryStorage_Set_Bounded(b *testing.B) {
+	store := NewMemoryStorage(30*time.Second, 30*time.Minute, WithMaxUsers(1024), WithMaxBytes(1<<20))
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Set(ctx, int64(i), "k", i)
+	}
+}
+
 func BenchmarkMemoryStorage_Get_Hit(b *testing.B) {
 	store := NewMemoryStorage(30*time.Second, 30*time.Minute)
 	ctx := context.Background()
@@ -35,7 +48,7 @@ func BenchmarkMemoryStorage_Get_Hit(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if v, ok := store.Get(ctx, userID, "k"); !ok || v.(int) == -1 {
+		if v, ok, _ := store.Get(ctx, userID, "k"); !ok || v.(int) == -1 {
 			b.Fail()
 		}
 	}
@@ -49,7 +62,7 @@ func BenchmarkMemoryStorage_Get_Miss(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if _, ok := store.Get(ctx, userID, "absent"); ok {
+		if _, ok, _ := store.Get(ctx, userID, "absent"); ok {
 			b.Fail()
 		}
 	}
@@ -80,7 +93,7 @@ func BenchmarkMemoryStorage_GetMedia_Hit(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if _, ok := store.GetMedia(ctx, userID, groupID); !ok {
+		if _, ok, _ := store.GetMedia(ctx, userID, groupID); !ok {
 			b.Fail()
 		}
 	}
@@ -94,7 +107,7 @@ func BenchmarkMemoryStorage_GetMedia_Miss(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		if _, ok := store.GetMedia(ctx, userID, "absent"); ok {
+		if _, ok, _ := store.GetMedia(ctx, userID, "absent"); ok {
 			b.Fail()
 		}
 	}
@@ -133,7 +146,7 @@ func BenchmarkMemoryStorage_GetMedia_SingleHotGroup_Parallel(b *testing.B) {
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
-			if _, ok := store.GetMedia(ctx, userID, groupID); !ok {
+			if _, ok, _ := store.GetMedia(ctx, userID, groupID); !ok {
 				b.Fail()
 			}
 		}
@@ -233,7 +246,7 @@ func BenchmarkMemoryStorage_Scale_GetMedia(b *testing.B) {
 			for i := 0; i < b.N; i++ {
 				u := uIDs[i%len(uIDs)]
 				g := groups[i%len(groups)]
-				if _, ok := store.GetMedia(ctx, u, g); !ok {
+				if _, ok, _ := store.GetMedia(ctx, u, g); !ok {
 					b.Fail()
 				}
 			}
@@ -344,3 +357,68 @@ func BenchmarkMemoryStorage_CleanCache_WithConcurrentTraffic(b *testing.B) {
 	close(stop)
 	wg.Wait()
 }
+
+// --- истечение и touch на большом числе пользователей ---
+
+// populate creates n users with one value each.
+func populate(b *testing.B, store *MemoryStorage, n int) {
+	b.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		store.Set(ctx, int64(i), "k", i)
+	}
+}
+
+// проход очистки, когда почти никто не истёк: стоимость должна зависеть
+// от числа истекающих пользователей, а не от общего числа
+func BenchmarkMemoryStorage_Evict_FewExpiring(b *testing.B) {
+	for _, users := range []int{10_000, 100_000} {
+		b.Run("users="+strconv.Itoa(users), func(b *testing.B) {
+			store := NewMemoryStorage(time.Hour, time.Hour)
+			defer store.Close()
+			populate(b, store, users)
+			now := time.Now()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				store.evict(now)
+			}
+		})
+	}
+}
+
+// параллельные обращения к разным пользователям: каждое обновляет last-seen
+func BenchmarkMemoryStorage_Touch_Parallel_ManyUsers(b *testing.B) {
+	const users = 100_000
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+	populate(b, store, users)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.Get(ctx, int64(i%users), "k")
+			i += 7919
+		}
+	})
+}
+
+// параллельная регистрация новых пользователей
+func BenchmarkMemoryStorage_Set_NewUsers_Parallel(b *testing.B) {
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+	var next atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.Set(ctx, next.Add(1), "k", 1)
+		}
+	})
+}
@@ -2,11 +2,14 @@ package memory
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"testing"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
 )
 
 func f(tpe, id string) media.File {
@@ -20,12 +23,12 @@ func TestSetAndGet(t *testing.T) {
 
 	store.Set(ctx, userID, "key1", "value1")
 
-	v, ok := store.Get(ctx, userID, "key1")
+	v, ok, _ := store.Get(ctx, userID, "key1")
 	if !ok || v.(string) != "value1" {
 		t.Errorf("expected value1, got %#v", v)
 	}
 
-	_, ok = store.Get(ctx, userID, "nonexistent")
+	_, ok, _ = store.Get(ctx, userID, "nonexistent")
 	if ok {
 		t.Error("expected not found for nonexistent key")
 	}
@@ -42,7 +45,7 @@ func TestSetMediaAndGetMedia(t *testing.T) {
 	store.SetMedia(ctx, userID, groupID, f("video", "id2"))
 
 	// retrieve
-	md, ok := store.GetMedia(ctx, userID, groupID)
+	md, ok, _ := store.GetMedia(ctx, userID, groupID)
 	if !ok {
 		t.Fatal("expected media group to exist")
 	}
@@ -61,21 +64,21 @@ func TestCleanMediaCache(t *testing.T) {
 
 	// add file
 	store.SetMedia(ctx, userID, groupID, f("photo", "id"))
-	if _, ok := store.GetMedia(ctx, userID, groupID); !ok {
+	if _, ok, _ := store.GetMedia(ctx, userID, groupID); !ok {
 		t.Fatal("media not found after set")
 	}
 
 	// clean it
-	ok := store.CleanMediaCache(ctx, userID, groupID)
+	ok, _ := store.CleanMediaCache(ctx, userID, groupID)
 	if !ok {
 		t.Error("expected CleanMediaCache to succeed")
 	}
-	if _, ok := store.GetMedia(ctx, userID, groupID); ok {
+	if _, ok, _ := store.GetMedia(ctx, userID, groupID); ok {
 		t.Error("expected media to be gone after CleanMediaCache")
 	}
 
 	// try cleaning non-existing
-	ok = store.CleanMediaCache(ctx, userID, "nonexistent")
+	ok, _ = store.CleanMediaCache(ctx, userID, "nonexistent")
 	if ok {
 		t.Error("expected false when cleaning nonexistent")
 	}
@@ -89,7 +92,7 @@ func TestCleanCache(t *testing.T) {
 	store.Set(ctx, userID, "k", "v")
 	store.CleanCache(ctx, userID)
 
-	_, ok := store.Get(ctx, userID, "k")
+	_, ok, _ := store.Get(ctx, userID, "k")
 	if ok {
 		t.Error("expected cache to be cleaned")
 	}
@@ -108,14 +111,14 @@ func TestConcurrencySafety(t *testing.T) {
 			defer wg.Done()
 			store.Set(ctx, userID, "key", i)
 			store.SetMedia(ctx, userID, groupID, f("photo", string(rune('A'+i%26))))
-			_, _ = store.Get(ctx, userID, "key")
-			_, _ = store.GetMedia(ctx, userID, groupID)
+			_, _, _ = store.Get(ctx, userID, "key")
+			_, _, _ = store.GetMedia(ctx, userID, groupID)
 		}(i)
 	}
 	wg.Wait()
 
 	// At least last key should exist
-	if v, ok := store.Get(ctx, userID, "key"); !ok {
+	if v, ok, _ := store.Get(ctx, userID, "key"); !ok {
 		t.Error("expected key to exist after concurrency")
 	} else {
 		_ = v
@@ -129,7 +132,7 @@ func TestMediaTouchAndElapsed(t *testing.T) {
 	groupID := "media"
 
 	store.SetMedia(ctx, userID, groupID, f("photo", "123"))
-	md, ok := store.GetMedia(ctx, userID, groupID)
+	md, ok, _ := store.GetMedia(ctx, userID, groupID)
 	if !ok {
 		t.Fatal("media not found")
 	}
@@ -137,3 +140,80 @@ func TestMediaTouchAndElapsed(t *testing.T) {
 		t.Error("just touched media should not be elapsed for 1h")
 	}
 }
+
+func TestCancelledContext(t *testing.T) {
+	store := NewMemoryStorage(30*time.Second, 30*time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.Set(ctx, 1, "k", "v"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Set: expected context.Canceled, got %v", err)
+	}
+	if _, _, err := store.Get(ctx, 1, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Get: expected context.Canceled, got %v", err)
+	}
+	if _, ok, _ := store.Get(context.Background(), 1, "k"); ok {
+		t.Fatal("value must not be stored with a cancelled context")
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", 20*time.Millisecond)
+	store.SetWithTTL(ctx, 1, "plain", "x", 20*time.Millisecond)
+	store.Set(ctx, 1, "plain", "y") // Set drops the expiry
+	store.Set(ctx, 1, "other", "z")
+
+	if v, ok, _ := store.Get(ctx, 1, "otp"); !ok || v != "1234" {
+		t.Fatalf("expected otp before expiry, got (%v, %v)", v, ok)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok, _ := store.Get(ctx, 1, "otp"); ok {
+		t.Fatal("expired value must not be returned")
+	}
+	if v, ok, _ := store.Get(ctx, 1, "plain"); !ok || v != "y" {
+		t.Fatalf("value overwritten by Set must not expire, got (%v, %v)", v, ok)
+	}
+	if _, ok, _ := store.Get(ctx, 1, "other"); !ok {
+		t.Fatal("other values of the user must stay")
+	}
+}
+
+func TestEvictExpiredValues(t *testing.T) {
+	store := NewMemoryStorage(time.Hour, time.Hour)
+	defer store.Close()
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", time.Minute)
+	store.evict(time.Now())
+	u, _ := store.loadUser(1)
+	if _, ok := u.data.Load("otp"); !ok {
+		t.Fatal("live value must stay")
+	}
+
+	store.evict(time.Now().Add(2 * time.Minute))
+
+	if _, ok := u.data.Load("otp"); ok {
+		t.Fatal("cleanup must drop expired values")
+	}
+	if n := store.queue.len(); n != 1 {
+		t.Fatalf("expected only the user's own expiry to stay queued, got %d", n)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+			store := NewMemoryStorage(time.Hour, time.Hour, WithClock(clock.Now))
+			clock.OnAdvance(func(time.Duration) { store.evict(clock.Now()) })
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+		TTL: time.Hour,
+	})
+}
@@ -0,0 +1,161 @@
+package redis
+
+import goredis "github.com/redis/go-redis/v9"
+
+// All scripts receive the same keys and leading arguments:
+//
+//	KEYS[1] data hash, KEYS[2] state, KEYS[3] media index, KEYS[4] expiring values index
+//	ARGV[1] TTL in milliseconds, ARGV[2] media list prefix,
+//	ARGV[3] expiring value prefix, ARGV[4] current time in milliseconds
+//
+// Operation specific arguments start at ARGV[5].
+//
+// Media lists and expiring values are often found only while a script
+// runs, so scripts access them by names built from ARGV[2] and ARGV[3]
+// without declaring them in KEYS. That is safe
+// only because every key of a user carries the user's hash tag and so
+// lives in the same cluster slot as KEYS; NewRedisStorage rejects prefixes
+// that would break the tag. Passing them in KEYS instead would take an
+// extra round trip to list them, racing with the script.
+
+// touchLua refreshes expiry of every key belonging to the user. Values set
+// with SetWithTTL keep their own deadline (the score in KEYS[4]) but never
+// outlive the user, so their expiry is the earlier of the two.
+const touchLua = `
+local function touch()
+	local ttl = tonumber(ARGV[1])
+	local now = tonumber(ARGV[4])
+	redis.call('ZREMRANGEBYSCORE', KEYS[4], '-inf', now)
+	if ttl <= 0 then return end
+	for i = 1, 4 do
+		redis.call('PEXPIRE', KEYS[i], ttl)
+	end
+	for _, g in ipairs(redis.call('HKEYS', KEYS[3])) do
+		redis.call('PEXPIRE', ARGV[2] .. g, ttl)
+	end
+	local exp = redis.call('ZRANGE', KEYS[4], 0, -1, 'WITHSCORES')
+	for i = 1, #exp, 2 do
+		redis.call('PEXPIRE', ARGV[3] .. exp[i], math.min(tonumber(exp[i + 1]) - now, ttl))
+	end
+end
+`
+
+var (
+	setScript = goredis.NewScript(touchLua + `
+redis.call('HSET', KEYS[1], ARGV[5], ARGV[6])
+redis.call('DEL', ARGV[3] .. ARGV[5])
+redis.call('ZREM', KEYS[4], ARGV[5])
+touch()
+return 1
+`)
+
+	setWithTTLScript = goredis.NewScript(touchLua + `
+local ms = tonumber(ARGV[7])
+redis.call('HDEL', KEYS[1], ARGV[5])
+redis.call('SET', ARGV[3] .. ARGV[5], ARGV[6], 'PX', ms)
+redis.call('ZADD', KEYS[4], tonumber(ARGV[4]) + ms, ARGV[5])
+touch()
+return 1
+`)
+
+	setIfAbsentScript = goredis.NewScript(touchLua + `
+if redis.call('EXISTS', ARGV[3] .. ARGV[5]) == 1 or redis.call('HEXISTS', KEYS[1], ARGV[5]) == 1 then
+	touch()
+	return 0
+end
+local ms = tonumber(ARGV[7])
+if ms > 0 then
+	redis.call('SET', ARGV[3] .. ARGV[5], ARGV[6], 'PX', ms)
+	redis.call('ZADD', KEYS[4], tonumber(ARGV[4]) + ms, ARGV[5])
+else
+	redis.call('HSET', KEYS[1], ARGV[5], ARGV[6])
+end
+touch()
+return 1
+`)
+
+	deleteScript = goredis.NewScript(`
+redis.call('HDEL', KEYS[1], ARGV[5])
+redis.call('DEL', ARGV[3] .. ARGV[5])
+redis.call('ZREM', KEYS[4], ARGV[5])
+return 1
+`)
+
+	getScript = goredis.NewScript(touchLua + `
+local v = redis.call('GET', ARGV[3] .. ARGV[5])
+if not v then v = redis.call('HGET', KEYS[1], ARGV[5]) end
+if v then touch() end
+return v
+`)
+
+	setMediaScript = goredis.NewScript(touchLua + `
+redis.call('RPUSH', ARGV[2] .. ARGV[5], ARGV[6])
+redis.call('HSET', KEYS[3], ARGV[5], ARGV[7])
+touch()
+return 1
+`)
+
+	getMediaScript = goredis.NewScript(touchLua + `
+local ts = redis.call('HGET', KEYS[3], ARGV[5])
+if not ts then return false end
+local files = redis.call('LRANGE', ARGV[2] .. ARGV[5], 0, -1)
+touch()
+return {ts, files}
+`)
+
+	cleanMediaScript = goredis.NewScript(touchLua + `
+local n = redis.call('HDEL', KEYS[3], ARGV[5])
+redis.call('DEL', ARGV[2] .. ARGV[5])
+if n == 1 then touch() end
+return n
+`)
+
+	cleanCacheScript = goredis.NewScript(`
+for _, g in ipairs(redis.call('HKEYS', KEYS[3])) do
+	redis.call('DEL', ARGV[2] .. g)
+end
+for _, k in ipairs(redis.call('ZRANGE', KEYS[4], 0, -1)) do
+	redis.call('DEL', ARGV[3] .. k)
+end
+redis.call('DEL', KEYS[1], KEYS[3], KEYS[4])
+return 1
+`)
+
+	createStateScript = goredis.NewScript(touchLua + `
+redis.call('SET', KEYS[2], ARGV[5], 'NX')
+touch()
+return 1
+`)
+
+	setStateScript = goredis.NewScript(touchLua + `
+redis.call('SET', KEYS[2], ARGV[5])
+touch()
+return 1
+`)
+
+	getStateScript = goredis.NewScript(touchLua + `
+local v = redis.call('GET', KEYS[2])
+if v then touch() end
+return v
+`)
+
+	// inspectScript returns {data hash as a flat list, live expiring values
+	// as a flat list, {group, last update, files} per media group} without
+	// touching the user.
+	inspectScript = goredis.NewScript(`
+local values = {}
+for _, k in ipairs(redis.call('ZRANGEBYSCORE', KEYS[4], '(' .. ARGV[4], '+inf')) do
+	local v = redis.call('GET', ARGV[3] .. k)
+	if v then
+		table.insert(values, k)
+		table.insert(values, v)
+	end
+end
+local groups = {}
+local index = redis.call('HGETALL', KEYS[3])
+for i = 1, #index, 2 do
+	table.insert(groups, {index[i], index[i + 1], redis.call('LRANGE', ARGV[2] .. index[i], 0, -1)})
+end
+return {redis.call('HGETALL', KEYS[1]), values, groups}
+`)
+)
@@ -0,0 +1,446 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+)
+
+// RedisStorage is a Redis-backed storage partitioned by userID.
+// It is meant for deployments where several bot replicas share sessions.
+//
+// Every user owns a small set of keys sharing one hash tag, so all of them
+// live in the same cluster slot:
+//
+//	<prefix>:{<userID>}:data          hash  key -> encoded value
+//	<prefix>:{<userID>}:state         string FSM state
+//	<prefix>:{<userID>}:media         hash  mediaGroupID -> last update (unix nano)
+//	<prefix>:{<userID>}:media:<group> list  JSON encoded media.File
+//	<prefix>:{<userID>}:ttl           zset  key -> deadline (unix ms) of SetWithTTL values
+//	<prefix>:{<userID>}:ttl:<key>     string encoded value with native expiry
+//
+// Each access refreshes native Redis expiry of all user keys, which gives
+// the same "inactive for longer than TTL" semantics as the memory storage
+// without a cleanup worker. Multi-key operations run as Lua scripts, so they
+// are atomic with respect to other replicas.
+//
+// Values passed to Set are serialised with a codec.Codec (codec.JSON by
+// default), so Get returns them with their original Go type. Custom types
+// must be registered with codec.Register.
+type RedisStorage struct {
+	client goredis.UniversalClient
+	codec  codec.Codec
+	prefix string
+	ttl    time.Duration
+	now    func() time.Time // clock passed to scripts
+}
+
+// Option configures a RedisStorage.
+type Option func(*RedisStorage)
+
+// WithPrefix sets the prefix for all keys written by the storage.
+// Use distinct prefixes to let several bots share one Redis database.
+// The prefix must not contain braces, which would replace the per-user
+// hash tag.
+func WithPrefix(prefix string) Option {
+	return func(r *RedisStorage) {
+		r.prefix = prefix
+	}
+}
+
+// WithCodec sets the codec used to serialise values passed to Set.
+func WithCodec(c codec.Codec) Option {
+	return func(r *RedisStorage) {
+		r.codec = c
+	}
+}
+
+// WithTTL sets how long user data is kept after the last access.
+// A non-positive value disables expiry.
+func WithTTL(ttl time.Duration) Option {
+	return func(r *RedisStorage) {
+		r.ttl = ttl
+	}
+}
+
+// WithClock sets the source of the current time passed to scripts for
+// deadlines of values set with SetWithTTL and media timestamps. Key expiry
+// itself follows the Redis server clock. It exists for tests, e.g. with
+// storagetest.Clock.
+func WithClock(now func() time.Time) Option {
+	return func(r *RedisStorage) {
+		r.now = now
+	}
+}
+
+// NewRedisStorage creates a RedisStorage on top of the given client.
+// The client lifecycle stays with the caller: Close does not close it.
+// It panics if the prefix set with WithPrefix contains braces.
+func NewRedisStorage(client goredis.UniversalClient, opts ...Option) *RedisStorage {
+	r := &RedisStorage{
+		client: client,
+		codec:  codec.JSON,
+		prefix: "fsm",
+		ttl:    30 * time.Minute,
+		now:    time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+	// Scripts reach keys not declared in KEYS, relying on the hash tag.
+	if strings.ContainsAny(r.prefix, "{}") {
+		panic(fmt.Sprintf("fsm/storage/redis: prefix %q must not contain braces", r.prefix))
+	}
+
+	return r
+}
+
+// Close is a no-op: the Redis client is owned by the caller.
+func (r *RedisStorage) Close() error { return nil }
+
+// keys returns the fixed per-user keys (data, state, media index,
+// expiring values index) and the prefixes of media lists and expiring values.
+func (r *RedisStorage) keys(userID int64) ([]string, string, string) {
+	base := r.prefix + ":{" + strconv.FormatInt(userID, 10) + "}:"
+	return []string{base + "data", base + "state", base + "media", base + "ttl"}, base + "media:", base + "ttl:"
+}
+
+// run executes a script with the common user keys and arguments
+// (TTL and current time in milliseconds, key prefixes) followed by args.
+func (r *RedisStorage) run(ctx context.Context, s *goredis.Script, userID int64, args ...any) *goredis.Cmd {
+	keys, mediaPrefix, valuePrefix := r.keys(userID)
+	argv := append([]any{r.ttl.Milliseconds(), mediaPrefix, valuePrefix, r.now().UnixMilli()}, args...)
+	return s.Run(ctx, r.client, keys, argv...)
+}
+
+// Set stores a key/value pair for the given userID.
+func (r *RedisStorage) Set(ctx context.Context, userID int64, key string, value any) error {
+	raw, err := r.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return r.run(ctx, setScript, userID, key, raw).Err()
+}
+
+// SetWithTTL stores a key/value pair in its own Redis key with native expiry
+// after ttl. Activity of the user does not extend it, but it never outlives
+// the user's keys. A non-positive ttl behaves like Set.
+func (r *RedisStorage) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return r.Set(ctx, userID, key, value)
+	}
+	raw, err := r.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return r.run(ctx, setWithTTLScript, userID, key, raw, max(ttl.Milliseconds(), 1)).Err()
+}
+
+// SetIfAbsent stores a key/value pair like SetWithTTL unless the key holds
+// an unexpired value, and reports whether it stored it. The check and the
+// write run in one script.
+func (r *RedisStorage) SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	raw, err := r.codec.Encode(value)
+	if err != nil {
+		return false, err
+	}
+	var ms int64
+	if ttl > 0 {
+		ms = max(ttl.Milliseconds(), 1)
+	}
+	n, err := r.run(ctx, setIfAbsentScript, userID, key, raw, ms).Int()
+	return n == 1, err
+}
+
+// Delete removes the value of key for the given userID.
+func (r *RedisStorage) Delete(ctx context.Context, userID int64, key string) error {
+	return r.run(ctx, deleteScript, userID, key).Err()
+}
+
+// Get retrieves a value by key for the given userID.
+func (r *RedisStorage) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	raw, err := r.run(ctx, getScript, userID, key).Text()
+	if errors.Is(err, goredis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	v, err := r.codec.Decode([]byte(raw))
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, nil
+}
+
+// SetMedia atomically appends a media.File into a mediaGroupID for the given user.
+func (r *RedisStorage) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	raw, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return r.run(ctx, setMediaScript, userID, mediaGroupID, raw, r.now().UnixNano()).Err()
+}
+
+// GetMedia retrieves MediaData for a given user and mediaGroupID.
+// The returned value is a snapshot: adding files to it does not affect Redis.
+func (r *RedisStorage) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	res, err := r.run(ctx, getMediaScript, userID, mediaGroupID).Slice()
+	if errors.Is(err, goredis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res) != 2 {
+		return nil, false, fmt.Errorf("fsm/redis: unexpected media reply of %d items", len(res))
+	}
+
+	md, err := decodeMedia(res[0], res[1])
+	if err != nil {
+		return nil, false, err
+	}
+	return md, true, nil
+}
+
+// decodeMedia builds MediaData from a script reply: the last update time
+// in unix nanoseconds and the list of JSON encoded files.
+func decodeMedia(ts, list any) (*media.MediaData, error) {
+	s, _ := ts.(string)
+	nanos, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("fsm/redis: bad media timestamp: %w", err)
+	}
+
+	items, _ := list.([]any)
+	files := make([]media.File, 0, len(items))
+	for _, it := range items {
+		s, _ := it.(string)
+		var f media.File
+		if err := json.Unmarshal([]byte(s), &f); err != nil {
+			return nil, fmt.Errorf("fsm/redis: bad media file: %w", err)
+		}
+		files = append(files, f)
+	}
+
+	return media.NewMediaData(files, time.Unix(0, nanos)), nil
+}
+
+// CleanMediaCache removes MediaData for a given user and mediaGroupID.
+func (r *RedisStorage) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	n, err := r.run(ctx, cleanMediaScript, userID, mediaGroupID).Int()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// CleanCache removes all cached data and media for the given userID.
+// The user's FSM state is kept.
+func (r *RedisStorage) CleanCache(ctx context.Context, userID int64) error {
+	return r.run(ctx, cleanCacheScript, userID).Err()
+}
+
+// CreateState stores state for the user only if no state exists yet.
+func (r *RedisStorage) CreateState(ctx context.Context, userID int64, state string) error {
+	return r.run(ctx, createStateScript, userID, state).Err()
+}
+
+// SetState stores state for the user.
+func (r *RedisStorage) SetState(ctx context.Context, userID int64, state string) error {
+	return r.run(ctx, setStateScript, userID, state).Err()
+}
+
+// GetState returns the user's state and refreshes expiry of the user keys.
+func (r *RedisStorage) GetState(ctx context.Context, userID int64) (string, bool, error) {
+	st, err := r.run(ctx, getStateScript, userID).Text()
+	if errors.Is(err, goredis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return st, true, nil
+}
+
+// PeekState returns the user's state without refreshing expiry.
+func (r *RedisStorage) PeekState(ctx context.Context, userID int64) (string, bool, error) {
+	keys, _, _ := r.keys(userID)
+	st, err := r.client.Get(ctx, keys[1]).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return st, true, nil
+}
+
+// Sessions lists stored states by scanning for state keys; with a cluster
+// client every master is scanned in turn. Redis does not record access
+// times, so LastSeen is derived from the remaining expiry of the state key
+// and is zero when TTL is disabled.
+func (r *RedisStorage) Sessions(ctx context.Context) iter.Seq2[storage.Session, error] {
+	return func(yield func(storage.Session, error) bool) {
+		nodes, err := r.nodes(ctx)
+		if err != nil {
+			yield(storage.Session{}, err)
+			return
+		}
+		for _, node := range nodes {
+			if !r.scanSessions(ctx, node, yield) {
+				return
+			}
+		}
+	}
+}
+
+// nodes returns the clients to scan: every master of a cluster, or the
+// client itself.
+func (r *RedisStorage) nodes(ctx context.Context) ([]goredis.Cmdable, error) {
+	cc, ok := r.client.(*goredis.ClusterClient)
+	if !ok {
+		return []goredis.Cmdable{r.client}, nil
+	}
+
+	var (
+		mu    sync.Mutex
+		nodes []goredis.Cmdable
+	)
+	err := cc.ForEachMaster(ctx, func(_ context.Context, c *goredis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, c)
+		return nil
+	})
+	return nodes, err
+}
+
+// scanSessions yields the sessions stored on one node and reports whether
+// the caller wants more.
+func (r *RedisStorage) scanSessions(ctx context.Context, node goredis.Cmdable, yield func(storage.Session, error) bool) bool {
+	match := r.prefix + ":{*}:state"
+
+	var cursor uint64
+	for {
+		keys, next, err := node.Scan(ctx, cursor, match, 100).Result()
+		if err != nil {
+			yield(storage.Session{}, err)
+			return false
+		}
+
+		sessions, err := r.readSessions(ctx, node, keys)
+		if err != nil {
+			yield(storage.Session{}, err)
+			return false
+		}
+		for _, sess := range sessions {
+			if !yield(sess, nil) {
+				return false
+			}
+		}
+
+		if cursor = next; cursor == 0 {
+			return true
+		}
+	}
+}
+
+// readSessions loads state and remaining expiry of the given state keys.
+// Keys that expired since the scan are skipped.
+func (r *RedisStorage) readSessions(ctx context.Context, node goredis.Cmdable, keys []string) ([]storage.Session, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	pipe := node.Pipeline()
+	states := make([]*goredis.StringCmd, len(keys))
+	ttls := make([]*goredis.DurationCmd, len(keys))
+	for i, k := range keys {
+		states[i] = pipe.Get(ctx, k)
+		ttls[i] = pipe.PTTL(ctx, k)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, goredis.Nil) {
+		return nil, err
+	}
+
+	now := r.now()
+	out := make([]storage.Session, 0, len(keys))
+	for i, k := range keys {
+		st, err := states[i].Result()
+		if errors.Is(err, goredis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseInt(k[strings.LastIndex(k, "{")+1:strings.LastIndex(k, "}")], 10, 64)
+		if err != nil {
+			continue // not a key written by this storage
+		}
+
+		sess := storage.Session{UserID: uid, State: st}
+		if left := ttls[i].Val(); r.ttl > 0 && left > 0 {
+			sess.LastSeen = now.Add(left - r.ttl)
+		}
+		out = append(out, sess)
+	}
+	return out, nil
+}
+
+// Inspect returns the user's live values and media groups in one script
+// call, without refreshing expiry.
+func (r *RedisStorage) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	out := storage.UserData{Values: make(map[string]any), Media: make(map[string]*media.MediaData)}
+
+	res, err := r.run(ctx, inspectScript, userID).Slice()
+	if err != nil {
+		return out, err
+	}
+	if len(res) != 3 {
+		return out, fmt.Errorf("fsm/redis: unexpected inspect reply of %d items", len(res))
+	}
+
+	data, _ := res[0].([]any)
+	expiring, _ := res[1].([]any)
+	for _, pairs := range [][]any{data, expiring} { // expiring values win, as in Get
+		for i := 0; i+1 < len(pairs); i += 2 {
+			k, _ := pairs[i].(string)
+			raw, _ := pairs[i+1].(string)
+			v, err := r.codec.Decode([]byte(raw))
+			if err != nil {
+				return out, err
+			}
+			out.Values[k] = v
+		}
+	}
+
+	groups, _ := res[2].([]any)
+	for _, g := range groups {
+		parts, _ := g.([]any)
+		if len(parts) != 3 {
+			return out, fmt.Errorf("fsm/redis: unexpected media group reply of %d items", len(parts))
+		}
+		name, _ := parts[0].(string)
+		md, err := decodeMedia(parts[1], parts[2])
+		if err != nil {
+			return out, err
+		}
+		out.Media[name] = md
+	}
+	return out, nil
+}
@@ -0,0 +1,384 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	goredis "github.com/redis/go-redis/v9"
+
+	fsm "github.com/whynot00/go-telegram-fsm/v2"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+func f(tpe, id string) media.File {
+	return media.File{Type: tpe, FileID: id}
+}
+
+// newTestStorage starts an in-process Redis stand-in and returns a storage bound to it.
+func newTestStorage(t *testing.T, opts ...Option) (*RedisStorage, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedisStorage(client, opts...), mr
+}
+
+func TestSetAndGet(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	store.Set(ctx, userID, "key1", "value1")
+
+	v, ok, _ := store.Get(ctx, userID, "key1")
+	if !ok || v.(string) != "value1" {
+		t.Errorf("expected value1, got %#v", v)
+	}
+
+	_, ok, _ = store.Get(ctx, userID, "nonexistent")
+	if ok {
+		t.Error("expected not found for nonexistent key")
+	}
+}
+
+func TestSetMediaAndGetMedia(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(42)
+	groupID := "grp1"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id1"))
+	store.SetMedia(ctx, userID, groupID, f("video", "id2"))
+
+	md, ok, _ := store.GetMedia(ctx, userID, groupID)
+	if !ok {
+		t.Fatal("expected media group to exist")
+	}
+
+	files := md.Files()
+	if len(files) != 2 || files[0].FileID != "id1" || files[1].FileID != "id2" {
+		t.Errorf("unexpected files: %+v", files)
+	}
+	if md.Elapsed(time.Minute) {
+		t.Error("last update should be recent")
+	}
+
+	if _, ok, _ := store.GetMedia(ctx, userID, "other"); ok {
+		t.Error("expected unknown group to be missing")
+	}
+}
+
+func TestCleanMediaCache(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(99)
+	groupID := "g"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id"))
+	if ok, _ := store.CleanMediaCache(ctx, userID, groupID); !ok {
+		t.Error("expected CleanMediaCache to succeed")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, groupID); ok {
+		t.Error("expected media to be gone after CleanMediaCache")
+	}
+	if ok, _ := store.CleanMediaCache(ctx, userID, "nonexistent"); ok {
+		t.Error("expected false when cleaning nonexistent")
+	}
+}
+
+func TestCleanCacheKeepsState(t *testing.T) {
+	store, mr := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(100)
+
+	store.SetState(ctx, userID, "step")
+	store.Set(ctx, userID, "k", "v")
+	store.SetMedia(ctx, userID, "g", f("photo", "id"))
+	store.CleanCache(ctx, userID)
+
+	if _, ok, _ := store.Get(ctx, userID, "k"); ok {
+		t.Error("expected cache to be cleaned")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, "g"); ok {
+		t.Error("expected media to be cleaned")
+	}
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "step" {
+		t.Errorf("state must survive CleanCache, got (%q, %v)", st, ok)
+	}
+	if keys := mr.Keys(); len(keys) != 1 {
+		t.Errorf("expected only the state key to remain, got %v", keys)
+	}
+}
+
+func TestStates(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(7)
+
+	if _, ok, _ := store.GetState(ctx, userID); ok {
+		t.Fatal("expected no state for new user")
+	}
+
+	store.CreateState(ctx, userID, "default")
+	store.SetState(ctx, userID, "custom")
+	store.CreateState(ctx, userID, "default")
+
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "custom" {
+		t.Fatalf("CreateState must not overwrite existing state, got (%q, %v)", st, ok)
+	}
+}
+
+func TestTTLExpiry(t *testing.T) {
+	store, mr := newTestStorage(t, WithTTL(time.Minute))
+	ctx := context.Background()
+	userID := int64(5)
+
+	store.SetState(ctx, userID, "s")
+	store.Set(ctx, userID, "k", "v")
+	store.SetMedia(ctx, userID, "g", f("photo", "id"))
+
+	// access in the middle of the TTL prolongs every key of the user
+	mr.FastForward(40 * time.Second)
+	if _, ok, _ := store.Get(ctx, userID, "k"); !ok {
+		t.Fatal("value expired too early")
+	}
+	mr.FastForward(40 * time.Second)
+	if _, ok, _ := store.GetMedia(ctx, userID, "g"); !ok {
+		t.Fatal("media was not prolonged by access")
+	}
+
+	mr.FastForward(2 * time.Minute)
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("expected all keys to expire, got %v", mr.Keys())
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	store, mr := newTestStorage(t, WithPrefix("bot1"))
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	if !mr.Exists("bot1:{1}:data") {
+		t.Fatalf("expected prefixed key, got %v", mr.Keys())
+	}
+}
+
+func TestPrefixWithBraces(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a prefix breaking the hash tag must panic")
+		}
+	}()
+	newTestStorage(t, WithPrefix("{bots}"))
+}
+
+func TestConcurrentMediaAppend(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.SetMedia(ctx, userID, "grp", f("photo", string(rune('A'+i%26))))
+		}(i)
+	}
+	wg.Wait()
+
+	md, ok, _ := store.GetMedia(ctx, userID, "grp")
+	if !ok || len(md.Files()) != 50 {
+		t.Fatalf("expected 50 files after concurrent appends, got %v", md)
+	}
+}
+
+func TestFSMSharesStateAcrossReplicas(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+
+	// two FSM instances on the same Redis behave like two bot replicas
+	replicaA := fsm.New(ctx, fsm.WithStorage(store))
+	replicaB := fsm.New(ctx, fsm.WithStorage(store))
+
+	upd := &models.Update{Message: &models.Message{From: &models.User{ID: 10}}}
+
+	fsm.Middleware(replicaA)(func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		replicaA.Transition(ctx, "step")
+	})(ctx, nil, upd)
+
+	var got fsm.StateFSM
+	fsm.Middleware(replicaB)(func(ctx context.Context, _ *bot.Bot, _ *models.Update) {
+		got, _, _ = replicaB.CurrentState(ctx)
+	})(ctx, nil, upd)
+
+	if got != "step" {
+		t.Fatalf("replica B does not see state from A, got %q", got)
+	}
+}
+
+type profile struct {
+	Name string
+	Age  int
+}
+
+func init() {
+	codec.Register(profile{})
+}
+
+func TestCodecPreservesType(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.Gob} {
+		store, _ := newTestStorage(t, WithCodec(c))
+		ctx := context.Background()
+
+		store.Set(ctx, 1, "profile", profile{Name: "Ann", Age: 30})
+		store.Set(ctx, 1, "age", 30)
+
+		if v, ok, _ := store.Get(ctx, 1, "profile"); !ok || v.(profile) != (profile{Name: "Ann", Age: 30}) {
+			t.Errorf("expected profile to round-trip, got (%#v, %v)", v, ok)
+		}
+		if v, ok, _ := store.Get(ctx, 1, "age"); !ok || v.(int) != 30 {
+			t.Errorf("expected int to round-trip, got (%#v, %v)", v, ok)
+		}
+
+		// values the codec cannot encode are rejected and not stored
+		if err := store.Set(ctx, 1, "ch", make(chan int)); !errors.Is(err, codec.ErrUnregisteredType) {
+			t.Errorf("expected ErrUnregisteredType, got %v", err)
+		}
+		if _, ok, _ := store.Get(ctx, 1, "ch"); ok {
+			t.Error("unencodable value must not be stored")
+		}
+	}
+}
+
+func TestServerErrorsAreReturned(t *testing.T) {
+	store, mr := newTestStorage(t)
+	ctx := context.Background()
+
+	mr.Close()
+
+	if err := store.Set(ctx, 1, "k", "v"); err == nil {
+		t.Fatal("expected Set to fail when Redis is down")
+	}
+	if _, _, err := store.GetState(ctx, 1); err == nil {
+		t.Fatal("expected GetState to fail when Redis is down")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := store.Get(cancelled, 1, "k"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store, mr := newTestStorage(t, WithTTL(time.Hour))
+	ctx := context.Background()
+
+	// keep the clock passed to scripts in step with miniredis
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	forward := func(d time.Duration) {
+		now = now.Add(d)
+		mr.FastForward(d)
+	}
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", time.Minute)
+	store.Set(ctx, 1, "name", "Ann")
+
+	if v, ok, _ := store.Get(ctx, 1, "otp"); !ok || v != "1234" {
+		t.Fatalf("expected otp before expiry, got (%v, %v)", v, ok)
+	}
+	if ttl := mr.TTL("fsm:{1}:ttl:otp"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected native expiry on the value key, got %v", ttl)
+	}
+
+	// activity does not prolong the value beyond its own TTL
+	forward(40 * time.Second)
+	store.Get(ctx, 1, "name")
+	forward(30 * time.Second)
+
+	if _, ok, _ := store.Get(ctx, 1, "otp"); ok {
+		t.Fatal("expired value must not be returned")
+	}
+	if _, ok, _ := store.Get(ctx, 1, "name"); !ok {
+		t.Fatal("other values of the user must stay")
+	}
+}
+
+func TestSetWithTTL_BoundedByUserTTL(t *testing.T) {
+	store, mr := newTestStorage(t, WithTTL(time.Minute))
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "marker", true, time.Hour)
+	if ttl := mr.TTL("fsm:{1}:ttl:marker"); ttl > time.Minute {
+		t.Fatalf("value must not outlive the user, got TTL %v", ttl)
+	}
+}
+
+func TestSetWithTTL_SetAndCleanCache(t *testing.T) {
+	store, mr := newTestStorage(t)
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "k", "short", time.Minute)
+	store.Set(ctx, 1, "k", "long")
+	if mr.Exists("fsm:{1}:ttl:k") {
+		t.Fatal("Set must drop the expiring copy")
+	}
+	if v, _, _ := store.Get(ctx, 1, "k"); v != "long" {
+		t.Fatalf("expected plain value, got %v", v)
+	}
+
+	store.SetWithTTL(ctx, 1, "otp", "1", time.Minute)
+	store.CleanCache(ctx, 1)
+	if len(mr.Keys()) != 0 {
+		t.Fatalf("CleanCache must remove expiring values too, got %v", mr.Keys())
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+			store, mr := newTestStorage(t, WithTTL(time.Hour), WithClock(clock.Now))
+			clock.OnAdvance(mr.FastForward)
+			return store
+		},
+		TTL: time.Hour,
+	})
+}
+
+func TestSessions_LastSeen(t *testing.T) {
+	clock := storagetest.NewClock()
+	store, mr := newTestStorage(t, WithTTL(time.Hour), WithClock(clock.Now))
+	ctx := context.Background()
+
+	store.SetState(ctx, 1, "start")
+	seen := clock.Now()
+	mr.FastForward(10 * time.Minute)
+	clock.Advance(10 * time.Minute)
+
+	var got []storage.Session
+	for sess, err := range store.Sessions(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, sess)
+	}
+	if len(got) != 1 || got[0].UserID != 1 || got[0].State != "start" {
+		t.Fatalf("unexpected sessions %+v", got)
+	}
+	if d := got[0].LastSeen.Sub(seen); d < -time.Second || d > time.Second {
+		t.Fatalf("last seen %v, expected about %v", got[0].LastSeen, seen)
+	}
+}
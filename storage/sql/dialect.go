@@ -0,0 +1,52 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Dialect selects SQL flavour specific details: placeholders and schema types.
+type Dialect int
+
+const (
+	// Postgres targets PostgreSQL (any database/sql driver, e.g. pgx or lib/pq).
+	Postgres Dialect = iota
+
+	// SQLite targets SQLite 3.24+ (e.g. modernc.org/sqlite or mattn/go-sqlite3).
+	SQLite
+)
+
+// String returns the dialect name, which is also its migrations directory.
+func (d Dialect) String() string {
+	switch d {
+	case Postgres:
+		return "postgres"
+	case SQLite:
+		return "sqlite"
+	}
+	return "unknown"
+}
+
+// rebind converts '?' placeholders into the dialect's form.
+// Queries are written with '?' and rebound once at construction time.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var (
+		sb strings.Builder
+		n  int
+	)
+	sb.Grow(len(query) + 8)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteByte('$')
+			sb.WriteString(strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
@@ -0,0 +1,125 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// Migrate creates or upgrades the storage schema for the given dialect.
+// Applied versions are tracked in the fsm_schema_migrations table, so it is
+// safe to call on every start. NewSQLStorage calls it unless disabled.
+func Migrate(ctx context.Context, db *dbsql.DB, d Dialect) error {
+	dir := path.Join("migrations", d.String())
+	entries, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return fmt.Errorf("fsm/sql: no migrations for dialect %s: %w", d, err)
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS fsm_schema_migrations (version BIGINT PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("fsm/sql: create migrations table: %w", err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".sql") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version, err := strconv.ParseInt(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("fsm/sql: bad migration name %q: %w", name, err)
+		}
+
+		body, err := migrations.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		if err := applyMigration(ctx, db, d, version, string(body)); err != nil {
+			return fmt.Errorf("fsm/sql: migration %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrationLock is the key of the PostgreSQL advisory lock serialising
+// migrations of replicas starting together.
+const migrationLock int64 = 0x66736d5f6d696772 // "fsm_migr"
+
+// applyMigration runs a single migration file in a transaction unless its
+// version is already recorded. On PostgreSQL the transaction holds an
+// advisory lock, so concurrent callers apply it one after another; other
+// dialects may fail on the second attempt, which is then taken as success
+// once the version is found recorded.
+func applyMigration(ctx context.Context, db *dbsql.DB, d Dialect, version int64, body string) error {
+	err := runMigration(ctx, db, d, version, body)
+	if err == nil {
+		return nil
+	}
+	if applied, cerr := migrationApplied(ctx, db, d, version); cerr == nil && applied {
+		return nil // applied concurrently by another replica
+	}
+	return err
+}
+
+// querier is the part of *sql.DB and *sql.Tx used by migrationApplied.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *dbsql.Row
+}
+
+// migrationApplied reports whether version is recorded.
+func migrationApplied(ctx context.Context, q querier, d Dialect, version int64) (bool, error) {
+	var n int
+	err := q.QueryRowContext(ctx,
+		d.rebind(`SELECT COUNT(*) FROM fsm_schema_migrations WHERE version = ?`), version).Scan(&n)
+	return n > 0, err
+}
+
+// runMigration applies a migration unless its version is recorded.
+func runMigration(ctx context.Context, db *dbsql.DB, d Dialect, version int64, body string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if d == Postgres {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+			return err
+		}
+	}
+	if applied, err := migrationApplied(ctx, tx, d, version); err != nil || applied {
+		return err
+	}
+
+	for _, stmt := range strings.Split(body, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		d.rebind(`INSERT INTO fsm_schema_migrations (version) VALUES (?)`), version); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
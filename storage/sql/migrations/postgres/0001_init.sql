@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS fsm_users (
+    user_id   BIGINT PRIMARY KEY,
+    last_seen BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS fsm_values (
+    user_id BIGINT NOT NULL,
+    name    TEXT   NOT NULL,
+    value   BYTEA  NOT NULL,
+    PRIMARY KEY (user_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS fsm_media_groups (
+    user_id     BIGINT NOT NULL,
+    group_id    TEXT   NOT NULL,
+    last_update BIGINT NOT NULL,
+    PRIMARY KEY (user_id, group_id)
+);
+
+CREATE TABLE IF NOT EXISTS fsm_media_files (
+    id        BIGSERIAL PRIMARY KEY,
+    user_id   BIGINT NOT NULL,
+    group_id  TEXT   NOT NULL,
+    file_type TEXT   NOT NULL,
+    file_id   TEXT   NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fsm_media_files_group ON fsm_media_files (user_id, group_id);
+
+CREATE TABLE IF NOT EXISTS fsm_states (
+    user_id BIGINT PRIMARY KEY,
+    state   TEXT   NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fsm_users_last_seen ON fsm_users (last_seen);
@@ -0,0 +1,3 @@
+ALTER TABLE fsm_values ADD COLUMN expires_at BIGINT;
+
+CREATE INDEX IF NOT EXISTS fsm_values_expires_at ON fsm_values (expires_at);
@@ -0,0 +1,122 @@
+package sql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// queries holds every statement used by SQLStorage, already rebound
+// to the dialect's placeholder syntax.
+type queries struct {
+	touch string
+
+	setValue     string
+	setValueTTL  string
+	claimValue   string // takes the current time last
+	getValue     string
+	deleteValue  string
+	expireValues string // takes the current time
+	listValues   string // takes user_id and the current time
+
+	addMediaFile     string
+	touchMediaGroup  string
+	getMediaGroup    string
+	getMediaFiles    string
+	listMediaGroups  string
+	deleteMediaGroup string
+	deleteMediaFiles string
+
+	createState string
+	setState    string
+	getState    string
+	listStates  string // takes the last user_id seen and a page size
+
+	cleanCache   []string // each takes user_id
+	expiredUsers string   // takes the last_seen deadline; locks the rows on PostgreSQL
+	expire       []string // each takes a list of user IDs, see in
+
+	dialect Dialect
+}
+
+// in fills the "%s" of an expire statement with n placeholders.
+func (q queries) in(stmt string, n int) string {
+	return q.dialect.rebind(fmt.Sprintf(stmt, strings.TrimSuffix(strings.Repeat("?, ", n), ", ")))
+}
+
+// newQueries prepares the statements for the dialect.
+// ON CONFLICT upserts are understood by both PostgreSQL and SQLite.
+func newQueries(d Dialect) queries {
+	expiredUsers := `SELECT user_id FROM fsm_users WHERE last_seen < ?`
+	if d == Postgres {
+		// Writers touch the user first, so a locked user cannot become
+		// active until cleanup has deleted it.
+		expiredUsers += ` FOR UPDATE`
+	}
+
+	q := queries{
+		dialect: d,
+
+		touch: `INSERT INTO fsm_users (user_id, last_seen) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET last_seen = excluded.last_seen`,
+
+		setValue: `INSERT INTO fsm_values (user_id, name, value, expires_at) VALUES (?, ?, ?, NULL)
+			ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value, expires_at = NULL`,
+		setValueTTL: `INSERT INTO fsm_values (user_id, name, value, expires_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at`,
+		claimValue: `INSERT INTO fsm_values (user_id, name, value, expires_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (user_id, name) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at
+			WHERE fsm_values.expires_at IS NOT NULL AND fsm_values.expires_at <= ?`,
+		getValue: `SELECT value FROM fsm_values
+			WHERE user_id = ? AND name = ? AND (expires_at IS NULL OR expires_at > ?)`,
+		deleteValue:  `DELETE FROM fsm_values WHERE user_id = ? AND name = ?`,
+		expireValues: `DELETE FROM fsm_values WHERE expires_at IS NOT NULL AND expires_at <= ?`,
+		listValues: `SELECT name, value FROM fsm_values
+			WHERE user_id = ? AND (expires_at IS NULL OR expires_at > ?)`,
+
+		addMediaFile: `INSERT INTO fsm_media_files (user_id, group_id, file_type, file_id) VALUES (?, ?, ?, ?)`,
+		touchMediaGroup: `INSERT INTO fsm_media_groups (user_id, group_id, last_update) VALUES (?, ?, ?)
+			ON CONFLICT (user_id, group_id) DO UPDATE SET last_update = excluded.last_update`,
+		getMediaGroup:    `SELECT last_update FROM fsm_media_groups WHERE user_id = ? AND group_id = ?`,
+		getMediaFiles:    `SELECT file_type, file_id FROM fsm_media_files WHERE user_id = ? AND group_id = ? ORDER BY id`,
+		listMediaGroups:  `SELECT group_id, last_update FROM fsm_media_groups WHERE user_id = ?`,
+		deleteMediaGroup: `DELETE FROM fsm_media_groups WHERE user_id = ? AND group_id = ?`,
+		deleteMediaFiles: `DELETE FROM fsm_media_files WHERE user_id = ? AND group_id = ?`,
+
+		createState: `INSERT INTO fsm_states (user_id, state) VALUES (?, ?)
+			ON CONFLICT (user_id) DO NOTHING`,
+		setState: `INSERT INTO fsm_states (user_id, state) VALUES (?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET state = excluded.state`,
+		getState: `SELECT state FROM fsm_states WHERE user_id = ?`,
+		listStates: `SELECT s.user_id, s.state, COALESCE(u.last_seen, 0) FROM fsm_states s
+			LEFT JOIN fsm_users u ON u.user_id = s.user_id
+			WHERE s.user_id > ? ORDER BY s.user_id LIMIT ?`,
+
+		cleanCache: []string{
+			`DELETE FROM fsm_values WHERE user_id = ?`,
+			`DELETE FROM fsm_media_groups WHERE user_id = ?`,
+			`DELETE FROM fsm_media_files WHERE user_id = ?`,
+		},
+		expiredUsers: expiredUsers,
+		expire: []string{
+			`DELETE FROM fsm_values WHERE user_id IN (%s)`,
+			`DELETE FROM fsm_media_groups WHERE user_id IN (%s)`,
+			`DELETE FROM fsm_media_files WHERE user_id IN (%s)`,
+			`DELETE FROM fsm_states WHERE user_id IN (%s)`,
+			`DELETE FROM fsm_users WHERE user_id IN (%s)`,
+		},
+	}
+
+	for _, s := range []*string{
+		&q.touch, &q.setValue, &q.setValueTTL, &q.claimValue, &q.getValue, &q.deleteValue, &q.expireValues, &q.listValues,
+		&q.addMediaFile, &q.touchMediaGroup, &q.getMediaGroup, &q.getMediaFiles, &q.listMediaGroups,
+		&q.deleteMediaGroup, &q.deleteMediaFiles,
+		&q.createState, &q.setState, &q.getState, &q.listStates, &q.expiredUsers,
+	} {
+		*s = d.rebind(*s)
+	}
+	for i := range q.cleanCache {
+		q.cleanCache[i] = d.rebind(q.cleanCache[i])
+	}
+
+	return q
+}
@@ -0,0 +1,554 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"iter"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+)
+
+// SQLStorage is a database/sql backed storage partitioned by userID.
+// It keeps cached values, media groups and FSM states in relational tables
+// (see the migrations directory) and tracks a last-seen timestamp per user.
+// A background worker periodically deletes users that were inactive for
+// longer than TTL, together with all their rows. Writes update the user's
+// last-seen time in the same transaction, so a user written to while the
+// worker runs keeps all of its rows.
+//
+// Values passed to Set are serialised with a codec.Codec (codec.JSON by
+// default), so Get returns them with their original Go type. Custom types
+// must be registered with codec.Register.
+type SQLStorage struct {
+	db    *dbsql.DB
+	q     queries
+	codec codec.Codec
+
+	ttl      time.Duration
+	interval time.Duration
+	migrate  bool
+	now      func() time.Time
+
+	stopOnce sync.Once
+	stopFn   context.CancelFunc
+}
+
+// Option configures an SQLStorage.
+type Option func(*SQLStorage)
+
+// WithCodec sets the codec used to serialise values passed to Set.
+func WithCodec(c codec.Codec) Option {
+	return func(s *SQLStorage) {
+		s.codec = c
+	}
+}
+
+// WithTTL sets how long user data is kept after the last access.
+// A non-positive value keeps inactive users forever.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *SQLStorage) {
+		s.ttl = ttl
+	}
+}
+
+// WithCleanupInterval sets how often expired users are deleted.
+// A non-positive value disables cleanup.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(s *SQLStorage) {
+		s.interval = interval
+	}
+}
+
+// WithoutMigrations skips running Migrate in NewSQLStorage,
+// for setups where the schema is managed externally.
+func WithoutMigrations() Option {
+	return func(s *SQLStorage) {
+		s.migrate = false
+	}
+}
+
+// WithClock sets the source of the current time used for last-seen times
+// and expiry. It exists for tests, e.g. with storagetest.Clock.
+func WithClock(now func() time.Time) Option {
+	return func(s *SQLStorage) {
+		s.now = now
+	}
+}
+
+// NewSQLStorage creates an SQLStorage, applies bundled migrations and starts
+// the cleanup worker. The database handle stays owned by the caller:
+// Close stops the worker but does not close db.
+func NewSQLStorage(ctx context.Context, db *dbsql.DB, dialect Dialect, opts ...Option) (*SQLStorage, error) {
+	s := &SQLStorage{
+		db:    db,
+		q:     newQueries(dialect),
+		codec: codec.JSON,
+
+		ttl:      30 * time.Minute,
+		interval: 30 * time.Second,
+		migrate:  true,
+		now:      time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.migrate {
+		if err := Migrate(ctx, db, dialect); err != nil {
+			return nil, err
+		}
+	}
+
+	// Start background cleanup worker
+	wctx, cancel := context.WithCancel(context.Background())
+	s.stopFn = cancel
+	go s.cleanupWorker(wctx)
+
+	return s, nil
+}
+
+// Close stops the background cleanup worker.
+func (s *SQLStorage) Close() error {
+	s.stopOnce.Do(func() {
+		if s.stopFn != nil {
+			s.stopFn()
+		}
+	})
+	return nil
+}
+
+// cleanupWorker periodically deletes users that exceeded TTL and expired values.
+func (s *SQLStorage) cleanupWorker(ctx context.Context) {
+	if s.interval <= 0 {
+		// nothing to do
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = s.cleanup(ctx, s.now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cleanupBatch is how many expired users cleanup deletes per statement.
+const cleanupBatch = 500
+
+// cleanup deletes values whose own TTL has passed and, if user TTL is set,
+// every user last seen before now-ttl with all their rows. The expired
+// users are selected once, so a user becoming active meanwhile is either
+// deleted completely or not at all.
+func (s *SQLStorage) cleanup(ctx context.Context, now time.Time) error {
+	deadline := now.Add(-s.ttl).UnixNano()
+
+	return s.inTx(ctx, func(tx *dbsql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.q.expireValues, now.UnixNano()); err != nil {
+			return err
+		}
+		if s.ttl <= 0 {
+			return nil
+		}
+
+		ids, err := s.expiredUsers(ctx, tx, deadline)
+		if err != nil {
+			return err
+		}
+		for len(ids) > 0 {
+			batch := ids[:min(len(ids), cleanupBatch)]
+			ids = ids[len(batch):]
+			for _, q := range s.q.expire {
+				if _, err := tx.ExecContext(ctx, s.q.in(q, len(batch)), batch...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// expiredUsers returns the IDs of users last seen before deadline.
+func (s *SQLStorage) expiredUsers(ctx context.Context, tx *dbsql.Tx, deadline int64) ([]any, error) {
+	rows, err := tx.QueryContext(ctx, s.q.expiredUsers, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// inTx runs fn in a transaction and commits it if fn succeeds.
+func (s *SQLStorage) inTx(ctx context.Context, fn func(tx *dbsql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// execer is the part of *sql.DB and *sql.Tx used by touch.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (dbsql.Result, error)
+}
+
+// touch updates last-seen timestamp for the given userID.
+func (s *SQLStorage) touch(ctx context.Context, ex execer, userID int64) error {
+	_, err := ex.ExecContext(ctx, s.q.touch, userID, s.now().UnixNano())
+	return err
+}
+
+// write runs fn and the user's touch in one transaction, so that cleanup
+// cannot delete the user between the two. The touch comes first and locks
+// the user's row, which cleanup locks as well.
+func (s *SQLStorage) write(ctx context.Context, userID int64, fn func(tx *dbsql.Tx) error) error {
+	return s.inTx(ctx, func(tx *dbsql.Tx) error {
+		if err := s.touch(ctx, tx, userID); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+// Set stores a key/value pair for the given userID.
+func (s *SQLStorage) Set(ctx context.Context, userID int64, key string, value any) error {
+	raw, err := s.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.q.setValue, userID, key, raw)
+		return err
+	})
+}
+
+// SetIfAbsent stores a key/value pair like SetWithTTL unless the key holds
+// an unexpired value, and reports whether it stored it. The check and the
+// write are a single conditional upsert.
+func (s *SQLStorage) SetIfAbsent(ctx context.Context, userID int64, key string, value any, ttl time.Duration) (bool, error) {
+	raw, err := s.codec.Encode(value)
+	if err != nil {
+		return false, err
+	}
+	now := s.now()
+	var expiresAt any
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).UnixNano()
+	}
+	var stored bool
+	err = s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.q.claimValue, userID, key, raw, expiresAt, now.UnixNano())
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		stored = n > 0
+		return err
+	})
+	return stored && err == nil, err
+}
+
+// Delete removes the value of key for the given userID.
+func (s *SQLStorage) Delete(ctx context.Context, userID int64, key string) error {
+	_, err := s.db.ExecContext(ctx, s.q.deleteValue, userID, key)
+	return err
+}
+
+// SetWithTTL stores a key/value pair with an expires_at deadline. Get ignores
+// the row once the deadline has passed and the cleanup worker deletes it.
+// A non-positive ttl behaves like Set.
+func (s *SQLStorage) SetWithTTL(ctx context.Context, userID int64, key string, value any, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.Set(ctx, userID, key, value)
+	}
+	raw, err := s.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	expiresAt := s.now().Add(ttl).UnixNano()
+	return s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.q.setValueTTL, userID, key, raw, expiresAt)
+		return err
+	})
+}
+
+// Get retrieves a value by key for the given userID.
+func (s *SQLStorage) Get(ctx context.Context, userID int64, key string) (any, bool, error) {
+	var raw []byte
+	err := s.db.QueryRowContext(ctx, s.q.getValue, userID, key, s.now().UnixNano()).Scan(&raw)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	v, err := s.codec.Decode(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	return v, true, s.touch(ctx, s.db, userID)
+}
+
+// SetMedia appends a media.File into a mediaGroupID for the given user.
+// The file row and the group's last update time are written in one transaction.
+func (s *SQLStorage) SetMedia(ctx context.Context, userID int64, mediaGroupID string, file media.File) error {
+	now := s.now().UnixNano()
+
+	return s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		if _, err := tx.ExecContext(ctx, s.q.addMediaFile, userID, mediaGroupID, file.Type, file.FileID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, s.q.touchMediaGroup, userID, mediaGroupID, now)
+		return err
+	})
+}
+
+// GetMedia retrieves MediaData for a given user and mediaGroupID.
+// The returned value is a snapshot: adding files to it does not affect the database.
+func (s *SQLStorage) GetMedia(ctx context.Context, userID int64, mediaGroupID string) (*media.MediaData, bool, error) {
+	var lastUpdate int64
+	err := s.db.QueryRowContext(ctx, s.q.getMediaGroup, userID, mediaGroupID).Scan(&lastUpdate)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	files, err := s.mediaFiles(ctx, userID, mediaGroupID)
+	if err != nil {
+		return nil, false, err
+	}
+	return media.NewMediaData(files, time.Unix(0, lastUpdate)), true, s.touch(ctx, s.db, userID)
+}
+
+// mediaFiles reads the files of a media group in insertion order.
+func (s *SQLStorage) mediaFiles(ctx context.Context, userID int64, mediaGroupID string) ([]media.File, error) {
+	rows, err := s.db.QueryContext(ctx, s.q.getMediaFiles, userID, mediaGroupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []media.File
+	for rows.Next() {
+		var f media.File
+		if err := rows.Scan(&f.Type, &f.FileID); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// CleanMediaCache removes MediaData for a given user and mediaGroupID.
+func (s *SQLStorage) CleanMediaCache(ctx context.Context, userID int64, mediaGroupID string) (bool, error) {
+	var existed bool
+
+	err := s.inTx(ctx, func(tx *dbsql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.q.deleteMediaGroup, userID, mediaGroupID)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		existed = n > 0
+
+		if _, err := tx.ExecContext(ctx, s.q.deleteMediaFiles, userID, mediaGroupID); err != nil || !existed {
+			return err
+		}
+		return s.touch(ctx, tx, userID) // consider it an access
+	})
+	return existed && err == nil, err
+}
+
+// CleanCache removes all cached data and media for the given userID.
+// The user's FSM state is kept.
+func (s *SQLStorage) CleanCache(ctx context.Context, userID int64) error {
+	return s.inTx(ctx, func(tx *dbsql.Tx) error {
+		for _, q := range s.q.cleanCache {
+			if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CreateState stores state for the user only if no state exists yet.
+func (s *SQLStorage) CreateState(ctx context.Context, userID int64, state string) error {
+	return s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.q.createState, userID, state)
+		return err
+	})
+}
+
+// SetState stores state for the user.
+func (s *SQLStorage) SetState(ctx context.Context, userID int64, state string) error {
+	return s.write(ctx, userID, func(tx *dbsql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.q.setState, userID, state)
+		return err
+	})
+}
+
+// GetState returns the user's state and refreshes the last-seen timestamp.
+func (s *SQLStorage) GetState(ctx context.Context, userID int64) (string, bool, error) {
+	var st string
+	err := s.db.QueryRowContext(ctx, s.q.getState, userID).Scan(&st)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return st, true, s.touch(ctx, s.db, userID)
+}
+
+// PeekState returns the user's state without refreshing the last-seen
+// timestamp.
+func (s *SQLStorage) PeekState(ctx context.Context, userID int64) (string, bool, error) {
+	var st string
+	err := s.db.QueryRowContext(ctx, s.q.getState, userID).Scan(&st)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return "", false, nil
+	}
+	return st, err == nil, err
+}
+
+// sessionPage is how many states Sessions reads per query.
+const sessionPage = 100
+
+// Sessions lists stored states in user ID order. Rows are read in pages,
+// so no connection is held while the caller handles a session.
+func (s *SQLStorage) Sessions(ctx context.Context) iter.Seq2[storage.Session, error] {
+	return func(yield func(storage.Session, error) bool) {
+		after := int64(math.MinInt64)
+		for {
+			page, err := s.sessionPage(ctx, after)
+			if err != nil {
+				yield(storage.Session{}, err)
+				return
+			}
+			for _, sess := range page {
+				if !yield(sess, nil) {
+					return
+				}
+			}
+			if len(page) < sessionPage {
+				return
+			}
+			after = page[len(page)-1].UserID
+		}
+	}
+}
+
+// sessionPage reads up to sessionPage states of users after the given ID.
+func (s *SQLStorage) sessionPage(ctx context.Context, after int64) ([]storage.Session, error) {
+	rows, err := s.db.QueryContext(ctx, s.q.listStates, after, sessionPage)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var page []storage.Session
+	for rows.Next() {
+		var (
+			sess storage.Session
+			seen int64
+		)
+		if err := rows.Scan(&sess.UserID, &sess.State, &seen); err != nil {
+			return nil, err
+		}
+		if seen > 0 {
+			sess.LastSeen = time.Unix(0, seen)
+		}
+		page = append(page, sess)
+	}
+	return page, rows.Err()
+}
+
+// Inspect returns the user's unexpired values and media groups.
+func (s *SQLStorage) Inspect(ctx context.Context, userID int64) (storage.UserData, error) {
+	out := storage.UserData{Values: make(map[string]any), Media: make(map[string]*media.MediaData)}
+
+	rows, err := s.db.QueryContext(ctx, s.q.listValues, userID, s.now().UnixNano())
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			raw  []byte
+		)
+		if err := rows.Scan(&name, &raw); err != nil {
+			return out, err
+		}
+		v, err := s.codec.Decode(raw)
+		if err != nil {
+			return out, err
+		}
+		out.Values[name] = v
+	}
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+	rows.Close()
+
+	groups := make(map[string]int64)
+	rows, err = s.db.QueryContext(ctx, s.q.listMediaGroups, userID)
+	if err != nil {
+		return out, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			group      string
+			lastUpdate int64
+		)
+		if err := rows.Scan(&group, &lastUpdate); err != nil {
+			return out, err
+		}
+		groups[group] = lastUpdate
+	}
+	if err := rows.Err(); err != nil {
+		return out, err
+	}
+	rows.Close()
+
+	for group, lastUpdate := range groups {
+		files, err := s.mediaFiles(ctx, userID, group)
+		if err != nil {
+			return out, err
+		}
+		out.Media[group] = media.NewMediaData(files, time.Unix(0, lastUpdate))
+	}
+	return out, nil
+}
@@ -0,0 +1,361 @@
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/codec"
+	"github.com/whynot00/go-telegram-fsm/v2/storage/storagetest"
+)
+
+func f(tpe, id string) media.File {
+	return media.File{Type: tpe, FileID: id}
+}
+
+// newTestStorage opens an embedded SQLite database in a temp dir.
+func newTestStorage(t *testing.T, opts ...Option) (*SQLStorage, *dbsql.DB) {
+	t.Helper()
+
+	db, err := dbsql.Open("sqlite", filepath.Join(t.TempDir(), "fsm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite allows a single writer; serialise access through one connection.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	store, err := NewSQLStorage(context.Background(), db, SQLite, opts...)
+	if err != nil {
+		t.Fatalf("NewSQLStorage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store, db
+}
+
+func TestSetAndGet(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	store.Set(ctx, userID, "key1", "value1")
+	store.Set(ctx, userID, "key2", 1)
+	store.Set(ctx, userID, "key1", "value2")
+
+	v, ok, _ := store.Get(ctx, userID, "key1")
+	if !ok || v.(string) != "value2" {
+		t.Errorf("expected value2, got %#v", v)
+	}
+
+	_, ok, _ = store.Get(ctx, userID, "nonexistent")
+	if ok {
+		t.Error("expected not found for nonexistent key")
+	}
+}
+
+func TestSetMediaAndGetMedia(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(42)
+	groupID := "grp1"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id1"))
+	store.SetMedia(ctx, userID, groupID, f("video", "id2"))
+
+	md, ok, _ := store.GetMedia(ctx, userID, groupID)
+	if !ok {
+		t.Fatal("expected media group to exist")
+	}
+
+	files := md.Files()
+	if len(files) != 2 || files[0].FileID != "id1" || files[1].FileID != "id2" {
+		t.Errorf("unexpected files: %+v", files)
+	}
+	if md.Elapsed(time.Minute) {
+		t.Error("last update should be recent")
+	}
+}
+
+func TestCleanMediaCache(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(99)
+	groupID := "g"
+
+	store.SetMedia(ctx, userID, groupID, f("photo", "id"))
+	if ok, _ := store.CleanMediaCache(ctx, userID, groupID); !ok {
+		t.Error("expected CleanMediaCache to succeed")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, groupID); ok {
+		t.Error("expected media to be gone after CleanMediaCache")
+	}
+	if ok, _ := store.CleanMediaCache(ctx, userID, "nonexistent"); ok {
+		t.Error("expected false when cleaning nonexistent")
+	}
+}
+
+func TestCleanCacheKeepsState(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(100)
+
+	store.SetState(ctx, userID, "step")
+	store.Set(ctx, userID, "k", "v")
+	store.SetMedia(ctx, userID, "g", f("photo", "id"))
+	store.CleanCache(ctx, userID)
+
+	if _, ok, _ := store.Get(ctx, userID, "k"); ok {
+		t.Error("expected cache to be cleaned")
+	}
+	if _, ok, _ := store.GetMedia(ctx, userID, "g"); ok {
+		t.Error("expected media to be cleaned")
+	}
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "step" {
+		t.Errorf("state must survive CleanCache, got (%q, %v)", st, ok)
+	}
+}
+
+func TestStates(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(7)
+
+	if _, ok, _ := store.GetState(ctx, userID); ok {
+		t.Fatal("expected no state for new user")
+	}
+
+	store.CreateState(ctx, userID, "default")
+	store.SetState(ctx, userID, "custom")
+	store.CreateState(ctx, userID, "default")
+
+	if st, ok, _ := store.GetState(ctx, userID); !ok || st != "custom" {
+		t.Fatalf("CreateState must not overwrite existing state, got (%q, %v)", st, ok)
+	}
+}
+
+func TestCleanupDeletesExpiredUsers(t *testing.T) {
+	store, db := newTestStorage(t, WithTTL(time.Minute), WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetState(ctx, 1, "s")
+	store.Set(ctx, 1, "k", "v")
+	store.SetMedia(ctx, 1, "g", f("photo", "id"))
+	store.Set(ctx, 2, "k", "v")
+
+	// nothing is expired yet
+	if err := store.cleanup(ctx, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := store.Get(ctx, 1, "k"); !ok {
+		t.Fatal("user removed before TTL")
+	}
+
+	if err := store.cleanup(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range []string{"fsm_users", "fsm_values", "fsm_media_groups", "fsm_media_files", "fsm_states"} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Errorf("expected %s to be empty after cleanup, got %d rows", table, n)
+		}
+	}
+}
+
+func TestCleanupDeletesInBatches(t *testing.T) {
+	clock := storagetest.NewClock()
+	store, db := newTestStorage(t, WithTTL(time.Minute), WithCleanupInterval(0), WithClock(clock.Now))
+	ctx := context.Background()
+
+	for id := range int64(cleanupBatch + 10) {
+		store.SetState(ctx, id, "s")
+		store.Set(ctx, id, "k", "v")
+	}
+	clock.Advance(2 * time.Minute)
+	store.SetState(ctx, -1, "active")
+	store.Set(ctx, -1, "k", "v")
+
+	if err := store.cleanup(ctx, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"fsm_users", "fsm_values", "fsm_states"} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("expected only the active user in %s, got %d rows", table, n)
+		}
+	}
+}
+
+func TestCleanupWorker(t *testing.T) {
+	store, _ := newTestStorage(t, WithTTL(20*time.Millisecond), WithCleanupInterval(10*time.Millisecond))
+	ctx := context.Background()
+
+	store.Set(ctx, 1, "k", "v")
+	time.Sleep(100 * time.Millisecond)
+
+	if _, ok, _ := store.Get(ctx, 1, "k"); ok {
+		t.Fatal("expected worker to evict inactive user")
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	_, db := newTestStorage(t)
+
+	if err := Migrate(context.Background(), db, SQLite); err != nil {
+		t.Fatalf("second Migrate failed: %v", err)
+	}
+}
+
+func TestRebindPostgres(t *testing.T) {
+	got := Postgres.rebind(`SELECT a FROM t WHERE x = ? AND y = ?`)
+	if got != `SELECT a FROM t WHERE x = $1 AND y = $2` {
+		t.Fatalf("unexpected rebind result: %s", got)
+	}
+	if SQLite.rebind(`x = ?`) != `x = ?` {
+		t.Fatal("sqlite queries must stay unchanged")
+	}
+}
+
+func TestConcurrencySafety(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx := context.Background()
+	userID := int64(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Set(ctx, userID, "key", i)
+			store.SetMedia(ctx, userID, "grp", f("photo", string(rune('A'+i%26))))
+		}(i)
+	}
+	wg.Wait()
+
+	md, ok, _ := store.GetMedia(ctx, userID, "grp")
+	if !ok || len(md.Files()) != 20 {
+		t.Fatalf("expected 20 files after concurrent appends, got %v", md)
+	}
+}
+
+type profile struct {
+	Name string
+	Age  int
+}
+
+func init() {
+	codec.Register(profile{})
+}
+
+func TestCodecPreservesType(t *testing.T) {
+	for _, c := range []codec.Codec{codec.JSON, codec.Gob} {
+		store, _ := newTestStorage(t, WithCodec(c))
+		ctx := context.Background()
+
+		store.Set(ctx, 1, "profile", profile{Name: "Ann", Age: 30})
+		store.Set(ctx, 1, "age", 30)
+
+		if v, ok, _ := store.Get(ctx, 1, "profile"); !ok || v.(profile) != (profile{Name: "Ann", Age: 30}) {
+			t.Errorf("expected profile to round-trip, got (%#v, %v)", v, ok)
+		}
+		if v, ok, _ := store.Get(ctx, 1, "age"); !ok || v.(int) != 30 {
+			t.Errorf("expected int to round-trip, got (%#v, %v)", v, ok)
+		}
+
+		// values the codec cannot encode are rejected and not stored
+		if err := store.Set(ctx, 1, "ch", make(chan int)); !errors.Is(err, codec.ErrUnregisteredType) {
+			t.Errorf("expected ErrUnregisteredType, got %v", err)
+		}
+		if _, ok, _ := store.Get(ctx, 1, "ch"); ok {
+			t.Error("unencodable value must not be stored")
+		}
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	store, _ := newTestStorage(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := store.Set(ctx, 1, "k", "v"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Set: expected context.Canceled, got %v", err)
+	}
+	if _, _, err := store.GetMedia(ctx, 1, "g"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("GetMedia: expected context.Canceled, got %v", err)
+	}
+	if err := store.SetState(ctx, 1, "s"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("SetState: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	store, _ := newTestStorage(t, WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", 30*time.Millisecond)
+	store.SetWithTTL(ctx, 1, "plain", "x", 30*time.Millisecond)
+	store.Set(ctx, 1, "plain", "y") // Set drops the expiry
+
+	if v, ok, _ := store.Get(ctx, 1, "otp"); !ok || v != "1234" {
+		t.Fatalf("expected otp before expiry, got (%v, %v)", v, ok)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if _, ok, _ := store.Get(ctx, 1, "otp"); ok {
+		t.Fatal("expired value must not be returned")
+	}
+	if v, ok, _ := store.Get(ctx, 1, "plain"); !ok || v != "y" {
+		t.Fatalf("value overwritten by Set must not expire, got (%v, %v)", v, ok)
+	}
+}
+
+func TestCleanupDeletesExpiredValues(t *testing.T) {
+	store, db := newTestStorage(t, WithTTL(0), WithCleanupInterval(0))
+	ctx := context.Background()
+
+	store.SetWithTTL(ctx, 1, "otp", "1234", time.Minute)
+	store.Set(ctx, 1, "name", "Ann")
+
+	if err := store.cleanup(ctx, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM fsm_values").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected only the plain value to remain, got %d rows", n)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, storagetest.Suite{
+		New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+			store, _ := newTestStorage(t, WithTTL(time.Hour), WithCleanupInterval(0), WithClock(clock.Now))
+			clock.OnAdvance(func(time.Duration) {
+				if err := store.cleanup(context.Background(), clock.Now()); err != nil {
+					t.Errorf("cleanup: %v", err)
+				}
+			})
+			return store
+		},
+		TTL: time.Hour,
+	})
+}
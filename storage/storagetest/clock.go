@@ -0,0 +1,49 @@
+package storagetest
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a manually advanced clock for storages under test. Pass its Now
+// method to the storage (e.g. memory.WithClock) and register with OnAdvance
+// whatever makes expiry observable after time moves: a cleanup pass, or
+// fast-forwarding an in-process server.
+type Clock struct {
+	mu    sync.Mutex
+	now   time.Time
+	hooks []func(d time.Duration)
+}
+
+// NewClock returns a clock set to the current wall time, so storages that
+// mix it with their own clock see plausible timestamps.
+func NewClock() *Clock {
+	return &Clock{now: time.Now()}
+}
+
+// Now returns the current time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and then runs the OnAdvance hooks
+// in registration order.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	hooks := append([]func(time.Duration){}, c.hooks...)
+	c.mu.Unlock()
+
+	for _, h := range hooks {
+		h(d)
+	}
+}
+
+// OnAdvance registers fn to run after every Advance with the step size.
+func (c *Clock) OnAdvance(fn func(d time.Duration)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hooks = append(c.hooks, fn)
+}
@@ -0,0 +1,693 @@
+// Package storagetest provides a conformance suite for storage.Storage
+// implementations. Every storage bundled with the module runs it, and custom
+// storages can run it from their own tests to check they behave like the
+// memory storage:
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, storagetest.Suite{
+//			New: func(t *testing.T, clock *storagetest.Clock) storage.Storage {
+//				s := NewMyStorage(WithTTL(time.Hour), WithClock(clock.Now))
+//				clock.OnAdvance(func(time.Duration) { s.Cleanup() })
+//				t.Cleanup(func() { s.Close() })
+//				return s
+//			},
+//			TTL: time.Hour,
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/whynot00/go-telegram-fsm/v2/media"
+	"github.com/whynot00/go-telegram-fsm/v2/storage"
+)
+
+// Suite describes the storage under test.
+type Suite struct {
+	// New returns a new, empty storage that reads the current time from
+	// clock.Now. It is called once per test; release resources with
+	// t.Cleanup. Storages that evict in a background worker should register
+	// a clock.OnAdvance hook running a cleanup pass.
+	New func(t *testing.T, clock *Clock) storage.Storage
+
+	// TTL is the user inactivity TTL configured by New. Zero skips the
+	// tests of user eviction.
+	TTL time.Duration
+}
+
+// Run runs the whole suite as subtests of t: functional behaviour,
+// optional state persistence, concurrency and TTL handling.
+func Run(t *testing.T, suite Suite) {
+	if suite.New == nil {
+		t.Fatal("storagetest: Suite.New is required")
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, suite Suite)
+	}{
+		{"SetGet", testSetGet},
+		{"ValueTypes", testValueTypes},
+		{"UsersAreIsolated", testUsersAreIsolated},
+		{"Media", testMedia},
+		{"CleanMediaCache", testCleanMediaCache},
+		{"CleanCache", testCleanCache},
+		{"CancelledContext", testCancelledContext},
+		{"States", testStates},
+		{"Sessions", testSessions},
+		{"Inspect", testInspect},
+		{"PeekState", testPeekState},
+		{"SetIfAbsent", testSetIfAbsent},
+		{"ConcurrentSetIfAbsent", testConcurrentSetIfAbsent},
+		{"ConcurrentMediaAppends", testConcurrentMediaAppends},
+		{"ConcurrentUsers", testConcurrentUsers},
+		{"ConcurrentCreateState", testConcurrentCreateState},
+		{"ValueTTL", testValueTTL},
+		{"UserTTL", testUserTTL},
+		{"AccessExtendsTTL", testAccessExtendsTTL},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) { tc.fn(t, suite) })
+	}
+}
+
+// newStorage creates a storage with a fresh clock.
+func newStorage(t *testing.T, suite Suite) (storage.Storage, *Clock) {
+	t.Helper()
+	clock := NewClock()
+	return suite.New(t, clock), clock
+}
+
+// must fails the test on an unexpected error.
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// expectValue checks that key holds want.
+func expectValue(t *testing.T, s storage.Storage, userID int64, key string, want any) {
+	t.Helper()
+	got, ok, err := s.Get(context.Background(), userID, key)
+	must(t, err)
+	if !ok {
+		t.Fatalf("Get(%d, %q): expected %v, got no value", userID, key, want)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Get(%d, %q): expected %#v, got %#v", userID, key, want, got)
+	}
+}
+
+// expectMissing checks that key holds no value.
+func expectMissing(t *testing.T, s storage.Storage, userID int64, key string) {
+	t.Helper()
+	got, ok, err := s.Get(context.Background(), userID, key)
+	must(t, err)
+	if ok {
+		t.Fatalf("Get(%d, %q): expected no value, got %#v", userID, key, got)
+	}
+}
+
+func file(id string) media.File {
+	return media.File{Type: "photo", FileID: id}
+}
+
+func testSetGet(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	expectMissing(t, s, 1, "k")
+
+	must(t, s.Set(ctx, 1, "k", "v1"))
+	expectValue(t, s, 1, "k", "v1")
+
+	must(t, s.Set(ctx, 1, "k", "v2"))
+	expectValue(t, s, 1, "k", "v2")
+
+	expectMissing(t, s, 1, "other")
+}
+
+func testValueTypes(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	values := map[string]any{
+		"string":  "text",
+		"int":     42,
+		"int64":   int64(1) << 40,
+		"float64": 3.5,
+		"bool":    true,
+		"strings": []string{"a", "b"},
+		"map":     map[string]string{"k": "v"},
+	}
+	for key, v := range values {
+		must(t, s.Set(ctx, 1, key, v))
+	}
+	for key, v := range values {
+		expectValue(t, s, 1, key, v)
+	}
+}
+
+func testUsersAreIsolated(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	must(t, s.Set(ctx, 1, "k", "one"))
+	must(t, s.Set(ctx, 2, "k", "two"))
+	must(t, s.SetMedia(ctx, 1, "g", file("a")))
+
+	expectValue(t, s, 1, "k", "one")
+	expectValue(t, s, 2, "k", "two")
+
+	if _, ok, err := s.GetMedia(ctx, 2, "g"); err != nil || ok {
+		t.Fatalf("media group of user 1 visible to user 2 (ok=%v, err=%v)", ok, err)
+	}
+}
+
+func testMedia(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	if _, ok, err := s.GetMedia(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("expected no media group, got ok=%v err=%v", ok, err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		must(t, s.SetMedia(ctx, 1, "g", file(id)))
+	}
+	must(t, s.SetMedia(ctx, 1, "other", file("x")))
+
+	md, ok, err := s.GetMedia(ctx, 1, "g")
+	must(t, err)
+	if !ok {
+		t.Fatal("expected media group")
+	}
+	files := md.Files()
+	if len(files) != 3 || files[0].FileID != "a" || files[1].FileID != "b" || files[2].FileID != "c" {
+		t.Fatalf("expected files a, b, c in order, got %+v", files)
+	}
+	if md.LastUpdate().IsZero() {
+		t.Fatal("expected media group to carry its last update time")
+	}
+}
+
+func testCleanMediaCache(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	if ok, err := s.CleanMediaCache(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("expected false for an unknown user, got ok=%v err=%v", ok, err)
+	}
+
+	must(t, s.SetMedia(ctx, 1, "g", file("a")))
+	must(t, s.SetMedia(ctx, 1, "keep", file("b")))
+
+	if ok, err := s.CleanMediaCache(ctx, 1, "g"); err != nil || !ok {
+		t.Fatalf("expected true for an existing group, got ok=%v err=%v", ok, err)
+	}
+	if ok, err := s.CleanMediaCache(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("expected false for a removed group, got ok=%v err=%v", ok, err)
+	}
+	if _, ok, err := s.GetMedia(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("removed group still readable (ok=%v, err=%v)", ok, err)
+	}
+	if _, ok, err := s.GetMedia(ctx, 1, "keep"); err != nil || !ok {
+		t.Fatalf("other group must stay (ok=%v, err=%v)", ok, err)
+	}
+}
+
+func testCleanCache(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	must(t, s.CleanCache(ctx, 1)) // unknown user
+
+	must(t, s.Set(ctx, 1, "k", "v"))
+	must(t, s.SetWithTTL(ctx, 1, "otp", "1234", time.Hour))
+	must(t, s.SetMedia(ctx, 1, "g", file("a")))
+	must(t, s.Set(ctx, 2, "k", "v"))
+
+	must(t, s.CleanCache(ctx, 1))
+
+	expectMissing(t, s, 1, "k")
+	expectMissing(t, s, 1, "otp")
+	if _, ok, err := s.GetMedia(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("CleanCache must drop media groups too (ok=%v, err=%v)", ok, err)
+	}
+	expectValue(t, s, 2, "k", "v")
+
+	// the user can start over
+	must(t, s.Set(ctx, 1, "k", "again"))
+	expectValue(t, s, 1, "k", "again")
+}
+
+func testCancelledContext(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	check := func(name string, err error) {
+		t.Helper()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected context.Canceled, got %v", name, err)
+		}
+	}
+
+	check("Set", s.Set(ctx, 1, "k", "v"))
+	check("SetWithTTL", s.SetWithTTL(ctx, 1, "k", "v", time.Minute))
+	_, _, err := s.Get(ctx, 1, "k")
+	check("Get", err)
+	check("SetMedia", s.SetMedia(ctx, 1, "g", file("a")))
+	_, _, err = s.GetMedia(ctx, 1, "g")
+	check("GetMedia", err)
+	_, err = s.CleanMediaCache(ctx, 1, "g")
+	check("CleanMediaCache", err)
+	check("CleanCache", s.CleanCache(ctx, 1))
+
+	if ss, ok := s.(storage.StateStorage); ok {
+		check("CreateState", ss.CreateState(ctx, 1, "a"))
+		check("SetState", ss.SetState(ctx, 1, "a"))
+		_, _, err = ss.GetState(ctx, 1)
+		check("GetState", err)
+	}
+}
+
+func testStates(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ss, ok := s.(storage.StateStorage)
+	if !ok {
+		t.Skip("storage does not implement storage.StateStorage")
+	}
+	ctx := context.Background()
+
+	if _, ok, err := ss.GetState(ctx, 1); err != nil || ok {
+		t.Fatalf("expected no state, got ok=%v err=%v", ok, err)
+	}
+
+	must(t, ss.CreateState(ctx, 1, "start"))
+	must(t, ss.CreateState(ctx, 1, "ignored"))
+	expectState(t, ss, 1, "start")
+
+	must(t, ss.SetState(ctx, 1, "next"))
+	expectState(t, ss, 1, "next")
+
+	must(t, s.Set(ctx, 1, "k", "v"))
+	must(t, s.CleanCache(ctx, 1))
+	expectState(t, ss, 1, "next")
+}
+
+func testSessions(t *testing.T, suite Suite) {
+	s, clock := newStorage(t, suite)
+	lister, ok := s.(storage.SessionLister)
+	if !ok {
+		t.Skip("storage does not implement storage.SessionLister")
+	}
+	ss := s.(storage.StateStorage)
+	ctx := context.Background()
+
+	// more users than a typical page, so paging backends turn pages
+	const users = 250
+	for uid := int64(1); uid <= users; uid++ {
+		must(t, ss.SetState(ctx, uid, fmt.Sprintf("s-%d", uid)))
+	}
+	must(t, s.Set(ctx, users+1, "k", "v")) // a user without state is not a session
+
+	seen := make(map[int64]bool)
+	for sess, err := range lister.Sessions(ctx) {
+		if errors.Is(err, storage.ErrSessionsUnsupported) {
+			t.Skip("storage cannot list sessions")
+		}
+		must(t, err)
+		if want := fmt.Sprintf("s-%d", sess.UserID); sess.State != want {
+			t.Fatalf("session %d: expected state %q, got %q", sess.UserID, want, sess.State)
+		}
+		if sess.LastSeen.After(clock.Now()) {
+			t.Fatalf("session %d: last seen %v is in the future", sess.UserID, sess.LastSeen)
+		}
+		if seen[sess.UserID] {
+			t.Fatalf("session %d listed twice", sess.UserID)
+		}
+		seen[sess.UserID] = true
+
+		// writing while listing must not deadlock
+		must(t, ss.SetState(ctx, sess.UserID, sess.State))
+	}
+	if len(seen) != users {
+		t.Fatalf("expected %d sessions, got %d", users, len(seen))
+	}
+
+	n := 0
+	for range lister.Sessions(ctx) {
+		if n++; n == 3 {
+			break
+		}
+	}
+}
+
+func testInspect(t *testing.T, suite Suite) {
+	s, clock := newStorage(t, suite)
+	in, ok := s.(storage.Inspector)
+	if !ok {
+		t.Skip("storage does not implement storage.Inspector")
+	}
+	ctx := context.Background()
+
+	data, err := in.Inspect(ctx, 1)
+	if errors.Is(err, storage.ErrInspectUnsupported) {
+		t.Skip("storage cannot list user data")
+	}
+	must(t, err)
+	if len(data.Values) != 0 || len(data.Media) != 0 {
+		t.Fatalf("expected no data for an unknown user, got %+v", data)
+	}
+
+	must(t, s.Set(ctx, 1, "name", "alice"))
+	must(t, s.SetWithTTL(ctx, 1, "otp", "1234", time.Minute))
+	must(t, s.SetWithTTL(ctx, 1, "gone", "x", time.Second))
+	must(t, s.SetMedia(ctx, 1, "album", file("a")))
+	must(t, s.SetMedia(ctx, 1, "album", file("b")))
+	must(t, s.Set(ctx, 2, "other", "user"))
+	clock.Advance(2 * time.Second)
+
+	data, err = in.Inspect(ctx, 1)
+	must(t, err)
+	want := map[string]any{"name": "alice", "otp": "1234"}
+	if !reflect.DeepEqual(data.Values, want) {
+		t.Fatalf("expected values %v, got %v", want, data.Values)
+	}
+	md, ok := data.Media["album"]
+	if len(data.Media) != 1 || !ok || !reflect.DeepEqual(md.Files(), []media.File{file("a"), file("b")}) {
+		t.Fatalf("unexpected media %+v", data.Media)
+	}
+}
+
+func testPeekState(t *testing.T, suite Suite) {
+	s, clock := newStorage(t, suite)
+	peeker, ok := s.(storage.StatePeeker)
+	if !ok {
+		t.Skip("storage does not implement storage.StatePeeker")
+	}
+	ctx := context.Background()
+
+	st, ok, err := peeker.PeekState(ctx, 1)
+	if errors.Is(err, storage.ErrPeekUnsupported) {
+		t.Skip("storage cannot peek states")
+	}
+	if err != nil || ok {
+		t.Fatalf("expected no state, got (%q, %v, %v)", st, ok, err)
+	}
+
+	must(t, s.(storage.StateStorage).SetState(ctx, 1, "step"))
+	must(t, s.Set(ctx, 1, "k", "v"))
+	if st, ok, err := peeker.PeekState(ctx, 1); err != nil || !ok || st != "step" {
+		t.Fatalf("expected state step, got (%q, %v, %v)", st, ok, err)
+	}
+
+	if suite.TTL <= 0 {
+		return
+	}
+	step := suite.TTL * 3 / 4
+	clock.Advance(step)
+	if _, _, err := peeker.PeekState(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(step)
+	expectMissing(t, s, 1, "k") // peeking did not extend the user's TTL
+}
+
+func testSetIfAbsent(t *testing.T, suite Suite) {
+	s, clock := newStorage(t, suite)
+	claimer, ok := s.(storage.Claimer)
+	if !ok {
+		t.Skip("storage does not implement storage.Claimer")
+	}
+	ctx := context.Background()
+
+	stored, err := claimer.SetIfAbsent(ctx, 1, "k", "first", 0)
+	if errors.Is(err, storage.ErrClaimUnsupported) {
+		t.Skip("storage cannot set values atomically")
+	}
+	if err != nil || !stored {
+		t.Fatalf("expected the first value to be stored, got (%v, %v)", stored, err)
+	}
+	if stored, err := claimer.SetIfAbsent(ctx, 1, "k", "second", 0); err != nil || stored {
+		t.Fatalf("an existing value must be kept, got (%v, %v)", stored, err)
+	}
+	expectValue(t, s, 1, "k", "first")
+
+	if stored, _ := claimer.SetIfAbsent(ctx, 1, "otp", "a", time.Second); !stored {
+		t.Fatal("expected the expiring value to be stored")
+	}
+	if stored, _ := claimer.SetIfAbsent(ctx, 1, "otp", "b", time.Second); stored {
+		t.Fatal("an unexpired value must be kept")
+	}
+	clock.Advance(2 * time.Second)
+	if stored, err := claimer.SetIfAbsent(ctx, 1, "otp", "c", time.Minute); err != nil || !stored {
+		t.Fatalf("an expired value must be replaced, got (%v, %v)", stored, err)
+	}
+	expectValue(t, s, 1, "otp", "c")
+
+	must(t, claimer.Delete(ctx, 1, "otp"))
+	must(t, claimer.Delete(ctx, 1, "k"))
+	must(t, claimer.Delete(ctx, 1, "missing"))
+	expectMissing(t, s, 1, "otp")
+	expectMissing(t, s, 1, "k")
+	if stored, err := claimer.SetIfAbsent(ctx, 1, "otp", "d", time.Minute); err != nil || !stored {
+		t.Fatalf("a deleted key must be claimable again, got (%v, %v)", stored, err)
+	}
+}
+
+func testConcurrentSetIfAbsent(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	claimer, ok := s.(storage.Claimer)
+	if !ok {
+		t.Skip("storage does not implement storage.Claimer")
+	}
+	ctx := context.Background()
+
+	const workers = 8
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		winners int
+	)
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stored, err := claimer.SetIfAbsent(ctx, 1, "once", i, 0)
+			if errors.Is(err, storage.ErrClaimUnsupported) {
+				return
+			}
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if stored {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if winners > 1 {
+		t.Fatalf("expected a single winner, got %d", winners)
+	}
+}
+
+func expectState(t *testing.T, ss storage.StateStorage, userID int64, want string) {
+	t.Helper()
+	got, ok, err := ss.GetState(context.Background(), userID)
+	must(t, err)
+	if !ok || got != want {
+		t.Fatalf("GetState(%d): expected %q, got (%q, %v)", userID, want, got, ok)
+	}
+}
+
+const (
+	workers    = 8
+	iterations = 25
+)
+
+func testConcurrentMediaAppends(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range iterations {
+				errs <- s.SetMedia(ctx, 1, "g", file(fmt.Sprintf("%d-%d", w, i)))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		must(t, err)
+	}
+
+	md, ok, err := s.GetMedia(ctx, 1, "g")
+	must(t, err)
+	if !ok || len(md.Files()) != workers*iterations {
+		t.Fatalf("expected %d files, got ok=%v", workers*iterations, ok)
+	}
+}
+
+func testConcurrentUsers(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- func() error {
+				uid := int64(w + 1)
+				for i := range iterations {
+					if err := s.Set(ctx, uid, "k", i); err != nil {
+						return err
+					}
+					v, ok, err := s.Get(ctx, uid, "k")
+					if err != nil {
+						return err
+					}
+					if !ok || v != i {
+						return fmt.Errorf("user %d: expected %d, got (%v, %v)", uid, i, v, ok)
+					}
+					if err := s.SetMedia(ctx, uid, "g", file("a")); err != nil {
+						return err
+					}
+					if _, err := s.CleanMediaCache(ctx, uid, "g"); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		must(t, err)
+	}
+}
+
+func testConcurrentCreateState(t *testing.T, suite Suite) {
+	s, _ := newStorage(t, suite)
+	ss, ok := s.(storage.StateStorage)
+	if !ok {
+		t.Skip("storage does not implement storage.StateStorage")
+	}
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- ss.CreateState(ctx, 1, fmt.Sprintf("state-%d", w))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		must(t, err)
+	}
+
+	first, ok, err := ss.GetState(ctx, 1)
+	must(t, err)
+	if !ok {
+		t.Fatal("expected a state after concurrent CreateState")
+	}
+	// the winner must stick
+	must(t, ss.CreateState(ctx, 1, "late"))
+	expectState(t, ss, 1, first)
+}
+
+func testValueTTL(t *testing.T, suite Suite) {
+	s, clock := newStorage(t, suite)
+	ctx := context.Background()
+
+	// stay well within the user TTL, so only the value expires
+	ttl := time.Minute
+	if suite.TTL > 0 {
+		ttl = suite.TTL / 4
+	}
+
+	must(t, s.SetWithTTL(ctx, 1, "otp", "1234", ttl))
+	must(t, s.SetWithTTL(ctx, 1, "plain", "x", ttl))
+	must(t, s.Set(ctx, 1, "plain", "y")) // Set drops the expiry
+	must(t, s.Set(ctx, 1, "other", "z"))
+	must(t, s.SetWithTTL(ctx, 1, "zero", "w", 0)) // behaves like Set
+
+	clock.Advance(ttl / 2)
+	expectValue(t, s, 1, "otp", "1234")
+
+	clock.Advance(ttl/2 + ttl/10)
+	expectMissing(t, s, 1, "otp")
+	expectValue(t, s, 1, "plain", "y")
+	expectValue(t, s, 1, "other", "z")
+	expectValue(t, s, 1, "zero", "w")
+}
+
+func testUserTTL(t *testing.T, suite Suite) {
+	if suite.TTL <= 0 {
+		t.Skip("Suite.TTL is not set")
+	}
+	s, clock := newStorage(t, suite)
+	ctx := context.Background()
+
+	must(t, s.Set(ctx, 1, "k", "v"))
+	must(t, s.SetMedia(ctx, 1, "g", file("a")))
+	must(t, s.Set(ctx, 2, "k", "v"))
+
+	clock.Advance(suite.TTL / 2)
+	expectValue(t, s, 2, "k", "v") // user 2 stays active
+
+	clock.Advance(suite.TTL/2 + suite.TTL/10)
+	expectMissing(t, s, 1, "k")
+	if _, ok, err := s.GetMedia(ctx, 1, "g"); err != nil || ok {
+		t.Fatalf("media of an expired user still readable (ok=%v, err=%v)", ok, err)
+	}
+	expectValue(t, s, 2, "k", "v")
+}
+
+func testAccessExtendsTTL(t *testing.T, suite Suite) {
+	if suite.TTL <= 0 {
+		t.Skip("Suite.TTL is not set")
+	}
+	s, clock := newStorage(t, suite)
+	ctx := context.Background()
+	step := suite.TTL * 3 / 4
+
+	must(t, s.Set(ctx, 1, "k", "v"))
+	must(t, s.SetMedia(ctx, 1, "g", file("a")))
+	must(t, s.Set(ctx, 2, "k", "v"))
+	must(t, s.SetMedia(ctx, 2, "g", file("a")))
+
+	clock.Advance(step)
+	expectValue(t, s, 1, "k", "v") // Get touches user 1
+	if _, ok, err := s.GetMedia(ctx, 2, "g"); err != nil || !ok {
+		t.Fatalf("expected media group (ok=%v, err=%v)", ok, err)
+	} // GetMedia touches user 2
+
+	clock.Advance(step)
+	expectValue(t, s, 1, "k", "v")
+	expectValue(t, s, 2, "k", "v")
+}
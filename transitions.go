@@ -8,52 +8,87 @@ import (
 // Create ensures a user entry exists with StateDefault.
 // If the user already exists, it leaves the entry unchanged.
 // This method does not modify existing state, only initializes missing entries.
-func (f *FSM) Create(ctx context.Context) {
+func (f *FSM) Create(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	userID := userFromContext(ctx)
 
+	if f.states != nil {
+		return f.states.CreateState(ctx, userID, string(StateDefault))
+	}
+
 	f.current.LoadOrStore(userID, stateData{
 		state:   StateDefault,
 		lastUse: time.Now(),
 	})
+	return nil
 }
 
 // Transition sets the user's FSM state and updates the last-use timestamp to now.
 // If the new state is StateDefault, it also clears the user's local cache via CleanCache.
 // This method overwrites any existing state for the user.
-func (f *FSM) Transition(ctx context.Context, state StateFSM) {
+func (f *FSM) Transition(ctx context.Context, state StateFSM) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	userID := userFromContext(ctx)
 
-	f.current.Store(userID, stateData{
-		state:   state,
-		lastUse: time.Now(),
-	})
+	if f.states != nil {
+		if err := f.states.SetState(ctx, userID, string(state)); err != nil {
+			return err
+		}
+	} else {
+		f.current.Store(userID, stateData{
+			state:   state,
+			lastUse: time.Now(),
+		})
+	}
 
 	if state == StateDefault {
-		f.CleanCache(ctx, userID)
+		// Clearing the cache also drops the session version, if any.
+		return f.CleanCache(ctx, userID)
+	}
+	if f.callbackSecret != nil {
+		_, err := f.newCallbackEpoch(ctx, userID)
+		return err
 	}
+	return nil
 }
 
 // Finish resets the user's state to StateDefault.
 // This is a convenience wrapper around Transition(ctx, StateDefault).
-func (f *FSM) Finish(ctx context.Context) {
-	f.Transition(ctx, StateDefault)
+func (f *FSM) Finish(ctx context.Context) error {
+	return f.Transition(ctx, StateDefault)
 }
 
 // CurrentState returns the current FSM state for the user and a boolean flag.
 // It does NOT create an entry if absent.
-//   - On hit: updates the last-use timestamp and returns (state, true).
-//   - On miss: returns (StateNil, false).
-func (f *FSM) CurrentState(ctx context.Context) (StateFSM, bool) {
+//   - On hit: updates the last-use timestamp and returns (state, true, nil).
+//   - On miss: returns (StateNil, false, nil).
+//   - On storage failure: returns (StateNil, false, err).
+func (f *FSM) CurrentState(ctx context.Context) (StateFSM, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return StateNil, false, err
+	}
 	userID := userFromContext(ctx)
 
+	if f.states != nil {
+		st, ok, err := f.states.GetState(ctx, userID)
+		if err != nil || !ok {
+			return StateNil, false, err
+		}
+		return StateFSM(st), true, nil
+	}
+
 	v, ok := f.current.Load(userID)
 	if !ok {
-		return StateNil, false
+		return StateNil, false, nil
 	}
 
 	sd := v.(stateData)
 	sd.lastUse = time.Now()
 	f.current.Store(userID, sd)
 
-	return sd.state, true
+	return sd.state, true, nil
 }
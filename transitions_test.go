@@ -2,10 +2,11 @@ package fsm
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
-	"github.com/whynot00/go-telegram-fsm/media"
+	"github.com/whynot00/go-telegram-fsm/v2/media"
 )
 
 // --- stub storage to observe CleanCache calls ---
@@ -13,20 +14,29 @@ import (
 type stubStorage struct {
 	cleanCalled int
 	lastUserID  int64
+	err         error // returned by CleanCache
 }
 
-func (s *stubStorage) Set(context.Context, int64, string, any)             {}
-func (s *stubStorage) Get(context.Context, int64, string) (any, bool)      { return nil, false }
-func (s *stubStorage) SetMedia(context.Context, int64, string, media.File) {}
-func (s *stubStorage) GetMedia(context.Context, int64, string) (*media.MediaData, bool) {
-	return nil, false
+func (s *stubStorage) Set(context.Context, int64, string, any) error { return nil }
+func (s *stubStorage) SetWithTTL(context.Context, int64, string, any, time.Duration) error {
+	return nil
 }
-func (s *stubStorage) CleanMediaCache(context.Context, int64, string) bool { return false }
-func (s *stubStorage) CleanCache(_ context.Context, userID int64) {
+func (s *stubStorage) Get(context.Context, int64, string) (any, bool, error) { return nil, false, nil }
+func (s *stubStorage) SetMedia(context.Context, int64, string, media.File) error {
+	return nil
+}
+func (s *stubStorage) GetMedia(context.Context, int64, string) (*media.MediaData, bool, error) {
+	return nil, false, nil
+}
+func (s *stubStorage) CleanMediaCache(context.Context, int64, string) (bool, error) {
+	return false, nil
+}
+func (s *stubStorage) CleanCache(_ context.Context, userID int64) error {
 	s.cleanCalled++
 	s.lastUserID = userID
+	return s.err
 }
-func (s *stubStorage) Close() {}
+func (s *stubStorage) Close() error { return nil }
 
 // helper to build FSM with stub storage
 func newTestFSM() (*FSM, *stubStorage) {
@@ -138,7 +148,7 @@ func TestCurrentState_MissReturnsNilFalse(t *testing.T) {
 	f, _ := newTestFSM()
 	ctx := userWithContext(context.Background(), 5005)
 
-	state, ok := f.CurrentState(ctx)
+	state, ok, _ := f.CurrentState(ctx)
 	if ok {
 		t.Fatalf("expected miss (ok=false) when no entry exists, got ok=true")
 	}
@@ -156,7 +166,7 @@ func TestCurrentState_HitUpdatesLastUseAndReturnsState(t *testing.T) {
 	f.current.Store(uid, stateData{state: StateFSM("in_progress"), lastUse: old})
 
 	ctx := userWithContext(context.Background(), uid)
-	ret, ok := f.CurrentState(ctx)
+	ret, ok, _ := f.CurrentState(ctx)
 	if !ok {
 		t.Fatalf("expected hit")
 	}
@@ -170,3 +180,23 @@ func TestCurrentState_HitUpdatesLastUseAndReturnsState(t *testing.T) {
 		t.Fatalf("expected lastUse to be updated, old=%v new=%v", old, sd.lastUse)
 	}
 }
+
+func TestTransition_ReturnsStorageAndContextErrors(t *testing.T) {
+	t.Parallel()
+	f, ss := newTestFSM()
+	ctx := userWithContext(context.Background(), 3003)
+
+	ss.err = errors.New("storage down")
+	if err := f.Finish(ctx); !errors.Is(err, ss.err) {
+		t.Fatalf("expected CleanCache error from Finish, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := f.Transition(cancelled, StateFSM("x")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, _, err := f.CurrentState(cancelled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled from CurrentState, got %v", err)
+	}
+}